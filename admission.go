@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+const defaultAdmissionTimeout = 5 * time.Second
+
+// AdmissionHook is an external validator which is sent objects of the given
+// resource types before they are persisted. See Admitter.
+type AdmissionHook struct {
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Resources []string `json:"resources,omitempty"`
+
+	// FailOpen admits objects if the hook cannot be reached or responds with
+	// an error, by default they are rejected.
+	FailOpen bool `json:"fail_open,omitempty"`
+}
+
+// AdmissionDeniedError is returned when an admission hook rejects an object.
+type AdmissionDeniedError struct {
+	Hook   string
+	Reason string
+}
+
+func (e AdmissionDeniedError) Error() string {
+	return fmt.Sprintf("controller: rejected by admission hook %s: %s", e.Hook, e.Reason)
+}
+
+// Admitter sends objects to admission hooks before they are persisted. Each
+// hook is sent a ct.AdmissionReview and responds with a ct.AdmissionResponse
+// which either rejects the object or admits it, optionally replacing it with
+// a mutated copy which is passed on to the next hook. Hooks are run in order.
+type Admitter struct {
+	Hooks  []AdmissionHook
+	client *http.Client
+}
+
+func NewAdmitter(hooks []AdmissionHook) *Admitter {
+	return &Admitter{Hooks: hooks, client: &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: defaultAdmissionTimeout}}}
+}
+
+// LoadAdmissionHooks reads a JSON list of admission hooks, e.g.
+//
+//	[{
+//	  "name": "image-allowlist",
+//	  "url": "https://policy.example.com/admit",
+//	  "resources": ["releases", "formations"]
+//	}]
+//
+// An empty resources list sends every resource type to the hook.
+func LoadAdmissionHooks(name string) ([]AdmissionHook, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hooks []AdmissionHook
+	if err := json.NewDecoder(f).Decode(&hooks); err != nil {
+		return nil, fmt.Errorf("controller: error parsing admission hooks %s: %s", name, err)
+	}
+	for i, hook := range hooks {
+		if hook.URL == "" {
+			return nil, fmt.Errorf("controller: admission hook %d is missing a url", i)
+		}
+		if hook.Name == "" {
+			hooks[i].Name = hook.URL
+		}
+	}
+	return hooks, nil
+}
+
+// Admit sends obj to the hooks for the resource type. If a hook mutates the
+// object, obj is updated in place. An AdmissionDeniedError is returned if any
+// hook rejects the object.
+func (a *Admitter) Admit(resource, action string, obj interface{}) error {
+	if a == nil {
+		return nil
+	}
+	for _, hook := range a.Hooks {
+		if len(hook.Resources) > 0 && !matchAny(hook.Resources, resource) {
+			continue
+		}
+		res, err := a.review(hook, resource, action, obj)
+		if err != nil {
+			if hook.FailOpen {
+				continue
+			}
+			return AdmissionDeniedError{Hook: hook.Name, Reason: err.Error()}
+		}
+		if !res.Allowed {
+			reason := res.Reason
+			if reason == "" {
+				reason = "denied"
+			}
+			return AdmissionDeniedError{Hook: hook.Name, Reason: reason}
+		}
+		if len(res.Object) > 0 && string(res.Object) != "null" {
+			if err := json.Unmarshal(res.Object, obj); err != nil {
+				return AdmissionDeniedError{Hook: hook.Name, Reason: fmt.Sprintf("invalid mutated object: %s", err)}
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Admitter) review(hook AdmissionHook, resource, action string, obj interface{}) (*ct.AdmissionResponse, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(&ct.AdmissionReview{Resource: resource, Action: action, Object: data})
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.client.Post(hook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("hook unavailable: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("hook responded with status %d", res.StatusCode)
+	}
+	review := &ct.AdmissionResponse{}
+	if err := json.NewDecoder(res.Body).Decode(review); err != nil {
+		return nil, fmt.Errorf("invalid hook response: %s", err)
+	}
+	return review, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/strowger/types"
+	. "github.com/titanous/gocheck"
+)
+
+// fakeAdmissionHook requires releases to set OWNER and caps formations at
+// two processes per type.
+func fakeAdmissionHook() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		review := &ct.AdmissionReview{}
+		if err := json.NewDecoder(req.Body).Decode(review); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		res := &ct.AdmissionResponse{Allowed: true}
+		switch review.Resource {
+		case "releases":
+			release := &ct.Release{}
+			json.Unmarshal(review.Object, release)
+			if release.Env["OWNER"] == "" {
+				res = &ct.AdmissionResponse{Reason: "releases must set OWNER"}
+			}
+		case "formations":
+			formation := &ct.Formation{}
+			json.Unmarshal(review.Object, formation)
+			for typ, n := range formation.Processes {
+				if n > 2 {
+					formation.Processes[typ] = 2
+				}
+			}
+			res.Object, _ = json.Marshal(formation)
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+func (s *S) TestAdmissionHooks(c *C) {
+	hook := httptest.NewServer(fakeAdmissionHook())
+	defer hook.Close()
+
+	admitter := s.m.Get(reflect.TypeOf((*Admitter)(nil))).Interface().(*Admitter)
+	admitter.Hooks = []AdmissionHook{{Name: "test", URL: hook.URL, Resources: []string{"releases", "formations"}}}
+	defer func() { admitter.Hooks = nil }()
+
+	app := s.createTestApp(c, &ct.App{Name: "admission"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+
+	res, err := s.Post("/releases", &ct.Release{ArtifactID: artifact.ID}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 403)
+
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID, Env: map[string]string{"OWNER": "core"}})
+	formation := &ct.Formation{}
+	_, err = s.Put("/apps/"+app.ID+"/formations/"+release.ID, &ct.Formation{Processes: map[string]int{"web": 5}}, formation)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	c.Assert(formation.AppID, Equals, app.ID)
+
+	hook.Close()
+	res, err = s.Post("/releases", &ct.Release{ArtifactID: artifact.ID, Env: map[string]string{"OWNER": "core"}}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 403)
+
+	admitter.Hooks[0].FailOpen = true
+	res, err = s.Post("/releases", &ct.Release{ArtifactID: artifact.ID, Env: map[string]string{"OWNER": "core"}}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+}
+
+// TestAdmissionIndirectWrites checks that releases, formations and routes
+// created as a side effect of other requests are admitted.
+func (s *S) TestAdmissionIndirectWrites(c *C) {
+	hook := httptest.NewServer(fakeAdmissionHook())
+	defer hook.Close()
+	denyRoutes := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&ct.AdmissionResponse{Reason: "routes are not allowed"})
+	}))
+	defer denyRoutes.Close()
+
+	// the app, its releases, formation and route are created before the
+	// hooks are configured
+	app := s.createTestApp(c, &ct.App{Name: "admission-indirect"})
+	release1 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	release2 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}, Env: map[string]string{"OWNER": "core"}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release1.ID, Processes: map[string]int{"web": 5}})
+	s.setAppRelease(c, app.ID, release1.ID)
+	s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "admission-indirect"}).ToRoute())
+	group := &ct.EnvGroup{}
+	_, err := s.Post("/env-groups", &ct.EnvGroup{Name: "admission-indirect", Env: map[string]string{"FOO": "bar"}}, group)
+	c.Assert(err, IsNil)
+
+	admitter := s.m.Get(reflect.TypeOf((*Admitter)(nil))).Interface().(*Admitter)
+	admitter.Hooks = []AdmissionHook{
+		{Name: "test", URL: hook.URL, Resources: []string{"releases", "formations"}},
+		{Name: "deny-routes", URL: denyRoutes.URL, Resources: []string{"routes"}},
+	}
+	defer func() { admitter.Hooks = nil }()
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	// the release created by applying an env group lacks OWNER
+	res, err := s.Put("/apps/"+app.ID+"/env-groups/"+group.ID, nil, &ct.EnvGroup{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 403)
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release1.ID)
+
+	// deploying a release moves the formation, which the hook caps
+	s.setAppRelease(c, app.ID, release2.ID)
+	formation, err := client.GetFormation(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// routes of restored apps are not recreated if they are rejected
+	c.Assert(client.DeleteApp(app.ID), IsNil)
+	_, err = client.RestoreApp(app.ID)
+	c.Assert(err, IsNil)
+	routes, err := client.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 0)
+
+	// default routes are not created if they are rejected
+	apps := s.m.Get(reflect.TypeOf((*AppRepo)(nil))).Interface().(*AppRepo)
+	apps.defaultDomain = "example.com"
+	defer func() { apps.defaultDomain = "" }()
+	other := s.createTestApp(c, &ct.App{Name: "admission-default-route"})
+	routes, err = client.RouteList(other.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 0)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/martini-contrib/render"
+)
+
+// The cluster API does not allow changing the attributes of a running job, so
+// adopted containers are recorded by the controller and their attributes are
+// filled in when listing jobs.
+type AdoptedJobRepo struct {
+	db *DB
+}
+
+func NewAdoptedJobRepo(db *DB) *AdoptedJobRepo {
+	return &AdoptedJobRepo{db}
+}
+
+var ErrAlreadyAdopted = errors.New("controller: job has already been adopted")
+
+func (r *AdoptedJobRepo) Add(hostID, jobID string, job *ct.AdoptJobReq) error {
+	err := r.db.QueryRow("INSERT INTO adopted_jobs (host_id, job_id, app_id, release_id, type) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		hostID, jobID, job.AppID, job.ReleaseID, job.Type).Scan(&job.CreatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return ErrAlreadyAdopted
+	}
+	return err
+}
+
+type adoptedJob struct {
+	ReleaseID string
+	Type      string
+}
+
+// AppList returns the jobs adopted by an app keyed by host ID and job ID.
+func (r *AdoptedJobRepo) AppList(appID string) (map[jobKey]adoptedJob, error) {
+	rows, err := r.db.Query("SELECT host_id, job_id, release_id, type FROM adopted_jobs WHERE app_id = $1", appID)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make(map[jobKey]adoptedJob)
+	for rows.Next() {
+		var k jobKey
+		var j adoptedJob
+		var typ sql.NullString
+		if err := rows.Scan(&k.hostID, &k.jobID, &j.ReleaseID, &typ); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		j.ReleaseID = cleanUUID(j.ReleaseID)
+		j.Type = typ.String
+		jobs[k] = j
+	}
+	return jobs, rows.Err()
+}
+
+type jobKey struct {
+	hostID, jobID string
+}
+
+func adoptJob(app *ct.App, req ct.AdoptJobReq, repo *AdoptedJobRepo, releases *ReleaseRepo, cl clusterClient, r render.Render) {
+	hostID, jobID, err := utils.ParseJobID(req.JobID)
+	if err != nil {
+		r.JSON(400, ct.ValidationError{Field: "id", Message: "is invalid"})
+		return
+	}
+	release, err := releases.GetForApp(app.ID, req.ReleaseID)
+	if err != nil {
+		if err == ErrNotFound {
+			r.JSON(400, ct.ValidationError{Field: "release", Message: "does not exist"})
+			return
+		}
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	req.ReleaseID = release.ID
+
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	h, ok := hosts[hostID]
+	if !ok {
+		r.JSON(404, struct{}{})
+		return
+	}
+	var found bool
+	for _, j := range h.Jobs {
+		if j.ID != jobID {
+			continue
+		}
+		if j.Attributes["flynn-controller.app"] != "" {
+			r.JSON(409, ct.ValidationError{Field: "id", Message: "is already managed by the controller"})
+			return
+		}
+		found = true
+		break
+	}
+	if !found {
+		r.JSON(404, struct{}{})
+		return
+	}
+
+	req.AppID = app.ID
+	if err := repo.Add(hostID, jobID, &req); err != nil {
+		if err == ErrAlreadyAdopted {
+			r.JSON(409, ct.ValidationError{Field: "id", Message: "has already been adopted"})
+			return
+		}
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	r.JSON(200, &req)
+}
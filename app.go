@@ -1,23 +1,40 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
 	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
 	"github.com/flynn/pq/hstore"
 	strowgerc "github.com/flynn/strowger/client"
 	"github.com/flynn/strowger/types"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
 )
 
 type AppRepo struct {
 	router        strowgerc.Client
 	defaultDomain string
 
+	// reservedNames are names of system components which apps may not use.
+	reservedNames map[string]bool
+
+	admitter *Admitter
+
 	db *DB
 }
 
@@ -27,18 +44,87 @@ func NewAppRepo(db *DB, defaultDomain string, router strowgerc.Client) *AppRepo
 
 var appNamePattern = regexp.MustCompile(`^[a-z\d]+(-[a-z\d]+)*$`)
 
+// defaultReservedAppNames are the names of the controller and the system
+// components which share the app namespace.
+var defaultReservedAppNames = []string{"controller", "flynn-controller", "router", "strowger", "discoverd", "flynn-host", "etcd"}
+
+// appRouteNames are the names of the routes under /apps, such as POST
+// /apps/bulk, which would shadow apps of the same name. Unlike the reserved
+// names of system components they cannot be configured.
+var appRouteNames = map[string]bool{"bulk": true, "import": true}
+
+// reservedAppNamesFromEnv returns the comma separated RESERVED_APP_NAMES, or
+// the defaults if unset. It may be set to "none" to reserve no names.
+func reservedAppNamesFromEnv() []string {
+	switch s := os.Getenv("RESERVED_APP_NAMES"); s {
+	case "":
+		return defaultReservedAppNames
+	case "none":
+		return []string{}
+	default:
+		return splitList(s)
+	}
+}
+
+// SetAdmitter sets the admission hooks which default routes are sent to.
+func (r *AppRepo) SetAdmitter(admitter *Admitter) {
+	r.admitter = admitter
+}
+
+// SetReservedNames replaces the names which apps may not use.
+func (r *AppRepo) SetReservedNames(names []string) {
+	r.reservedNames = make(map[string]bool, len(names))
+	for _, name := range names {
+		r.reservedNames[name] = true
+	}
+}
+
 func (r *AppRepo) Add(data interface{}) error {
 	app := data.(*ct.App)
+	if err := r.validate(app); err != nil {
+		return err
+	}
+	if err := insertApp(r.db, app); err != nil {
+		return err
+	}
+	r.createDefaultRoute(app)
+	return nil
+}
+
+// validate checks the name, strategy and release retention of a new app,
+// setting defaults.
+func (r *AppRepo) validate(app *ct.App) error {
 	// TODO: actually validate
+	// names are case-insensitive, so store them in lowercase
+	app.Name = strings.ToLower(app.Name)
 	if app.Name == "" {
 		return errors.New("controller: app name must not be blank")
 	}
 	if len(app.Name) > 30 || !appNamePattern.MatchString(app.Name) {
 		return errors.New("controller: invalid app name")
 	}
+	if r.reservedNames[app.Name] {
+		return ct.ValidationError{Field: "name", Message: "is reserved for a system component"}
+	}
+	if appRouteNames[app.Name] {
+		return ct.ValidationError{Field: "name", Message: "is reserved by the API"}
+	}
+	if app.Strategy == "" {
+		app.Strategy = ct.DeployAllAtOnce
+	}
+	if err := validateStrategy(app.Strategy); err != nil {
+		return err
+	}
+	if app.ReleaseRetention < 0 {
+		return ct.ValidationError{Field: "release_retention", Message: "must not be negative"}
+	}
 	if app.ID == "" {
 		app.ID = utils.UUID()
 	}
+	return nil
+}
+
+func insertApp(db rowQueryer, app *ct.App) error {
 	var meta hstore.Hstore
 	if len(app.Meta) > 0 {
 		meta.Map = make(map[string]sql.NullString, len(app.Meta))
@@ -46,27 +132,170 @@ func (r *AppRepo) Add(data interface{}) error {
 			meta.Map[k] = sql.NullString{String: v, Valid: true}
 		}
 	}
-	err := r.db.QueryRow("INSERT INTO apps (app_id, name, protected, meta) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at", app.ID, app.Name, app.Protected, meta).Scan(&app.CreatedAt, &app.UpdatedAt)
+	err := db.QueryRow("INSERT INTO apps (app_id, name, protected, maintenance, strategy, release_retention, meta) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at, updated_at", app.ID, app.Name, app.Protected, app.Maintenance, app.Strategy, app.ReleaseRetention, meta).Scan(&app.CreatedAt, &app.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return ct.ValidationError{Field: "name", Message: "is already taken by another app"}
+	}
 	app.ID = cleanUUID(app.ID)
+	return err
+}
+
+func (r *AppRepo) createDefaultRoute(app *ct.App) {
 	if !app.Protected && r.defaultDomain != "" {
 		route := (&strowger.HTTPRoute{
 			Domain:  fmt.Sprintf("%s.%s", app.Name, r.defaultDomain),
 			Service: app.Name + "-web",
 		}).ToRoute()
 		route.ParentRef = routeParentRef(app)
+		if err := r.admitter.Admit("routes", "create", route); err != nil {
+			log.Printf("Error admitting default route for %s: %s", app.Name, err)
+			return
+		}
+		route.ParentRef = routeParentRef(app)
 		if err := r.router.CreateRoute(route); err != nil {
 			log.Printf("Error creating default route for %s: %s", app.Name, err)
 		}
 	}
-	return err
+}
+
+const maxBulkApps = 100
+
+// AddBulk creates apps in a single transaction. errs holds an error for each
+// app, apps which already have one are skipped and validation errors are
+// recorded in it. The transaction is only committed if no app has an error,
+// and reports whether the apps were created.
+func (r *AppRepo) AddBulk(apps []*ct.App, errs []error) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	failed := false
+	for i, app := range apps {
+		if errs[i] == nil {
+			errs[i] = r.validate(app)
+		}
+		if errs[i] != nil {
+			failed = true
+			continue
+		}
+		// a savepoint allows the remaining apps to be checked after an
+		// insert fails, such as for a duplicate name
+		if _, err := tx.Exec("SAVEPOINT bulk_app"); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		err := insertApp(tx, app)
+		if e, ok := err.(ct.ValidationError); ok {
+			errs[i] = e
+			failed = true
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT bulk_app"); err != nil {
+				tx.Rollback()
+				return false, err
+			}
+		} else if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	if failed {
+		return false, tx.Rollback()
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	for _, app := range apps {
+		r.createDefaultRoute(app)
+	}
+	return true, nil
+}
+
+// createBulkApps creates the apps in the request body, responding with the
+// result of each. If any app is rejected none are created.
+func createBulkApps(req *http.Request, repo *AppRepo, admitter *Admitter, r render.Render) {
+	var apps []*ct.App
+	if err := json.NewDecoder(req.Body).Decode(&apps); err != nil {
+		r.JSON(400, ct.ValidationError{Field: "apps", Message: "must be an array of apps"})
+		return
+	}
+	if len(apps) == 0 {
+		r.JSON(400, ct.ValidationError{Field: "apps", Message: "must not be empty"})
+		return
+	}
+	if len(apps) > maxBulkApps {
+		r.JSON(400, ct.ValidationError{Field: "apps", Message: "must not contain more than 100 apps"})
+		return
+	}
+	errs := make([]error, len(apps))
+	for i, app := range apps {
+		if app == nil {
+			errs[i] = ct.ValidationError{Field: "app", Message: "must not be null"}
+			apps[i] = &ct.App{}
+			continue
+		}
+		err := admitter.Admit("apps", "create", app)
+		if _, ok := err.(AdmissionDeniedError); ok {
+			errs[i] = err
+		} else if err != nil {
+			respondWithError(r, err)
+			return
+		}
+	}
+	created, err := repo.AddBulk(apps, errs)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	res := &ct.BulkAppsRes{Created: created, Results: make([]*ct.BulkAppResult, len(apps))}
+	for i, app := range apps {
+		result := &ct.BulkAppResult{}
+		if errs[i] != nil {
+			result.Error = errs[i].Error()
+		} else if created {
+			result.App = app
+		}
+		res.Results[i] = result
+	}
+	r.JSON(200, res)
 }
 
 var ErrNotFound = errors.New("controller: resource not found")
 
+// ErrAppMaintenance is returned when attempting to run jobs, deploy or
+// restart, or scale up processes of an app in maintenance mode.
+var ErrAppMaintenance = errors.New("controller: app is in maintenance mode")
+
+// ErrAppProtected is returned when making a destructive change to a protected
+// app without setting the ProtectedOverrideHeader.
+var ErrAppProtected = errors.New("controller: app is protected")
+
+func protectedOverride(req *http.Request) bool {
+	return req.Header.Get(ct.ProtectedOverrideHeader) == "true"
+}
+
+// checkAppProtected rejects destructive requests to protected apps, such as
+// stopping jobs or deleting routes, unless they set the
+// ProtectedOverrideHeader.
+func checkAppProtected(app *ct.App, req *http.Request, r render.Render) {
+	if app.Protected && !protectedOverride(req) {
+		respondWithError(r, ErrAppProtected)
+	}
+}
+
+// checkAppMaintenance rejects requests which run jobs or change the release
+// or formations of an app in maintenance mode. Formations may still be scaled
+// down, see checkMaintenanceScale.
+func checkAppMaintenance(app *ct.App, r render.Render) {
+	if app.Maintenance {
+		respondWithError(r, ErrAppMaintenance)
+	}
+}
+
+const appColumns = "app_id, name, protected, maintenance, strategy, release_retention, meta, created_at, updated_at, deleted_at"
+
 func scanApp(s Scanner) (*ct.App, error) {
 	app := &ct.App{}
 	var meta hstore.Hstore
-	err := s.Scan(&app.ID, &app.Name, &app.Protected, &meta, &app.CreatedAt, &app.UpdatedAt)
+	err := s.Scan(&app.ID, &app.Name, &app.Protected, &app.Maintenance, &app.Strategy, &app.ReleaseRetention, &meta, &app.CreatedAt, &app.UpdatedAt, &app.DeletedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -88,15 +317,15 @@ type rowQueryer interface {
 
 func selectApp(db rowQueryer, id string, update bool) (*ct.App, error) {
 	var row Scanner
-	query := "SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
+	query := "SELECT " + appColumns + " FROM apps WHERE deleted_at IS NULL AND "
 	var suffix string
 	if update {
 		suffix = " FOR UPDATE"
 	}
 	if idPattern.MatchString(id) {
-		row = db.QueryRow(query+"(app_id = $1 OR name = $2) LIMIT 1"+suffix, id, id)
+		row = db.QueryRow(query+"(app_id = $1 OR lower(name) = $2) LIMIT 1"+suffix, id, strings.ToLower(id))
 	} else {
-		row = db.QueryRow(query+"name = $1"+suffix, id)
+		row = db.QueryRow(query+"lower(name) = $1"+suffix, strings.ToLower(id))
 	}
 	return scanApp(row)
 }
@@ -106,6 +335,172 @@ func (r *AppRepo) Get(id string) (interface{}, error) {
 }
 
 func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, error) {
+	return r.update(id, "", data)
+}
+
+// UpdateIfMatch updates an app only if its ETag matches ifMatch, see ETag.
+func (r *AppRepo) UpdateIfMatch(id, ifMatch string, data map[string]interface{}) (interface{}, error) {
+	return r.update(id, ifMatch, data)
+}
+
+// LastModified returns the time the app was last updated.
+func (r *AppRepo) LastModified(thing interface{}) time.Time {
+	app := thing.(*ct.App)
+	if app.UpdatedAt != nil {
+		return *app.UpdatedAt
+	}
+	if app.CreatedAt != nil {
+		return *app.CreatedAt
+	}
+	return time.Time{}
+}
+
+// ETag returns the ETag of an app, which changes whenever the app is updated.
+func (r *AppRepo) ETag(thing interface{}) string {
+	app := thing.(*ct.App)
+	var updated int64
+	if app.UpdatedAt != nil {
+		updated = app.UpdatedAt.UnixNano()
+	}
+	return fmt.Sprintf(`"%s-%x"`, app.ID, updated)
+}
+
+// appUpdateField is a field of an app which can be changed by an update.
+// decode validates the JSON value of the field in a merge patch, which is nil
+// if the patch removes the field, and applies it to the app. value returns
+// the column value of the field.
+type appUpdateField struct {
+	column string
+	decode func(app *ct.App, v interface{}) error
+	value  func(app *ct.App) interface{}
+	// touchFormations is set for fields which are part of formation events.
+	touchFormations bool
+}
+
+// appUpdateFields are the fields of an app which can be updated, by their
+// JSON name. Other fields are rejected.
+var appUpdateFields = map[string]*appUpdateField{
+	"protected": {
+		column: "protected",
+		decode: func(app *ct.App, v interface{}) (err error) {
+			app.Protected, err = decodeBoolField("protected", v)
+			return
+		},
+		value: func(app *ct.App) interface{} { return app.Protected },
+	},
+	"maintenance": {
+		column: "maintenance",
+		decode: func(app *ct.App, v interface{}) (err error) {
+			app.Maintenance, err = decodeBoolField("maintenance", v)
+			return
+		},
+		value:           func(app *ct.App) interface{} { return app.Maintenance },
+		touchFormations: true,
+	},
+	"strategy": {
+		column: "strategy",
+		decode: func(app *ct.App, v interface{}) error {
+			if v == nil {
+				app.Strategy = ct.DeployAllAtOnce
+				return nil
+			}
+			strategy, ok := v.(string)
+			if !ok {
+				return ct.ValidationError{Field: "strategy", Message: "must be a string"}
+			}
+			if err := validateStrategy(strategy); err != nil {
+				return err
+			}
+			app.Strategy = strategy
+			return nil
+		},
+		value: func(app *ct.App) interface{} { return app.Strategy },
+	},
+	"release_retention": {
+		column: "release_retention",
+		decode: func(app *ct.App, v interface{}) error {
+			if v == nil {
+				app.ReleaseRetention = 0
+				return nil
+			}
+			keep, ok := v.(float64)
+			if !ok || keep != float64(int(keep)) {
+				return ct.ValidationError{Field: "release_retention", Message: "must be an integer"}
+			}
+			if keep < 0 {
+				return ct.ValidationError{Field: "release_retention", Message: "must not be negative"}
+			}
+			app.ReleaseRetention = int(keep)
+			return nil
+		},
+		value: func(app *ct.App) interface{} { return app.ReleaseRetention },
+	},
+	"meta": {
+		column: "meta",
+		decode: func(app *ct.App, v interface{}) error {
+			meta, err := mergeMeta(app.Meta, v)
+			app.Meta = meta
+			return err
+		},
+		value: func(app *ct.App) interface{} { return envHstore(app.Meta) },
+	},
+}
+
+func decodeBoolField(field string, v interface{}) (bool, error) {
+	if v == nil {
+		return false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, ct.ValidationError{Field: field, Message: "must be a boolean"}
+	}
+	return b, nil
+}
+
+// mergeMeta applies the meta object of a merge patch to meta, setting the
+// keys with string values and removing the keys with null values. A null
+// patch removes all keys.
+func mergeMeta(meta map[string]string, v interface{}) (map[string]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	patch, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ct.ValidationError{Field: "meta", Message: "must be an object"}
+	}
+	merged := make(map[string]string, len(meta)+len(patch))
+	for k, v := range meta {
+		merged[k] = v
+	}
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(merged, k)
+		case string:
+			merged[k] = v
+		default:
+			return nil, ct.ValidationError{Field: "meta." + k, Message: "must be a string or null"}
+		}
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+	return merged, nil
+}
+
+// update applies a JSON merge patch (RFC 7396) of the fields in
+// appUpdateFields to an app. The patch is validated as a whole before any
+// field is changed.
+func (r *AppRepo) update(id, ifMatch string, data map[string]interface{}) (interface{}, error) {
+	fields := make([]string, 0, len(data))
+	for k := range data {
+		if _, ok := appUpdateFields[k]; !ok {
+			return nil, ct.ValidationError{Field: k, Message: "cannot be updated"}
+		}
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
 	tx, err := r.db.Begin()
 	if err != nil {
 		return nil, err
@@ -115,30 +510,300 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 		tx.Rollback()
 		return nil, err
 	}
+	if ifMatch != "" && !etagMatch(ifMatch, r.ETag(app)) {
+		tx.Rollback()
+		return nil, ErrPreconditionFailed
+	}
 
-	for k, v := range data {
-		switch k {
-		case "protected":
-			protected, ok := v.(bool)
-			if !ok {
+	updated := *app
+	var set []string
+	args := []interface{}{app.ID}
+	var touch bool
+	for _, k := range fields {
+		field := appUpdateFields[k]
+		if err := field.decode(&updated, data[k]); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		value := field.value(&updated)
+		if reflect.DeepEqual(value, field.value(app)) {
+			continue
+		}
+		args = append(args, value)
+		set = append(set, fmt.Sprintf("%s = $%d", field.column, len(args)))
+		touch = touch || field.touchFormations
+	}
+	if len(set) > 0 {
+		if _, err := tx.Exec("UPDATE apps SET "+strings.Join(set, ", ")+", updated_at = now() WHERE app_id = $1", args...); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if touch {
+			if err := touchFormations(tx, app.ID); err != nil {
 				tx.Rollback()
-				return nil, fmt.Errorf("controller: expected bool, got %T", v)
-			}
-			if app.Protected != protected {
-				if _, err := tx.Exec("UPDATE apps SET protected = $2 WHERE app_id = $1", app.ID, protected); err != nil {
-					tx.Rollback()
-					return nil, err
-				}
-				app.Protected = protected
+				return nil, err
 			}
 		}
 	}
+	app = &updated
 
+	if err := tx.QueryRow("SELECT updated_at FROM apps WHERE app_id = $1", app.ID).Scan(&app.UpdatedAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	return app, tx.Commit()
 }
 
+// touchFormations updates the formations of an app so that a formation event
+// carrying the current app state is emitted for each of them.
+func touchFormations(tx *dbTx, appID string) error {
+	_, err := tx.Exec("UPDATE formations SET updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL", appID)
+	return err
+}
+
+// GetEnv returns the app-scoped environment of an app.
+func (r *AppRepo) GetEnv(appID string) (map[string]string, error) {
+	var env hstore.Hstore
+	if err := r.db.QueryRow("SELECT env FROM apps WHERE app_id = $1 AND deleted_at IS NULL", appID).Scan(&env); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	res := make(map[string]string, len(env.Map))
+	for k, v := range env.Map {
+		res[k] = v.String
+	}
+	return res, nil
+}
+
+// SetEnv replaces the app-scoped environment of an app. The environment is
+// applied to new jobs, running jobs are not restarted.
+func (r *AppRepo) SetEnv(appID string, env map[string]string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE apps SET env = $2, updated_at = now() WHERE app_id = $1", appID, envHstore(env)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := touchFormations(tx, appID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func getAppEnv(app *ct.App, repo *AppRepo, r render.Render) {
+	env, err := repo.GetEnv(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, env)
+}
+
+func setAppEnv(app *ct.App, repo *AppRepo, req *http.Request, r render.Render) {
+	var env map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&env); err != nil {
+		r.JSON(400, ct.ValidationError{Message: "body must be an object of string values"})
+		return
+	}
+	for k := range env {
+		if k == "" {
+			r.JSON(400, ct.ValidationError{Field: "env", Message: "keys must not be blank"})
+			return
+		}
+	}
+	if err := repo.SetEnv(app.ID, env); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, env)
+}
+
+// At reconstructs the release, env and formations of an app as of t from the
+// app log.
+func (r *AppRepo) At(app *ct.App, t time.Time) (*ct.AppSnapshot, error) {
+	snapshot := &ct.AppSnapshot{App: app, Time: t, Env: map[string]string{}, Formations: []*ct.Formation{}}
+
+	var releaseID string
+	err := r.db.QueryRow("SELECT subject_id FROM app_logs WHERE app_id = $1 AND event = 'release' AND created_at <= $2 ORDER BY log_id DESC LIMIT 1", app.ID, t).Scan(&releaseID)
+	if err == nil {
+		// releases deleted since t are still part of the snapshot
+		row := r.db.QueryRow("SELECT release_id, artifact_id, data, schema_version, created_at FROM releases WHERE release_id = $1", releaseID)
+		if snapshot.Release, err = scanRelease(row); err != nil {
+			return nil, err
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var env []byte
+	err = r.db.QueryRow("SELECT data FROM app_logs WHERE app_id = $1 AND event = 'env' AND created_at <= $2 ORDER BY log_id DESC LIMIT 1", app.ID, t).Scan(&env)
+	if err == nil {
+		if err := json.Unmarshal(env, &snapshot.Env); err != nil {
+			return nil, err
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := r.db.Query("SELECT DISTINCT ON (subject_id) subject_id, data, created_at FROM app_logs WHERE app_id = $1 AND event = 'formation' AND created_at <= $2 ORDER BY subject_id, log_id DESC", app.ID, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := &ct.Formation{AppID: app.ID}
+		var data []byte
+		if err := rows.Scan(&f.ReleaseID, &data, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		// hstore values are encoded as strings, a null formation was deleted
+		var procs map[string]string
+		if err := json.Unmarshal(data, &procs); err != nil {
+			return nil, err
+		}
+		if procs == nil {
+			continue
+		}
+		f.ReleaseID = cleanUUID(f.ReleaseID)
+		f.Processes = make(map[string]int, len(procs))
+		for k, v := range procs {
+			if n, _ := strconv.Atoi(v); n > 0 {
+				f.Processes[k] = n
+			}
+		}
+		snapshot.Formations = append(snapshot.Formations, f)
+	}
+	return snapshot, rows.Err()
+}
+
+func getAppAt(app *ct.App, req *http.Request, repo *AppRepo, r render.Render) {
+	t, err := parseTimestamp(req.URL.Query().Get("time"))
+	if err != nil {
+		r.JSON(400, ct.ValidationError{Field: "time", Message: "must be an RFC 3339 timestamp"})
+		return
+	}
+	snapshot, err := repo.At(app, t)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, snapshot)
+}
+
+func validateStrategy(strategy string) error {
+	for _, s := range ct.DeployStrategies {
+		if strategy == s {
+			return nil
+		}
+	}
+	return ct.ValidationError{Field: "strategy", Message: fmt.Sprintf("must be one of %s", strings.Join(ct.DeployStrategies, ", "))}
+}
+
 func (r *AppRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	return r.list(" WHERE deleted_at IS NULL", defaultAppOrder, "")
+}
+
+// Filter lists apps matching the label query parameters. Each label is
+// either key=value, matching apps with that meta value, or key, matching apps
+// with the meta key set. Multiple labels must all match. Deleted apps are
+// included if include_deleted is true. The apps are sorted by the sort
+// parameter, see appOrder.
+func (r *AppRepo) Filter(q url.Values) (interface{}, error) {
+	filter, args, err := appFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	order, err := appOrder(q)
+	if err != nil {
+		return nil, err
+	}
+	return r.list(filter, order, "", args...)
+}
+
+// Page lists apps matching the label query parameters like Filter, limited
+// to a page of results, and returns the total number of matching apps.
+func (r *AppRepo) Page(q url.Values, limit, offset int) (interface{}, int, error) {
+	filter, args, err := appFilter(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	order, err := appOrder(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := r.db.QueryRow("SELECT count(*) FROM apps"+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, limit, offset)
+	apps, err := r.list(filter, order, fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args...)
+	return apps, total, err
+}
+
+func appFilter(q url.Values) (string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+	if q.Get("include_deleted") != "true" {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	for _, label := range q["label"] {
+		kv := strings.SplitN(label, "=", 2)
+		if kv[0] == "" {
+			return "", nil, ct.ValidationError{Field: "label", Message: fmt.Sprintf("%q must be of the form key=value or key", label)}
+		}
+		if len(kv) == 2 {
+			args = append(args, envHstore(map[string]string{kv[0]: kv[1]}))
+			conds = append(conds, fmt.Sprintf("meta @> $%d", len(args)))
+		} else {
+			args = append(args, kv[0])
+			conds = append(conds, fmt.Sprintf("exist(meta, $%d)", len(args)))
+		}
+	}
+	if prefix := q.Get("name_prefix"); prefix != "" {
+		args = append(args, likeEscaper.Replace(strings.ToLower(prefix))+"%")
+		conds = append(conds, fmt.Sprintf("lower(name) LIKE $%d", len(args)))
+	}
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+const defaultAppOrder = "created_at DESC"
+
+// appSortColumns are the columns apps may be sorted by.
+var appSortColumns = []string{"name", "created_at", "updated_at"}
+
+// appOrder returns the ORDER BY expression for the sort parameter, which is
+// a column in appSortColumns sorted ascending, or descending if prefixed with
+// a minus, such as -updated_at.
+func appOrder(q url.Values) (string, error) {
+	sort := q.Get("sort")
+	if sort == "" {
+		return defaultAppOrder, nil
+	}
+	dir := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		sort, dir = sort[1:], "DESC"
+	}
+	for _, col := range appSortColumns {
+		if sort == col {
+			return col + " " + dir, nil
+		}
+	}
+	return "", ct.ValidationError{Field: "sort", Message: fmt.Sprintf("must be one of %s, optionally prefixed with -", strings.Join(appSortColumns, ", "))}
+}
+
+// likeEscaper escapes the LIKE wildcards in a user supplied pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (r *AppRepo) list(filter, order, page string, args ...interface{}) (interface{}, error) {
+	rows, err := r.db.Query("SELECT "+appColumns+" FROM apps"+filter+" ORDER BY "+order+", app_id"+page, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -154,11 +819,170 @@ func (r *AppRepo) List() (interface{}, error) {
 	return apps, rows.Err()
 }
 
-func (r *AppRepo) SetRelease(appID string, releaseID string) error {
-	return r.db.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", appID, releaseID)
+// Stats counts the releases, formations and resources of an app, the jobs are
+// counted by the caller.
+func (r *AppRepo) Stats(appID string) (*ct.AppStats, error) {
+	stats := &ct.AppStats{AppID: appID}
+	err := r.db.QueryRow(`SELECT
+		(SELECT count(*) FROM (
+			SELECT subject_id FROM app_logs WHERE app_id = $1 AND event IN ('release', 'formation') AND subject_id IS NOT NULL
+			UNION SELECT release_id FROM apps WHERE app_id = $1 AND release_id IS NOT NULL
+		) r),
+		(SELECT count(*) FROM formations WHERE app_id = $1 AND deleted_at IS NULL),
+		(SELECT count(*) FROM app_resources WHERE app_id = $1 AND deleted_at IS NULL)`, appID).Scan(&stats.Releases, &stats.Formations, &stats.Resources)
+	return stats, err
+}
+
+// Delete soft deletes the app along with its formations, resource
+// attachments, network policy and env group memberships.
+func (r *AppRepo) Delete(appID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"UPDATE apps SET deleted_at = now(), updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL",
+		"UPDATE formations SET deleted_at = now(), updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL",
+		"UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL",
+		"UPDATE network_policies SET deleted_at = now(), updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL",
+		"DELETE FROM app_env_groups WHERE app_id = $1",
+	} {
+		if _, err := tx.Exec(query, appID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Restore undeletes an app along with the formations, resource attachments
+// and network policy deleted with it, returning the restored app and the
+// routes it had when it was deleted. Env group memberships are not restored.
+func (r *AppRepo) Restore(id string) (*ct.App, []*strowger.Route, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	query := "SELECT " + appColumns + ", deleted_routes FROM apps WHERE deleted_at IS NOT NULL AND "
+	var row Scanner
+	if idPattern.MatchString(id) {
+		row = tx.QueryRow(query+"(app_id = $1 OR lower(name) = $2) ORDER BY deleted_at DESC LIMIT 1 FOR UPDATE", id, strings.ToLower(id))
+	} else {
+		row = tx.QueryRow(query+"lower(name) = $1 ORDER BY deleted_at DESC LIMIT 1 FOR UPDATE", strings.ToLower(id))
+	}
+	app := &ct.App{}
+	var meta hstore.Hstore
+	var routesJSON sql.NullString
+	err = row.Scan(&app.ID, &app.Name, &app.Protected, &app.Maintenance, &app.Strategy, &app.ReleaseRetention, &meta, &app.CreatedAt, &app.UpdatedAt, &app.DeletedAt, &routesJSON)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, nil, err
+	}
+	app.ID = cleanUUID(app.ID)
+	if len(meta.Map) > 0 {
+		app.Meta = make(map[string]string, len(meta.Map))
+		for k, v := range meta.Map {
+			app.Meta[k] = v.String
+		}
+	}
+	var routes []*strowger.Route
+	if routesJSON.Valid {
+		if err := json.Unmarshal([]byte(routesJSON.String), &routes); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+
+	// rows deleted with the app share its deletion timestamp
+	deletedAt := *app.DeletedAt
+	err = tx.QueryRow("UPDATE apps SET deleted_at = NULL, deleted_routes = NULL, updated_at = now() WHERE app_id = $1 RETURNING updated_at", app.ID).Scan(&app.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		tx.Rollback()
+		return nil, nil, ct.ValidationError{Field: "name", Message: "is already taken by another app"}
+	} else if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	app.DeletedAt = nil
+	for _, query := range []string{
+		"UPDATE formations SET deleted_at = NULL, updated_at = now() WHERE app_id = $1 AND deleted_at = $2",
+		"UPDATE app_resources SET deleted_at = NULL WHERE app_id = $1 AND deleted_at = $2",
+		"UPDATE network_policies SET deleted_at = NULL, updated_at = now() WHERE app_id = $1 AND deleted_at = $2",
+	} {
+		if _, err := tx.Exec(query, app.ID, deletedAt); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	return app, routes, tx.Commit()
+}
+
+// SetDeletedRoutes records the routes of a deleted app so that they can be
+// recreated if the app is restored.
+func (r *AppRepo) SetDeletedRoutes(appID string, routes []*strowger.Route) error {
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	return r.db.Exec("UPDATE apps SET deleted_routes = $2 WHERE app_id = $1", appID, string(data))
+}
+
+func restoreApp(params martini.Params, apps *AppRepo, router strowgerc.Client, admitter *Admitter, r render.Render) {
+	app, routes, err := apps.Restore(params["apps_id"])
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	for _, route := range routes {
+		route.ID = ""
+		route.CreatedAt = nil
+		route.UpdatedAt = nil
+		route.ParentRef = routeParentRef(app)
+		if err := admitter.Admit("routes", "create", route); err != nil {
+			log.Printf("error admitting route of restored app %s: %s", app.ID, err)
+			continue
+		}
+		route.ParentRef = routeParentRef(app)
+		if err := router.CreateRoute(route); err != nil {
+			log.Printf("error recreating route of restored app %s: %s", app.ID, err)
+		}
+	}
+	r.JSON(200, app)
+}
+
+func deleteApp(app *ct.App, apps *AppRepo, adopted *AdoptedJobRepo, cl clusterClient, router strowgerc.Client, r render.Render) {
+	if app.Protected {
+		r.JSON(400, ct.ValidationError{Field: "protected", Message: "must be false to delete the app"})
+		return
+	}
+	if err := apps.Delete(app.ID); err != nil {
+		respondWithError(r, err)
+		return
+	}
+
+	// The app is gone at this point, so cleanup failures are logged rather
+	// than failing the request.
+	routes, err := router.ListRoutes(routeParentRef(app))
+	if err != nil {
+		log.Printf("error listing routes of deleted app %s: %s", app.ID, err)
+	} else if err := apps.SetDeletedRoutes(app.ID, routes); err != nil {
+		log.Printf("error saving routes of deleted app %s: %s", app.ID, err)
+	}
+	for _, route := range routes {
+		if err := router.DeleteRoute(route.ID); err != nil && err != strowgerc.ErrNotFound {
+			log.Printf("error deleting route %s of deleted app %s: %s", route.ID, app.ID, err)
+		}
+	}
+	if err := stopAppJobs(app, adopted, cl); err != nil {
+		log.Printf("error stopping jobs of deleted app %s: %s", app.ID, err)
+	}
+	r.JSON(200, struct{}{})
 }
 
 func (r *AppRepo) GetRelease(id string) (*ct.Release, error) {
-	row := r.db.QueryRow("SELECT r.release_id, r.artifact_id, r.data, r.created_at FROM apps a JOIN releases r USING (release_id) WHERE a.app_id = $1", id)
+	row := r.db.QueryRow("SELECT r.release_id, r.artifact_id, r.data, r.schema_version, r.created_at FROM apps a JOIN releases r USING (release_id) WHERE a.app_id = $1", id)
 	return scanRelease(row)
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/martini-contrib/render"
+)
+
+const (
+	// maxAppEvents is the number of events returned by a list or written to
+	// an event stream at once.
+	maxAppEvents = 100
+
+	appEventKeepalive = 30 * time.Second
+)
+
+const appLogInsert = "INSERT INTO app_logs (app_id, log_id, event, object_id, data) VALUES ($1, next_log_id($1), $2, $3, $4)"
+
+// appLogData encodes the data of an app log event, nil is encoded as null to
+// record that the object was deleted.
+func appLogData(v interface{}) (string, error) {
+	data, err := json.Marshal(normalizeTimes(v))
+	return string(data), err
+}
+
+// AppEventRepo reads the events recorded in the app log and notifies
+// subscribers of new events.
+type AppEventRepo struct {
+	db *DB
+
+	subMtx        sync.Mutex
+	subscriptions map[string]map[chan struct{}]struct{}
+	stopListener  chan struct{}
+}
+
+func NewAppEventRepo(db *DB) *AppEventRepo {
+	return &AppEventRepo{
+		db:            db,
+		subscriptions: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+// Add records an event for the object of an app.
+func (r *AppEventRepo) Add(appID string, objectType ct.EventType, objectID string, v interface{}) error {
+	data, err := appLogData(v)
+	if err != nil {
+		return err
+	}
+	return r.db.Exec(appLogInsert, appID, string(objectType), objectID, data)
+}
+
+// List returns up to limit events of an app with IDs greater than after.
+func (r *AppEventRepo) List(appID string, after int64, limit int) ([]*ct.AppEvent, error) {
+	return r.list(appID, "", after, limit)
+}
+
+// ListObject is like List but only returns the events of one object.
+func (r *AppEventRepo) ListObject(appID string, objectType ct.EventType, objectID string, after int64, limit int) ([]*ct.AppEvent, error) {
+	return r.list(appID, " AND event = $4 AND object_id = $5", after, limit, string(objectType), objectID)
+}
+
+func (r *AppEventRepo) list(appID, filter string, after int64, limit int, args ...interface{}) ([]*ct.AppEvent, error) {
+	args = append([]interface{}{appID, after, limit}, args...)
+	rows, err := r.db.Query("SELECT log_id, event, object_id, subject_id, data, created_at FROM app_logs WHERE app_id = $1 AND log_id > $2"+filter+" ORDER BY log_id LIMIT $3", args...)
+	if err != nil {
+		return nil, err
+	}
+	events := []*ct.AppEvent{}
+	for rows.Next() {
+		event := &ct.AppEvent{AppID: appID}
+		var objectType string
+		var objectID, subjectID sql.NullString
+		var data []byte
+		if err := rows.Scan(&event.ID, &objectType, &objectID, &subjectID, &data, &event.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		event.ObjectType = ct.EventType(objectType)
+		event.ObjectID = objectID.String
+		if !objectID.Valid {
+			event.ObjectID = cleanUUID(subjectID.String)
+		}
+		raw := json.RawMessage(data)
+		event.Data = &raw
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Subscribe returns a channel which receives a value when events are added
+// to the app log of an app.
+func (r *AppEventRepo) Subscribe(appID string) (chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	if len(r.subscriptions) == 0 {
+		if err := r.startListener(); err != nil {
+			return nil, err
+		}
+	}
+	appID = cleanUUID(appID)
+	if r.subscriptions[appID] == nil {
+		r.subscriptions[appID] = make(map[chan struct{}]struct{})
+	}
+	r.subscriptions[appID][ch] = struct{}{}
+	return ch, nil
+}
+
+func (r *AppEventRepo) Unsubscribe(appID string, ch chan struct{}) {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	appID = cleanUUID(appID)
+	delete(r.subscriptions[appID], ch)
+	if len(r.subscriptions[appID]) == 0 {
+		delete(r.subscriptions, appID)
+	}
+	if len(r.subscriptions) == 0 {
+		close(r.stopListener)
+	}
+}
+
+func (r *AppEventRepo) startListener() error {
+	listener := pq.NewListener(r.db.DSN(), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("app event listener error:", err)
+		}
+	})
+	if err := listener.Listen("app_logs"); err != nil {
+		return err
+	}
+	// each listener has its own stop channel as it is closed without
+	// waiting for the listener to stop
+	stop := make(chan struct{})
+	r.stopListener = stop
+	go func() {
+		for {
+			select {
+			case n := <-listener.Notify:
+				// a nil notification is sent after reconnecting, when
+				// notifications may have been missed
+				var appID string
+				if n != nil {
+					// app_id:log_id
+					appID = strings.SplitN(n.Extra, ":", 2)[0]
+				}
+				r.notify(appID)
+			case <-stop:
+				listener.Close()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// notify wakes the subscribers of an app, or all subscribers if appID is
+// empty.
+func (r *AppEventRepo) notify(appID string) {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	appID = cleanUUID(appID)
+	for id, subs := range r.subscriptions {
+		if appID != "" && id != appID {
+			continue
+		}
+		for ch := range subs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// lastEventID returns the event ID in the Last-Event-ID header or since
+// parameter of a request, or zero if neither is set.
+func lastEventID(req *http.Request) (int64, error) {
+	since := req.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = req.FormValue("since")
+	}
+	if since == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(since, 10, 64)
+	if err != nil {
+		return 0, ct.ValidationError{Field: "since", Message: "must be an event ID"}
+	}
+	return id, nil
+}
+
+// streamAppEvents responds with the events of an app after the ID in the
+// Last-Event-ID header or since parameter. Clients accepting
+// text/event-stream are sent new events as they are recorded, others receive
+// a JSON list of up to maxAppEvents events.
+func streamAppEvents(app *ct.App, repo *AppEventRepo, req *http.Request, w http.ResponseWriter, r render.Render) {
+	after, err := lastEventID(req)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		events, err := repo.List(app.ID, after, maxAppEvents)
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		r.JSON(200, events)
+		return
+	}
+
+	ch, err := repo.Subscribe(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	defer repo.Unsubscribe(app.ID, ch)
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	keepalive := time.NewTicker(appEventKeepalive)
+	defer keepalive.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(200)
+	flush()
+	for {
+		events, err := repo.List(app.ID, after, maxAppEvents)
+		if err != nil {
+			log.Println("error listing app events:", err)
+			return
+		}
+		for _, e := range events {
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.ObjectType, *e.Data); err != nil {
+				return
+			}
+			after = e.ID
+		}
+		flush()
+		if len(events) == maxAppEvents {
+			continue
+		}
+		select {
+		case <-ch:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+			flush()
+		case <-closed:
+			return
+		}
+	}
+}
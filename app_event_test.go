@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	strowgerc "github.com/flynn/strowger/client"
+	"github.com/flynn/strowger/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestAppEvents(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-events"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+
+	route := s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "app-events"}).ToRoute())
+	res, err := s.Delete(fmt.Sprintf("/apps/%s/routes/%s", app.ID, route.ID))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"web0": {Job: &host.Job{ID: "web0", Attributes: map[string]string{"flynn-controller.app": app.ID, "flynn-controller.type": "web"}}, Status: host.StatusRunning},
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+	defer s.cc.setHosts(map[string]host.Host{})
+	index := s.m.Get(reflect.TypeOf((*JobIndex)(nil))).Interface().(*JobIndex)
+	c.Assert(index.Sync(), IsNil)
+	// unchanged jobs are not recorded again
+	c.Assert(index.Sync(), IsNil)
+
+	events, err := client.AppEvents(app.ID, 0)
+	c.Assert(err, IsNil)
+	type object struct {
+		typ ct.EventType
+		id  string
+	}
+	objects := make([]object, len(events))
+	for i, e := range events {
+		objects[i] = object{e.ObjectType, e.ObjectID}
+	}
+	jobID := utils.FormatJobID("host0", "web0")
+	c.Assert(objects, DeepEquals, []object{
+		{ct.EventTypeFormation, release.ID},
+		{ct.EventTypeRelease, release.ID},
+		{ct.EventTypeRoute, route.ID},
+		{ct.EventTypeRoute, route.ID},
+		{ct.EventTypeJob, jobID},
+	})
+	var routeEvent ct.RouteEvent
+	c.Assert(json.Unmarshal(*events[2].Data, &routeEvent), IsNil)
+	c.Assert(routeEvent.Action, Equals, ct.RouteCreated)
+	c.Assert(json.Unmarshal(*events[3].Data, &routeEvent), IsNil)
+	c.Assert(routeEvent.Action, Equals, ct.RouteDeleted)
+	c.Assert(routeEvent.Route.ID, Equals, route.ID)
+
+	// events are listed after the given ID
+	last := events[len(events)-1].ID
+	hc.jobs = nil
+	c.Assert(index.Sync(), IsNil)
+	events, err = client.AppEvents(app.ID, last)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].ObjectID, Equals, jobID)
+	c.Assert(string(*events[0].Data), Equals, "null")
+
+	res, err = s.Get("/apps/"+app.ID+"/events?since=foo", &events)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestEventTypeJSON(c *C) {
+	var e ct.AppEvent
+	c.Assert(json.Unmarshal([]byte(`{"object_type":"deployment"}`), &e), IsNil)
+	c.Assert(e.ObjectType, Equals, ct.EventTypeDeployment)
+
+	// unknown values are decoded, so that older clients can decode values
+	// added later
+	c.Assert(json.Unmarshal([]byte(`{"object_type":"foo"}`), &e), IsNil)
+	c.Assert(e.ObjectType, Equals, ct.EventType("foo"))
+	c.Assert(e.ObjectType.Valid(), Equals, false)
+
+	var j ct.Job
+	c.Assert(json.Unmarshal([]byte(`{"state":"crashed"}`), &j), IsNil)
+	c.Assert(j.State, Equals, ct.JobStateCrashed)
+	c.Assert(json.Unmarshal([]byte(`{"state":"running"}`), &j), IsNil)
+	c.Assert(j.State.Valid(), Equals, false)
+}
+
+func (s *S) TestRouteEvents(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "route-events"})
+	router := s.m.Get(reflect.TypeOf((*strowgerc.Client)(nil)).Elem()).Interface().(strowgerc.Client)
+	index := s.m.Get(reflect.TypeOf((*RouteIndex)(nil))).Interface().(*RouteIndex)
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	var last int64
+	actions := func() []ct.RouteAction {
+		events, err := client.AppEvents(app.ID, last)
+		c.Assert(err, IsNil)
+		var res []ct.RouteAction
+		for _, e := range events {
+			last = e.ID
+			if e.ObjectType != ct.EventTypeRoute {
+				continue
+			}
+			var data ct.RouteEvent
+			c.Assert(json.Unmarshal(*e.Data, &data), IsNil)
+			c.Assert(data.Route.ID, Equals, e.ObjectID)
+			res = append(res, data.Action)
+		}
+		return res
+	}
+
+	// routes changed directly in the router are picked up by syncing
+	config := json.RawMessage(`{"service":"route-events","port":1234}`)
+	route := &strowger.Route{Type: "tcp", ParentRef: routeParentRef(app), Config: &config}
+	c.Assert(router.CreateRoute(route), IsNil)
+	c.Assert(index.Sync(), IsNil)
+	c.Assert(actions(), DeepEquals, []ct.RouteAction{ct.RouteCreated})
+	c.Assert(index.Sync(), IsNil)
+	c.Assert(actions(), HasLen, 0)
+
+	updated := json.RawMessage(`{"service":"route-events","port":1235}`)
+	route.Config = &updated
+	c.Assert(index.Sync(), IsNil)
+	c.Assert(actions(), DeepEquals, []ct.RouteAction{ct.RouteUpdated})
+
+	c.Assert(router.DeleteRoute(route.ID), IsNil)
+	c.Assert(index.Sync(), IsNil)
+	c.Assert(actions(), DeepEquals, []ct.RouteAction{ct.RouteDeleted})
+
+	// routes changed through the controller are recorded once
+	created := s.createTestRoute(c, app.ID, &strowger.Route{Type: "tcp", Config: &config})
+	c.Assert(index.Sync(), IsNil)
+	c.Assert(actions(), DeepEquals, []ct.RouteAction{ct.RouteCreated})
+	res, err := s.Delete(fmt.Sprintf("/apps/%s/routes/%s", app.ID, created.ID))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(index.Sync(), IsNil)
+	c.Assert(actions(), DeepEquals, []ct.RouteAction{ct.RouteDeleted})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+const (
+	defaultAppLockTTL = time.Minute
+	maxAppLockTTL     = time.Hour
+)
+
+// ErrAppLocked is returned when acquiring a lock on an app which is already
+// locked by another holder.
+var ErrAppLocked = errors.New("controller: app is locked")
+
+type AppLockRepo struct {
+	db *DB
+}
+
+func NewAppLockRepo(db *DB) *AppLockRepo {
+	return &AppLockRepo{db}
+}
+
+func scanAppLock(s Scanner) (*ct.AppLock, error) {
+	lock := &ct.AppLock{}
+	var operation sql.NullString
+	err := s.Scan(&lock.ID, &lock.AppID, &lock.Holder, &operation, &lock.TTL, &lock.ExpiresAt, &lock.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	lock.ID = cleanUUID(lock.ID)
+	lock.AppID = cleanUUID(lock.AppID)
+	lock.Operation = operation.String
+	return lock, err
+}
+
+const appLockColumns = "lock_id, app_id, holder, operation, ttl, expires_at, created_at"
+
+// Get returns the unexpired lock held on an app.
+func (r *AppLockRepo) Get(appID string) (*ct.AppLock, error) {
+	return scanAppLock(r.db.QueryRow("SELECT "+appLockColumns+" FROM app_locks WHERE app_id = $1 AND expires_at > now()", appID))
+}
+
+// Acquire locks an app for lock.TTL seconds. If the app is already locked,
+// ErrAppLocked is returned along with the existing lock.
+func (r *AppLockRepo) Acquire(lock *ct.AppLock) (*ct.AppLock, error) {
+	if lock.Holder == "" {
+		return nil, ct.ValidationError{Field: "holder", Message: "must not be blank"}
+	}
+	if lock.TTL == 0 {
+		lock.TTL = int(defaultAppLockTTL / time.Second)
+	}
+	if lock.TTL < 0 || lock.TTL > int(maxAppLockTTL/time.Second) {
+		return nil, ct.ValidationError{Field: "ttl", Message: "must be between 1 and 3600 seconds"}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// lock the app row to serialize concurrent acquisitions
+	if _, err := selectApp(tx, lock.AppID, true); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	existing, err := scanAppLock(tx.QueryRow("SELECT "+appLockColumns+" FROM app_locks WHERE app_id = $1 AND expires_at > now()", lock.AppID))
+	if err == nil {
+		tx.Rollback()
+		return existing, ErrAppLocked
+	} else if err != ErrNotFound {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM app_locks WHERE app_id = $1", lock.AppID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.QueryRow("INSERT INTO app_locks (app_id, holder, operation, ttl, expires_at) VALUES ($1, $2, $3, $4, now() + $4 * interval '1 second') RETURNING lock_id, expires_at, created_at",
+		lock.AppID, lock.Holder, lock.Operation, lock.TTL).Scan(&lock.ID, &lock.ExpiresAt, &lock.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	lock.ID = cleanUUID(lock.ID)
+	return lock, tx.Commit()
+}
+
+// Renew extends an unexpired lock by its TTL. ErrNotFound is returned if the
+// lock has expired or been broken.
+func (r *AppLockRepo) Renew(appID, lockID string) (*ct.AppLock, error) {
+	if !idPattern.MatchString(lockID) {
+		return nil, ErrNotFound
+	}
+	return scanAppLock(r.db.QueryRow("UPDATE app_locks SET expires_at = now() + ttl * interval '1 second' WHERE app_id = $1 AND lock_id = $2 AND expires_at > now() RETURNING "+appLockColumns, appID, lockID))
+}
+
+// Release removes a lock, returning ErrNotFound if the lock is not held.
+func (r *AppLockRepo) Release(appID, lockID string) error {
+	if !idPattern.MatchString(lockID) {
+		return ErrNotFound
+	}
+	var id string
+	err := r.db.QueryRow("DELETE FROM app_locks WHERE app_id = $1 AND lock_id = $2 AND expires_at > now() RETURNING lock_id", appID, lockID).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// Break removes any lock held on an app.
+func (r *AppLockRepo) Break(appID string) error {
+	return r.db.Exec("DELETE FROM app_locks WHERE app_id = $1", appID)
+}
+
+// redactAppLock returns a copy of a lock without its ID, which is the
+// credential for modifying the locked app and is only returned to the client
+// which acquired the lock.
+func redactAppLock(lock *ct.AppLock) *ct.AppLock {
+	redacted := *lock
+	redacted.ID = ""
+	return &redacted
+}
+
+func respondAppLocked(w http.ResponseWriter, r render.Render, lock *ct.AppLock) {
+	w.Header().Set(ct.AppLockHeader, "true")
+	r.JSON(409, redactAppLock(lock))
+}
+
+// checkAppLock rejects requests which modify a locked app unless they carry
+// the ID of the lock in the AppLockHeader.
+func checkAppLock(app *ct.App, repo *AppLockRepo, req *http.Request, w http.ResponseWriter, r render.Render) {
+	lock, err := repo.Get(app.ID)
+	if err == ErrNotFound {
+		return
+	} else if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if req.Header.Get(ct.AppLockHeader) != lock.ID {
+		respondAppLocked(w, r, lock)
+	}
+}
+
+func acquireAppLock(lock ct.AppLock, app *ct.App, repo *AppLockRepo, w http.ResponseWriter, r render.Render) {
+	lock.AppID = app.ID
+	existing, err := repo.Acquire(&lock)
+	if err == ErrAppLocked {
+		respondAppLocked(w, r, existing)
+		return
+	} else if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, &lock)
+}
+
+func getAppLock(app *ct.App, repo *AppLockRepo, r render.Render) {
+	lock, err := repo.Get(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, redactAppLock(lock))
+}
+
+func renewAppLock(app *ct.App, params martini.Params, repo *AppLockRepo, r render.Render) {
+	lock, err := repo.Renew(app.ID, params["lock_id"])
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, lock)
+}
+
+func releaseAppLock(app *ct.App, params martini.Params, repo *AppLockRepo, w http.ResponseWriter, r render.Render) {
+	if err := repo.Release(app.ID, params["lock_id"]); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// breakAppLock removes the lock on an app regardless of who holds it. It
+// requires ?force=true and is restricted to admins.
+func breakAppLock(app *ct.App, req *http.Request, repo *AppLockRepo, w http.ResponseWriter, r render.Render) {
+	if requestSubject(req) != SubjectAdmin {
+		r.JSON(403, struct {
+			Message string `json:"message"`
+		}{"admin access required"})
+		return
+	}
+	if req.URL.Query().Get("force") != "true" {
+		r.JSON(400, ct.ValidationError{Field: "force", Message: "must be true to break a lock held by another client"})
+		return
+	}
+	if err := repo.Break(app.ID); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -1,63 +1,233 @@
 package main
 
 import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
 	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
 	"github.com/flynn/go-sql"
 	"github.com/flynn/pq"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
 )
 
 type ArtifactRepo struct {
-	db *DB
+	db        *DB
+	resolver  ArtifactResolver
+	allowlist *ImageAllowlist
 }
 
-func NewArtifactRepo(db *DB) *ArtifactRepo {
-	return &ArtifactRepo{db}
+// NewArtifactRepo returns an artifact repository which looks up the digests
+// of artifacts created without one using resolver, if it is not nil.
+func NewArtifactRepo(db *DB, resolver ArtifactResolver) *ArtifactRepo {
+	return &ArtifactRepo{db: db, resolver: resolver}
 }
 
+// SetImageAllowlist restricts the artifacts which can be created, nil allows
+// every artifact.
+func (r *ArtifactRepo) SetImageAllowlist(allowlist *ImageAllowlist) {
+	r.allowlist = allowlist
+}
+
+// CheckCreate rejects artifacts outside the image allowlist.
+func (r *ArtifactRepo) CheckCreate(data interface{}, req *http.Request) error {
+	return r.allowlist.Check(data.(*ct.Artifact), req)
+}
+
+const artifactColumns = "artifact_id, type, uri, digest, size, created_at"
+
+var artifactDigestPattern = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+
+func validateArtifact(a *ct.Artifact) error {
+	switch a.Type {
+	case ct.ArtifactTypeFile:
+		u, err := url.Parse(a.URI)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return ct.ValidationError{Field: "uri", Message: fmt.Sprintf("must be an http or https URL for %s artifacts", a.Type)}
+		}
+	}
+	if a.Digest != "" && !artifactDigestPattern.MatchString(a.Digest) {
+		return ct.ValidationError{Field: "digest", Message: "must be of the form algorithm:hex, such as sha256:..."}
+	}
+	if a.Size < 0 {
+		return ct.ValidationError{Field: "size", Message: "must not be negative"}
+	}
+	return nil
+}
+
+// Add creates an artifact, or returns the existing artifact with the same
+// type and URI. A digest given by the client must match the digest of the
+// existing artifact, if it has one, as a URI whose tag was moved refers to
+// different content.
 func (r *ArtifactRepo) Add(data interface{}) error {
 	a := data.(*ct.Artifact)
-	// TODO: actually validate
+	resolved, err := r.prepare(a)
+	if err != nil {
+		return err
+	}
 	// TODO: use a transaction here
 	if a.ID == "" {
 		a.ID = utils.UUID()
 	}
-	err := r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri) VALUES ($1, $2, $3) RETURNING created_at",
-		a.ID, a.Type, a.URI).Scan(&a.CreatedAt)
+	digest := sql.NullString{String: a.Digest, Valid: a.Digest != ""}
+	size := sql.NullInt64{Int64: a.Size, Valid: a.Size > 0}
+	err = r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri, digest, size) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		a.ID, a.Type, a.URI, digest, size).Scan(&a.CreatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
 		var deleted *time.Time
-		err = r.db.QueryRow("SELECT artifact_id, created_at, deleted_at FROM artifacts WHERE type = $1 AND uri = $2",
-			a.Type, a.URI).Scan(&a.ID, &a.CreatedAt, &deleted)
+		var existingDigest sql.NullString
+		var existingSize sql.NullInt64
+		err = r.db.QueryRow("SELECT artifact_id, digest, size, created_at, deleted_at FROM artifacts WHERE type = $1 AND uri = $2",
+			a.Type, a.URI).Scan(&a.ID, &existingDigest, &existingSize, &a.CreatedAt, &deleted)
 		if err != nil {
 			return err
 		}
-		if deleted != nil {
-			err = r.db.Exec("UPDATE artifacts SET deleted_at = NULL WHERE artifact_id = $1", a.ID)
+		var update bool
+		if update, err = mergeExistingArtifact(a, deleted, existingDigest, existingSize, resolved); err == nil && update {
+			err = r.db.Exec("UPDATE artifacts SET deleted_at = NULL, digest = COALESCE(digest, $2), size = COALESCE(size, $3) WHERE artifact_id = $1",
+				a.ID, digest, size)
+		}
+	}
+	a.ID = cleanUUID(a.ID)
+	return err
+}
+
+// AddTx is like Add, in a transaction.
+func (r *ArtifactRepo) AddTx(tx *dbTx, a *ct.Artifact) error {
+	resolved, err := r.prepare(a)
+	if err != nil {
+		return err
+	}
+	digest := sql.NullString{String: a.Digest, Valid: a.Digest != ""}
+	size := sql.NullInt64{Int64: a.Size, Valid: a.Size > 0}
+	var deleted *time.Time
+	var existingDigest sql.NullString
+	var existingSize sql.NullInt64
+	// the existing artifact is looked up first, as a failed insert would
+	// abort the transaction
+	err = tx.QueryRow("SELECT artifact_id, digest, size, created_at, deleted_at FROM artifacts WHERE type = $1 AND uri = $2 FOR UPDATE",
+		a.Type, a.URI).Scan(&a.ID, &existingDigest, &existingSize, &a.CreatedAt, &deleted)
+	if err == sql.ErrNoRows {
+		if a.ID == "" {
+			a.ID = utils.UUID()
+		}
+		err = tx.QueryRow("INSERT INTO artifacts (artifact_id, type, uri, digest, size) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+			a.ID, a.Type, a.URI, digest, size).Scan(&a.CreatedAt)
+	} else if err == nil {
+		var update bool
+		if update, err = mergeExistingArtifact(a, deleted, existingDigest, existingSize, resolved); err == nil && update {
+			_, err = tx.Exec("UPDATE artifacts SET deleted_at = NULL, digest = COALESCE(digest, $2), size = COALESCE(size, $3) WHERE artifact_id = $1",
+				a.ID, digest, size)
 		}
 	}
 	a.ID = cleanUUID(a.ID)
 	return err
 }
 
+// prepare validates an artifact being added and resolves its digest,
+// reporting whether it was resolved.
+func (r *ArtifactRepo) prepare(a *ct.Artifact) (bool, error) {
+	if err := validateArtifact(a); err != nil {
+		return false, err
+	}
+	if a.Digest == "" && r.resolver != nil {
+		// the digest is best effort, the artifact is usable without it
+		if err := r.resolver.Resolve(a); err != nil {
+			log.Printf("error resolving digest of artifact %s: %s", a.URI, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// mergeExistingArtifact fills in an artifact being added from the existing
+// artifact with the same type and URI, and reports whether the existing
+// artifact must be restored or given the digest and size.
+func mergeExistingArtifact(a *ct.Artifact, deleted *time.Time, existingDigest sql.NullString, existingSize sql.NullInt64, resolved bool) (bool, error) {
+	digest, size := a.Digest != "", a.Size > 0
+	if existingDigest.Valid && digest && existingDigest.String != a.Digest && !resolved {
+		return false, ct.ValidationError{Field: "digest", Message: "does not match the digest of the existing artifact with this uri"}
+	}
+	if existingDigest.Valid {
+		a.Digest = existingDigest.String
+	}
+	if existingSize.Valid {
+		a.Size = existingSize.Int64
+	}
+	return deleted != nil || !existingDigest.Valid && digest || !existingSize.Valid && size, nil
+}
+
 func scanArtifact(s Scanner) (*ct.Artifact, error) {
 	artifact := &ct.Artifact{}
-	err := s.Scan(&artifact.ID, &artifact.Type, &artifact.URI, &artifact.CreatedAt)
+	var digest sql.NullString
+	var size sql.NullInt64
+	err := s.Scan(&artifact.ID, &artifact.Type, &artifact.URI, &digest, &size, &artifact.CreatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
 	artifact.ID = cleanUUID(artifact.ID)
+	artifact.Digest = digest.String
+	artifact.Size = size.Int64
 	return artifact, err
 }
 
 func (r *ArtifactRepo) Get(id string) (interface{}, error) {
-	row := r.db.QueryRow("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL", id)
+	row := r.db.QueryRow("SELECT "+artifactColumns+" FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL", id)
 	return scanArtifact(row)
 }
 
 func (r *ArtifactRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	return r.list("", "")
+}
+
+// Filter lists the artifacts matching the type, uri and uri_prefix query
+// parameters.
+func (r *ArtifactRepo) Filter(q url.Values) (interface{}, error) {
+	filter, args := artifactFilter(q)
+	return r.list(filter, "", args...)
+}
+
+// Page lists a page of artifacts matching the query parameters like Filter
+// and returns the total number of matching artifacts.
+func (r *ArtifactRepo) Page(q url.Values, limit, offset int) (interface{}, int, error) {
+	filter, args := artifactFilter(q)
+	var total int
+	if err := r.db.QueryRow("SELECT count(*) FROM artifacts WHERE deleted_at IS NULL"+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, limit, offset)
+	artifacts, err := r.list(filter, fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args...)
+	return artifacts, total, err
+}
+
+// artifactFilter returns the conditions selecting the artifacts of a type,
+// with a URI, or with URIs starting with a prefix, such as the images of a
+// registry.
+func artifactFilter(q url.Values) (string, []interface{}) {
+	var filter string
+	var args []interface{}
+	if typ := q.Get("type"); typ != "" {
+		args = append(args, typ)
+		filter += fmt.Sprintf(" AND type = $%d", len(args))
+	}
+	if uri := q.Get("uri"); uri != "" {
+		args = append(args, uri)
+		filter += fmt.Sprintf(" AND uri = $%d", len(args))
+	}
+	if prefix := q.Get("uri_prefix"); prefix != "" {
+		args = append(args, likeEscaper.Replace(prefix)+"%")
+		filter += fmt.Sprintf(" AND uri LIKE $%d", len(args))
+	}
+	return filter, args
+}
+
+func (r *ArtifactRepo) list(filter, page string, args ...interface{}) (interface{}, error) {
+	rows, err := r.db.Query("SELECT "+artifactColumns+" FROM artifacts WHERE deleted_at IS NULL"+filter+" ORDER BY created_at DESC, artifact_id"+page, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -70,5 +240,96 @@ func (r *ArtifactRepo) List() (interface{}, error) {
 		}
 		artifacts = append(artifacts, artifact)
 	}
+	return artifacts, rows.Err()
+}
+
+// GetMany returns the artifacts with the given IDs in the order requested,
+// omitting any that do not exist.
+func (r *ArtifactRepo) GetMany(ids []string) ([]*ct.Artifact, error) {
+	rows, err := r.db.Query("SELECT "+artifactColumns+" FROM artifacts WHERE artifact_id = ANY($1::uuid[]) AND deleted_at IS NULL", uuidArray(ids))
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]*ct.Artifact, len(ids))
+	for rows.Next() {
+		artifact, err := scanArtifact(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found[artifact.ID] = artifact
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	artifacts := make([]*ct.Artifact, 0, len(found))
+	for _, id := range ids {
+		if artifact, ok := found[cleanUUID(id)]; ok {
+			artifacts = append(artifacts, artifact)
+			delete(found, artifact.ID)
+		}
+	}
 	return artifacts, nil
 }
+
+// ArtifactInUseError is returned when deleting an artifact which releases
+// reference.
+type ArtifactInUseError struct {
+	Releases []string
+}
+
+func (e ArtifactInUseError) Error() string {
+	return fmt.Sprintf("controller: artifact is used by %d releases", len(e.Releases))
+}
+
+// Delete marks an artifact as deleted. Unless force is true, an
+// ArtifactInUseError is returned if any release references the artifact.
+func (r *ArtifactRepo) Delete(id string, force bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow("SELECT artifact_id FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&id)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return ErrNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !force {
+		releases, err := queryIDs(tx, "SELECT release_id FROM releases WHERE artifact_id = $1 AND deleted_at IS NULL ORDER BY created_at, release_id", id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(releases) > 0 {
+			tx.Rollback()
+			for i, releaseID := range releases {
+				releases[i] = cleanUUID(releaseID)
+			}
+			return ArtifactInUseError{Releases: releases}
+		}
+	}
+	if _, err := tx.Exec("UPDATE artifacts SET deleted_at = now() WHERE artifact_id = $1", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteArtifact deletes an artifact, responding with 409 and the releases
+// which reference it unless force=true is set by an admin.
+func deleteArtifact(params martini.Params, req *http.Request, repo *ArtifactRepo, w http.ResponseWriter, r render.Render) {
+	err := repo.Delete(params["artifacts_id"], req.URL.Query().Get("force") == "true")
+	if e, ok := err.(ArtifactInUseError); ok {
+		w.Header().Set(ct.ArtifactInUseHeader, "true")
+		r.JSON(409, &ct.ArtifactInUse{Releases: e.Releases})
+		return
+	}
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+const defaultArtifactVerifyTimeout = 10 * time.Second
+
+// ArtifactVerifier checks that artifacts can be pulled, so that deploys can
+// fail before starting jobs whose image is missing. Docker images are checked
+// by requesting their manifest from their registry, and file artifacts with
+// a HEAD request to their URI.
+//
+// Artifact URIs are chosen by API clients, so requests are only sent to the
+// configured hosts, and the errors of failed requests are not reported, so
+// that verification cannot be used to probe the cluster network.
+type ArtifactVerifier struct {
+	client    *http.Client
+	allowlist *ImageAllowlist
+	hosts     hostAllowlist
+}
+
+// NewArtifactVerifier returns a verifier which reports artifacts outside
+// allowlist, if it is not nil, without checking them. Only artifacts on
+// hosts are checked, which are host names or host:port pairs.
+func NewArtifactVerifier(timeout time.Duration, allowlist *ImageAllowlist, hosts []string) *ArtifactVerifier {
+	v := &ArtifactVerifier{allowlist: allowlist, hosts: hosts}
+	v.client = v.hosts.client(timeout)
+	return v
+}
+
+// artifactVerifyHostsFromEnv reads the comma separated hosts artifacts may
+// be verified on from ARTIFACT_VERIFY_HOSTS.
+func artifactVerifyHostsFromEnv() []string {
+	return splitList(os.Getenv("ARTIFACT_VERIFY_HOSTS"))
+}
+
+// hostAllowlist is the list of host names or host:port pairs requests to
+// URLs chosen by API clients may be sent to.
+type hostAllowlist []string
+
+// client returns an HTTP client whose requests time out after timeout and
+// which only follows redirects to the hosts in the list.
+func (l hostAllowlist) client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport:     &http.Transport{ResponseHeaderTimeout: timeout},
+		Timeout:       timeout,
+		CheckRedirect: l.checkRedirect,
+	}
+}
+
+// allows reports whether requests may be sent to the host of u.
+func (l hostAllowlist) allows(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	for _, h := range l {
+		if h == u.Host || h == hostname(u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostname returns host without its port.
+func hostname(host string) string {
+	for i := len(host) - 1; i >= 0; i-- {
+		switch host[i] {
+		case ':':
+			return host[:i]
+		case ']':
+			return host
+		}
+	}
+	return host
+}
+
+var errRedirectHost = errors.New("controller: redirected to a host which is not allowed")
+
+func (l hostAllowlist) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("controller: too many redirects")
+	}
+	if !l.allows(req.URL) {
+		return errRedirectHost
+	}
+	return nil
+}
+
+// checkHost marks the artifact as unverifiable unless requests may be sent
+// to the host of rawurl, returning whether they may.
+func (v *ArtifactVerifier) checkHost(rawurl string, res *ct.ArtifactVerification) bool {
+	if u, err := url.Parse(rawurl); err == nil && v.hosts.allows(u) {
+		return true
+	}
+	res.Status, res.Error = ct.ArtifactUnverifiable, "the artifact host is not in ARTIFACT_VERIFY_HOSTS"
+	return false
+}
+
+// Verify checks an artifact. Failures to reach the source of the artifact
+// are reported in the result rather than as an error.
+func (v *ArtifactVerifier) Verify(a *ct.Artifact) *ct.ArtifactVerification {
+	now := time.Now()
+	res := &ct.ArtifactVerification{ArtifactID: a.ID, CheckedAt: &now}
+	if !v.allowlist.Allows(a) {
+		res.Status, res.Error = ct.ArtifactNotAllowed, "the image is not in the image allowlist"
+		return res
+	}
+	switch a.Type {
+	case ct.ArtifactTypeFile:
+		v.verifyFile(a, res)
+	default:
+		v.verifyImage(a, res)
+	}
+	return res
+}
+
+func (v *ArtifactVerifier) verifyImage(a *ct.Artifact, res *ct.ArtifactVerification) {
+	manifestURL := manifestURL(a.URI)
+	if manifestURL == "" {
+		res.Status = ct.ArtifactUnverifiable
+		res.Error = "the image does not name a registry host"
+		return
+	}
+	if !v.checkHost(manifestURL, res) {
+		return
+	}
+	r, err := headManifest(v.client, manifestURL)
+	if !v.checkStatus(r, err, res) {
+		return
+	}
+	res.Digest = r.Header.Get("Docker-Content-Digest")
+	if a.Digest != "" && res.Digest != "" && res.Digest != a.Digest {
+		res.Status = ct.ArtifactMismatch
+		res.Error = fmt.Sprintf("the tag refers to %s rather than %s", res.Digest, a.Digest)
+	}
+}
+
+func (v *ArtifactVerifier) verifyFile(a *ct.Artifact, res *ct.ArtifactVerification) {
+	if !v.checkHost(a.URI, res) {
+		return
+	}
+	req, err := http.NewRequest("HEAD", a.URI, nil)
+	if err != nil {
+		res.Status, res.Error = ct.ArtifactMissing, "the URI is invalid"
+		return
+	}
+	r, err := v.client.Do(req)
+	if err == nil {
+		r.Body.Close()
+	}
+	if !v.checkStatus(r, err, res) {
+		return
+	}
+	if a.Size > 0 && r.ContentLength > 0 && r.ContentLength != a.Size {
+		res.Status = ct.ArtifactMismatch
+		res.Error = fmt.Sprintf("the file is %d bytes rather than %d", r.ContentLength, a.Size)
+	}
+}
+
+// checkStatus sets the status of a verification from the response to the
+// request for an artifact, returning whether it is available. Request errors
+// are logged rather than reported, as they describe the network of the
+// controller.
+func (v *ArtifactVerifier) checkStatus(r *http.Response, err error, res *ct.ArtifactVerification) bool {
+	switch {
+	case err != nil:
+		log.Printf("error verifying artifact %s: %s", res.ArtifactID, err)
+		res.Status, res.Error = ct.ArtifactUnreachable, "the artifact host could not be reached"
+	case r.StatusCode == 200:
+		res.Status = ct.ArtifactAvailable
+		return true
+	case r.StatusCode == 404:
+		res.Status, res.Error = ct.ArtifactMissing, "not found"
+	case r.StatusCode == 401 || r.StatusCode == 403:
+		res.Status, res.Error = ct.ArtifactUnverifiable, fmt.Sprintf("access denied with status %d", r.StatusCode)
+	default:
+		res.Status, res.Error = ct.ArtifactUnreachable, fmt.Sprintf("unexpected status %d", r.StatusCode)
+	}
+	return false
+}
+
+func verifyArtifact(params martini.Params, repo *ArtifactRepo, verifier *ArtifactVerifier, r render.Render) {
+	data, err := repo.Get(params["artifacts_id"])
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, verifier.Verify(data.(*ct.Artifact)))
+}
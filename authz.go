@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+// SubjectAdmin is the subject of requests authenticated with the cluster
+// auth key.
+const SubjectAdmin = "admin"
+
+// authSubjectHeader carries the subject of an authenticated request from
+// rpcMuxHandler to the handlers. Values sent by clients are discarded.
+const authSubjectHeader = "Flynn-Auth-Subject"
+
+// requestSubject returns the authenticated subject of a request.
+func requestSubject(req *http.Request) string {
+	return req.Header.Get(authSubjectHeader)
+}
+
+// subjectKeysFromEnv parses AUTH_KEYS, comma separated subject:key pairs for
+// clients which are not admins, returning the subjects keyed by auth key.
+func subjectKeysFromEnv() (map[string]string, error) {
+	return parseSubjectKeys(os.Getenv("AUTH_KEYS"))
+}
+
+func parseSubjectKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("controller: invalid auth key %q, expected subject:key", pair)
+		}
+		if parts[0] == SubjectAdmin {
+			return nil, fmt.Errorf("controller: the %s subject is reserved for AUTH_KEY", SubjectAdmin)
+		}
+		keys[parts[1]] = parts[0]
+	}
+	return keys, nil
+}
+
+// adminResources are only accessible to admins regardless of policy.
+var adminResources = []string{
+	"jobs", "jobs/*",
+	"gc",
+	"cluster",
+	"ca/certificates",
+	"debug", "debug/*",
+	"online-migrations", "online-migrations/*",
+	"tasks",
+}
+
+// adminWriteResources can be read by any subject but only changed by admins
+// regardless of policy. Registry mirrors are applied after the image
+// allowlist, so only admins may redirect the images of an app.
+var adminWriteResources = []string{"providers", "env-groups", "apps/registry-config"}
+
+// adminActions are only permitted for admins regardless of policy.
+var adminActions = []string{"force_delete", "override_image_allowlist"}
+
+// AuthzRequest describes an API request for an authorization decision.
+//
+// Resource is the resource type derived from the request path with IDs
+// removed, so /apps/foo/formations/bar is "apps/formations". ID is the ID of
+// the top-level resource, if any.
+type AuthzRequest struct {
+	Subject  string
+	Action   string
+	Resource string
+	ID       string
+
+	attrs    map[string]string
+	resolver func(*AuthzRequest) map[string]string
+}
+
+// Attrs returns attributes of the resource being accessed, such as
+// "protected" for apps. They are resolved on first use.
+func (r *AuthzRequest) Attrs() map[string]string {
+	if r.attrs == nil {
+		if r.resolver != nil {
+			r.attrs = r.resolver(r)
+		}
+		if r.attrs == nil {
+			r.attrs = map[string]string{}
+		}
+	}
+	return r.attrs
+}
+
+// Authorizer decides whether a request is allowed. It returns an
+// AuthzDeniedError if the request is denied.
+type Authorizer interface {
+	Authorize(req *AuthzRequest) error
+}
+
+type AuthzDeniedError struct {
+	Reason string
+}
+
+func (e AuthzDeniedError) Error() string {
+	return "controller: request denied: " + e.Reason
+}
+
+// allowAll allows every request that has been authenticated.
+type allowAll struct{}
+
+func (allowAll) Authorize(*AuthzRequest) error { return nil }
+
+// AuthzRule matches requests by subject, action and resource patterns (see
+// path.Match) and optional resource attribute values. Empty lists match all
+// requests.
+type AuthzRule struct {
+	Effect     string            `json:"effect"`
+	Subjects   []string          `json:"subjects,omitempty"`
+	Actions    []string          `json:"actions,omitempty"`
+	Resources  []string          `json:"resources,omitempty"`
+	Conditions map[string]string `json:"conditions,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+}
+
+const (
+	authzAllow = "allow"
+	authzDeny  = "deny"
+)
+
+func (rule *AuthzRule) matches(req *AuthzRequest) bool {
+	if !matchAny(rule.Subjects, req.Subject) || !matchAny(rule.Actions, req.Action) || !matchAny(rule.Resources, req.Resource) {
+		return false
+	}
+	for k, v := range rule.Conditions {
+		if req.Attrs()[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyAuthorizer applies the first matching rule, falling back to Default
+// if no rule matches.
+type PolicyAuthorizer struct {
+	Default string      `json:"default"`
+	Rules   []AuthzRule `json:"rules"`
+}
+
+// LoadPolicyAuthorizer reads a JSON policy file, e.g.
+//
+//	{
+//	  "default": "allow",
+//	  "rules": [{
+//	    "effect": "deny",
+//	    "actions": ["delete"],
+//	    "resources": ["apps"],
+//	    "conditions": {"protected": "true"},
+//	    "reason": "protected apps cannot be deleted"
+//	  }]
+//	}
+func LoadPolicyAuthorizer(name string) (*PolicyAuthorizer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := &PolicyAuthorizer{}
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("controller: error parsing authorization policy %s: %s", name, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PolicyAuthorizer) validate() error {
+	if p.Default == "" {
+		p.Default = authzAllow
+	}
+	if p.Default != authzAllow && p.Default != authzDeny {
+		return fmt.Errorf("controller: invalid default authorization effect %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if rule.Effect != authzAllow && rule.Effect != authzDeny {
+			return fmt.Errorf("controller: invalid effect %q in authorization rule %d", rule.Effect, i)
+		}
+	}
+	return nil
+}
+
+func (p *PolicyAuthorizer) Authorize(req *AuthzRequest) error {
+	for _, rule := range p.Rules {
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Effect == authzDeny {
+			reason := rule.Reason
+			if reason == "" {
+				reason = "denied by policy"
+			}
+			return AuthzDeniedError{reason}
+		}
+		return nil
+	}
+	if p.Default == authzDeny {
+		return AuthzDeniedError{"denied by default policy"}
+	}
+	return nil
+}
+
+var methodActions = map[string]string{
+	"GET":    "read",
+	"HEAD":   "read",
+	"POST":   "create",
+	"PUT":    "update",
+	"PATCH":  "update",
+	"DELETE": "delete",
+}
+
+func newAuthzRequest(req *http.Request, apps *AppRepo) *AuthzRequest {
+	a := &AuthzRequest{Subject: requestSubject(req), Action: methodActions[req.Method]}
+	if isReadRequest(req) {
+		a.Action = "read"
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	var types []string
+	for i, part := range parts {
+		if i%2 == 0 {
+			types = append(types, part)
+		} else if i == 1 {
+			a.ID = part
+		}
+	}
+	a.Resource = strings.Join(types, "/")
+	// DELETE ?force=true overrides other clients, such as breaking an app lock
+	if req.Method == "DELETE" && req.URL.Query().Get("force") == "true" {
+		a.Action = "force_delete"
+	}
+	// creating artifacts or releases outside the image allowlist
+	if req.Method == "POST" && req.Header.Get(ct.ImageAllowlistOverrideHeader) == "true" {
+		a.Action = "override_image_allowlist"
+	}
+	// POST /ca/certificates issues certificates rather than acting on a CA
+	// with the ID "certificates"
+	if a.Resource == "ca" && a.ID == "certificates" {
+		a.Resource = "ca/certificates"
+		a.ID = ""
+	}
+	// POST /apps/bulk and /apps/import create apps
+	if a.Resource == "apps" && (a.ID == "bulk" || a.ID == "import") && req.Method == "POST" {
+		a.ID = ""
+	}
+	// POST /apps/:id updates the app (see crud)
+	if a.Resource == "apps" && a.ID != "" && req.Method == "POST" {
+		a.Action = "update"
+	}
+	if parts[0] == "apps" && a.ID != "" {
+		a.resolver = func(*AuthzRequest) map[string]string {
+			data, err := apps.Get(a.ID)
+			if err != nil {
+				return nil
+			}
+			app := data.(*ct.App)
+			attrs := map[string]string{"name": app.Name, "protected": strconv.FormatBool(app.Protected)}
+			for k, v := range app.Meta {
+				attrs["meta."+k] = v
+			}
+			return attrs
+		}
+	}
+	return a
+}
+
+// requiresAdmin reports whether only admins may make a request, see
+// adminResources, adminWriteResources and adminActions.
+func requiresAdmin(a *AuthzRequest) bool {
+	if matchAny(adminResources, a.Resource) || matchAny(adminActions, a.Action) {
+		return true
+	}
+	return a.Action != "read" && matchAny(adminWriteResources, a.Resource)
+}
+
+// changesAppOrg reports whether a request creating or updating apps sets or
+// removes the org meta of an app, see ct.AppMetaOrg. Setting the org an app
+// already has is not a change. The body of the request is left to be read
+// by the handler.
+func changesAppOrg(a *AuthzRequest, req *http.Request) bool {
+	if a.Resource != "apps" || (a.Action != "create" && a.Action != "update") || req.Body == nil {
+		return false
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		// the handler rejects the invalid body
+		return false
+	}
+	current, hasCurrent := a.Attrs()["meta."+ct.AppMetaOrg]
+	changes := func(v interface{}) bool {
+		app, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		// POST /apps/import nests the app in the bundle
+		if nested, ok := app["app"].(map[string]interface{}); ok {
+			app = nested
+		}
+		m, ok := app["meta"]
+		if !ok {
+			return false
+		}
+		meta, ok := m.(map[string]interface{})
+		if !ok {
+			// a null meta removes the org along with the rest of it
+			return hasCurrent
+		}
+		org, ok := meta[ct.AppMetaOrg]
+		if !ok {
+			return false
+		}
+		s, ok := org.(string)
+		return !ok || !hasCurrent || s != current
+	}
+	// POST /apps/bulk creates a list of apps
+	if list, ok := body.([]interface{}); ok {
+		for _, v := range list {
+			if changes(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return changes(body)
+}
+
+// authzHandler checks each request with the authorizer before passing it to
+// the handler, responding with 403 if the request is denied.
+func authzHandler(h http.Handler, authz Authorizer, apps *AppRepo) http.Handler {
+	if authz == nil {
+		authz = allowAll{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a := newAuthzRequest(req, apps)
+		err := authz.Authorize(a)
+		if err == nil && a.Subject != SubjectAdmin && requiresAdmin(a) {
+			err = AuthzDeniedError{"admin access required"}
+		}
+		// deployment limits are applied per org, so apps cannot choose it
+		if err == nil && a.Subject != SubjectAdmin && changesAppOrg(a, req) {
+			err = AuthzDeniedError{"only admins can set the org of apps"}
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(403)
+			if e, ok := err.(AuthzDeniedError); ok {
+				json.NewEncoder(w).Encode(struct {
+					Message string `json:"message"`
+				}{e.Reason})
+			}
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/titanous/gocheck"
+)
+
+type AuthzSuite struct{}
+
+var _ = Suite(&AuthzSuite{})
+
+func (AuthzSuite) TestNewAuthzRequest(c *C) {
+	for _, t := range []struct {
+		method, path     string
+		action, resource string
+		id               string
+	}{
+		{"GET", "/apps", "read", "apps", ""},
+		{"POST", "/apps", "create", "apps", ""},
+		{"POST", "/apps/foo", "update", "apps", "foo"},
+		{"POST", "/apps/bulk", "create", "apps", ""},
+		{"POST", "/apps/import", "create", "apps", ""},
+		{"DELETE", "/apps/foo/formations/bar", "delete", "apps/formations", "foo"},
+		{"PUT", "/apps/foo/env-groups/bar", "update", "apps/env-groups", "foo"},
+		{"GET", "/debug/consistency", "read", "debug", "consistency"},
+		{"DELETE", "/apps/foo/lock?force=true", "force_delete", "apps/lock", "foo"},
+		{"GET", "/gc/apps", "read", "gc", "apps"},
+		{"POST", "/ca/certificates", "create", "ca/certificates", ""},
+		{"POST", "/online-migrations/foo/cutover", "create", "online-migrations/cutover", "foo"},
+	} {
+		req, _ := http.NewRequest(t.method, "http://localhost"+t.path, nil)
+		req.Header.Set(authSubjectHeader, SubjectAdmin)
+		a := newAuthzRequest(req, nil)
+		c.Assert(a.Subject, Equals, SubjectAdmin)
+		c.Assert(a.Action, Equals, t.action)
+		c.Assert(a.Resource, Equals, t.resource)
+		c.Assert(a.ID, Equals, t.id)
+	}
+}
+
+func (AuthzSuite) TestPolicyAuthorizer(c *C) {
+	p := &PolicyAuthorizer{Rules: []AuthzRule{
+		{Effect: "allow", Actions: []string{"read"}},
+		{Effect: "deny", Actions: []string{"delete", "update"}, Resources: []string{"apps", "apps/*"}, Conditions: map[string]string{"protected": "true"}, Reason: "app is protected"},
+		{Effect: "deny", Resources: []string{"providers"}},
+	}}
+	c.Assert(p.validate(), IsNil)
+
+	protected := func(protected string) func(*AuthzRequest) map[string]string {
+		return func(*AuthzRequest) map[string]string { return map[string]string{"protected": protected} }
+	}
+	for _, t := range []struct {
+		req     *AuthzRequest
+		allowed bool
+	}{
+		{&AuthzRequest{Action: "read", Resource: "providers"}, true},
+		{&AuthzRequest{Action: "create", Resource: "providers"}, false},
+		{&AuthzRequest{Action: "delete", Resource: "apps/formations", resolver: protected("true")}, false},
+		{&AuthzRequest{Action: "delete", Resource: "apps/formations", resolver: protected("false")}, true},
+		{&AuthzRequest{Action: "update", Resource: "apps", resolver: protected("true")}, false},
+		{&AuthzRequest{Action: "create", Resource: "releases"}, true},
+	} {
+		err := p.Authorize(t.req)
+		c.Assert(err == nil, Equals, t.allowed, Commentf("%s %s", t.req.Action, t.req.Resource))
+	}
+	err := p.Authorize(&AuthzRequest{Action: "update", Resource: "apps", resolver: protected("true")})
+	c.Assert(err, DeepEquals, AuthzDeniedError{"app is protected"})
+
+	c.Assert((&PolicyAuthorizer{Default: "maybe"}).validate(), NotNil)
+	c.Assert((&PolicyAuthorizer{Rules: []AuthzRule{{}}}).validate(), NotNil)
+	c.Assert((&PolicyAuthorizer{Default: "deny"}).Authorize(&AuthzRequest{}), NotNil)
+}
+
+func (AuthzSuite) TestAuthzHandler(c *C) {
+	h := authzHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	}), &PolicyAuthorizer{Default: "allow", Rules: []AuthzRule{{Effect: "deny", Actions: []string{"create"}}}}, nil)
+
+	for method, status := range map[string]int{"GET": 200, "POST": 403} {
+		req, _ := http.NewRequest(method, "http://localhost/apps", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, status)
+	}
+}
+
+func (AuthzSuite) TestSubjectKeys(c *C) {
+	keys, err := parseSubjectKeys("deployer:key1, ci:key2")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, map[string]string{"key1": "deployer", "key2": "ci"})
+	_, err = parseSubjectKeys("admin:key3")
+	c.Assert(err, NotNil)
+	_, err = parseSubjectKeys("key4")
+	c.Assert(err, NotNil)
+
+	h := rpcMuxHandler(authzHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(requestSubject(req)))
+	}), nil, nil), nil, "adminkey", keys)
+	for _, t := range []struct {
+		method, key, path, subject string
+		status                     int
+	}{
+		{"GET", "adminkey", "/jobs", SubjectAdmin, 200},
+		{"GET", "key1", "/apps", "deployer", 200},
+		{"GET", "key1", "/jobs", "", 403},
+		{"DELETE", "key2", "/apps/foo/lock?force=true", "", 403},
+		{"POST", "key1", "/ca/certificates", "", 403},
+		{"GET", "key1", "/debug/consistency", "", 403},
+		{"POST", "key1", "/debug/consistency/repair", "", 403},
+		{"PUT", "key1", "/debug/sim-cluster", "", 403},
+		{"GET", "key1", "/debug/vars", "", 403},
+		{"GET", "key1", "/online-migrations", "", 403},
+		{"POST", "key1", "/online-migrations/foo/cutover", "", 403},
+		{"GET", "key1", "/tasks", "", 403},
+		{"POST", "key1", "/tasks", "", 403},
+		{"GET", "key1", "/providers", "deployer", 200},
+		{"POST", "key1", "/providers", "", 403},
+		{"GET", "key1", "/env-groups/foo", "deployer", 200},
+		{"POST", "key1", "/env-groups", "", 403},
+		{"PUT", "key1", "/env-groups/foo", "", 403},
+		{"PUT", "key1", "/apps/foo/env-groups/bar", "deployer", 200},
+		{"GET", "key1", "/apps/foo/registry-config", "deployer", 200},
+		{"PUT", "key1", "/apps/foo/registry-config", "", 403},
+		{"DELETE", "key1", "/apps/foo/registry-config", "", 403},
+		{"PUT", "key1", "/cluster/registry-config", "", 403},
+		{"GET", "wrong", "/apps", "", 401},
+	} {
+		req, _ := http.NewRequest(t.method, "http://localhost"+t.path, nil)
+		req.SetBasicAuth("", t.key)
+		// subjects sent by clients are ignored
+		req.Header.Set(authSubjectHeader, SubjectAdmin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, t.status, Commentf("%s %s", t.method, t.path))
+		if t.status == 200 {
+			c.Assert(w.Body.String(), Equals, t.subject)
+		}
+	}
+}
+
+func (AuthzSuite) TestChangesAppOrg(c *C) {
+	org := func(org string) func(*AuthzRequest) map[string]string {
+		return func(*AuthzRequest) map[string]string {
+			if org == "" {
+				return nil
+			}
+			return map[string]string{"meta.org": org}
+		}
+	}
+	for _, t := range []struct {
+		method, path, body string
+		resolver           func(*AuthzRequest) map[string]string
+		changes            bool
+	}{
+		{"POST", "/apps", `{"name":"foo"}`, nil, false},
+		{"POST", "/apps", `{"name":"foo","meta":{"team":"a"}}`, nil, false},
+		{"POST", "/apps", `{"name":"foo","meta":{"org":"a"}}`, nil, true},
+		{"POST", "/apps/bulk", `[{"name":"foo"},{"name":"bar","meta":{"org":"a"}}]`, nil, true},
+		{"POST", "/apps/import", `{"app":{"name":"foo","meta":{"org":"a"}}}`, nil, true},
+		{"POST", "/apps/foo", `{"meta":{"org":"a"}}`, org("a"), false},
+		{"POST", "/apps/foo", `{"meta":{"org":"b"}}`, org("a"), true},
+		{"PATCH", "/apps/foo", `{"meta":{"org":null}}`, org("a"), true},
+		{"PATCH", "/apps/foo", `{"meta":null}`, org("a"), true},
+		{"PATCH", "/apps/foo", `{"meta":null}`, org(""), false},
+		{"POST", "/apps/foo/restore", `{"meta":{"org":"b"}}`, org("a"), false},
+	} {
+		req, _ := http.NewRequest(t.method, "http://localhost"+t.path, strings.NewReader(t.body))
+		a := newAuthzRequest(req, nil)
+		a.resolver = t.resolver
+		c.Assert(changesAppOrg(a, req), Equals, t.changes, Commentf("%s %s %s", t.method, t.path, t.body))
+		// the body is still readable by the handler
+		body, err := ioutil.ReadAll(req.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, t.body)
+	}
+
+	h := authzHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	}), nil, nil)
+	for subject, status := range map[string]int{SubjectAdmin: 200, "deployer": 403} {
+		req, _ := http.NewRequest("POST", "http://localhost/apps", strings.NewReader(`{"name":"foo","meta":{"org":"a"}}`))
+		req.Header.Set(authSubjectHeader, subject)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, status)
+	}
+}
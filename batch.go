@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/martini-contrib/render"
+)
+
+const maxBatchGet = 100
+
+// uuidArray formats IDs as a Postgres array literal. The IDs must have been
+// checked with validateBatchGet.
+func uuidArray(ids []string) string {
+	return "{" + strings.Join(ids, ",") + "}"
+}
+
+func validateBatchGet(req *ct.BatchGetReq) error {
+	if len(req.IDs) == 0 {
+		return ct.ValidationError{Field: "ids", Message: "must not be empty"}
+	}
+	if len(req.IDs) > maxBatchGet {
+		return ct.ValidationError{Field: "ids", Message: "must not contain more than 100 IDs"}
+	}
+	for _, id := range req.IDs {
+		if !idPattern.MatchString(id) {
+			return ct.ValidationError{Field: "ids", Message: id + " is not a valid ID"}
+		}
+	}
+	return nil
+}
+
+// batchGetPaths are the paths batch gets are POSTed to.
+var batchGetPaths = map[string]bool{
+	"/releases/get":  true,
+	"/artifacts/get": true,
+}
+
+// verifyArtifactPath matches the path artifact verifications are POSTed to.
+var verifyArtifactPath = regexp.MustCompile(`^/artifacts/[^/]+/verify$`)
+
+// isReadRequest reports whether a request does not modify state.
+func isReadRequest(req *http.Request) bool {
+	if req.Method == "POST" {
+		return batchGetPaths[req.URL.Path] || verifyArtifactPath.MatchString(req.URL.Path)
+	}
+	return req.Method == "GET" || req.Method == "HEAD"
+}
+
+func getReleases(req ct.BatchGetReq, repo *ReleaseRepo, r render.Render) {
+	if err := validateBatchGet(&req); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	releases, err := repo.GetMany(req.IDs)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, releases)
+}
+
+func getArtifacts(req ct.BatchGetReq, repo *ArtifactRepo, r render.Render) {
+	if err := validateBatchGet(&req); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	artifacts, err := repo.GetMany(req.IDs)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, artifacts)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	strowgerc "github.com/flynn/strowger/client"
+	"github.com/flynn/strowger/types"
+)
+
+// BreakerConfig configures the timeouts and circuit breakers wrapping calls
+// to the cluster, hosts and router.
+type BreakerConfig struct {
+	// ClusterTimeout, HostTimeout and RouterTimeout bound each call to the
+	// respective endpoint. Calls which time out return ErrCallTimeout and
+	// count as failures, the call itself is abandoned in the background.
+	ClusterTimeout time.Duration
+	HostTimeout    time.Duration
+	RouterTimeout  time.Duration
+
+	// Threshold is the number of consecutive failures which open a
+	// breaker, while open calls fail immediately with ErrBreakerOpen.
+	Threshold int
+
+	// Cooldown is how long a breaker stays open before a trial call is
+	// allowed through.
+	Cooldown time.Duration
+}
+
+var defaultBreakerConfig = BreakerConfig{
+	ClusterTimeout: 10 * time.Second,
+	HostTimeout:    10 * time.Second,
+	RouterTimeout:  5 * time.Second,
+	Threshold:      5,
+	Cooldown:       30 * time.Second,
+}
+
+func breakerConfigFromEnv() BreakerConfig {
+	conf := defaultBreakerConfig
+	for env, d := range map[string]*time.Duration{
+		"CLUSTER_CALL_TIMEOUT": &conf.ClusterTimeout,
+		"HOST_CALL_TIMEOUT":    &conf.HostTimeout,
+		"ROUTER_CALL_TIMEOUT":  &conf.RouterTimeout,
+		"BREAKER_COOLDOWN":     &conf.Cooldown,
+	} {
+		if v, err := time.ParseDuration(os.Getenv(env)); err == nil && v > 0 {
+			*d = v
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv("BREAKER_THRESHOLD")); err == nil && n > 0 {
+		conf.Threshold = n
+	}
+	return conf
+}
+
+var (
+	ErrBreakerOpen = errors.New("controller: circuit breaker open")
+	ErrCallTimeout = errors.New("controller: call timed out")
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// BreakerStats are the counters of a breaker exposed in the
+// circuit_breakers expvar.
+type BreakerStats struct {
+	State    string `json:"state"`
+	Calls    uint64 `json:"calls"`
+	Failures uint64 `json:"failures"`
+	Timeouts uint64 `json:"timeouts"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// Breaker bounds calls to an endpoint with a timeout and rejects calls after
+// Threshold consecutive failures until Cooldown has passed.
+type Breaker struct {
+	name    string
+	timeout time.Duration
+	conf    BreakerConfig
+
+	// expected reports whether an error is an expected response, such as
+	// not found, rather than a failure of the endpoint.
+	expected func(error) bool
+
+	mtx       sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+	stats     BreakerStats
+}
+
+func NewBreaker(name string, timeout time.Duration, conf BreakerConfig) *Breaker {
+	b := &Breaker{name: name, timeout: timeout, conf: conf}
+	breakers.add(b)
+	return b
+}
+
+// Call runs fn unless the breaker is open. Results assigned by fn must only
+// be read if Call returns nil or an error returned by fn, as fn continues
+// running in the background after a timeout.
+func (b *Breaker) Call(fn func() error) error {
+	if !b.allow() {
+		return ErrBreakerOpen
+	}
+	var err error
+	if b.timeout > 0 {
+		done := make(chan error, 1)
+		go func() { done <- fn() }()
+		select {
+		case err = <-done:
+		case <-time.After(b.timeout):
+			b.done(ErrCallTimeout)
+			return ErrCallTimeout
+		}
+	} else {
+		err = fn()
+	}
+	b.done(err)
+	return err
+}
+
+func (b *Breaker) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.stats.Calls++
+	if b.failures < b.conf.Threshold || b.conf.Threshold <= 0 {
+		return true
+	}
+	// open, allow a single trial call once the cooldown has passed
+	if b.trial || time.Now().Before(b.openUntil) {
+		b.stats.Rejected++
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *Breaker) done(err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.trial = false
+	if err == nil || b.expected != nil && b.expected(err) {
+		b.failures = 0
+		return
+	}
+	b.stats.Failures++
+	if err == ErrCallTimeout {
+		b.stats.Timeouts++
+	}
+	b.failures++
+	if b.failures >= b.conf.Threshold {
+		b.openUntil = time.Now().Add(b.conf.Cooldown)
+	}
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	stats := b.stats
+	switch {
+	case b.conf.Threshold <= 0 || b.failures < b.conf.Threshold:
+		stats.State = breakerClosed
+	case time.Now().Before(b.openUntil):
+		stats.State = breakerOpen
+	default:
+		stats.State = breakerHalfOpen
+	}
+	return stats
+}
+
+// breakerSet is the set of breakers published in the circuit_breakers
+// expvar, keyed by name.
+type breakerSet struct {
+	mtx  sync.Mutex
+	once sync.Once
+	m    map[string]*Breaker
+}
+
+var breakers = &breakerSet{m: make(map[string]*Breaker)}
+
+func (s *breakerSet) add(b *Breaker) {
+	s.mtx.Lock()
+	s.m[b.name] = b
+	s.mtx.Unlock()
+	s.once.Do(func() {
+		expvar.Publish("circuit_breakers", expvar.Func(s.stats))
+	})
+}
+
+func (s *breakerSet) stats() interface{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stats := make(map[string]BreakerStats, len(s.m))
+	for name, b := range s.m {
+		stats[name] = b.Stats()
+	}
+	return stats
+}
+
+// breakerCluster wraps a cluster client with a breaker for the cluster and
+// one for each host.
+type breakerCluster struct {
+	clusterClient
+	b    *Breaker
+	conf BreakerConfig
+
+	hostsMtx sync.Mutex
+	hosts    map[string]*Breaker
+}
+
+func newBreakerCluster(cc clusterClient, conf BreakerConfig) *breakerCluster {
+	return &breakerCluster{
+		clusterClient: cc,
+		b:             NewBreaker("cluster", conf.ClusterTimeout, conf),
+		conf:          conf,
+		hosts:         make(map[string]*Breaker),
+	}
+}
+
+func (c *breakerCluster) ListHosts() (map[string]host.Host, error) {
+	var hosts map[string]host.Host
+	err := c.b.Call(func() (err error) {
+		hosts, err = c.clusterClient.ListHosts()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (c *breakerCluster) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
+	var res *host.AddJobsRes
+	err := c.b.Call(func() (err error) {
+		res, err = c.clusterClient.AddJobs(req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *breakerCluster) hostBreaker(id string) *Breaker {
+	c.hostsMtx.Lock()
+	defer c.hostsMtx.Unlock()
+	b, ok := c.hosts[id]
+	if !ok {
+		b = NewBreaker("host:"+id, c.conf.HostTimeout, c.conf)
+		c.hosts[id] = b
+	}
+	return b
+}
+
+func (c *breakerCluster) DialHost(id string) (cluster.Host, error) {
+	b := c.hostBreaker(id)
+	var h cluster.Host
+	err := b.Call(func() (err error) {
+		h, err = c.clusterClient.DialHost(id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &breakerHost{Host: h, b: b}, nil
+}
+
+// breakerHost wraps the request/response calls of a host client with the
+// breaker of the host. Streams and attach are long lived so are passed
+// through.
+type breakerHost struct {
+	cluster.Host
+	b *Breaker
+}
+
+func (h *breakerHost) ListJobs() (map[string]host.ActiveJob, error) {
+	var jobs map[string]host.ActiveJob
+	err := h.b.Call(func() (err error) {
+		jobs, err = h.Host.ListJobs()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (h *breakerHost) GetJob(id string) (*host.ActiveJob, error) {
+	var job *host.ActiveJob
+	err := h.b.Call(func() (err error) {
+		job, err = h.Host.GetJob(id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (h *breakerHost) StopJob(id string) error {
+	return h.b.Call(func() error { return h.Host.StopJob(id) })
+}
+
+// breakerRouter wraps a router client with a breaker.
+type breakerRouter struct {
+	strowgerc.Client
+	b *Breaker
+}
+
+func newBreakerRouter(sc strowgerc.Client, conf BreakerConfig) *breakerRouter {
+	b := NewBreaker("router", conf.RouterTimeout, conf)
+	b.expected = func(err error) bool { return err == strowgerc.ErrNotFound }
+	return &breakerRouter{Client: sc, b: b}
+}
+
+func (r *breakerRouter) CreateRoute(route *strowger.Route) error {
+	// copy the route so that a timed out call cannot modify it
+	res := *route
+	if err := r.b.Call(func() error { return r.Client.CreateRoute(&res) }); err != nil {
+		return err
+	}
+	*route = res
+	return nil
+}
+
+func (r *breakerRouter) DeleteRoute(id string) error {
+	return r.b.Call(func() error { return r.Client.DeleteRoute(id) })
+}
+
+func (r *breakerRouter) GetRoute(id string) (*strowger.Route, error) {
+	var route *strowger.Route
+	err := r.b.Call(func() (err error) {
+		route, err = r.Client.GetRoute(id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return route, nil
+}
+
+func (r *breakerRouter) ListRoutes(parentRef string) ([]*strowger.Route, error) {
+	var routes []*strowger.Route
+	err := r.b.Call(func() (err error) {
+		routes, err = r.Client.ListRoutes(parentRef)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// UpdateRoute updates a route if the wrapped router client supports it, see
+// RouteUpdater.
+func (r *breakerRouter) UpdateRoute(route *strowger.Route) error {
+	updater, ok := r.Client.(RouteUpdater)
+	if !ok {
+		return errRouteUpdateUnsupported
+	}
+	res := *route
+	if err := r.b.Call(func() error { return updater.UpdateRoute(&res) }); err != nil {
+		return err
+	}
+	*route = res
+	return nil
+}
+
+// RouteStats reports the traffic of a route if the wrapped router client
+// supports it, see RouteStatser.
+func (r *breakerRouter) RouteStats(id string) (float64, float64, error) {
+	statser, ok := r.Client.(RouteStatser)
+	if !ok {
+		return 0, 0, errRouteStatsUnsupported
+	}
+	var requestRate, errorRate float64
+	err := r.b.Call(func() (err error) {
+		requestRate, errorRate, err = statser.RouteStats(id)
+		return
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return requestRate, errorRate, nil
+}
+
+// WildcardDomains reports whether the wrapped router client supports
+// wildcard domains, see RouterCapabilities.
+func (r *breakerRouter) WildcardDomains() bool {
+	caps, ok := r.Client.(RouterCapabilities)
+	return ok && caps.WildcardDomains()
+}
+
+// PathPrefixes reports whether the wrapped router client supports path
+// prefixes, see RouterCapabilities.
+func (r *breakerRouter) PathPrefixes() bool {
+	caps, ok := r.Client.(RouterCapabilities)
+	return ok && caps.PathPrefixes()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	strowgerc "github.com/flynn/strowger/client"
+	"github.com/flynn/strowger/types"
+	. "github.com/titanous/gocheck"
+)
+
+type BreakerSuite struct{}
+
+var _ = Suite(&BreakerSuite{})
+
+func (BreakerSuite) TestBreakerOpens(c *C) {
+	b := NewBreaker("test-open", 0, BreakerConfig{Threshold: 2, Cooldown: 50 * time.Millisecond})
+	failure := errors.New("failure")
+	fail := func() error { return failure }
+	calls := 0
+	succeed := func() error { calls++; return nil }
+
+	c.Assert(b.Call(fail), Equals, failure)
+	c.Assert(b.Call(fail), Equals, failure)
+	c.Assert(b.Stats().State, Equals, breakerOpen)
+	c.Assert(b.Call(succeed), Equals, ErrBreakerOpen)
+	c.Assert(calls, Equals, 0)
+
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(b.Stats().State, Equals, breakerHalfOpen)
+	c.Assert(b.Call(succeed), IsNil)
+	c.Assert(calls, Equals, 1)
+	c.Assert(b.Stats().State, Equals, breakerClosed)
+
+	stats := b.Stats()
+	c.Assert(stats.Calls, Equals, uint64(4))
+	c.Assert(stats.Failures, Equals, uint64(2))
+	c.Assert(stats.Rejected, Equals, uint64(1))
+}
+
+func (BreakerSuite) TestBreakerTimeout(c *C) {
+	b := NewBreaker("test-timeout", 10*time.Millisecond, BreakerConfig{Threshold: 1, Cooldown: time.Minute})
+	release := make(chan struct{})
+	defer close(release)
+
+	c.Assert(b.Call(func() error { <-release; return nil }), Equals, ErrCallTimeout)
+	c.Assert(b.Stats().Timeouts, Equals, uint64(1))
+	c.Assert(b.Call(func() error { return nil }), Equals, ErrBreakerOpen)
+}
+
+func (BreakerSuite) TestBreakerExpectedErrors(c *C) {
+	b := NewBreaker("test-expected", 0, BreakerConfig{Threshold: 1, Cooldown: time.Minute})
+	b.expected = func(err error) bool { return err == ErrNotFound }
+
+	c.Assert(b.Call(func() error { return ErrNotFound }), Equals, ErrNotFound)
+	c.Assert(b.Stats().State, Equals, breakerClosed)
+}
+
+// statslessRouter is a router client which does not report route stats.
+type statslessRouter struct {
+	strowgerc.Client
+}
+
+func (BreakerSuite) TestBreakerRouterStats(c *C) {
+	conf := BreakerConfig{Threshold: 1, Cooldown: time.Minute}
+	fake := newFakeRouter().(*fakeRouter)
+	route := &strowger.Route{Type: "tcp"}
+	c.Assert(fake.CreateRoute(route), IsNil)
+	fake.stats = map[string]*ct.RouteTraffic{route.ID: {RequestRate: 10, ErrorRate: 0.5}}
+
+	router := newBreakerRouter(fake, conf)
+	c.Assert(statsRoutes(router), Equals, true)
+	requestRate, errorRate, err := router.RouteStats(route.ID)
+	c.Assert(err, IsNil)
+	c.Assert(requestRate, Equals, 10.0)
+	c.Assert(errorRate, Equals, 0.5)
+
+	router = newBreakerRouter(statslessRouter{fake}, conf)
+	c.Assert(statsRoutes(router), Equals, false)
+	_, _, err = router.RouteStats(route.ID)
+	c.Assert(err, Equals, errRouteStatsUnsupported)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/martini-contrib/render"
+)
+
+const (
+	caName         = "jobs"
+	caValidity     = 10 * 365 * 24 * time.Hour
+	jobCertDomain  = "job.flynn"
+	defaultCertTTL = 24 * time.Hour
+)
+
+// CA is the internal certificate authority used to issue job identity
+// certificates.
+type CA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+type CARepo struct {
+	db  *DB
+	ttl time.Duration
+
+	ca  *CA
+	mtx sync.Mutex
+}
+
+func NewCARepo(db *DB, ttl time.Duration) *CARepo {
+	if ttl == 0 {
+		ttl = defaultCertTTL
+	}
+	return &CARepo{db: db, ttl: ttl}
+}
+
+// CA returns the cluster CA, generating and persisting it on first use.
+func (r *CARepo) CA() (*CA, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.ca != nil {
+		return r.ca, nil
+	}
+
+	var certPEM, keyPEM []byte
+	err := r.db.QueryRow("SELECT cert, key FROM certificate_authorities WHERE name = $1", caName).Scan(&certPEM, &keyPEM)
+	if err == nil {
+		ca, err := parseCA(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		r.ca = ca
+		return ca, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	certPEM, keyPEM, err = generateCA()
+	if err != nil {
+		return nil, err
+	}
+	err = r.db.Exec("INSERT INTO certificate_authorities (name, cert, key) VALUES ($1, $2, $3)", caName, certPEM, keyPEM)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		// another controller generated the CA first
+		err = r.db.QueryRow("SELECT cert, key FROM certificate_authorities WHERE name = $1", caName).Scan(&certPEM, &keyPEM)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ca, err := parseCA(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	r.ca = ca
+	return ca, nil
+}
+
+func generateCA() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Flynn Job CA", Organization: []string{"Flynn"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func parseCA(certPEM, keyPEM []byte) (*CA, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, errors.New("controller: invalid CA PEM data")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// JobCertName returns the DNS SAN that identifies a job of the given process
+// type running from a release of an app. One-off jobs use the type "run".
+func JobCertName(appID, releaseID, typ string) string {
+	if typ == "" {
+		typ = "run"
+	}
+	return fmt.Sprintf("%s.%s.%s.%s", typ, releaseID, appID, jobCertDomain)
+}
+
+// Issue creates a short-lived certificate for a job, returning the PEM
+// encoded certificate and private key.
+func (r *CARepo) Issue(req *ct.CertificateReq) (*ct.Certificate, error) {
+	if req.AppID == "" {
+		return nil, ct.ValidationError{Field: "app", Message: "must not be blank"}
+	}
+	if req.ReleaseID == "" {
+		return nil, ct.ValidationError{Field: "release", Message: "must not be blank"}
+	}
+	if req.Type != "" && !processTypePattern.MatchString(req.Type) {
+		return nil, ct.ValidationError{Field: "type", Message: "is not a valid process type"}
+	}
+	ca, err := r.CA()
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expires := now.Add(r.ttl)
+	name := JobCertName(req.AppID, req.ReleaseID, req.Type)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Flynn"}},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     expires,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ct.Certificate{
+		Name:      name,
+		Cert:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:       string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		CACert:    string(ca.certPEM),
+		ExpiresAt: &expires,
+	}, nil
+}
+
+func getCACert(repo *CARepo, w http.ResponseWriter) {
+	ca, err := repo.CA()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(200)
+	w.Write(ca.certPEM)
+}
+
+// issueCertificate issues a certificate for a job of an existing app and
+// release.
+func issueCertificate(req ct.CertificateReq, repo *CARepo, apps *AppRepo, releases *ReleaseRepo, r render.Render) {
+	if req.AppID != "" {
+		app, err := apps.Get(req.AppID)
+		if err == ErrNotFound {
+			respondWithError(r, ct.ValidationError{Field: "app", Message: "does not exist"})
+			return
+		} else if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		req.AppID = app.(*ct.App).ID
+	}
+	if req.ReleaseID != "" {
+		release, err := releases.Get(req.ReleaseID)
+		if err == ErrNotFound {
+			respondWithError(r, ct.ValidationError{Field: "release", Message: "does not exist"})
+			return
+		} else if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		req.ReleaseID = release.(*ct.Release).ID
+	}
+	cert, err := repo.Issue(&req)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, cert)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) getCACert(c *C) *x509.Certificate {
+	req, err := http.NewRequest("GET", s.srv.URL+"/ca", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "application/x-pem-file")
+
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	block, _ := pem.Decode(data)
+	c.Assert(block, Not(IsNil))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	c.Assert(err, IsNil)
+	c.Assert(cert.IsCA, Equals, true)
+	return cert
+}
+
+func (s *S) TestIssueCertificate(c *C) {
+	caCert := s.getCACert(c)
+
+	app := s.createTestApp(c, &ct.App{Name: "issue-certificate"})
+	release := s.createTestRelease(c, &ct.Release{})
+	appID, releaseID := app.ID, release.ID
+	for _, req := range []*ct.CertificateReq{
+		{ReleaseID: releaseID},
+		{AppID: appID},
+		{AppID: utils.UUID(), ReleaseID: releaseID},
+		{AppID: appID, ReleaseID: utils.UUID()},
+		{AppID: appID, ReleaseID: releaseID, Type: "web.evil"},
+	} {
+		res, err := s.Post("/ca/certificates", req, &ct.Certificate{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400, Commentf("%#v", req))
+	}
+
+	out := &ct.Certificate{}
+	res, err := s.Post("/ca/certificates", &ct.CertificateReq{AppID: appID, ReleaseID: releaseID, Type: "web"}, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.Name, Equals, JobCertName(appID, releaseID, "web"))
+	c.Assert(out.Key, Not(Equals), "")
+	c.Assert(out.ExpiresAt, Not(IsNil))
+
+	block, _ := pem.Decode([]byte(out.Cert))
+	c.Assert(block, Not(IsNil))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	c.Assert(err, IsNil)
+	c.Assert(cert.DNSNames, DeepEquals, []string{out.Name})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	_, err = cert.Verify(x509.VerifyOptions{
+		DNSName:   out.Name,
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	c.Assert(err, IsNil)
+
+	// the CA is stable across calls
+	c.Assert(s.getCACert(c).Equal(caCert), Equals, true)
+
+	// certificates can be issued in read-only mode, as nothing is stored
+	mode := &ct.ReadOnlyMode{}
+	_, err = s.Put("/cluster/read-only", &ct.ReadOnlyMode{Enabled: true}, mode)
+	c.Assert(err, IsNil)
+	defer s.Put("/cluster/read-only", &ct.ReadOnlyMode{Enabled: false}, mode)
+	res, err = s.Post("/ca/certificates", &ct.CertificateReq{AppID: appID, ReleaseID: releaseID}, &ct.Certificate{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+}
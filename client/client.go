@@ -1,16 +1,19 @@
 package controller
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
@@ -75,8 +78,28 @@ type Client struct {
 	addr string
 	http *http.Client
 
+	// LockID is sent with each request so that requests which modify an app
+	// locked by this client are permitted, see AcquireAppLock.
+	LockID string
+
+	// UserAgent is sent with each request so that the controller can
+	// attribute requests to the component using the client, see
+	// SetUserAgent.
+	UserAgent string
+
+	// Header holds default headers which are sent with each request.
+	Header http.Header
+
+	// OnStreamEvent, if set, is called when a stream opened by the client
+	// connects or disconnects. It must not block. See also StreamHealth.
+	OnStreamEvent func(*StreamEvent)
+
 	dial      rpcplus.DialFunc
 	dialClose io.Closer
+	streams   streamHealthSet
+
+	cache    map[string]*cacheEntry
+	cacheMtx sync.Mutex
 }
 
 func (c *Client) Close() error {
@@ -86,14 +109,38 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// SetUserAgent identifies requests as coming from a version of a component,
+// such as the scheduler or gitreceive.
+func (c *Client) SetUserAgent(component, version string) {
+	c.UserAgent = fmt.Sprintf("%s/%s flynn-controller-client", component, version)
+}
+
+// setHeaders adds the default headers and credentials to a request.
+func (c *Client) setHeaders(req *http.Request) {
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if c.LockID != "" {
+		req.Header.Set(ct.AppLockHeader, c.LockID)
+	}
+	req.SetBasicAuth("", c.key)
+}
+
 var ErrNotFound = errors.New("controller: not found")
 
+// ErrPreconditionFailed is returned when updating an app which has changed
+// since its ETag was read, see UpdateApp.
+var ErrPreconditionFailed = errors.New("controller: precondition failed")
+
 func toJSON(v interface{}) (io.Reader, error) {
 	data, err := json.Marshal(v)
 	return bytes.NewBuffer(data), err
 }
 
-func (c *Client) rawReq(method, path string, contentType string, in, out interface{}) (*http.Response, error) {
+func (c *Client) rawReq(method, path string, header http.Header, in, out interface{}) (*http.Response, error) {
 	var payload io.Reader
 	switch v := in.(type) {
 	case io.Reader:
@@ -111,19 +158,65 @@ func (c *Client) rawReq(method, path string, contentType string, in, out interfa
 	if err != nil {
 		return nil, err
 	}
-	if contentType == "" {
-		contentType = "application/json"
+	c.setHeaders(req)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	req.Header.Set("Content-Type", contentType)
-	req.SetBasicAuth("", c.key)
 	res, err := c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode == 304 {
+		res.Body.Close()
+		return res, nil
+	}
 	if res.StatusCode == 404 {
 		res.Body.Close()
 		return res, ErrNotFound
 	}
+	if res.StatusCode == 412 {
+		res.Body.Close()
+		return res, ErrPreconditionFailed
+	}
+	if res.StatusCode == 503 && res.Header.Get(ct.ReadOnlyHeader) == "true" {
+		defer res.Body.Close()
+		mode := &ct.ReadOnlyMode{}
+		json.NewDecoder(res.Body).Decode(mode)
+		return res, &ReadOnlyError{Reason: mode.Reason}
+	}
+	if res.StatusCode == 409 && res.Header.Get(ct.ArtifactInUseHeader) == "true" {
+		defer res.Body.Close()
+		inUse := &ct.ArtifactInUse{}
+		json.NewDecoder(res.Body).Decode(inUse)
+		return res, &ArtifactInUseError{Releases: inUse.Releases}
+	}
+	if res.StatusCode == 409 && res.Header.Get(ct.RouteConflictHeader) == "true" {
+		defer res.Body.Close()
+		conflict := &ct.RouteConflict{}
+		json.NewDecoder(res.Body).Decode(conflict)
+		return res, &RouteConflictError{Domain: conflict.Domain, Path: conflict.Path, RouteID: conflict.RouteID}
+	}
+	if res.StatusCode == 409 && res.Header.Get(ct.ReleaseMismatchHeader) == "true" {
+		defer res.Body.Close()
+		mismatch := &ct.ReleaseMismatch{}
+		json.NewDecoder(res.Body).Decode(mismatch)
+		return res, &ReleaseMismatchError{Expected: mismatch.Expected, Current: mismatch.Current}
+	}
+	if res.StatusCode == 429 {
+		defer res.Body.Close()
+		throttled := &ct.FormationThrottled{}
+		json.NewDecoder(res.Body).Decode(throttled)
+		return res, &FormationThrottledError{Limit: throttled.Limit, RetryAfter: time.Duration(throttled.RetryAfter) * time.Second}
+	}
+	if res.StatusCode == 409 && res.Header.Get(ct.AppLockHeader) != "" {
+		defer res.Body.Close()
+		lock := &ct.AppLock{}
+		json.NewDecoder(res.Body).Decode(lock)
+		return res, &AppLockedError{Lock: lock}
+	}
 	if res.StatusCode != 200 {
 		res.Body.Close()
 		return res, &url.Error{
@@ -140,7 +233,7 @@ func (c *Client) rawReq(method, path string, contentType string, in, out interfa
 }
 
 func (c *Client) send(method, path string, in, out interface{}) error {
-	_, err := c.rawReq(method, path, "", in, out)
+	_, err := c.rawReq(method, path, nil, in, out)
 	return err
 }
 
@@ -153,41 +246,138 @@ func (c *Client) post(path string, in, out interface{}) error {
 }
 
 func (c *Client) get(path string, out interface{}) error {
-	_, err := c.rawReq("GET", path, "", nil, out)
+	_, err := c.rawReq("GET", path, nil, nil, out)
 	return err
 }
 
+type cacheEntry struct {
+	etag string
+	body []byte
+}
+
+const maxCacheEntries = 1000
+
+// getCached is like get but caches responses by ETag, revalidating them with
+// If-None-Match on each request.
+func (c *Client) getCached(path string, out interface{}) error {
+	c.cacheMtx.Lock()
+	entry := c.cache[path]
+	c.cacheMtx.Unlock()
+
+	var header http.Header
+	if entry != nil {
+		header = http.Header{"If-None-Match": {entry.etag}}
+	}
+	res, err := c.rawReq("GET", path, header, nil, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == 304 {
+		return json.Unmarshal(entry.body, out)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if etag := res.Header.Get("ETag"); etag != "" {
+		c.cacheMtx.Lock()
+		if c.cache == nil || len(c.cache) >= maxCacheEntries {
+			c.cache = make(map[string]*cacheEntry)
+		}
+		c.cache[path] = &cacheEntry{etag: etag, body: body}
+		c.cacheMtx.Unlock()
+	}
+	return json.Unmarshal(body, out)
+}
+
 func (c *Client) delete(path string) error {
-	res, err := c.rawReq("DELETE", path, "", nil, nil)
+	res, err := c.rawReq("DELETE", path, nil, nil, nil)
 	if err == nil {
 		res.Body.Close()
 	}
 	return err
 }
 
+// FormationSnapshot loads the active formations of the cluster, fetching
+// pageSize formations per request. Passing the returned time to
+// StreamFormations streams the changes made after the snapshot.
+func (c *Client) FormationSnapshot(pageSize int) ([]*ct.ExpandedFormation, time.Time, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	var formations []*ct.ExpandedFormation
+	var page string
+	for {
+		snapshot := &ct.FormationSnapshot{}
+		path := fmt.Sprintf("/formations?expanded=true&limit=%d", pageSize)
+		if page != "" {
+			path += "&page=" + url.QueryEscape(page)
+		}
+		if err := c.get(path, snapshot); err != nil {
+			return nil, time.Time{}, err
+		}
+		formations = append(formations, snapshot.Formations...)
+		if snapshot.NextPage == "" {
+			return formations, snapshot.Since, nil
+		}
+		page = snapshot.NextPage
+	}
+}
+
 func (c *Client) StreamFormations(since *time.Time) (<-chan *ct.ExpandedFormation, *error) {
 	if since == nil {
 		s := time.Unix(0, 0)
 		since = &s
 	}
-	dial := c.dial
-	if dial == nil {
-		dial = net.Dial
+	ch := make(chan *ct.ExpandedFormation)
+	client, err := c.rpcClient()
+	if err != nil {
+		c.streamConnectFailed(StreamNameFormations, err)
+		close(ch)
+		return ch, &err
 	}
+	return ch, c.observeStream(StreamNameFormations, client, "Controller.StreamFormations", since, ch)
+}
+
+// StreamFormationUpdates is like StreamFormations, but allows the server to
+// coalesce bursts of updates to the same formation within req.CoalesceWindow.
+func (c *Client) StreamFormationUpdates(req *ct.StreamFormationsReq) (<-chan *ct.ExpandedFormation, *error) {
 	ch := make(chan *ct.ExpandedFormation)
-	conn, err := dial("tcp", c.addr)
+	client, err := c.rpcClient()
 	if err != nil {
+		c.streamConnectFailed(StreamNameFormationUpdates, err)
 		close(ch)
 		return ch, &err
 	}
-	header := make(http.Header)
-	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+c.key)))
-	client, err := rpcplus.NewHTTPClient(conn, rpcplus.DefaultRPCPath, header)
+	return ch, c.observeStream(StreamNameFormationUpdates, client, "Controller.StreamFormationUpdates", req, ch)
+}
+
+// StreamPolicies streams the compiled network policy set, sending the full
+// set initially and after every change.
+func (c *Client) StreamPolicies() (<-chan *ct.PolicySet, *error) {
+	ch := make(chan *ct.PolicySet)
+	client, err := c.rpcClient()
 	if err != nil {
+		c.streamConnectFailed(StreamNamePolicies, err)
 		close(ch)
 		return ch, &err
 	}
-	return ch, &client.StreamGo("Controller.StreamFormations", since, ch).Error
+	return ch, c.observeStream(StreamNamePolicies, client, "Controller.StreamPolicies", struct{}{}, ch)
+}
+
+func (c *Client) rpcClient() (*rpcplus.Client, error) {
+	dial := c.dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+c.key)))
+	return rpcplus.NewHTTPClient(conn, rpcplus.DefaultRPCPath, header)
 }
 
 func (c *Client) CreateArtifact(artifact *ct.Artifact) error {
@@ -202,6 +392,45 @@ func (c *Client) CreateApp(app *ct.App) error {
 	return c.post("/apps", app, app)
 }
 
+// CreateApps creates apps in a single transaction, returning the result of
+// each. If any app is rejected none are created and res.Created is false.
+func (c *Client) CreateApps(apps []*ct.App) (*ct.BulkAppsRes, error) {
+	res := &ct.BulkAppsRes{}
+	return res, c.post("/apps/bulk", apps, res)
+}
+
+// ExportApp returns a bundle of an app and its current release, artifact,
+// formation, env and routes.
+func (c *Client) ExportApp(appID string) (*ct.AppExport, error) {
+	bundle := &ct.AppExport{}
+	return bundle, c.get("/apps/"+appID+"/export", bundle)
+}
+
+// ImportApp creates an app from a bundle returned by ExportApp, which may be
+// from another cluster. The app is given a new ID.
+func (c *Client) ImportApp(bundle *ct.AppExport) (*ct.AppExport, error) {
+	res := &ct.AppExport{}
+	return res, c.post("/apps/import", bundle, res)
+}
+
+// DeleteArtifact deletes an artifact, returning an *ArtifactInUseError if any
+// release references it.
+func (c *Client) DeleteArtifact(artifactID string) error {
+	return c.send("DELETE", "/artifacts/"+artifactID, nil, nil)
+}
+
+// ForceDeleteArtifact deletes an artifact even if releases reference it,
+// which requires admin access.
+func (c *Client) ForceDeleteArtifact(artifactID string) error {
+	return c.send("DELETE", "/artifacts/"+artifactID+"?force=true", nil, nil)
+}
+
+// VerifyArtifact checks that the content of an artifact can be pulled.
+func (c *Client) VerifyArtifact(artifactID string) (*ct.ArtifactVerification, error) {
+	res := &ct.ArtifactVerification{}
+	return res, c.post(fmt.Sprintf("/artifacts/%s/verify", artifactID), nil, res)
+}
+
 func (c *Client) CreateProvider(provider *ct.Provider) error {
 	return c.post("/providers", provider, provider)
 }
@@ -222,6 +451,11 @@ func (c *Client) PutResource(resource *ct.Resource) error {
 	return c.put(fmt.Sprintf("/providers/%s/resources/%s", resource.ProviderID, resource.ID), resource, resource)
 }
 
+func (c *Client) GetResourceStatus(providerID, resourceID string) (*ct.ResourceStatus, error) {
+	status := &ct.ResourceStatus{}
+	return status, c.get(fmt.Sprintf("/providers/%s/resources/%s/status", providerID, resourceID), status)
+}
+
 func (c *Client) PutFormation(formation *ct.Formation) error {
 	if formation.AppID == "" || formation.ReleaseID == "" {
 		return errors.New("controller: missing app id and/or release id")
@@ -229,6 +463,10 @@ func (c *Client) PutFormation(formation *ct.Formation) error {
 	return c.put(fmt.Sprintf("/apps/%s/formations/%s", formation.AppID, formation.ReleaseID), formation, formation)
 }
 
+func (c *Client) DeleteFormation(appID, releaseID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID))
+}
+
 func (c *Client) SetAppRelease(appID, releaseID string) error {
 	return c.put(fmt.Sprintf("/apps/%s/release", appID), &ct.Release{ID: releaseID}, nil)
 }
@@ -247,28 +485,308 @@ func (c *Client) CreateRoute(appID string, route *strowger.Route) error {
 	return c.post(fmt.Sprintf("/apps/%s/routes", appID), route, route)
 }
 
+// CreateHTTPRoute creates an HTTP route for an app, returning a
+// *RouteConflictError if a route with the same domain and path exists.
+func (c *Client) CreateHTTPRoute(appID string, config *ct.HTTPRoute) (*strowger.Route, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(data)
+	route := &strowger.Route{Type: "http", Config: &raw}
+	return route, c.CreateRoute(appID, route)
+}
+
+func (c *Client) DeleteRoute(appID, routeID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/routes/%s", appID, routeID))
+}
+
+// FormationList returns the formations of an app for each of its releases,
+// newest first.
+func (c *Client) FormationList(appID string) ([]*ct.Formation, error) {
+	var formations []*ct.Formation
+	return formations, c.get(fmt.Sprintf("/apps/%s/formations", appID), &formations)
+}
+
 func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
 	formation := &ct.Formation{}
 	return formation, c.get(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID), formation)
 }
 
+// GetExpandedFormation fetches a formation along with its app, release and
+// artifact.
+func (c *Client) GetExpandedFormation(appID, releaseID string) (*ct.ExpandedFormation, error) {
+	formation := &ct.ExpandedFormation{}
+	return formation, c.get(fmt.Sprintf("/apps/%s/formations/%s?expand=true", appID, releaseID), formation)
+}
+
 func (c *Client) GetRelease(releaseID string) (*ct.Release, error) {
 	release := &ct.Release{}
-	return release, c.get(fmt.Sprintf("/releases/%s", releaseID), release)
+	return release, c.getCached(fmt.Sprintf("/releases/%s", releaseID), release)
 }
 
 func (c *Client) GetArtifact(artifactID string) (*ct.Artifact, error) {
 	artifact := &ct.Artifact{}
-	return artifact, c.get(fmt.Sprintf("/artifacts/%s", artifactID), artifact)
+	return artifact, c.getCached(fmt.Sprintf("/artifacts/%s", artifactID), artifact)
+}
+
+// GetReleases fetches several releases in one request. Releases that do not
+// exist are omitted from the result.
+func (c *Client) GetReleases(releaseIDs []string) ([]*ct.Release, error) {
+	var releases []*ct.Release
+	return releases, c.post("/releases/get", &ct.BatchGetReq{IDs: releaseIDs}, &releases)
+}
+
+// GetArtifacts fetches several artifacts in one request. Artifacts that do
+// not exist are omitted from the result.
+func (c *Client) GetArtifacts(artifactIDs []string) ([]*ct.Artifact, error) {
+	var artifacts []*ct.Artifact
+	return artifacts, c.post("/artifacts/get", &ct.BatchGetReq{IDs: artifactIDs}, &artifacts)
+}
+
+// CloneRelease creates a new release from an existing one with the given
+// overrides applied.
+func (c *Client) CloneRelease(releaseID string, req *ct.CloneReleaseReq) (*ct.Release, error) {
+	release := &ct.Release{}
+	return release, c.post(fmt.Sprintf("/releases/%s/clone", releaseID), req, release)
+}
+
+// DeleteRelease deletes a release which is not in use by an app or
+// formation.
+func (c *Client) DeleteRelease(releaseID string) error {
+	return c.send("DELETE", "/releases/"+releaseID, nil, nil)
+}
+
+// Deploy starts deploying a release to an app, returning the pending
+// deployment, or the queued deployment if too many deployments are running.
+// Use GetDeployment or StreamDeploymentEvents to follow its status.
+func (c *Client) Deploy(appID, releaseID string) (*ct.Deployment, error) {
+	deployment := &ct.Deployment{}
+	return deployment, c.post(fmt.Sprintf("/apps/%s/deploy", appID), &ct.DeployReq{ReleaseID: releaseID}, deployment)
+}
+
+func (c *Client) GetDeployment(appID, deploymentID string) (*ct.Deployment, error) {
+	deployment := &ct.Deployment{}
+	return deployment, c.get(fmt.Sprintf("/apps/%s/deployments/%s", appID, deploymentID), deployment)
+}
+
+func (c *Client) Deployments(appID string) ([]*ct.Deployment, error) {
+	var deployments []*ct.Deployment
+	return deployments, c.get(fmt.Sprintf("/apps/%s/deployments", appID), &deployments)
+}
+
+// DeploymentEvents returns the status and progress events recorded so far
+// for a deployment.
+func (c *Client) DeploymentEvents(appID, deploymentID string) ([]*ct.DeploymentEvent, error) {
+	var events []*ct.DeploymentEvent
+	return events, c.get(fmt.Sprintf("/apps/%s/deployments/%s/events", appID, deploymentID), &events)
+}
+
+// StreamDeploymentEvents streams the events of a deployment until it
+// finishes. The channel is closed once the stream ends, after which the
+// returned error is set.
+func (c *Client) StreamDeploymentEvents(appID, deploymentID string) (<-chan *ct.DeploymentEvent, *error) {
+	ch := make(chan *ct.DeploymentEvent)
+	res, err := c.rawReq("GET", fmt.Sprintf("/apps/%s/deployments/%s/events", appID, deploymentID), http.Header{"Accept": {"text/event-stream"}}, nil, nil)
+	if err != nil {
+		close(ch)
+		return ch, &err
+	}
+	go func() {
+		defer close(ch)
+		defer res.Body.Close()
+		s := bufio.NewScanner(res.Body)
+		for s.Scan() {
+			line := s.Text()
+			if line == "event: eof" {
+				return
+			}
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			event := &ct.DeploymentEvent{}
+			if err = json.Unmarshal([]byte(line[len("data: "):]), event); err != nil {
+				return
+			}
+			ch <- event
+		}
+		if err = s.Err(); err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	return ch, &err
+}
+
+// ReleaseTags returns the tags of a release in an app.
+func (c *Client) ReleaseTags(appID, releaseID string) ([]string, error) {
+	var tags []string
+	return tags, c.get(fmt.Sprintf("/apps/%s/releases/%s/tags", appID, releaseID), &tags)
+}
+
+// SetReleaseTags replaces the tags of a release in an app, moving any of the
+// tags which belong to another release of the app. Tags may be used in place
+// of a release ID in requests for the app.
+func (c *Client) SetReleaseTags(appID, releaseID string, tags []string) ([]string, error) {
+	var res []string
+	return res, c.send("PUT", fmt.Sprintf("/apps/%s/releases/%s/tags", appID, releaseID), tags, &res)
+}
+
+// CreateAppRelease creates a release from the current release of the app
+// with the overrides in req applied and deploys it. It returns
+// ErrPreconditionFailed if req.Base is set and is no longer the current
+// release of the app.
+func (c *Client) CreateAppRelease(appID string, req *ct.AppReleaseReq) (*ct.Release, error) {
+	release := &ct.Release{}
+	return release, c.post(fmt.Sprintf("/apps/%s/releases", appID), req, release)
+}
+
+func (c *Client) AppList() ([]*ct.App, error) {
+	var apps []*ct.App
+	return apps, c.get("/apps", &apps)
+}
+
+// AppListByLabel lists the apps with all of the given meta labels set.
+func (c *Client) AppListByLabel(labels map[string]string) ([]*ct.App, error) {
+	q := make(url.Values)
+	for k, v := range labels {
+		q.Add("label", k+"="+v)
+	}
+	var apps []*ct.App
+	return apps, c.get("/apps?"+q.Encode(), &apps)
+}
+
+// AppListByNamePrefix lists the apps with names starting with prefix.
+func (c *Client) AppListByNamePrefix(prefix string) ([]*ct.App, error) {
+	var apps []*ct.App
+	return apps, c.get("/apps?"+url.Values{"name_prefix": {prefix}}.Encode(), &apps)
+}
+
+// AppListSorted lists apps sorted by name, created_at or updated_at,
+// descending if prefixed with a minus, such as -updated_at.
+func (c *Client) AppListSorted(sort string) ([]*ct.App, error) {
+	var apps []*ct.App
+	return apps, c.get("/apps?"+url.Values{"sort": {sort}}.Encode(), &apps)
+}
+
+// AppStatus returns the job summary and routes of an app, along with the
+// traffic of each route if the router reports it.
+func (c *Client) AppStatus(appID string) (*ct.AppStatus, error) {
+	status := &ct.AppStatus{}
+	return status, c.get("/apps/"+appID+"/status", status)
+}
+
+// AppStats returns counts of the releases, formations, running jobs and
+// resources of an app.
+func (c *Client) AppStats(appID string) (*ct.AppStats, error) {
+	stats := &ct.AppStats{}
+	return stats, c.get("/apps/"+appID+"/stats", stats)
+}
+
+// GetAppEnv returns the app-scoped environment of an app.
+func (c *Client) GetAppEnv(appID string) (map[string]string, error) {
+	var env map[string]string
+	return env, c.get("/apps/"+appID+"/env", &env)
+}
+
+// SetAppEnv replaces the app-scoped environment of an app, which is merged
+// into the environment of new jobs and overridden by the release environment.
+func (c *Client) SetAppEnv(appID string, env map[string]string) error {
+	return c.put("/apps/"+appID+"/env", env, &map[string]string{})
+}
+
+// AppEvents returns the events of an app with IDs greater than since, such
+// as changes to its releases, formations, jobs and routes.
+func (c *Client) AppEvents(appID string, since int64) ([]*ct.AppEvent, error) {
+	var events []*ct.AppEvent
+	return events, c.get(fmt.Sprintf("/apps/%s/events?since=%d", appID, since), &events)
+}
+
+// GetAppAt returns the release, env and formations of an app as of t.
+func (c *Client) GetAppAt(appID string, t time.Time) (*ct.AppSnapshot, error) {
+	snapshot := &ct.AppSnapshot{}
+	return snapshot, c.get("/apps/"+appID+"/at?time="+url.QueryEscape(t.Format(time.RFC3339Nano)), snapshot)
+}
+
+// SetAppMaintenance enables or disables maintenance mode for an app.
+func (c *Client) SetAppMaintenance(appID string, enabled bool) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.post("/apps/"+appID, map[string]interface{}{"maintenance": enabled}, app)
+}
+
+// GetAppWithETag returns an app along with its ETag, which may be passed to
+// UpdateApp to only update the app if it has not changed since.
+func (c *Client) GetAppWithETag(appID string) (*ct.App, string, error) {
+	app := &ct.App{}
+	res, err := c.rawReq("GET", "/apps/"+appID, nil, nil, app)
+	if err != nil {
+		return nil, "", err
+	}
+	return app, res.Header.Get("ETag"), nil
+}
+
+// UpdateApp updates the fields of an app, such as meta and maintenance. data
+// is applied as a JSON merge patch, so keys of meta which are not in data are
+// kept and fields or meta keys set to nil are removed. If etag is set the
+// update is only applied if the app has not changed since the ETag was read,
+// otherwise ErrPreconditionFailed is returned.
+func (c *Client) UpdateApp(appID, etag string, data map[string]interface{}) (*ct.App, string, error) {
+	header := http.Header{"Content-Type": {"application/merge-patch+json"}}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	app := &ct.App{}
+	res, err := c.rawReq("POST", "/apps/"+appID, header, data, app)
+	if err != nil {
+		return nil, "", err
+	}
+	return app, res.Header.Get("ETag"), nil
+}
+
+// UpdateAppMeta replaces the meta of an app, returning ErrPreconditionFailed
+// if the app is updated concurrently.
+func (c *Client) UpdateAppMeta(appID string, meta map[string]string) (*ct.App, error) {
+	app, etag, err := c.GetAppWithETag(appID)
+	if err != nil {
+		return nil, err
+	}
+	patch := make(map[string]interface{}, len(app.Meta)+len(meta))
+	for k := range app.Meta {
+		patch[k] = nil
+	}
+	for k, v := range meta {
+		patch[k] = v
+	}
+	app, _, err = c.UpdateApp(appID, etag, map[string]interface{}{"meta": patch})
+	return app, err
+}
+
+func (c *Client) DeleteApp(appID string) error {
+	return c.delete("/apps/" + appID)
+}
+
+// RestoreApp undeletes a deleted app and recreates its routes.
+func (c *Client) RestoreApp(appID string) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.post("/apps/"+appID+"/restore", nil, app)
 }
 
 func (c *Client) GetApp(appID string) (*ct.App, error) {
 	app := &ct.App{}
-	return app, c.get(fmt.Sprintf("/apps/%s", appID), app)
+	return app, c.getCached(fmt.Sprintf("/apps/%s", appID), app)
 }
 
 func (c *Client) GetJobLog(appID, jobID string) (io.ReadCloser, error) {
-	res, err := c.rawReq("GET", fmt.Sprintf("/apps/%s/jobs/%s/log", appID, jobID), "", nil, nil)
+	res, err := c.rawReq("GET", fmt.Sprintf("/apps/%s/jobs/%s/log", appID, jobID), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// GetJobLogByID fetches the log of a job without knowing which app it
+// belongs to. It requires admin access.
+func (c *Client) GetJobLogByID(jobID string) (io.ReadCloser, error) {
+	res, err := c.rawReq("GET", fmt.Sprintf("/jobs/%s/log", jobID), nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -281,9 +799,9 @@ func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCl
 		return nil, err
 	}
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/apps/%s/jobs", c.url, appID), data)
+	c.setHeaders(req)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/vnd.flynn.attach")
-	req.SetBasicAuth("", c.key)
 	var dial rpcplus.DialFunc
 	if c.dial != nil {
 		dial = c.dial
@@ -296,16 +814,68 @@ func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCl
 	return rwc, nil
 }
 
+// RunJobDetached runs a job, returning a *ReleaseMismatchError if
+// req.ExpectedReleaseID is set and is not the current release of the app.
 func (c *Client) RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error) {
 	job := &ct.Job{}
 	return job, c.post(fmt.Sprintf("/apps/%s/jobs", appID), req, job)
 }
 
+// MultiAppJobList returns the jobs of the apps keyed by app ID.
+func (c *Client) MultiAppJobList(appIDs []string) (map[string][]*ct.Job, error) {
+	var jobs map[string][]*ct.Job
+	return jobs, c.get("/jobs?app_ids="+url.QueryEscape(strings.Join(appIDs, ",")), &jobs)
+}
+
+// RestartApp starts a rolling restart of the jobs of the current release of
+// the app, limited to the process type if it is not empty, and returns the
+// deployment performing it. Restarts are queued and fail like deployments.
+func (c *Client) RestartApp(appID, typ string) (*ct.Deployment, error) {
+	path := fmt.Sprintf("/apps/%s/restart", appID)
+	if typ != "" {
+		path += "?type=" + url.QueryEscape(typ)
+	}
+	deployment := &ct.Deployment{}
+	return deployment, c.post(path, nil, deployment)
+}
+
+// JobEnvDiff returns the env vars of a job which differ from the current
+// release of its app.
+func (c *Client) JobEnvDiff(appID, jobID string) (*ct.JobEnvDiff, error) {
+	diff := &ct.JobEnvDiff{}
+	return diff, c.get(fmt.Sprintf("/apps/%s/jobs/%s/env-diff", appID, jobID), diff)
+}
+
+// ReserveJob reserves a job ID for the idempotency token, returning the
+// existing reservation if the token has been reserved before.
+func (c *Client) ReserveJob(appID, token string) (*ct.JobReservation, error) {
+	res := &ct.JobReservation{}
+	return res, c.post(fmt.Sprintf("/apps/%s/jobs/reservations", appID), &ct.JobReservation{Token: token}, res)
+}
+
 func (c *Client) JobList(appID string) ([]*ct.Job, error) {
 	var jobs []*ct.Job
 	return jobs, c.get(fmt.Sprintf("/apps/%s/jobs", appID), &jobs)
 }
 
+// StopJobs stops the jobs of an app matching the filter, which may set type,
+// state and older_than, for example to stop stuck one-off jobs.
+func (c *Client) StopJobs(appID string, filter url.Values) (*ct.StopJobsRes, error) {
+	res := &ct.StopJobsRes{}
+	return res, c.send("DELETE", "/apps/"+appID+"/jobs?"+filter.Encode(), nil, res)
+}
+
+// JobSummary counts the jobs of an app by type and state.
+func (c *Client) JobSummary(appID string) (*ct.JobSummary, error) {
+	summary := &ct.JobSummary{}
+	return summary, c.get("/apps/"+appID+"/jobs?summary=true", summary)
+}
+
+// AdoptJob assigns a running job that lacks controller attributes to an app.
+func (c *Client) AdoptJob(appID string, req *ct.AdoptJobReq) error {
+	return c.post(fmt.Sprintf("/apps/%s/jobs/adopt", appID), req, req)
+}
+
 func (c *Client) KeyList() ([]*ct.Key, error) {
 	var keys []*ct.Key
 	return keys, c.get("/keys", &keys)
@@ -324,3 +894,288 @@ func (c *Client) ProviderList() ([]*ct.Provider, error) {
 	var providers []*ct.Provider
 	return providers, c.get("/providers", &providers)
 }
+
+func (c *Client) GetCACert() ([]byte, error) {
+	res, err := c.rawReq("GET", "/ca", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+func (c *Client) IssueCertificate(req *ct.CertificateReq) (*ct.Certificate, error) {
+	cert := &ct.Certificate{}
+	return cert, c.post("/ca/certificates", req, cert)
+}
+
+func (c *Client) GetPolicy(appID string) (*ct.NetworkPolicy, error) {
+	policy := &ct.NetworkPolicy{}
+	return policy, c.get(fmt.Sprintf("/apps/%s/policies", appID), policy)
+}
+
+func (c *Client) PutPolicy(policy *ct.NetworkPolicy) error {
+	if policy.AppID == "" {
+		return errors.New("controller: missing app id")
+	}
+	return c.put(fmt.Sprintf("/apps/%s/policies", policy.AppID), policy, policy)
+}
+
+func (c *Client) DeletePolicy(appID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/policies", appID))
+}
+
+// GetRegistryConfig returns the registry config of the cluster.
+func (c *Client) GetRegistryConfig() (*ct.RegistryConfig, error) {
+	conf := &ct.RegistryConfig{}
+	return conf, c.get("/cluster/registry-config", conf)
+}
+
+// PutRegistryConfig replaces the registry config of the cluster.
+func (c *Client) PutRegistryConfig(conf *ct.RegistryConfig) error {
+	return c.put("/cluster/registry-config", conf, conf)
+}
+
+func (c *Client) DeleteRegistryConfig() error {
+	return c.delete("/cluster/registry-config")
+}
+
+// GetAppRegistryConfig returns the registry config overrides of an app.
+func (c *Client) GetAppRegistryConfig(appID string) (*ct.RegistryConfig, error) {
+	conf := &ct.RegistryConfig{}
+	return conf, c.get(fmt.Sprintf("/apps/%s/registry-config", appID), conf)
+}
+
+// PutAppRegistryConfig replaces the registry config overrides of an app. It
+// requires the admin key, as mirrors redirect the images of the app.
+func (c *Client) PutAppRegistryConfig(appID string, conf *ct.RegistryConfig) error {
+	return c.put(fmt.Sprintf("/apps/%s/registry-config", appID), conf, conf)
+}
+
+func (c *Client) DeleteAppRegistryConfig(appID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/registry-config", appID))
+}
+
+func (c *Client) CreateEnvGroup(group *ct.EnvGroup) error {
+	return c.post("/env-groups", group, group)
+}
+
+func (c *Client) EnvGroupList() ([]*ct.EnvGroup, error) {
+	var groups []*ct.EnvGroup
+	return groups, c.get("/env-groups", &groups)
+}
+
+func (c *Client) GetEnvGroup(groupID string) (*ct.EnvGroup, error) {
+	group := &ct.EnvGroup{}
+	return group, c.get("/env-groups/"+groupID, group)
+}
+
+// UpdateEnvGroup replaces the env of a group, creating new releases for the
+// apps that reference it. If it fails part way through, calling it again
+// releases the remaining apps.
+func (c *Client) UpdateEnvGroup(group *ct.EnvGroup) error {
+	if group.ID == "" {
+		return errors.New("controller: missing id")
+	}
+	return c.put("/env-groups/"+group.ID, group, group)
+}
+
+func (c *Client) AppEnvGroups(appID string) ([]*ct.EnvGroup, error) {
+	var groups []*ct.EnvGroup
+	return groups, c.get(fmt.Sprintf("/apps/%s/env-groups", appID), &groups)
+}
+
+func (c *Client) AddAppEnvGroup(appID, groupID string) error {
+	return c.put(fmt.Sprintf("/apps/%s/env-groups/%s", appID, groupID), nil, nil)
+}
+
+func (c *Client) RemoveAppEnvGroup(appID, groupID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/env-groups/%s", appID, groupID))
+}
+
+func (c *Client) GetTask(taskID string) (*ct.Task, error) {
+	task := &ct.Task{}
+	return task, c.get("/tasks/"+taskID, task)
+}
+
+func (c *Client) TaskList() ([]*ct.Task, error) {
+	var tasks []*ct.Task
+	return tasks, c.get("/tasks", &tasks)
+}
+
+// CheckConsistency runs the consistency checks of the controller database,
+// repairing the rows which can be fixed automatically if repair is true.
+func (c *Client) CheckConsistency(repair bool) (*ct.ConsistencyReport, error) {
+	report := &ct.ConsistencyReport{}
+	if repair {
+		return report, c.post("/debug/consistency/repair", nil, report)
+	}
+	return report, c.get("/debug/consistency", report)
+}
+
+// PreviewAppGC returns the deleted apps, and the releases and artifacts only
+// they use, which the next garbage collection run would purge.
+func (c *Client) PreviewAppGC() (*ct.AppGCReport, error) {
+	report := &ct.AppGCReport{}
+	return report, c.get("/gc/apps", report)
+}
+
+// StreamStats returns the subscribers to the controller streams keyed by
+// stream name.
+func (c *Client) StreamStats() (map[string][]*ct.StreamSubscriber, error) {
+	var stats map[string][]*ct.StreamSubscriber
+	return stats, c.get("/debug/streams", &stats)
+}
+
+// ReadOnlyError is returned when a request is rejected because the cluster is
+// in read-only mode.
+type ReadOnlyError struct {
+	Reason string
+}
+
+func (e *ReadOnlyError) Error() string {
+	if e.Reason == "" {
+		return "controller: cluster is in read-only mode"
+	}
+	return "controller: cluster is in read-only mode: " + e.Reason
+}
+
+// AppLockedError is returned when a request is rejected because the app is
+// locked by another client.
+type AppLockedError struct {
+	Lock *ct.AppLock
+}
+
+func (e *AppLockedError) Error() string {
+	return fmt.Sprintf("controller: app is locked by %s until %s", e.Lock.Holder, e.Lock.ExpiresAt)
+}
+
+// ArtifactInUseError is returned when deleting an artifact which is
+// referenced by the Releases.
+type ArtifactInUseError struct {
+	Releases []string
+}
+
+func (e *ArtifactInUseError) Error() string {
+	return fmt.Sprintf("controller: artifact is used by releases %s", strings.Join(e.Releases, ", "))
+}
+
+// RouteConflictError is returned when creating an HTTP route with the same
+// domain and path as an existing route. RouteID is only set if the existing
+// route belongs to the same app.
+type RouteConflictError struct {
+	Domain  string
+	Path    string
+	RouteID string
+}
+
+func (e *RouteConflictError) Error() string {
+	if e.RouteID != "" {
+		return fmt.Sprintf("controller: %s%s is already routed by route %s", e.Domain, e.Path, e.RouteID)
+	}
+	return fmt.Sprintf("controller: %s%s is already routed to another app", e.Domain, e.Path)
+}
+
+// ReleaseMismatchError is returned when running a job with an expected
+// release which is not the current release of the app. Current is empty if
+// the app has no release.
+type ReleaseMismatchError struct {
+	Expected string
+	Current  string
+}
+
+func (e *ReleaseMismatchError) Error() string {
+	if e.Current == "" {
+		return fmt.Sprintf("controller: expected release %s, but the app has no release", e.Expected)
+	}
+	return fmt.Sprintf("controller: expected release %s, but the current release is %s", e.Expected, e.Current)
+}
+
+// FormationThrottledError is returned when a formation change is rejected
+// because the formations of the app have changed more than Limit times a
+// minute. Changes are accepted again after RetryAfter.
+type FormationThrottledError struct {
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *FormationThrottledError) Error() string {
+	return fmt.Sprintf("controller: formation changes exceeded %d per minute, retry after %s", e.Limit, e.RetryAfter)
+}
+
+// AcquireAppLock locks an app, returning an *AppLockedError if it is already
+// locked. Set LockID to the ID of the returned lock to modify the app while
+// it is locked, and renew it with RenewAppLock before it expires.
+func (c *Client) AcquireAppLock(appID string, lock *ct.AppLock) (*ct.AppLock, error) {
+	res := &ct.AppLock{}
+	return res, c.post("/apps/"+appID+"/lock", lock, res)
+}
+
+func (c *Client) GetAppLock(appID string) (*ct.AppLock, error) {
+	lock := &ct.AppLock{}
+	return lock, c.get("/apps/"+appID+"/lock", lock)
+}
+
+// RenewAppLock extends a lock by its TTL, returning ErrNotFound if the lock
+// has expired or been broken.
+func (c *Client) RenewAppLock(appID, lockID string) (*ct.AppLock, error) {
+	lock := &ct.AppLock{}
+	return lock, c.put("/apps/"+appID+"/lock/"+lockID, nil, lock)
+}
+
+func (c *Client) ReleaseAppLock(appID, lockID string) error {
+	return c.delete("/apps/" + appID + "/lock/" + lockID)
+}
+
+// BreakAppLock removes the lock on an app regardless of who holds it. It is
+// only permitted for admins.
+func (c *Client) BreakAppLock(appID string) error {
+	return c.delete("/apps/" + appID + "/lock?force=true")
+}
+
+func (c *Client) OnlineMigrations() ([]*ct.OnlineMigration, error) {
+	var list []*ct.OnlineMigration
+	return list, c.get("/online-migrations", &list)
+}
+
+func (c *Client) GetOnlineMigration(name string) (*ct.OnlineMigration, error) {
+	migration := &ct.OnlineMigration{}
+	return migration, c.get("/online-migrations/"+name, migration)
+}
+
+// StartOnlineMigration enables dual writes to the new column of an online
+// migration.
+func (c *Client) StartOnlineMigration(name string) (*ct.OnlineMigration, error) {
+	migration := &ct.OnlineMigration{}
+	return migration, c.post("/online-migrations/"+name+"/dual-write", nil, migration)
+}
+
+// BackfillOnlineMigration starts a task copying the existing rows of a dual
+// writing online migration to the new column.
+func (c *Client) BackfillOnlineMigration(name string) (*ct.Task, error) {
+	task := &ct.Task{}
+	return task, c.post("/online-migrations/"+name+"/backfill", nil, task)
+}
+
+// CutoverOnlineMigration switches the readers of a backfilled online
+// migration over to the new column.
+func (c *Client) CutoverOnlineMigration(name string) (*ct.OnlineMigration, error) {
+	migration := &ct.OnlineMigration{}
+	return migration, c.post("/online-migrations/"+name+"/cutover", nil, migration)
+}
+
+// AbortOnlineMigration stops dual writes of an online migration which has
+// not been cut over.
+func (c *Client) AbortOnlineMigration(name string) (*ct.OnlineMigration, error) {
+	migration := &ct.OnlineMigration{}
+	return migration, c.post("/online-migrations/"+name+"/abort", nil, migration)
+}
+
+func (c *Client) GetReadOnly() (*ct.ReadOnlyMode, error) {
+	mode := &ct.ReadOnlyMode{}
+	return mode, c.get("/cluster/read-only", mode)
+}
+
+func (c *Client) SetReadOnly(enabled bool, reason string) error {
+	return c.put("/cluster/read-only", &ct.ReadOnlyMode{Enabled: enabled, Reason: reason}, &ct.ReadOnlyMode{})
+}
@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"fmt"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+// envPatchAttempts is the number of times an env change is attempted when the
+// release of the app changes concurrently.
+const envPatchAttempts = 3
+
+// EnvOptions configures an env change.
+type EnvOptions struct {
+	// Deploy rolls the new release out with a deployment instead of moving
+	// the formation over to it immediately.
+	Deploy bool
+}
+
+// EnvChange is the result of an env change. Release is the new release of the
+// app, or the current one if the env was already as requested, and
+// Deployment is set if the release is being deployed.
+type EnvChange struct {
+	Release    *ct.Release
+	Deployment *ct.Deployment
+}
+
+// EnvGet returns the env of the current release of an app.
+func (c *Client) EnvGet(appID string) (map[string]string, error) {
+	release, err := c.GetAppRelease(appID)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string, len(release.Env))
+	for k, v := range release.Env {
+		env[k] = v
+	}
+	return env, nil
+}
+
+// EnvSet sets env vars of an app by creating a release from the current
+// release with the vars changed, and deploying it.
+func (c *Client) EnvSet(appID string, env map[string]string, opts *EnvOptions) (*EnvChange, error) {
+	patch := make(map[string]*string, len(env))
+	for k, v := range env {
+		v := v
+		patch[k] = &v
+	}
+	return c.envPatch(appID, patch, opts)
+}
+
+// EnvUnset is like EnvSet but removes env vars.
+func (c *Client) EnvUnset(appID string, keys []string, opts *EnvOptions) (*EnvChange, error) {
+	patch := make(map[string]*string, len(keys))
+	for _, k := range keys {
+		patch[k] = nil
+	}
+	return c.envPatch(appID, patch, opts)
+}
+
+// envPatch applies patch to the env of the current release of an app. The
+// change is based on the release it was computed from, so if another change
+// is deployed in the meantime it is computed again from the new release
+// rather than undoing the other change. ErrPreconditionFailed is returned if
+// the release keeps changing.
+func (c *Client) envPatch(appID string, patch map[string]*string, opts *EnvOptions) (*EnvChange, error) {
+	if opts == nil {
+		opts = &EnvOptions{}
+	}
+	for i := 0; i < envPatchAttempts; i++ {
+		current, err := c.GetAppRelease(appID)
+		if err != nil {
+			return nil, err
+		}
+		if !envChanged(current.Env, patch) {
+			return &EnvChange{Release: current}, nil
+		}
+		req := &ct.CloneReleaseReq{Env: patch}
+
+		if !opts.Deploy {
+			release, err := c.CreateAppRelease(appID, &ct.AppReleaseReq{CloneReleaseReq: *req, Base: current.ID})
+			if err == ErrPreconditionFailed {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			return &EnvChange{Release: release}, nil
+		}
+
+		release, err := c.CloneRelease(current.ID, req)
+		if err != nil {
+			return nil, err
+		}
+		deployment := &ct.Deployment{}
+		err = c.post(fmt.Sprintf("/apps/%s/deploy", appID), &ct.DeployReq{ReleaseID: release.ID, Base: current.ID}, deployment)
+		if err == ErrPreconditionFailed {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return &EnvChange{Release: release, Deployment: deployment}, nil
+	}
+	return nil, ErrPreconditionFailed
+}
+
+func envChanged(env map[string]string, patch map[string]*string) bool {
+	for k, v := range patch {
+		current, ok := env[k]
+		if v == nil && ok || v != nil && (!ok || current != *v) {
+			return true
+		}
+	}
+	return false
+}
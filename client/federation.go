@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+// Federation fans requests out to the controllers of several clusters, for
+// example one per region. Listings are merged across clusters and app-scoped
+// calls are routed to the cluster that owns the app.
+type Federation struct {
+	clusters map[string]*Client
+	names    []string
+
+	ownersMtx sync.Mutex
+	owners    map[string]string
+}
+
+// NewFederation returns a Federation of the given controller clients keyed by
+// cluster name.
+func NewFederation(clusters map[string]*Client) *Federation {
+	f := &Federation{
+		clusters: clusters,
+		names:    make([]string, 0, len(clusters)),
+		owners:   make(map[string]string),
+	}
+	for name := range clusters {
+		f.names = append(f.names, name)
+	}
+	sort.Strings(f.names)
+	return f
+}
+
+// FederationError holds the errors returned by individual clusters, keyed by
+// cluster name.
+type FederationError map[string]error
+
+func (e FederationError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e[name])
+	}
+	return "controller: federated request failed: " + strings.Join(msgs, ", ")
+}
+
+// FederatedApp is an app along with the name of the cluster it belongs to.
+type FederatedApp struct {
+	*ct.App
+	Cluster string `json:"cluster"`
+}
+
+// each calls fn concurrently for every cluster and collects the errors.
+func (f *Federation) each(fn func(name string, c *Client) error) error {
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(FederationError)
+	for _, name := range f.names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := fn(name, f.clusters[name]); err != nil {
+				mtx.Lock()
+				errs[name] = err
+				mtx.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// AppList returns the apps of all clusters ordered by cluster name. If some
+// clusters fail, the apps of the others are returned along with a
+// FederationError.
+func (f *Federation) AppList() ([]*FederatedApp, error) {
+	lists := make(map[string][]*ct.App, len(f.names))
+	var mtx sync.Mutex
+	err := f.each(func(name string, c *Client) error {
+		apps, err := c.AppList()
+		if err != nil {
+			return err
+		}
+		mtx.Lock()
+		lists[name] = apps
+		mtx.Unlock()
+		return nil
+	})
+
+	var apps []*FederatedApp
+	for _, name := range f.names {
+		for _, app := range lists[name] {
+			f.setOwner(app.ID, name)
+			apps = append(apps, &FederatedApp{App: app, Cluster: name})
+		}
+	}
+	return apps, err
+}
+
+func (f *Federation) setOwner(appID, cluster string) {
+	f.ownersMtx.Lock()
+	f.owners[appID] = cluster
+	f.ownersMtx.Unlock()
+}
+
+// Cluster returns the name and client of the cluster that owns the app with
+// the given ID or name. App names are only unique within a cluster, so a name
+// that exists in more than one cluster is an error.
+func (f *Federation) Cluster(appID string) (string, *Client, error) {
+	f.ownersMtx.Lock()
+	name, ok := f.owners[appID]
+	f.ownersMtx.Unlock()
+	if ok {
+		return name, f.clusters[name], nil
+	}
+
+	var mtx sync.Mutex
+	var found []string
+	err := f.each(func(name string, c *Client) error {
+		if _, err := c.GetApp(appID); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		mtx.Lock()
+		found = append(found, name)
+		mtx.Unlock()
+		return nil
+	})
+	switch {
+	case len(found) > 1:
+		sort.Strings(found)
+		return "", nil, fmt.Errorf("controller: app %q exists in multiple clusters: %s", appID, strings.Join(found, ", "))
+	case len(found) == 1:
+		f.setOwner(appID, found[0])
+		return found[0], f.clusters[found[0]], nil
+	case err != nil:
+		return "", nil, err
+	default:
+		return "", nil, ErrNotFound
+	}
+}
+
+// App returns the client of the cluster that owns the app, for making
+// app-scoped calls.
+func (f *Federation) App(appID string) (*Client, error) {
+	_, c, err := f.Cluster(appID)
+	return c, err
+}
+
+func (f *Federation) GetApp(appID string) (*FederatedApp, error) {
+	name, c, err := f.Cluster(appID)
+	if err != nil {
+		return nil, err
+	}
+	app, err := c.GetApp(appID)
+	if err != nil {
+		return nil, err
+	}
+	return &FederatedApp{App: app, Cluster: name}, nil
+}
+
+func (f *Federation) Close() error {
+	for _, c := range f.clusters {
+		c.Close()
+	}
+	return nil
+}
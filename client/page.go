@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+// DefaultPageSize is the number of results requested per page by iterators
+// created with a page size of zero.
+const DefaultPageSize = 100
+
+// listPage fetches a page of the list at path into out and returns the total
+// number of results.
+func (c *Client) listPage(path string, limit, offset int, out interface{}) (int, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	res, err := c.rawReq("GET", fmt.Sprintf("%s%slimit=%d&offset=%d", path, sep, limit, offset), nil, nil, out)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res.Header.Get(ct.TotalCountHeader))
+}
+
+// pager tracks the position of an iterator in a paginated list.
+type pager struct {
+	size   int
+	offset int
+	total  int
+	n      int
+	done   bool
+	err    error
+}
+
+func newPager(size int) pager {
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	return pager{size: size, total: -1}
+}
+
+// fetch loads the next page using load, which returns the number of results
+// in the page and the total, and reports whether any results were loaded.
+func (p *pager) fetch(load func(limit, offset int) (int, int, error)) bool {
+	if p.done || p.err != nil {
+		return false
+	}
+	n, total, err := load(p.size, p.offset)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	p.total = total
+	p.offset += n
+	if n == 0 || p.offset >= total {
+		p.done = true
+	}
+	return n > 0
+}
+
+// AppIterator pages through the apps of a cluster.
+//
+//	it := client.Apps(0)
+//	for it.Next() {
+//		app := it.App()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type AppIterator struct {
+	c    *Client
+	page []*ct.App
+	app  *ct.App
+	pager
+}
+
+// Apps returns an iterator over all apps, fetching pageSize apps per
+// request.
+func (c *Client) Apps(pageSize int) *AppIterator {
+	return &AppIterator{c: c, pager: newPager(pageSize)}
+}
+
+// Next advances to the next app, fetching another page if necessary. It
+// returns false when there are no more apps or an error occurred.
+func (it *AppIterator) Next() bool {
+	if len(it.page) == 0 && !it.fetch(func(limit, offset int) (int, int, error) {
+		it.page = nil
+		total, err := it.c.listPage("/apps", limit, offset, &it.page)
+		return len(it.page), total, err
+	}) {
+		return false
+	}
+	it.app, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+func (it *AppIterator) App() *ct.App { return it.app }
+
+// Total returns the total number of apps, or -1 if no page has been fetched.
+func (it *AppIterator) Total() int { return it.total }
+
+func (it *AppIterator) Err() error { return it.err }
+
+// ListReleases returns a page of the releases matching filter, which may set
+// artifact_id, app_id and since, along with the total number of matching
+// releases.
+func (c *Client) ListReleases(filter url.Values, limit, offset int) ([]*ct.Release, int, error) {
+	var releases []*ct.Release
+	path := "/releases"
+	if len(filter) > 0 {
+		path += "?" + filter.Encode()
+	}
+	total, err := c.listPage(path, limit, offset, &releases)
+	return releases, total, err
+}
+
+// ArtifactList returns a page of the artifacts matching filter, which may
+// set type, uri and uri_prefix, along with the total number of matching
+// artifacts.
+func (c *Client) ArtifactList(filter url.Values, limit, offset int) ([]*ct.Artifact, int, error) {
+	var artifacts []*ct.Artifact
+	path := "/artifacts"
+	if len(filter) > 0 {
+		path += "?" + filter.Encode()
+	}
+	total, err := c.listPage(path, limit, offset, &artifacts)
+	return artifacts, total, err
+}
+
+// ReleaseIterator pages through the releases of a cluster.
+type ReleaseIterator struct {
+	c       *Client
+	page    []*ct.Release
+	release *ct.Release
+	pager
+}
+
+// Releases returns an iterator over all releases, fetching pageSize releases
+// per request.
+func (c *Client) Releases(pageSize int) *ReleaseIterator {
+	return &ReleaseIterator{c: c, pager: newPager(pageSize)}
+}
+
+// Next advances to the next release, fetching another page if necessary. It
+// returns false when there are no more releases or an error occurred.
+func (it *ReleaseIterator) Next() bool {
+	if len(it.page) == 0 && !it.fetch(func(limit, offset int) (int, int, error) {
+		it.page = nil
+		total, err := it.c.listPage("/releases", limit, offset, &it.page)
+		return len(it.page), total, err
+	}) {
+		return false
+	}
+	it.release, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+func (it *ReleaseIterator) Release() *ct.Release { return it.release }
+
+// Total returns the total number of releases, or -1 if no page has been
+// fetched.
+func (it *ReleaseIterator) Total() int { return it.total }
+
+func (it *ReleaseIterator) Err() error { return it.err }
@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/flynn/rpcplus"
+)
+
+// Names of the streams opened by the client, used in StreamEvent and
+// StreamHealth.
+const (
+	StreamNameFormations       = "formations"
+	StreamNameFormationUpdates = "formation_updates"
+	StreamNamePolicies         = "policies"
+)
+
+type StreamEventType string
+
+const (
+	StreamConnected    StreamEventType = "connected"
+	StreamReconnected  StreamEventType = "reconnected"
+	StreamDisconnected StreamEventType = "disconnected"
+)
+
+// StreamEvent describes a change in the state of a stream. Err is set if the
+// stream failed to connect or was closed because of an error, including
+// errors decoding a message.
+type StreamEvent struct {
+	Stream string
+	Type   StreamEventType
+	Err    error
+	Time   time.Time
+}
+
+// StreamHealth tracks the health of the streams of a name opened by a client,
+// so that a component can notice a stream which has stopped delivering
+// messages.
+type StreamHealth struct {
+	Connects    int
+	Disconnects int
+	Errors      int
+	Events      int64
+	LastConnect time.Time
+	LastEvent   time.Time
+	LastError   error
+}
+
+type streamHealthSet struct {
+	mtx   sync.Mutex
+	names map[string]*StreamHealth
+}
+
+// StreamHealth returns the health of the streams of the name opened by the
+// client.
+func (c *Client) StreamHealth(name string) StreamHealth {
+	c.streams.mtx.Lock()
+	defer c.streams.mtx.Unlock()
+	if s, ok := c.streams.names[name]; ok {
+		return *s
+	}
+	return StreamHealth{}
+}
+
+// updateStream applies f to the health of the named stream with the lock
+// held.
+func (c *Client) updateStream(name string, f func(*StreamHealth)) {
+	c.streams.mtx.Lock()
+	defer c.streams.mtx.Unlock()
+	if c.streams.names == nil {
+		c.streams.names = make(map[string]*StreamHealth)
+	}
+	s, ok := c.streams.names[name]
+	if !ok {
+		s = &StreamHealth{}
+		c.streams.names[name] = s
+	}
+	f(s)
+}
+
+func (c *Client) streamEvent(e *StreamEvent) {
+	if c.OnStreamEvent != nil {
+		c.OnStreamEvent(e)
+	}
+}
+
+// streamConnectFailed records a stream which could not be opened.
+func (c *Client) streamConnectFailed(name string, err error) {
+	now := time.Now()
+	c.updateStream(name, func(s *StreamHealth) {
+		s.Errors++
+		s.LastError = err
+	})
+	c.streamEvent(&StreamEvent{Stream: name, Type: StreamDisconnected, Err: err, Time: now})
+}
+
+// observeStream starts an RPC stream into a channel of the type of out and
+// forwards the messages to out, counting them in the health of the stream.
+// out is closed once the stream ends, after which the returned error is set.
+func (c *Client) observeStream(name string, client *rpcplus.Client, method string, args, out interface{}) *error {
+	outV := reflect.ValueOf(out)
+	in := reflect.MakeChan(outV.Type(), 0)
+	call := client.StreamGo(method, args, in.Interface())
+
+	now := time.Now()
+	typ := StreamConnected
+	c.updateStream(name, func(s *StreamHealth) {
+		s.Connects++
+		s.LastConnect = now
+		if s.Connects > 1 {
+			typ = StreamReconnected
+		}
+	})
+	c.streamEvent(&StreamEvent{Stream: name, Type: typ, Time: now})
+
+	go func() {
+		for {
+			v, ok := in.Recv()
+			if !ok {
+				break
+			}
+			now := time.Now()
+			c.updateStream(name, func(s *StreamHealth) {
+				s.Events++
+				s.LastEvent = now
+			})
+			outV.Send(v)
+		}
+		err := call.Error
+		now := time.Now()
+		c.updateStream(name, func(s *StreamHealth) {
+			s.Disconnects++
+			if err != nil {
+				s.Errors++
+				s.LastError = err
+			}
+		})
+		c.streamEvent(&StreamEvent{Stream: name, Type: StreamDisconnected, Err: err, Time: now})
+		outV.Close()
+	}()
+	return &call.Error
+}
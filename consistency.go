@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/martini-contrib/render"
+)
+
+// consistencyCheck is a query returning the IDs of rows that violate an
+// integrity rule. If repair is set it is executed with each ID to fix the row.
+// Repairs repeat the rule of the query, as the row may have been fixed since
+// it was found, and return a row if the row was fixed. IDs made of several
+// UUIDs join them with a colon, and findings report them without dashes like
+// the IDs of the API.
+type consistencyCheck struct {
+	name    string
+	message string
+	query   string
+	repair  string
+}
+
+var consistencyChecks = []consistencyCheck{
+	{
+		name:    "app_release",
+		message: "app references deleted release",
+		query:   "SELECT a.app_id::text FROM apps a JOIN releases r USING (release_id) WHERE a.deleted_at IS NULL AND r.deleted_at IS NOT NULL",
+	},
+	{
+		name:    "release_artifact",
+		message: "release references deleted artifact",
+		query:   "SELECT r.release_id::text FROM releases r JOIN artifacts a USING (artifact_id) WHERE r.deleted_at IS NULL AND a.deleted_at IS NOT NULL",
+	},
+	{
+		name:    "formation_app",
+		message: "formation belongs to deleted app",
+		query:   "SELECT f.app_id || ':' || f.release_id FROM formations f JOIN apps a USING (app_id) WHERE f.deleted_at IS NULL AND a.deleted_at IS NOT NULL",
+		repair: `UPDATE formations f SET deleted_at = now() FROM apps a
+				WHERE f.app_id || ':' || f.release_id = $1 AND a.app_id = f.app_id AND f.deleted_at IS NULL AND a.deleted_at IS NOT NULL
+				RETURNING true`,
+	},
+	{
+		name:    "formation_release",
+		message: "formation references deleted release",
+		query:   "SELECT f.app_id || ':' || f.release_id FROM formations f JOIN releases r USING (release_id) WHERE f.deleted_at IS NULL AND r.deleted_at IS NOT NULL",
+		repair: `UPDATE formations f SET deleted_at = now() FROM releases r
+				WHERE f.app_id || ':' || f.release_id = $1 AND r.release_id = f.release_id AND f.deleted_at IS NULL AND r.deleted_at IS NOT NULL
+				RETURNING true`,
+	},
+	{
+		name:    "resource_provider",
+		message: "resource belongs to deleted provider",
+		query:   "SELECT r.resource_id::text FROM resources r JOIN providers p USING (provider_id) WHERE r.deleted_at IS NULL AND p.deleted_at IS NOT NULL",
+	},
+	{
+		name:    "app_resource",
+		message: "app resource references deleted app or resource",
+		query: `SELECT ar.app_id || ':' || ar.resource_id FROM app_resources ar JOIN apps a USING (app_id) JOIN resources r USING (resource_id)
+				WHERE ar.deleted_at IS NULL AND (a.deleted_at IS NOT NULL OR r.deleted_at IS NOT NULL)`,
+		repair: `UPDATE app_resources ar SET deleted_at = now() FROM apps a, resources r
+				WHERE ar.app_id || ':' || ar.resource_id = $1 AND a.app_id = ar.app_id AND r.resource_id = ar.resource_id
+				AND ar.deleted_at IS NULL AND (a.deleted_at IS NOT NULL OR r.deleted_at IS NOT NULL)
+				RETURNING true`,
+	},
+	{
+		name:    "app_env_group",
+		message: "app references deleted env group",
+		query:   "SELECT ag.app_id || ':' || ag.env_group_id FROM app_env_groups ag JOIN env_groups g USING (env_group_id) WHERE g.deleted_at IS NOT NULL",
+		repair: `DELETE FROM app_env_groups ag USING env_groups g
+				WHERE ag.app_id || ':' || ag.env_group_id = $1 AND g.env_group_id = ag.env_group_id AND g.deleted_at IS NOT NULL
+				RETURNING true`,
+	},
+}
+
+type ConsistencyChecker struct {
+	db *DB
+}
+
+func NewConsistencyChecker(db *DB) *ConsistencyChecker {
+	return &ConsistencyChecker{db}
+}
+
+// Check runs all integrity checks, repairing the rows that can be fixed
+// automatically if repair is true.
+func (c *ConsistencyChecker) Check(repair bool) (*ct.ConsistencyReport, error) {
+	now := time.Now()
+	report := &ct.ConsistencyReport{Findings: []*ct.ConsistencyFinding{}, CheckedAt: &now}
+	for _, check := range consistencyChecks {
+		ids, err := c.queryIDs(check.query)
+		if err != nil {
+			return nil, fmt.Errorf("controller: consistency check %s failed: %s", check.name, err)
+		}
+		for _, id := range ids {
+			finding := &ct.ConsistencyFinding{Check: check.name, ID: cleanUUID(id), Message: check.message}
+			if repair && check.repair != "" {
+				repaired, err := c.repair(check.repair, id)
+				if err != nil {
+					return nil, err
+				}
+				finding.Repaired = repaired
+			}
+			report.Findings = append(report.Findings, finding)
+		}
+	}
+	for _, f := range []func() ([]*ct.ConsistencyFinding, error){c.checkReleaseData, c.checkPolicySources} {
+		findings, err := f()
+		if err != nil {
+			return nil, err
+		}
+		report.Findings = append(report.Findings, findings...)
+	}
+	return report, nil
+}
+
+// repair runs the repair query of a check for the row with the given ID,
+// reporting whether the row still violated the rule and was fixed.
+func (c *ConsistencyChecker) repair(query, id string) (bool, error) {
+	var repaired bool
+	err := c.db.QueryRow(query, id).Scan(&repaired)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return repaired, err
+}
+
+func (c *ConsistencyChecker) queryIDs(query string) ([]string, error) {
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (c *ConsistencyChecker) checkReleaseData() ([]*ct.ConsistencyFinding, error) {
+	rows, err := c.db.Query("SELECT release_id, data, schema_version FROM releases WHERE deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	var findings []*ct.ConsistencyFinding
+	for rows.Next() {
+		var id string
+		var data []byte
+		var version int
+		if err := rows.Scan(&id, &data, &version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var release ct.Release
+		data, err := upgradeReleaseData(version, data)
+		if err == nil {
+			err = json.Unmarshal(data, &release)
+		}
+		if err != nil {
+			findings = append(findings, &ct.ConsistencyFinding{
+				Check:   "release_data",
+				ID:      cleanUUID(id),
+				Message: fmt.Sprintf("release data is malformed: %s", err),
+			})
+		}
+	}
+	return findings, rows.Err()
+}
+
+func (c *ConsistencyChecker) checkPolicySources() ([]*ct.ConsistencyFinding, error) {
+	rows, err := c.db.Query(`SELECT p.app_id, p.ingress FROM network_policies p JOIN apps a USING (app_id)
+							 WHERE p.deleted_at IS NULL AND a.deleted_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	type policy struct {
+		appID   string
+		ingress []byte
+	}
+	var policies []policy
+	for rows.Next() {
+		var p policy
+		if err := rows.Scan(&p.appID, &p.ingress); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var findings []*ct.ConsistencyFinding
+	add := func(appID, format string, v ...interface{}) {
+		findings = append(findings, &ct.ConsistencyFinding{
+			Check:   "policy_source",
+			ID:      cleanUUID(appID),
+			Message: fmt.Sprintf(format, v...),
+		})
+	}
+	for _, p := range policies {
+		var sources []ct.PolicySource
+		if err := json.Unmarshal(p.ingress, &sources); err != nil {
+			add(p.appID, "network policy is malformed: %s", err)
+			continue
+		}
+		for _, src := range sources {
+			if src.App == "" {
+				continue
+			}
+			if !idPattern.MatchString(src.App) {
+				add(p.appID, "network policy source %q is not a valid UUID", src.App)
+				continue
+			}
+			var deleted bool
+			err := c.db.QueryRow("SELECT deleted_at IS NOT NULL FROM apps WHERE app_id = $1", src.App).Scan(&deleted)
+			if err != nil || deleted {
+				add(p.appID, "network policy source %s does not exist", src.App)
+			}
+		}
+	}
+	return findings, nil
+}
+
+// logConsistency runs the consistency checks at startup and logs the findings.
+func logConsistency(c *ConsistencyChecker, repair bool) {
+	report, err := c.Check(repair)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, f := range report.Findings {
+		log.Printf("consistency: %s %s: %s (repaired: %t)", f.Check, f.ID, f.Message, f.Repaired)
+	}
+}
+
+func getConsistency(c *ConsistencyChecker, r render.Render) {
+	respondConsistency(c, false, r)
+}
+
+// repairConsistency runs the consistency checks, repairing the rows which can
+// be fixed automatically.
+func repairConsistency(c *ConsistencyChecker, r render.Render) {
+	respondConsistency(c, true, r)
+}
+
+func respondConsistency(c *ConsistencyChecker, repair bool, r render.Render) {
+	report, err := c.Check(repair)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, report)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestConsistency(c *C) {
+	checker := s.m.Get(reflect.TypeOf((*ConsistencyChecker)(nil))).Interface().(*ConsistencyChecker)
+
+	app := s.createTestApp(c, &ct.App{Name: "consistency"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID})
+	c.Assert(checker.db.Exec("UPDATE apps SET deleted_at = now() WHERE app_id = $1", app.ID), IsNil)
+
+	formationID := app.ID + ":" + release.ID
+	find := func(report *ct.ConsistencyReport) *ct.ConsistencyFinding {
+		for _, f := range report.Findings {
+			if f.Check == "formation_app" && f.ID == formationID {
+				return f
+			}
+		}
+		return nil
+	}
+
+	report := &ct.ConsistencyReport{}
+	_, err := s.Get("/debug/consistency", report)
+	c.Assert(err, IsNil)
+	finding := find(report)
+	c.Assert(finding, NotNil)
+	c.Assert(finding.Repaired, Equals, false)
+
+	// repairs are only made by POST requests
+	_, err = s.Get("/debug/consistency?repair=true", report)
+	c.Assert(err, IsNil)
+	c.Assert(find(report).Repaired, Equals, false)
+	_, err = s.Post("/debug/consistency/repair", nil, report)
+	c.Assert(err, IsNil)
+	finding = find(report)
+	c.Assert(finding, NotNil)
+	c.Assert(finding.Repaired, Equals, true)
+
+	_, err = s.Get("/debug/consistency", report)
+	c.Assert(err, IsNil)
+	c.Assert(find(report), IsNil)
+
+	// rows fixed between the check and the repair are left alone
+	c.Assert(checker.db.Exec("UPDATE apps SET deleted_at = NULL WHERE app_id = $1", app.ID), IsNil)
+	release2 := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release2.ID})
+	c.Assert(checker.db.Exec("UPDATE apps SET deleted_at = now() WHERE app_id = $1", app.ID), IsNil)
+	var check consistencyCheck
+	for _, cc := range consistencyChecks {
+		if cc.name == "formation_app" {
+			check = cc
+		}
+	}
+	ids, err := checker.queryIDs(check.query)
+	c.Assert(err, IsNil)
+	var id string
+	for _, i := range ids {
+		if cleanUUID(i) == app.ID+":"+release2.ID {
+			id = i
+		}
+	}
+	c.Assert(id, Not(Equals), "")
+	c.Assert(checker.db.Exec("UPDATE apps SET deleted_at = NULL WHERE app_id = $1", app.ID), IsNil)
+	repaired, err := checker.repair(check.repair, id)
+	c.Assert(err, IsNil)
+	c.Assert(repaired, Equals, false)
+	_, err = s.Get("/apps/"+app.ID+"/formations/"+release2.ID, &ct.Formation{})
+	c.Assert(err, IsNil)
+}
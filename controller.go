@@ -4,11 +4,15 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/go-discoverd"
@@ -25,6 +29,11 @@ import (
 )
 
 func main() {
+	simHosts := flag.Int("fake-cluster", 0, "back the cluster client with `N` simulated hosts for load testing")
+	simChurnRate := flag.Float64("fake-cluster-churn", 0, "fraction of simulated jobs replaced each churn interval")
+	simChurnInterval := flag.Duration("fake-cluster-churn-interval", defaultSimChurnInterval, "interval between simulated job churn")
+	flag.Parse()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
@@ -40,8 +49,11 @@ func main() {
 		log.Fatal(err)
 	}
 
-	cc, err := cluster.NewClient()
-	if err != nil {
+	var cc clusterClient
+	if *simHosts > 0 {
+		log.Printf("using a simulated cluster of %d hosts", *simHosts)
+		cc = newSimCluster(*simHosts, *simChurnRate, *simChurnInterval)
+	} else if cc, err = cluster.NewClient(); err != nil {
 		log.Fatal(err)
 	}
 
@@ -54,7 +66,69 @@ func main() {
 		log.Fatal(err)
 	}
 
-	handler, _ := appHandler(handlerConfig{db: db, cc: cc, sc: sc, dc: discoverd.DefaultClient, key: os.Getenv("AUTH_KEY")})
+	controllers, err := discoverd.NewServiceSet("flynn-controller")
+	if err != nil {
+		log.Fatal(err)
+	}
+	isLeader := func() bool {
+		leader := controllers.Leader()
+		return leader != nil && leader.Addr == controllers.SelfAddr()
+	}
+
+	var authz Authorizer
+	if name := os.Getenv("AUTHZ_POLICY"); name != "" {
+		if authz, err = LoadPolicyAuthorizer(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var shadowRepos map[string]Repository
+	if resources := splitList(os.Getenv("SHADOW_READS")); len(resources) > 0 {
+		shadowDB, err := postgres.Open("", os.Getenv("SHADOW_READ_DSN"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if shadowRepos, err = newShadowRepos(NewDB(shadowDB), sc, resources); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var admissionHooks []AdmissionHook
+	if name := os.Getenv("ADMISSION_HOOKS"); name != "" {
+		if admissionHooks, err = LoadAdmissionHooks(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	subjectKeys, err := subjectKeysFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler, _ := appHandler(handlerConfig{
+		db:               db,
+		cc:               cc,
+		sc:               sc,
+		dc:               discoverd.DefaultClient,
+		key:              os.Getenv("AUTH_KEY"),
+		subjectKeys:      subjectKeys,
+		isLeader:         isLeader,
+		checkConsistency: true,
+		authz:            authz,
+		admissionHooks:   admissionHooks,
+		shadowRepos:      shadowRepos,
+		sse:              sseConfigFromEnv(),
+		breaker:          breakerConfigFromEnv(),
+		appRetention:     appRetentionFromEnv(),
+		releaseRetention: releaseRetentionFromEnv(),
+		formationRate:    formationRateLimitFromEnv(),
+		reservedAppNames: reservedAppNamesFromEnv(),
+		artifactResolver: artifactResolverFromEnv(),
+		certProvider:     certProviderFromEnv(),
+		imageAllowlist:   imageAllowlistFromEnv(),
+		deploymentLimits: deploymentLimitsFromEnv(),
+		verifyHosts:      artifactVerifyHostsFromEnv(),
+	})
 	log.Fatal(http.ListenAndServe(addr, handler))
 }
 
@@ -70,6 +144,77 @@ type handlerConfig struct {
 	sc  strowgerc.Client
 	dc  *discoverd.Client
 	key string
+
+	// subjectKeys are the auth keys of clients which are not admins, keyed
+	// to their subjects.
+	subjectKeys map[string]string
+
+	// isLeader reports whether this controller runs background tasks, if
+	// nil the controller is assumed to be the only instance.
+	isLeader func() bool
+
+	// checkConsistency runs the consistency checker on startup.
+	checkConsistency bool
+
+	// authz makes authorization decisions for API requests, if nil all
+	// requests with a valid key are allowed.
+	authz Authorizer
+
+	// admissionHooks are sent releases, formations and routes before they
+	// are persisted.
+	admissionHooks []AdmissionHook
+
+	// shadowRepos are read in the background for get and list requests of
+	// their resource and compared with the primary repositories.
+	shadowRepos map[string]Repository
+
+	// sse configures buffering of job log event streams, if zero the
+	// defaults are used.
+	sse SSEConfig
+
+	// breaker configures the timeouts and circuit breakers of cluster, host
+	// and router calls, if zero the defaults are used.
+	breaker BreakerConfig
+
+	// appRetention is how long deleted apps are kept before being purged,
+	// if zero the default is used.
+	appRetention time.Duration
+
+	// releaseRetention is how long unused releases are kept before being
+	// removed, if zero the default is used.
+	releaseRetention time.Duration
+
+	// formationRate limits how often the formations of an app may change,
+	// if zero the default is used.
+	formationRate FormationRateLimit
+
+	// reservedAppNames may not be used by apps, if nil the default system
+	// component names are reserved.
+	reservedAppNames []string
+
+	// onlineMigrations are the online migrations which can be run, if nil
+	// the default migrations are used.
+	onlineMigrations []*onlineMigration
+
+	// artifactResolver looks up the digests of artifacts created without
+	// one, if nil they are left unset.
+	artifactResolver ArtifactResolver
+
+	// certProvider issues the certificates of routes with managed TLS, if
+	// nil routes cannot enable managed TLS.
+	certProvider CertificateProvider
+
+	// imageAllowlist restricts the images artifacts and releases may use,
+	// if nil every image is allowed.
+	imageAllowlist *ImageAllowlist
+
+	// deploymentLimits caps how many deployments run at once, if zero
+	// deployments are not limited.
+	deploymentLimits DeploymentLimits
+
+	// verifyHosts are the hosts artifacts may be verified on, if empty
+	// artifacts are not verified.
+	verifyHosts []string
 }
 
 func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
@@ -78,72 +223,270 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	m.Use(martini.Logger())
 	m.Use(martini.Recovery())
 	m.Use(render.Renderer())
+	m.Use(utcRenderer)
 	m.Action(r.Handle)
 
+	if c.breaker == (BreakerConfig{}) {
+		c.breaker = defaultBreakerConfig
+	}
+	sim, _ := c.cc.(*simCluster)
+	if c.cc != nil {
+		c.cc = newBreakerCluster(c.cc, c.breaker)
+	}
+	if c.sc != nil {
+		c.sc = newBreakerRouter(c.sc, c.breaker)
+	}
+
 	d := NewDB(c.db)
 
 	providerRepo := NewProviderRepo(d)
 	keyRepo := NewKeyRepo(d)
 	resourceRepo := NewResourceRepo(d)
 	appRepo := NewAppRepo(d, os.Getenv("DEFAULT_ROUTE_DOMAIN"), c.sc)
-	artifactRepo := NewArtifactRepo(d)
+	if c.reservedAppNames == nil {
+		c.reservedAppNames = defaultReservedAppNames
+	}
+	appRepo.SetReservedNames(c.reservedAppNames)
+	admitter := NewAdmitter(c.admissionHooks)
+	appRepo.SetAdmitter(admitter)
+	artifactRepo := NewArtifactRepo(d, c.artifactResolver)
+	artifactRepo.SetImageAllowlist(c.imageAllowlist)
 	releaseRepo := NewReleaseRepo(d)
-	formationRepo := NewFormationRepo(d, appRepo, releaseRepo, artifactRepo)
+	releaseRepo.SetImageAllowlist(c.imageAllowlist)
+	registryConfigRepo := NewRegistryConfigRepo(d)
+	formationRepo := NewFormationRepo(d, appRepo, releaseRepo, artifactRepo, registryConfigRepo)
+	formationRepo.SetAdmitter(admitter)
+	publishStreamStats(formationRepo)
+	certTTL, _ := time.ParseDuration(os.Getenv("JOB_CERT_TTL"))
+	caRepo := NewCARepo(d, certTTL)
+	policyRepo := NewPolicyRepo(d, appRepo)
+	adoptedJobRepo := NewAdoptedJobRepo(d)
+	envGroupRepo := NewEnvGroupRepo(d)
+	taskRepo := NewTaskRepo(d)
+	taskRunner := NewTaskRunner(taskRepo, c.isLeader)
+	deploymentRepo := NewDeploymentRepo(d, c.deploymentLimits)
+	deploymentQueue := NewDeploymentQueue(deploymentRepo, taskRunner)
+	taskRunner.RegisterPeriodic(deploymentQueueTask, deploymentQueueInterval, deploymentQueue.Run)
+	taskRunner.RegisterConcurrent(deploymentTask, NewDeployer(deploymentRepo, releaseRepo, formationRepo, c.cc, deploymentQueue).Run)
+	if c.onlineMigrations == nil {
+		c.onlineMigrations = defaultOnlineMigrations
+	}
+	onlineMigrator := NewOnlineMigrator(d, c.onlineMigrations)
+	taskRunner.Register(onlineMigrationBackfillTask, onlineMigrator.Backfill)
+	consistencyChecker := NewConsistencyChecker(d)
+	readOnlyRepo := NewReadOnlyRepo(d)
+	appLockRepo := NewAppLockRepo(d)
+	if c.appRetention == 0 {
+		c.appRetention = defaultAppRetention
+	}
+	appGC := NewAppGC(d, c.appRetention)
+	taskRunner.RegisterPeriodic(appGCTask, appGCInterval, appGC.Run)
+	if c.releaseRetention == 0 {
+		c.releaseRetention = defaultReleaseRetention
+	}
+	releaseGC := NewReleaseGC(d, c.releaseRetention)
+	taskRunner.RegisterPeriodic(releaseGCTask, appGCInterval, releaseGC.Run)
+	if c.formationRate == (FormationRateLimit{}) {
+		c.formationRate = defaultFormationRateLimit
+	}
 	m.Map(resourceRepo)
+	m.Map(NewResourceStatusCache(resourceStatusTTL))
 	m.Map(appRepo)
 	m.Map(artifactRepo)
+	m.Map(NewArtifactVerifier(defaultArtifactVerifyTimeout, c.imageAllowlist, c.verifyHosts))
 	m.Map(releaseRepo)
 	m.Map(formationRepo)
+	m.Map(registryConfigRepo)
+	m.Map(caRepo)
+	m.Map(policyRepo)
+	m.Map(adoptedJobRepo)
+	m.Map(NewJobReservationRepo(d))
+	m.Map(envGroupRepo)
+	m.Map(NewEnvGroupApplier(envGroupRepo, appRepo, releaseRepo, formationRepo, appLockRepo, deploymentRepo, admitter))
+	m.Map(taskRunner)
+	m.Map(deploymentRepo)
+	m.Map(deploymentQueue)
+	m.Map(onlineMigrator)
+	m.Map(consistencyChecker)
+	m.Map(readOnlyRepo)
+	m.Map(appLockRepo)
+	m.Map(appGC)
+	m.Map(releaseGC)
+	m.Map(NewAppEventRepo(d))
+	if c.sse == (SSEConfig{}) {
+		c.sse = defaultSSEConfig
+	}
+	jobLogRepo := NewJobLogRepo(d, c.sse.MaxLogSize)
+	m.Map(jobLogRepo)
+	jobIndex := NewJobIndex(d, c.cc, jobLogRepo)
+	taskRunner.RegisterPeriodic(jobIndexTask, jobIndexInterval, jobIndex.Run)
+	taskRunner.OnStepDown(jobIndex.unfollowAll)
+	m.Map(jobIndex)
+	routeIndex := NewRouteIndex(d, c.sc)
+	m.Map(routeIndex)
+	routeCerts := NewRouteCertManager(d, c.sc, routeIndex, c.certProvider, taskRunner)
+	m.Map(routeCerts)
+	if c.sc != nil {
+		taskRunner.RegisterPeriodic(routeIndexTask, routeIndexInterval, routeIndex.Run)
+		taskRunner.RegisterPeriodic(routeCertTask, routeCertInterval, routeCerts.Run)
+	}
+	m.Map(NewFormationThrottle(d, c.formationRate))
+	m.Map(admitter)
+	shadowReader := NewShadowReader(c.shadowRepos)
+	publishShadowStats(shadowReader)
+	m.Map(shadowReader)
+	m.Map(c.sse)
 	m.Map(c.dc)
 	m.MapTo(c.cc, (*clusterClient)(nil))
 	m.MapTo(c.sc, (*strowgerc.Client)(nil))
 	m.MapTo(c.dc, (*resource.DiscoverdClient)(nil))
 
-	getAppMiddleware := crud("apps", ct.App{}, appRepo, r)
+	// registered before crud, which matches POST /apps/:apps_id, so apps
+	// may not use these names, see appRouteNames
+	r.Post("/apps/bulk", createBulkApps)
+	r.Post("/apps/import", binding.Bind(ct.AppExport{}), importApp)
+	getAppMiddleware := crud("apps", ct.App{}, appRepo, r, checkAppLock)
 	getReleaseMiddleware := crud("releases", ct.Release{}, releaseRepo, r)
 	getProviderMiddleware := crud("providers", ct.Provider{}, providerRepo, r)
 	crud("artifacts", ct.Artifact{}, artifactRepo, r)
+	r.Delete("/artifacts/:artifacts_id", deleteArtifact)
+	r.Post("/artifacts/:artifacts_id/verify", verifyArtifact)
 	crud("keys", ct.Key{}, keyRepo, r)
+	crud("tasks", ct.Task{}, taskRepo, r)
+
+	r.Post("/releases/get", binding.Bind(ct.BatchGetReq{}), getReleases)
+	r.Post("/artifacts/get", binding.Bind(ct.BatchGetReq{}), getArtifacts)
+
+	r.Put("/releases/:releases_id", getReleaseMiddleware, rejectReleaseMutation)
+	r.Post("/releases/:releases_id", getReleaseMiddleware, rejectReleaseMutation)
+	r.Delete("/releases/:releases_id", getReleaseMiddleware, deleteRelease)
+	r.Post("/releases/:releases_id/clone", getReleaseMiddleware, binding.Bind(ct.CloneReleaseReq{}), cloneRelease)
+
+	r.Delete("/apps/:apps_id", getAppMiddleware, checkAppLock, deleteApp)
+	r.Post("/apps/:apps_id/restore", restoreApp)
 
-	r.Put("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getReleaseMiddleware, binding.Bind(ct.Formation{}), putFormation)
+	r.Post("/apps/:apps_id/lock", getAppMiddleware, binding.Bind(ct.AppLock{}), acquireAppLock)
+	r.Get("/apps/:apps_id/lock", getAppMiddleware, getAppLock)
+	r.Delete("/apps/:apps_id/lock", getAppMiddleware, breakAppLock)
+	r.Put("/apps/:apps_id/lock/:lock_id", getAppMiddleware, renewAppLock)
+	r.Delete("/apps/:apps_id/lock/:lock_id", getAppMiddleware, releaseAppLock)
+
+	r.Put("/apps/:apps_id/formations/:releases_id", getAppMiddleware, checkAppLock, checkFormationRate, getAppReleaseMiddleware, binding.Bind(ct.Formation{}), putFormation)
 	r.Get("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, getFormation)
-	r.Delete("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, deleteFormation)
+	r.Delete("/apps/:apps_id/formations/:releases_id", getAppMiddleware, checkAppLock, checkAppProtected, checkFormationRate, getFormationMiddleware, deleteFormation)
 	r.Get("/apps/:apps_id/formations", getAppMiddleware, listFormations)
+	r.Get("/formations", formationSnapshot)
 
-	r.Post("/apps/:apps_id/jobs", getAppMiddleware, binding.Bind(ct.NewJob{}), runJob)
+	r.Post("/apps/:apps_id/jobs", getAppMiddleware, checkAppLock, checkAppMaintenance, binding.Bind(ct.NewJob{}), runJob)
 	r.Get("/apps/:apps_id/jobs", getAppMiddleware, jobList)
-	r.Delete("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, connectHostMiddleware, killJob)
-	r.Get("/apps/:apps_id/jobs/:jobs_id/log", getAppMiddleware, connectHostMiddleware, jobLog)
-
-	r.Put("/apps/:apps_id/release", getAppMiddleware, binding.Bind(releaseID{}), setAppRelease)
+	r.Post("/apps/:apps_id/restart", getAppMiddleware, checkAppLock, checkAppMaintenance, restartApp)
+	r.Delete("/apps/:apps_id/jobs", getAppMiddleware, checkAppLock, checkAppProtected, stopJobs)
+	r.Post("/apps/:apps_id/jobs/adopt", getAppMiddleware, checkAppLock, binding.Bind(ct.AdoptJobReq{}), adoptJob)
+	r.Post("/apps/:apps_id/jobs/reservations", getAppMiddleware, checkAppLock, binding.Bind(ct.JobReservation{}), reserveJob)
+	r.Delete("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, checkAppLock, checkAppProtected, connectHostMiddleware, killJob)
+	r.Get("/apps/:apps_id/jobs/:jobs_id/log", getAppMiddleware, storedAppJobLog, connectHostMiddleware, jobLog)
+	r.Get("/apps/:apps_id/jobs/:jobs_id/env-diff", getAppMiddleware, connectHostMiddleware, jobEnvDiff)
+	r.Get("/jobs", multiAppJobList)
+	r.Get("/jobs/:jobs_id/log", auditJobLog, storedJobLog, connectHostMiddleware, jobLog)
+
+	r.Put("/apps/:apps_id/release", getAppMiddleware, checkAppLock, checkAppMaintenance, binding.Bind(releaseID{}), setAppRelease)
+	r.Post("/apps/:apps_id/releases", getAppMiddleware, checkAppLock, checkAppMaintenance, binding.Bind(ct.AppReleaseReq{}), createAppRelease)
+	r.Get("/apps/:apps_id/releases/:releases_id/tags", getAppMiddleware, getAppReleaseMiddleware, getReleaseTags)
+	r.Put("/apps/:apps_id/releases/:releases_id/tags", getAppMiddleware, checkAppLock, getAppReleaseMiddleware, setReleaseTags)
+	r.Post("/apps/:apps_id/deploy", getAppMiddleware, checkAppLock, checkAppMaintenance, binding.Bind(ct.DeployReq{}), createDeployment)
+	r.Get("/apps/:apps_id/deployments", getAppMiddleware, listDeployments)
+	r.Get("/apps/:apps_id/deployments/:deployment_id", getAppMiddleware, getDeployment)
+	r.Get("/apps/:apps_id/deployments/:deployment_id/events", getAppMiddleware, streamDeploymentEvents)
+	r.Get("/apps/:apps_id/env", getAppMiddleware, getAppEnv)
+	r.Get("/apps/:apps_id/at", getAppMiddleware, getAppAt)
+	r.Get("/apps/:apps_id/events", getAppMiddleware, streamAppEvents)
+	r.Get("/apps/:apps_id/export", getAppMiddleware, exportApp)
+	r.Get("/apps/:apps_id/status", getAppMiddleware, getAppStatus)
+	r.Get("/apps/:apps_id/stats", getAppMiddleware, getAppStats)
+	r.Put("/apps/:apps_id/env", getAppMiddleware, checkAppLock, setAppEnv)
 	r.Get("/apps/:apps_id/release", getAppMiddleware, getAppRelease)
 
+	r.Post("/providers", binding.Bind(ct.Provider{}), createProvider)
 	r.Post("/providers/:providers_id/resources", getProviderMiddleware, binding.Bind(ct.ResourceReq{}), resourceServerMiddleware, provisionResource)
 	r.Get("/providers/:providers_id/resources", getProviderMiddleware, getProviderResources)
 	r.Get("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, getResourceMiddleware, getResource)
 	r.Put("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, binding.Bind(ct.Resource{}), putResource)
+	r.Get("/providers/:providers_id/resources/:resources_id/status", getProviderMiddleware, getResourceMiddleware, getResourceStatus)
 	r.Get("/apps/:apps_id/resources", getAppMiddleware, getAppResources)
 
-	r.Post("/apps/:apps_id/routes", getAppMiddleware, binding.Bind(strowger.Route{}), createRoute)
+	r.Get("/apps/:apps_id/policies", getAppMiddleware, getPolicy)
+	r.Put("/apps/:apps_id/policies", getAppMiddleware, checkAppLock, binding.Bind(ct.NetworkPolicy{}), putPolicy)
+	r.Delete("/apps/:apps_id/policies", getAppMiddleware, checkAppLock, deletePolicy)
+	r.Get("/policies", getPolicySet)
+
+	r.Post("/env-groups", binding.Bind(ct.EnvGroup{}), createEnvGroup)
+	r.Get("/env-groups", listEnvGroups)
+	r.Get("/env-groups/:group_id", getEnvGroupMiddleware, getEnvGroup)
+	r.Put("/env-groups/:group_id", getEnvGroupMiddleware, binding.Bind(ct.EnvGroup{}), updateEnvGroup)
+	r.Get("/apps/:apps_id/env-groups", getAppMiddleware, getAppEnvGroups)
+	r.Put("/apps/:apps_id/env-groups/:group_id", getAppMiddleware, checkAppLock, checkAppMaintenance, checkAppProtected, getEnvGroupMiddleware, addAppEnvGroup)
+	r.Delete("/apps/:apps_id/env-groups/:group_id", getAppMiddleware, checkAppLock, checkAppMaintenance, checkAppProtected, getEnvGroupMiddleware, removeAppEnvGroup)
+
+	r.Get("/cluster/registry-config", getClusterRegistryConfig)
+	r.Put("/cluster/registry-config", binding.Bind(ct.RegistryConfig{}), putClusterRegistryConfig)
+	r.Delete("/cluster/registry-config", deleteClusterRegistryConfig)
+	r.Get("/apps/:apps_id/registry-config", getAppMiddleware, getAppRegistryConfig)
+	r.Put("/apps/:apps_id/registry-config", getAppMiddleware, checkAppLock, binding.Bind(ct.RegistryConfig{}), putAppRegistryConfig)
+	r.Delete("/apps/:apps_id/registry-config", getAppMiddleware, checkAppLock, deleteAppRegistryConfig)
+
+	r.Get("/debug/consistency", getConsistency)
+	r.Post("/debug/consistency/repair", repairConsistency)
+	r.Get("/gc/apps", previewAppGC)
+	r.Get("/online-migrations", listOnlineMigrations)
+	r.Get("/online-migrations/:migration_name", getOnlineMigration)
+	r.Post("/online-migrations/:migration_name/:step", updateOnlineMigration)
+	r.Get("/debug/streams", getStreamStats)
+	if sim != nil {
+		m.Map(sim)
+		r.Get("/debug/sim-cluster", getSimCluster)
+		r.Put("/debug/sim-cluster", binding.Bind(ct.SimClusterConfig{}), setSimCluster)
+	}
+	r.Get("/debug/vars", expvar.Handler().ServeHTTP)
+
+	r.Get(readOnlyPath, getReadOnly)
+	r.Put(readOnlyPath, binding.Bind(ct.ReadOnlyMode{}), setReadOnly)
+
+	r.Get("/ca", getCACert)
+	r.Post("/ca/certificates", binding.Bind(ct.CertificateReq{}), issueCertificate)
+
+	r.Post("/apps/:apps_id/routes", getAppMiddleware, checkAppLock, binding.Bind(strowger.Route{}), createRoute)
 	r.Get("/apps/:apps_id/routes", getAppMiddleware, getRouteList)
 	r.Get("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, getRoute)
-	r.Delete("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, deleteRoute)
+	r.Delete("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, checkAppLock, checkAppProtected, getRouteMiddleware, deleteRoute)
 
-	return rpcMuxHandler(m, rpcHandler(formationRepo), c.key), m
+	taskRunner.Start()
+	if c.checkConsistency {
+		go logConsistency(consistencyChecker, os.Getenv("CONSISTENCY_REPAIR") == "true")
+	}
+
+	return rpcMuxHandler(authzHandler(readOnlyHandler(m, readOnlyRepo), c.authz, appRepo), rpcHandler(formationRepo, policyRepo), c.key, c.subjectKeys), m
 }
 
-func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Handler {
+func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string, subjectKeys map[string]string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/ping" {
 			w.WriteHeader(200)
 			return
 		}
 		_, password, _ := parseBasicAuth(r.Header)
-		if len(password) != len(authKey) || subtle.ConstantTimeCompare([]byte(password), []byte(authKey)) != 1 {
+		subject := authSubject(password, authKey, subjectKeys)
+		if subject == "" {
 			w.WriteHeader(401)
 			return
 		}
+		r.Header.Set(authSubjectHeader, subject)
 		if r.URL.Path == rpcplus.DefaultRPCPath {
+			// the formation and policy streams are only for cluster
+			// components
+			if subject != SubjectAdmin {
+				w.WriteHeader(403)
+				return
+			}
 			rpch.ServeHTTP(w, r)
 		} else {
 			main.ServeHTTP(w, r)
@@ -151,19 +494,54 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 	})
 }
 
-func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, r render.Render) {
+// authSubject returns the subject authenticated by password, or an empty
+// string if it is not a valid key.
+func authSubject(password, authKey string, subjectKeys map[string]string) string {
+	if constantTimeEqual(password, authKey) {
+		return SubjectAdmin
+	}
+	var subject string
+	for key, s := range subjectKeys {
+		if constantTimeEqual(password, key) {
+			subject = s
+		}
+	}
+	return subject
+}
+
+func constantTimeEqual(a, b string) bool {
+	return len(a) == len(b) && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, admitter *Admitter, req *http.Request, r render.Render) {
 	formation.AppID = app.ID
 	formation.ReleaseID = release.ID
-	err := repo.Add(&formation)
-	if app.Protected {
+	if err := admitter.Admit("formations", "update", &formation); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	formation.AppID = app.ID
+	formation.ReleaseID = release.ID
+	if err := validateSpread(&formation, release); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if app.Maintenance {
+		if err := checkMaintenanceScale(repo, &formation); err != nil {
+			respondWithError(r, err)
+			return
+		}
+	}
+	// protected apps may not scale any process type to zero
+	if app.Protected && !protectedOverride(req) {
 		for typ := range release.Processes {
 			if formation.Processes[typ] == 0 {
-				r.JSON(400, struct{}{})
+				respondWithError(r, ErrAppProtected)
 				return
 			}
 		}
 	}
-	if err != nil {
+	if err := repo.Add(&formation); err != nil {
 		log.Println(err)
 		r.JSON(500, struct{}{})
 		return
@@ -171,8 +549,43 @@ func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo
 	r.JSON(200, &formation)
 }
 
-func getFormationMiddleware(c martini.Context, app *ct.App, params martini.Params, repo *FormationRepo, w http.ResponseWriter) {
-	formation, err := repo.Get(app.ID, params["releases_id"])
+// validateSpread checks that the spread hints of a formation are for process
+// types of the release.
+func validateSpread(formation *ct.Formation, release *ct.Release) error {
+	for typ, spread := range formation.Spread {
+		if _, ok := release.Processes[typ]; !ok {
+			return ct.ValidationError{Field: "spread", Message: fmt.Sprintf("%q is not a process type of the release", typ)}
+		}
+		if spread.MaxPerHost < 0 {
+			return ct.ValidationError{Field: "spread", Message: fmt.Sprintf("max_per_host of %q must not be negative", typ)}
+		}
+	}
+	return nil
+}
+
+// checkMaintenanceScale returns ErrAppMaintenance if the formation increases
+// the number of processes of any type.
+func checkMaintenanceScale(repo *FormationRepo, formation *ct.Formation) error {
+	current, err := repo.Get(formation.AppID, formation.ReleaseID)
+	if err == ErrNotFound {
+		current = &ct.Formation{}
+	} else if err != nil {
+		return err
+	}
+	for typ, n := range formation.Processes {
+		if n > current.Processes[typ] {
+			return ErrAppMaintenance
+		}
+	}
+	return nil
+}
+
+func getFormationMiddleware(c martini.Context, app *ct.App, params martini.Params, repo *FormationRepo, releases *ReleaseRepo, w http.ResponseWriter) {
+	var formation *ct.Formation
+	releaseID, err := releases.ResolveID(app.ID, params["releases_id"])
+	if err == nil {
+		formation, err = repo.Get(app.ID, releaseID)
+	}
 	if err != nil {
 		if err == ErrNotFound {
 			w.WriteHeader(404)
@@ -185,7 +598,16 @@ func getFormationMiddleware(c martini.Context, app *ct.App, params martini.Param
 	c.Map(formation)
 }
 
-func getFormation(formation *ct.Formation, r render.Render) {
+func getFormation(formation *ct.Formation, req *http.Request, repo *FormationRepo, r render.Render) {
+	if req.URL.Query().Get("expand") == "true" {
+		f, err := repo.expandFormation(formation)
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		r.JSON(200, f)
+		return
+	}
 	r.JSON(200, formation)
 }
 
@@ -202,54 +624,100 @@ func deleteFormation(formation *ct.Formation, repo *FormationRepo, w http.Respon
 func listFormations(app *ct.App, repo *FormationRepo, r render.Render) {
 	list, err := repo.List(app.ID)
 	if err != nil {
-		log.Println(err)
-		r.JSON(500, struct{}{})
+		respondWithError(r, err)
 		return
 	}
 	r.JSON(200, list)
 }
 
-type releaseID struct {
-	ID string `json:"id"`
-}
-
-func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, r render.Render) {
-	rel, err := releases.Get(rid.ID)
+// formationSnapshot responds with a page of the expanded formations of the
+// cluster. The first page fixes the time of the snapshot, which is carried in
+// the page token of the following pages.
+func formationSnapshot(repo *FormationRepo, req *http.Request, r render.Render) {
+	q := req.URL.Query()
+	if q.Get("expanded") != "true" {
+		r.JSON(400, ct.ValidationError{Field: "expanded", Message: "must be true"})
+		return
+	}
+	limit, _, err := pageParams(q)
 	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	snapshot := &ct.FormationSnapshot{}
+	var after *formationKey
+	if page := q.Get("page"); page != "" {
+		parts := strings.Split(page, ":")
+		var nsec int64
+		if len(parts) == 3 {
+			nsec, err = strconv.ParseInt(parts[0], 10, 64)
+		}
+		if len(parts) != 3 || err != nil || !idPattern.MatchString(parts[1]) || !idPattern.MatchString(parts[2]) {
+			r.JSON(400, ct.ValidationError{Field: "page", Message: "is invalid"})
+			return
+		}
+		snapshot.Since = time.Unix(0, nsec)
+		after = &formationKey{parts[1], parts[2]}
+	} else if snapshot.Since, err = repo.SnapshotTime(); err != nil {
 		log.Println(err)
 		r.JSON(500, struct{}{})
 		return
 	}
-	release := rel.(*ct.Release)
-	apps.SetRelease(app.ID, release.ID)
-
-	// TODO: use transaction/lock
-	fs, err := formations.List(app.ID)
+	list, more, err := repo.Snapshot(snapshot.Since, after, limit)
 	if err != nil {
 		log.Println(err)
 		r.JSON(500, struct{}{})
 		return
 	}
-	if len(fs) == 1 && fs[0].ReleaseID != release.ID {
-		if err := formations.Add(&ct.Formation{
-			AppID:     app.ID,
-			ReleaseID: release.ID,
-			Processes: fs[0].Processes,
-		}); err != nil {
-			log.Println(err)
-			r.JSON(500, struct{}{})
+	snapshot.Formations = list
+	if snapshot.Formations == nil {
+		snapshot.Formations = []*ct.ExpandedFormation{}
+	}
+	if more {
+		last := list[len(list)-1]
+		snapshot.NextPage = fmt.Sprintf("%d:%s:%s", snapshot.Since.UnixNano(), last.App.ID, last.Release.ID)
+	}
+	r.JSON(200, snapshot)
+}
+
+type releaseID struct {
+	ID string `json:"id"`
+}
+
+func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, req *http.Request, r render.Render) {
+	// the first release of a protected app may be set without an override
+	if app.Protected && !protectedOverride(req) {
+		if _, err := apps.GetRelease(app.ID); err == nil {
+			respondWithError(r, ErrAppProtected)
 			return
-		}
-		if err := formations.Remove(app.ID, fs[0].ReleaseID); err != nil {
-			log.Println(err)
-			r.JSON(500, struct{}{})
+		} else if err != ErrNotFound {
+			respondWithError(r, err)
 			return
 		}
 	}
-
+	release, err := releases.GetForApp(app.ID, rid.ID)
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	if err := releases.CheckRunnable(release); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := deployRelease(app.ID, release, formations); err != nil {
+		respondWithError(r, err)
+		return
+	}
 	r.JSON(200, release)
 }
 
+// deployRelease sets the current release of an app and moves the formation
+// of the previous release over to it.
+func deployRelease(appID string, release *ct.Release, formations *FormationRepo) error {
+	return formations.Deploy(appID, release.ID)
+}
+
 func getAppRelease(app *ct.App, apps *AppRepo, r render.Render, w http.ResponseWriter) {
 	release, err := apps.GetRelease(app.ID)
 	if err != nil {
@@ -288,11 +756,10 @@ func putResource(p *ct.Provider, params martini.Params, resource ct.Resource, re
 }
 
 func provisionResource(rs *resource.Server, p *ct.Provider, req ct.ResourceReq, repo *ResourceRepo, r render.Render) {
-	var config []byte
-	if req.Config != nil {
-		config = *req.Config
-	} else {
-		config = []byte(`{}`)
+	config, err := planConfig(p, &req)
+	if err != nil {
+		respondWithError(r, err)
+		return
 	}
 	data, err := rs.Provision(config)
 	if err != nil {
@@ -304,6 +771,7 @@ func provisionResource(rs *resource.Server, p *ct.Provider, req ct.ResourceReq,
 	res := &ct.Resource{
 		ProviderID: p.ID,
 		ExternalID: data.ID,
+		Plan:       req.Plan,
 		Env:        data.Env,
 		Apps:       req.Apps,
 	}
@@ -354,6 +822,68 @@ func getAppResources(app *ct.App, repo *ResourceRepo, r render.Render) {
 	r.JSON(200, res)
 }
 
+func respondWithError(r render.Render, err error) {
+	switch e := err.(type) {
+	case ct.ValidationError:
+		r.JSON(400, err)
+	case AdmissionDeniedError:
+		r.JSON(403, struct {
+			Message string `json:"message"`
+		}{e.Reason})
+	case ImageNotAllowedError:
+		r.JSON(403, struct {
+			Message string `json:"message"`
+		}{fmt.Sprintf("%s is not in the image allowlist", e.URI)})
+	default:
+		switch err {
+		case ErrNotFound:
+			r.JSON(404, struct{}{})
+			return
+		case ErrAppMaintenance:
+			r.JSON(409, ct.ValidationError{Field: "app", Message: "is in maintenance mode"})
+			return
+		case ErrAppProtected:
+			r.JSON(400, ct.ValidationError{Field: "app", Message: "is protected"})
+			return
+		case ErrAppLocked:
+			r.JSON(409, ct.ValidationError{Field: "app", Message: "is locked"})
+			return
+		case ErrPreconditionFailed:
+			r.JSON(412, ct.ValidationError{Field: "If-Match", Message: "does not match the current ETag"})
+			return
+		case ErrDeploymentInProgress:
+			r.JSON(409, ct.ValidationError{Field: "app", Message: "has a deployment in progress"})
+			return
+		case ErrOnlineMigrationState:
+			r.JSON(409, ct.ValidationError{Field: "state", Message: "does not allow this online migration step"})
+			return
+		case ErrJobReservationPending:
+			r.JSON(409, ct.ValidationError{Field: "idempotency_token", Message: "is in use by a job which is still being scheduled"})
+			return
+		case ErrReleaseInUse:
+			r.JSON(409, ct.ValidationError{Field: "id", Message: "refers to a release in use by an app or formation"})
+			return
+		case ErrReleaseImmutable:
+			r.JSON(409, ct.ValidationError{Field: "id", Message: "refers to an existing release, releases are immutable"})
+			return
+		}
+		log.Println(err)
+		r.JSON(500, struct{}{})
+	}
+}
+
+// splitList parses a comma separated list, such as the SHADOW_READS
+// environment variable.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func parseBasicAuth(h http.Header) (username, password string, err error) {
 	s := strings.SplitN(h.Get("Authorization"), " ", 2)
 
@@ -6,14 +6,23 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/flynn/flynn-host/types"
 	"github.com/flynn/go-sql"
 	"github.com/flynn/rpcplus"
+	strowgerc "github.com/flynn/strowger/client"
+	"github.com/flynn/strowger/types"
 	"github.com/go-martini/martini"
 
+	"github.com/flynn/flynn-controller/client"
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
 	_ "github.com/flynn/pq"
@@ -24,9 +33,10 @@ import (
 func Test(t *testing.T) { TestingT(t) }
 
 type S struct {
-	cc  *fakeCluster
-	srv *httptest.Server
-	m   *martini.Martini
+	cc        *fakeCluster
+	srv       *httptest.Server
+	m         *martini.Martini
+	providers *httptest.Server
 }
 
 var _ = Suite(&S{})
@@ -64,8 +74,10 @@ func (s *S) SetUpSuite(c *C) {
 	}
 	dbw := testDBWrapper{DB: db, dsn: dsn}
 
+	s.providers = httptest.NewServer(fakeProviderHandler())
+
 	s.cc = newFakeCluster()
-	handler, m := appHandler(handlerConfig{db: dbw, cc: s.cc, sc: newFakeRouter(), key: "test"})
+	handler, m := appHandler(handlerConfig{db: dbw, cc: s.cc, sc: newFakeRouter(), key: "test", onlineMigrations: testOnlineMigrations})
 	s.m = m
 	s.srv = httptest.NewServer(handler)
 }
@@ -185,6 +197,21 @@ func (s *S) TestCreateApp(c *C) {
 	}
 }
 
+func (s *S) TestAppNameCase(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "Mixed-Case"})
+	c.Assert(app.Name, Equals, "mixed-case")
+
+	gotApp := &ct.App{}
+	res, err := s.Get("/apps/MIXED-case", gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.ID, Equals, app.ID)
+
+	res, err = s.Post("/apps", &ct.App{Name: "mixed-CASE"}, &ct.App{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *S) TestUpdateApp(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "update-app"})
 	c.Assert(app.Protected, Equals, false)
@@ -199,6 +226,250 @@ func (s *S) TestUpdateApp(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(res.StatusCode, Equals, 200)
 	c.Assert(gotApp.Protected, Equals, false)
+
+	c.Assert(app.Strategy, Equals, ct.DeployAllAtOnce)
+	res, err = s.Post("/apps/"+app.ID, map[string]string{"strategy": ct.DeployOneByOne}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.Strategy, Equals, ct.DeployOneByOne)
+	res, err = s.Post("/apps/"+app.ID, map[string]string{"strategy": "sideways"}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, err = s.Post("/apps", &ct.App{Name: "update-app-strategy", Strategy: "sideways"}, &ct.App{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestUpdateAppMergePatch(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "update-app-patch", Meta: map[string]string{"a": "1", "b": "2"}})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	updated, _, err := client.UpdateApp(app.ID, "", map[string]interface{}{
+		"meta":        map[string]interface{}{"b": nil, "c": "3"},
+		"maintenance": true,
+		"strategy":    ct.DeployOneByOne,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(updated.Meta, DeepEquals, map[string]string{"a": "1", "c": "3"})
+	c.Assert(updated.Maintenance, Equals, true)
+	c.Assert(updated.Strategy, Equals, ct.DeployOneByOne)
+
+	// null resets a field to its default
+	updated, _, err = client.UpdateApp(app.ID, "", map[string]interface{}{"maintenance": nil, "strategy": nil, "meta": nil})
+	c.Assert(err, IsNil)
+	c.Assert(updated.Maintenance, Equals, false)
+	c.Assert(updated.Strategy, Equals, ct.DeployAllAtOnce)
+	c.Assert(updated.Meta, IsNil)
+
+	for _, patch := range []map[string]interface{}{
+		{"name": "renamed"},
+		{"protected": "yes"},
+		{"meta": map[string]interface{}{"a": 1}},
+		{"release_retention": 1.5},
+		// invalid patches are not applied in part
+		{"protected": true, "strategy": "sideways"},
+	} {
+		res, err := s.Post("/apps/"+app.ID, patch, &ct.App{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400, Commentf("%v", patch))
+	}
+	got, err := client.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Protected, Equals, false)
+	c.Assert(got.Name, Equals, app.Name)
+}
+
+func (s *S) TestAppLabels(c *C) {
+	api := s.createTestApp(c, &ct.App{Name: "labels-api", Meta: map[string]string{"team": "core", "env": "prod"}})
+	web := s.createTestApp(c, &ct.App{Name: "labels-web", Meta: map[string]string{"team": "web", "env": "prod"}})
+	s.createTestApp(c, &ct.App{Name: "labels-none"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	names := func(labels ...string) []string {
+		q := ""
+		for i, l := range labels {
+			if i > 0 {
+				q += "&"
+			}
+			q += "label=" + l
+		}
+		var apps []*ct.App
+		_, err := s.Get("/apps?"+q, &apps)
+		c.Assert(err, IsNil)
+		var names []string
+		for _, a := range apps {
+			names = append(names, a.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	c.Assert(names("env=prod"), DeepEquals, []string{"labels-api", "labels-web"})
+	c.Assert(names("env=prod", "team=core"), DeepEquals, []string{"labels-api"})
+	c.Assert(names("team=nobody"), IsNil)
+
+	app, err := client.UpdateAppMeta(web.ID, map[string]string{"team": "core"})
+	c.Assert(err, IsNil)
+	c.Assert(app.Meta, DeepEquals, map[string]string{"team": "core"})
+
+	apps, err := client.AppListByLabel(map[string]string{"team": "core"})
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 2)
+	c.Assert(names("env=prod"), DeepEquals, []string{api.Name})
+
+	res, err := s.Get("/apps?label==foo", &[]*ct.App{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestReservedAppNames(c *C) {
+	res, err := s.Post("/apps", &ct.App{Name: "router"}, &ct.App{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	apps := s.m.Get(reflect.TypeOf((*AppRepo)(nil))).Interface().(*AppRepo)
+	apps.SetReservedNames([]string{"reserved-app"})
+	defer apps.SetReservedNames(defaultReservedAppNames)
+	res, err = s.Post("/apps", &ct.App{Name: "reserved-app"}, &ct.App{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	s.createTestApp(c, &ct.App{Name: "router"})
+
+	// the names of routes under /apps are always reserved
+	apps.SetReservedNames(nil)
+	for _, name := range []string{"bulk", "import"} {
+		res, err = s.Post("/apps", &ct.App{Name: name}, &ct.App{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+func (s *S) TestCreateBulkApps(c *C) {
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	res, err := client.CreateApps([]*ct.App{{Name: "bulk-a"}, {Name: "bulk-b", Meta: map[string]string{"team": "x"}}})
+	c.Assert(err, IsNil)
+	c.Assert(res.Created, Equals, true)
+	c.Assert(res.Results, HasLen, 2)
+	for i, name := range []string{"bulk-a", "bulk-b"} {
+		c.Assert(res.Results[i].Error, Equals, "")
+		c.Assert(res.Results[i].App.Name, Equals, name)
+		app, err := client.GetApp(res.Results[i].App.ID)
+		c.Assert(err, IsNil)
+		c.Assert(app.Name, Equals, name)
+	}
+
+	// a rejected app prevents the others being created
+	res, err = client.CreateApps([]*ct.App{{Name: "bulk-c"}, {Name: "bulk-a"}, {Name: "bulk-d"}, {Name: "bulk-d"}, {Name: "in_valid"}})
+	c.Assert(err, IsNil)
+	c.Assert(res.Created, Equals, false)
+	c.Assert(res.Results, HasLen, 5)
+	c.Assert(res.Results[0], DeepEquals, &ct.BulkAppResult{})
+	c.Assert(res.Results[1].Error, Equals, "validation error: name is already taken by another app")
+	c.Assert(res.Results[2], DeepEquals, &ct.BulkAppResult{})
+	c.Assert(res.Results[3].Error, Equals, "validation error: name is already taken by another app")
+	c.Assert(res.Results[4].Error, Not(Equals), "")
+	_, err = client.GetApp("bulk-c")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	_, err = client.CreateApps(nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestAppListSort(c *C) {
+	s.createTestApp(c, &ct.App{Name: "sort-b"})
+	updated := s.createTestApp(c, &ct.App{Name: "sort-a"})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	_, err = client.UpdateAppMeta(updated.ID, map[string]string{"sorted": "true"})
+	c.Assert(err, IsNil)
+
+	apps, err := client.AppListSorted("name")
+	c.Assert(err, IsNil)
+	names := make([]string, len(apps))
+	for i, a := range apps {
+		names[i] = a.Name
+	}
+	c.Assert(sort.StringsAreSorted(names), Equals, true)
+
+	apps, err = client.AppListSorted("-name")
+	c.Assert(err, IsNil)
+	for i := 1; i < len(apps); i++ {
+		c.Assert(apps[i-1].Name >= apps[i].Name, Equals, true)
+	}
+
+	apps, err = client.AppListSorted("-updated_at")
+	c.Assert(err, IsNil)
+	c.Assert(apps[0].ID, Equals, updated.ID)
+	for i := 1; i < len(apps); i++ {
+		c.Assert(apps[i-1].UpdatedAt.Before(*apps[i].UpdatedAt), Equals, false)
+	}
+
+	var page []*ct.App
+	_, err = s.Get("/apps?sort=-updated_at&limit=1", &page)
+	c.Assert(err, IsNil)
+	c.Assert(page, HasLen, 1)
+	c.Assert(page[0].ID, Equals, updated.ID)
+
+	res, err := s.Get("/apps?sort=deleted_at", &page)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestAppNamePrefix(c *C) {
+	s.createTestApp(c, &ct.App{Name: "prefix-api"})
+	s.createTestApp(c, &ct.App{Name: "prefix-web"})
+	s.createTestApp(c, &ct.App{Name: "prefix_x"})
+	s.createTestApp(c, &ct.App{Name: "other-prefix"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	names := func(prefix string) []string {
+		apps, err := client.AppListByNamePrefix(prefix)
+		c.Assert(err, IsNil)
+		var names []string
+		for _, a := range apps {
+			names = append(names, a.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	c.Assert(names("prefix-"), DeepEquals, []string{"prefix-api", "prefix-web"})
+	c.Assert(names("prefix_"), DeepEquals, []string{"prefix_x"})
+	c.Assert(names("nonexistent"), IsNil)
+}
+
+func (s *S) TestAppPagination(c *C) {
+	for i := 0; i < 3; i++ {
+		s.createTestApp(c, &ct.App{Name: fmt.Sprintf("paginated-%d", i)})
+	}
+
+	var all []*ct.App
+	_, err := s.Get("/apps", &all)
+	c.Assert(err, IsNil)
+
+	var page []*ct.App
+	res, err := s.Get("/apps?limit=2&offset=1", &page)
+	c.Assert(err, IsNil)
+	c.Assert(res.Header.Get(ct.TotalCountHeader), Equals, strconv.Itoa(len(all)))
+	c.Assert(page, DeepEquals, all[1:3])
+
+	for _, q := range []string{"limit=0", "limit=10000", "offset=-1", "limit=foo"} {
+		res, err = s.Get("/apps?"+q, &page)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	it := client.Apps(2)
+	var iterated []*ct.App
+	for it.Next() {
+		iterated = append(iterated, it.App())
+	}
+	c.Assert(it.Err(), IsNil)
+	c.Assert(it.Total(), Equals, len(all))
+	c.Assert(iterated, DeepEquals, all)
 }
 
 func (s *S) TestProtectedApp(c *C) {
@@ -222,6 +493,288 @@ func (s *S) TestProtectedApp(c *C) {
 		res.Body.Close()
 		c.Assert(res.StatusCode, Equals, t.status)
 	}
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	override, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	override.Header = http.Header{ct.ProtectedOverrideHeader: {"true"}}
+
+	// rejected scales are not persisted
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0, "worker": 1}}), NotNil)
+	formation, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 1, "worker": 1})
+	c.Assert(override.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0, "worker": 1}}), IsNil)
+
+	// the first release may be set, but not changed
+	c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+	newRelease := s.createTestRelease(c, &ct.Release{Processes: release.Processes})
+	c.Assert(client.SetAppRelease(app.ID, newRelease.ID), NotNil)
+	c.Assert(override.SetAppRelease(app.ID, newRelease.ID), IsNil)
+
+	_, err = client.StopJobs(app.ID, url.Values{"type": {"web"}})
+	c.Assert(err, NotNil)
+	_, err = override.StopJobs(app.ID, url.Values{"type": {"web"}})
+	c.Assert(err, IsNil)
+
+	route := s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "protected-app"}).ToRoute())
+	c.Assert(client.DeleteRoute(app.ID, route.ID), NotNil)
+	c.Assert(override.DeleteRoute(app.ID, route.ID), IsNil)
+
+	c.Assert(client.DeleteFormation(app.ID, newRelease.ID), NotNil)
+	c.Assert(override.DeleteFormation(app.ID, newRelease.ID), IsNil)
+}
+
+func (s *S) TestAppLock(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "lock-app"})
+	release := s.createTestRelease(c, &ct.Release{})
+
+	alice, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	bob, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	lock, err := alice.AcquireAppLock(app.ID, &ct.AppLock{Holder: "alice", Operation: "deploy", TTL: 30})
+	c.Assert(err, IsNil)
+	c.Assert(lock.ID, Not(Equals), "")
+	c.Assert(lock.TTL, Equals, 30)
+	alice.LockID = lock.ID
+
+	_, err = bob.AcquireAppLock(app.ID, &ct.AppLock{Holder: "bob"})
+	c.Assert(err, FitsTypeOf, &controller.AppLockedError{})
+	c.Assert(err.(*controller.AppLockedError).Lock.Holder, Equals, "alice")
+	c.Assert(err.(*controller.AppLockedError).Lock.ID, Equals, "")
+	current, err := bob.GetAppLock(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.Holder, Equals, "alice")
+	c.Assert(current.ID, Equals, "")
+
+	c.Assert(bob.SetAppRelease(app.ID, release.ID), FitsTypeOf, &controller.AppLockedError{})
+	c.Assert(bob.SetAppEnv(app.ID, map[string]string{"FOO": "bar"}), FitsTypeOf, &controller.AppLockedError{})
+	_, err = bob.UpdateAppMeta(app.ID, map[string]string{"foo": "bar"})
+	c.Assert(err, FitsTypeOf, &controller.AppLockedError{})
+	c.Assert(alice.SetAppRelease(app.ID, release.ID), IsNil)
+	c.Assert(alice.SetAppEnv(app.ID, map[string]string{"FOO": "bar"}), IsNil)
+
+	renewed, err := alice.RenewAppLock(app.ID, lock.ID)
+	c.Assert(err, IsNil)
+	c.Assert(renewed.ExpiresAt.After(*lock.ExpiresAt), Equals, true)
+
+	c.Assert(alice.ReleaseAppLock(app.ID, lock.ID), IsNil)
+	_, err = alice.GetAppLock(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	lock, err = bob.AcquireAppLock(app.ID, &ct.AppLock{Holder: "bob"})
+	c.Assert(err, IsNil)
+	res, err := s.Delete("/apps/" + app.ID + "/lock")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	c.Assert(alice.BreakAppLock(app.ID), IsNil)
+	_, err = bob.RenewAppLock(app.ID, lock.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestAppMaintenance(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "maintenance"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	_, err := s.Put("/apps/"+app.ID+"/release", &releaseID{ID: release.ID}, &ct.Release{})
+	c.Assert(err, IsNil)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	now := time.Now()
+	ch, _ := client.StreamFormations(&now)
+	for f := range ch {
+		if f.App == nil {
+			break
+		}
+	}
+
+	updated, err := client.SetAppMaintenance(app.ID, true)
+	c.Assert(err, IsNil)
+	c.Assert(updated.Maintenance, Equals, true)
+
+	select {
+	case f := <-ch:
+		c.Assert(f.App.ID, Equals, app.ID)
+		c.Assert(f.App.Maintenance, Equals, true)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for formation event")
+	}
+
+	res, err := s.Put("/apps/"+app.ID+"/formations/"+release.ID, &ct.Formation{Processes: map[string]int{"web": 3}}, &ct.Formation{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	res, err = s.Put("/apps/"+app.ID+"/formations/"+release.ID, &ct.Formation{Processes: map[string]int{"web": 1}}, &ct.Formation{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Post("/apps/"+app.ID+"/jobs", &ct.NewJob{ReleaseID: release.ID}, &ct.Job{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+
+	// releases and formations cannot be changed other than by scaling down
+	next := s.createTestRelease(c, &ct.Release{})
+	res, err = s.Post("/apps/"+app.ID+"/deploy", &ct.DeployReq{ReleaseID: next.ID}, &ct.Deployment{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	res, err = s.Put("/apps/"+app.ID+"/release", &releaseID{ID: next.ID}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	res, err = s.Post("/apps/"+app.ID+"/releases", &ct.AppReleaseReq{}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	res, err = s.Post("/apps/"+app.ID+"/restart", nil, &ct.Task{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	group := &ct.EnvGroup{Env: map[string]string{"FOO": "bar"}}
+	c.Assert(client.CreateEnvGroup(group), IsNil)
+	res, err = s.Put("/apps/"+app.ID+"/env-groups/"+group.ID, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release.ID)
+
+	// an imported app in maintenance mode cannot have processes
+	bundle, err := client.ExportApp(app.ID)
+	c.Assert(err, IsNil)
+	bundle.App.Name = "maintenance-import"
+	bundle.Routes = nil
+	_, err = client.ImportApp(bundle)
+	c.Assert(err, NotNil)
+	bundle.Formation.Processes = map[string]int{"web": 0}
+	_, err = client.ImportApp(bundle)
+	c.Assert(err, IsNil)
+
+	updated, err = client.SetAppMaintenance(app.ID, false)
+	c.Assert(err, IsNil)
+	c.Assert(updated.Maintenance, Equals, false)
+}
+
+func (s *S) TestDeleteApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "delete-app", Protected: true})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "delete-app"}).ToRoute())
+
+	hc := newFakeHostClient()
+	hostID := utils.UUID()
+	s.cc.setHosts(map[string]host.Host{hostID: {
+		ID: hostID,
+		Jobs: []*host.Job{
+			{ID: "job0", Attributes: map[string]string{"flynn-controller.app": app.ID}},
+			{ID: "job1", Attributes: map[string]string{"flynn-controller.app": "otherApp"}},
+		},
+	}})
+	s.cc.setHostClient(hostID, hc)
+
+	res, err := s.Delete("/apps/" + app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, err = s.Post("/apps/"+app.ID, map[string]bool{"protected": false}, &ct.App{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	res, err = s.Delete("/apps/" + app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	res, err = s.Get("/apps/"+app.ID, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 404)
+	res, err = s.Get(formationPath(app.ID, release.ID), &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	router := s.m.Get(reflect.TypeOf((*strowgerc.Client)(nil)).Elem()).Interface().(strowgerc.Client)
+	routes, err := router.ListRoutes(routeParentRef(app))
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 0)
+
+	c.Assert(hc.isStopped("job0"), Equals, true)
+	c.Assert(hc.isStopped("job1"), Equals, false)
+
+	// the name can be reused once the app is deleted
+	s.createTestApp(c, &ct.App{Name: "delete-app"})
+}
+
+func (s *S) TestRestoreApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "restore-app"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+	s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "restore-app"}).ToRoute())
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	c.Assert(client.DeleteApp(app.ID), IsNil)
+
+	var apps []*ct.App
+	_, err = s.Get("/apps?include_deleted=true&name_prefix=restore-app", &apps)
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 1)
+	c.Assert(apps[0].DeletedAt, Not(IsNil))
+
+	restored, err := client.RestoreApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(restored.ID, Equals, app.ID)
+	c.Assert(restored.DeletedAt, IsNil)
+
+	formation := &ct.Formation{}
+	_, err = s.Get(formationPath(app.ID, release.ID), formation)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	routes, err := client.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+
+	// restoring fails if the name has been reused
+	c.Assert(client.DeleteApp(app.ID), IsNil)
+	s.createTestApp(c, &ct.App{Name: "restore-app"})
+	_, err = client.RestoreApp(app.ID)
+	c.Assert(err, NotNil)
+
+	_, err = client.RestoreApp("does-not-exist")
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestGetAppAt(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-at"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+	c.Assert(client.SetAppEnv(app.ID, map[string]string{"FOO": "bar"}), IsNil)
+
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	newRelease := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: newRelease.ID, Processes: map[string]int{"web": 3}})
+	c.Assert(client.SetAppRelease(app.ID, newRelease.ID), IsNil)
+	c.Assert(client.SetAppEnv(app.ID, map[string]string{"FOO": "baz"}), IsNil)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}})
+
+	snapshot, err := client.GetAppAt(app.ID, before)
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Release.ID, Equals, release.ID)
+	c.Assert(snapshot.Env, DeepEquals, map[string]string{"FOO": "bar"})
+	c.Assert(snapshot.Formations, HasLen, 1)
+	c.Assert(snapshot.Formations[0].ReleaseID, Equals, release.ID)
+	c.Assert(snapshot.Formations[0].Processes, DeepEquals, map[string]int{"web": 2})
+
+	snapshot, err = client.GetAppAt(app.ID, time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Release.ID, Equals, newRelease.ID)
+	c.Assert(snapshot.Env, DeepEquals, map[string]string{"FOO": "baz"})
+	c.Assert(snapshot.Formations, HasLen, 2)
+
+	res, err := s.Get("/apps/"+app.ID+"/at?time=yesterday", &ct.AppSnapshot{})
+	c.Assert(res.StatusCode, Equals, 400)
 }
 
 func (s *S) createTestArtifact(c *C, in *ct.Artifact) *ct.Artifact {
@@ -258,6 +811,132 @@ func (s *S) TestCreateArtifact(c *C) {
 	}
 }
 
+func (s *S) TestCreateArtifactDuplicate(c *C) {
+	in := &ct.Artifact{Type: "docker", URI: "docker://registry.example.com/artifact-duplicate?tag=v1"}
+	out := s.createTestArtifact(c, in)
+
+	// registering the same image again returns the existing artifact
+	again := &ct.Artifact{}
+	res, err := s.Post("/artifacts", &ct.Artifact{Type: in.Type, URI: in.URI}, again)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(again, DeepEquals, out)
+
+	var list []*ct.Artifact
+	_, err = s.Get("/artifacts?uri="+url.QueryEscape(in.URI), &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+}
+
+func (s *S) TestArtifactTypes(c *C) {
+	for _, a := range []*ct.Artifact{
+		{Type: ct.ArtifactTypeFile, URI: "docker://registry.example.com/artifact-types"},
+		{Type: ct.ArtifactTypeFile, URI: "/artifact-types.tgz"},
+	} {
+		res, err := s.Post("/artifacts", a, &ct.Artifact{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400, Commentf("%s %s", a.Type, a.URI))
+	}
+	file := s.createTestArtifact(c, &ct.Artifact{Type: ct.ArtifactTypeFile, URI: "https://blobstore.example.com/artifact-types.tgz"})
+	c.Assert(file.Type, Equals, ct.ArtifactTypeFile)
+}
+
+func (s *S) TestVerifyArtifact(c *C) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/verify-artifact.tgz" {
+			w.WriteHeader(404)
+		}
+	}))
+	defer files.Close()
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	// artifacts are only verified on the configured hosts
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: ct.ArtifactTypeFile, URI: files.URL + "/verify-artifact.tgz"})
+	res, err := client.VerifyArtifact(artifact.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, ct.ArtifactUnverifiable)
+
+	verifier := s.m.Get(reflect.TypeOf((*ArtifactVerifier)(nil))).Interface().(*ArtifactVerifier)
+	verifier.hosts = []string{strings.TrimPrefix(files.URL, "http://")}
+	defer func() { verifier.hosts = nil }()
+	res, err = client.VerifyArtifact(artifact.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.ArtifactID, Equals, artifact.ID)
+	c.Assert(res.Status, Equals, ct.ArtifactAvailable)
+
+	missing := s.createTestArtifact(c, &ct.Artifact{Type: ct.ArtifactTypeFile, URI: files.URL + "/verify-artifact-missing.tgz"})
+	res, err = client.VerifyArtifact(missing.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, ct.ArtifactMissing)
+
+	_, err = client.VerifyArtifact(utils.UUID())
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestArtifactDigest(c *C) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	in := &ct.Artifact{Type: "docker", URI: "docker://registry.example.com/artifact-digest?tag=v1", Digest: digest, Size: 1234}
+	out := s.createTestArtifact(c, in)
+	c.Assert(out.Digest, Equals, digest)
+	c.Assert(out.Size, Equals, int64(1234))
+
+	got := &ct.Artifact{}
+	_, err := s.Get("/artifacts/"+out.ID, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Digest, Equals, digest)
+	c.Assert(got.Size, Equals, int64(1234))
+
+	// the same content returns the existing artifact, different content is
+	// rejected
+	again := s.createTestArtifact(c, &ct.Artifact{Type: in.Type, URI: in.URI, Digest: digest})
+	c.Assert(again.ID, Equals, out.ID)
+	c.Assert(again.Size, Equals, int64(1234))
+	res, err := s.Post("/artifacts", &ct.Artifact{Type: in.Type, URI: in.URI, Digest: "sha256:" + strings.Repeat("b", 64)}, &ct.Artifact{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	for _, a := range []*ct.Artifact{{Digest: "foo"}, {Digest: "sha256:abc"}, {Size: -1}} {
+		a.Type, a.URI = "docker", "docker://registry.example.com/artifact-digest?tag=invalid"
+		res, err := s.Post("/artifacts", a, &ct.Artifact{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+func (s *S) TestDeleteArtifact(c *C) {
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	unused := s.createTestArtifact(c, &ct.Artifact{Type: "docker-image", URI: "docker://delete-artifact?id=unused"})
+	c.Assert(client.DeleteArtifact(unused.ID), IsNil)
+	_, err = client.GetArtifact(unused.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	c.Assert(client.DeleteArtifact(unused.ID), Equals, controller.ErrNotFound)
+
+	// releases cannot be created against a deleted artifact
+	res, err := s.Post("/releases", &ct.Release{ArtifactID: unused.ID}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker-image", URI: "docker://delete-artifact?id=used"})
+	r1 := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	r2 := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	err = client.DeleteArtifact(artifact.ID)
+	c.Assert(err, FitsTypeOf, &controller.ArtifactInUseError{})
+	releases := err.(*controller.ArtifactInUseError).Releases
+	sort.Strings(releases)
+	expected := []string{r1.ID, r2.ID}
+	sort.Strings(expected)
+	c.Assert(releases, DeepEquals, expected)
+	_, err = client.GetArtifact(artifact.ID)
+	c.Assert(err, IsNil)
+
+	c.Assert(client.ForceDeleteArtifact(artifact.ID), IsNil)
+	_, err = client.GetArtifact(artifact.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
 func (s *S) createTestRelease(c *C, in *ct.Release) *ct.Release {
 	if in.ArtifactID == "" {
 		in.ArtifactID = s.createTestArtifact(c, &ct.Artifact{}).ID
@@ -296,6 +975,443 @@ func (s *S) TestCreateRelease(c *C) {
 	}
 }
 
+func (s *S) TestReleaseImmutable(c *C) {
+	release := s.createTestRelease(c, &ct.Release{Env: map[string]string{"FOO": "bar"}})
+
+	res, err := s.Post("/releases", &ct.Release{ID: release.ID, ArtifactID: release.ArtifactID}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	res, err = s.Put("/releases/"+release.ID, &ct.Release{Env: map[string]string{"FOO": "baz"}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	res, err = s.Post("/releases/"+release.ID, &ct.Release{Env: map[string]string{"FOO": "baz"}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+
+	gotRelease := &ct.Release{}
+	_, err = s.Get("/releases/"+release.ID, gotRelease)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease, DeepEquals, release)
+}
+
+func (s *S) TestReleaseSchemaVersion(c *C) {
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(release.SchemaVersion, Equals, ct.ReleaseSchemaVersion)
+
+	gotRelease := &ct.Release{}
+	_, err := s.Get("/releases/"+release.ID, gotRelease)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.SchemaVersion, Equals, ct.ReleaseSchemaVersion)
+
+	res, err := s.Post("/releases", &ct.Release{ArtifactID: release.ArtifactID, SchemaVersion: ct.ReleaseSchemaVersion + 1}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestReleaseProcessDependencies(c *C) {
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{
+		"web":    {},
+		"worker": {DependsOn: []string{"web"}},
+	}})
+	c.Assert(release.Processes["worker"].DependsOn, DeepEquals, []string{"web"})
+
+	for _, procs := range []map[string]ct.ProcessType{
+		{"worker": {DependsOn: []string{"web"}}},
+		{"web": {DependsOn: []string{"worker"}}, "worker": {DependsOn: []string{"web"}}},
+	} {
+		res, err := s.Post("/releases", &ct.Release{ArtifactID: release.ArtifactID, Processes: procs}, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+func (s *S) TestReleaseValidation(c *C) {
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	for _, t := range []struct {
+		release *ct.Release
+		field   string
+	}{
+		{&ct.Release{Processes: map[string]ct.ProcessType{"Web Server": {}}}, "processes.Web Server"},
+		{&ct.Release{Processes: map[string]ct.ProcessType{"web": {Cmd: []string{"start", ""}}}}, "processes.web.cmd.1"},
+		{&ct.Release{Processes: map[string]ct.ProcessType{"web": {Env: map[string]string{"1PORT": "80"}}}}, "processes.web.env.1PORT"},
+		{&ct.Release{Env: map[string]string{"FOO=BAR": "baz"}}, "env.FOO=BAR"},
+	} {
+		t.release.ArtifactID = artifact.ID
+		var e ct.ValidationError
+		res, err := s.send("POST", "/releases", t.release, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+		c.Assert(json.NewDecoder(res.Body).Decode(&e), IsNil)
+		res.Body.Close()
+		c.Assert(e.Field, Equals, t.field)
+	}
+}
+
+func (s *S) TestCloneRelease(c *C) {
+	release := s.createTestRelease(c, &ct.Release{
+		Env:       map[string]string{"FOO": "bar", "BAZ": "qux"},
+		Processes: map[string]ct.ProcessType{"web": {Cmd: []string{"start", "web"}}, "worker": {Cmd: []string{"start", "worker"}}},
+	})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	foo := "baz"
+	clone, err := client.CloneRelease(release.ID, &ct.CloneReleaseReq{
+		Env:       map[string]*string{"FOO": &foo, "BAZ": nil},
+		Processes: map[string]*ct.ProcessType{"worker": nil, "clock": {Cmd: []string{"start", "clock"}}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(clone.ID, Not(Equals), release.ID)
+	c.Assert(clone.ArtifactID, Equals, release.ArtifactID)
+	c.Assert(clone.Env, DeepEquals, map[string]string{"FOO": "baz"})
+	c.Assert(clone.Processes, DeepEquals, map[string]ct.ProcessType{
+		"web":   {Cmd: []string{"start", "web"}},
+		"clock": {Cmd: []string{"start", "clock"}},
+	})
+
+	gotRelease := &ct.Release{}
+	_, err = s.Get("/releases/"+release.ID, gotRelease)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease, DeepEquals, release)
+
+	_, err = client.CloneRelease(utils.UUID(), &ct.CloneReleaseReq{})
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestCreateAppRelease(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "create-app-release"})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	foo := "baz"
+	req := &ct.AppReleaseReq{CloneReleaseReq: ct.CloneReleaseReq{Env: map[string]*string{"FOO": &foo, "BAZ": nil}}}
+	_, err = client.CreateAppRelease(app.ID, req)
+	c.Assert(err, NotNil)
+
+	release := s.createTestRelease(c, &ct.Release{Env: map[string]string{"FOO": "bar", "BAZ": "qux"}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	created, err := client.CreateAppRelease(app.ID, req)
+	c.Assert(err, IsNil)
+	c.Assert(created.ID, Not(Equals), release.ID)
+	c.Assert(created.ArtifactID, Equals, release.ArtifactID)
+	c.Assert(created.Env, DeepEquals, map[string]string{"FOO": "baz"})
+
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, created.ID)
+	formation, err := client.GetFormation(app.ID, created.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// a stale base release is rejected
+	req.Base = release.ID
+	_, err = client.CreateAppRelease(app.ID, req)
+	c.Assert(err, Equals, controller.ErrPreconditionFailed)
+	req.Base = created.ID
+	_, err = client.CreateAppRelease(app.ID, req)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestClientEnv(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "client-env"})
+	release := s.createTestRelease(c, &ct.Release{Env: map[string]string{"FOO": "bar", "BAZ": "qux"}})
+	s.setAppRelease(c, app.ID, release.ID)
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	env, err := client.EnvGet(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, map[string]string{"FOO": "bar", "BAZ": "qux"})
+
+	change, err := client.EnvSet(app.ID, map[string]string{"FOO": "baz", "NEW": "1"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(change.Release.ID, Not(Equals), release.ID)
+	c.Assert(change.Deployment, IsNil)
+	env, err = client.EnvGet(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, map[string]string{"FOO": "baz", "BAZ": "qux", "NEW": "1"})
+
+	// unchanged env does not create a release
+	unchanged, err := client.EnvSet(app.ID, map[string]string{"FOO": "baz"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(unchanged.Release.ID, Equals, change.Release.ID)
+
+	change, err = client.EnvUnset(app.ID, []string{"BAZ", "MISSING"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(change.Release.Env, DeepEquals, map[string]string{"FOO": "baz", "NEW": "1"})
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, change.Release.ID)
+
+	// the change can be rolled out with a deployment
+	change, err = client.EnvSet(app.ID, map[string]string{"FOO": "deployed"}, &controller.EnvOptions{Deploy: true})
+	c.Assert(err, IsNil)
+	c.Assert(change.Deployment, NotNil)
+	c.Assert(change.Deployment.OldReleaseID, Equals, current.ID)
+	c.Assert(change.Deployment.NewReleaseID, Equals, change.Release.ID)
+	deployment := waitDeployment(c, client, app.ID, change.Deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusComplete)
+
+	// a deployment based on a stale release is rejected
+	res, err := s.Post("/apps/"+app.ID+"/deploy", &ct.DeployReq{ReleaseID: release.ID, Base: release.ID}, &ct.Deployment{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 412)
+}
+
+func (s *S) TestReleaseTags(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "release-tags"})
+	other := s.createTestApp(c, &ct.App{Name: "release-tags-other"})
+	release1 := s.createTestRelease(c, &ct.Release{})
+	release2 := s.createTestRelease(c, &ct.Release{})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	tags, err := client.SetReleaseTags(app.ID, release1.ID, []string{"v1.0", "stable"})
+	c.Assert(err, IsNil)
+	c.Assert(tags, DeepEquals, []string{"stable", "v1.0"})
+
+	c.Assert(client.SetAppRelease(app.ID, "stable"), IsNil)
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release1.ID)
+
+	// tags are only resolved within their app
+	_, err = client.GetRelease("stable")
+	c.Assert(err, Equals, controller.ErrNotFound)
+	c.Assert(client.SetAppRelease(other.ID, "stable"), NotNil)
+
+	// tagging another release of another app leaves the tag in place
+	_, err = client.SetReleaseTags(other.ID, release2.ID, []string{"stable"})
+	c.Assert(err, IsNil)
+	tags, err = client.ReleaseTags(app.ID, release1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(tags, DeepEquals, []string{"stable", "v1.0"})
+
+	// tagging another release of the app moves the tag
+	_, err = client.SetReleaseTags(app.ID, release2.ID, []string{"stable"})
+	c.Assert(err, IsNil)
+	c.Assert(client.SetAppRelease(app.ID, "stable"), IsNil)
+	current, err = client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release2.ID)
+	tags, err = client.ReleaseTags(app.ID, release1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(tags, DeepEquals, []string{"v1.0"})
+
+	_, err = client.SetReleaseTags(app.ID, release1.ID, []string{"-invalid"})
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestIfModifiedSince(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "if-modified-since"})
+	release := s.createTestRelease(c, &ct.Release{})
+
+	get := func(path string, since time.Time) *http.Response {
+		req, err := http.NewRequest("GET", s.srv.URL+path, nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth("", authKey)
+		if !since.IsZero() {
+			req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res
+	}
+	for _, path := range []string{"/apps/" + app.ID, "/releases/" + release.ID} {
+		res := get(path, time.Time{})
+		c.Assert(res.StatusCode, Equals, 200)
+		modified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+		c.Assert(err, IsNil)
+
+		c.Assert(get(path, modified).StatusCode, Equals, 304)
+		c.Assert(get(path, modified.Add(time.Hour)).StatusCode, Equals, 304)
+		c.Assert(get(path, modified.Add(-time.Second)).StatusCode, Equals, 200)
+	}
+
+	// updating the app changes its modification time
+	res := get("/apps/"+app.ID, time.Time{})
+	modified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	c.Assert(err, IsNil)
+	time.Sleep(time.Second)
+	_, err = s.Post("/apps/"+app.ID, map[string]interface{}{"meta": map[string]string{"foo": "bar"}}, &ct.App{})
+	c.Assert(err, IsNil)
+	c.Assert(get("/apps/"+app.ID, modified).StatusCode, Equals, 200)
+}
+
+func (s *S) TestConditionalGet(c *C) {
+	release := s.createTestRelease(c, &ct.Release{Env: map[string]string{"FOO": "bar"}})
+
+	get := func(etag string) *http.Response {
+		req, err := http.NewRequest("GET", s.srv.URL+"/releases/"+release.ID, nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth("", authKey)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res
+	}
+	res := get("")
+	c.Assert(res.StatusCode, Equals, 200)
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, Not(Equals), "")
+
+	c.Assert(get(etag).StatusCode, Equals, 304)
+	c.Assert(get(`"stale", `+etag).StatusCode, Equals, 304)
+	c.Assert(get(`"stale"`).StatusCode, Equals, 200)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		got, err := client.GetRelease(release.ID)
+		c.Assert(err, IsNil)
+		c.Assert(got, DeepEquals, release)
+	}
+}
+
+func (s *S) TestConditionalAppUpdate(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "conditional-update"})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	_, etag, err := client.GetAppWithETag(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(etag, Not(Equals), "")
+
+	updated, newETag, err := client.UpdateApp(app.ID, etag, map[string]interface{}{"meta": map[string]string{"a": "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(updated.Meta, DeepEquals, map[string]string{"a": "b"})
+	c.Assert(newETag, Not(Equals), etag)
+
+	// the update was made since the first ETag was read
+	_, _, err = client.UpdateApp(app.ID, etag, map[string]interface{}{"meta": map[string]string{"c": "d"}})
+	c.Assert(err, Equals, controller.ErrPreconditionFailed)
+	got, gotETag, err := client.GetAppWithETag(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Meta, DeepEquals, map[string]string{"a": "b"})
+	c.Assert(gotETag, Equals, newETag)
+
+	_, _, err = client.UpdateApp(app.ID, newETag, map[string]interface{}{"protected": true})
+	c.Assert(err, IsNil)
+	_, _, err = client.UpdateApp(app.ID, newETag, map[string]interface{}{"protected": false})
+	c.Assert(err, Equals, controller.ErrPreconditionFailed)
+
+	// updates without If-Match are unconditional
+	_, _, err = client.UpdateApp(app.ID, "", map[string]interface{}{"protected": false})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestListReleases(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "list-releases"})
+	r1 := s.createTestRelease(c, &ct.Release{})
+	r2 := s.createTestRelease(c, &ct.Release{ArtifactID: r1.ArtifactID})
+	r3 := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, r1.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: r3.ID})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	ids := func(filter url.Values, limit int) ([]string, int) {
+		releases, total, err := client.ListReleases(filter, limit, 0)
+		c.Assert(err, IsNil)
+		res := make([]string, len(releases))
+		for i, r := range releases {
+			res[i] = r.ID
+		}
+		return res, total
+	}
+
+	list, total := ids(url.Values{"artifact_id": {r1.ArtifactID}}, 10)
+	c.Assert(list, DeepEquals, []string{r2.ID, r1.ID})
+	c.Assert(total, Equals, 2)
+	list, total = ids(url.Values{"app_id": {app.ID}}, 1)
+	c.Assert(list, DeepEquals, []string{r3.ID})
+	c.Assert(total, Equals, 2)
+	list, _ = ids(url.Values{"since": {r3.CreatedAt.Format(time.RFC3339Nano)}, "app_id": {app.ID}}, 10)
+	c.Assert(list, DeepEquals, []string{r3.ID})
+
+	for _, q := range []string{"artifact_id=foo", "app_id=foo", "since=yesterday"} {
+		res, _ := s.Get("/releases?"+q, nil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+func (s *S) TestReleaseMeta(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "release-meta"})
+	meta := map[string]string{"git_sha": "release-meta-sha", "author": "someone"}
+	release := s.createTestRelease(c, &ct.Release{Meta: meta})
+	c.Assert(release.Meta, DeepEquals, meta)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	got, err := client.GetRelease(release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Meta, DeepEquals, meta)
+	expanded, err := client.GetExpandedFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(expanded.Release.Meta, DeepEquals, meta)
+
+	// releases can be found by their meta
+	other := s.createTestRelease(c, &ct.Release{Meta: map[string]string{"git_sha": "other"}})
+	for q, expected := range map[string][]string{
+		"release-meta-sha": {release.ID},
+		"other":            {other.ID},
+		"missing":          {},
+	} {
+		releases, _, err := client.ListReleases(url.Values{"meta": {"git_sha=" + q}}, 10, 0)
+		c.Assert(err, IsNil)
+		ids := make([]string, len(releases))
+		for i, r := range releases {
+			ids[i] = r.ID
+		}
+		c.Assert(ids, DeepEquals, expected)
+	}
+	releases, _, err := client.ListReleases(url.Values{"meta": {"author"}, "artifact_id": {release.ArtifactID}}, 10, 0)
+	c.Assert(err, IsNil)
+	c.Assert(releases, HasLen, 1)
+	res, _ := s.Get("/releases?meta==foo", nil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// clones keep the meta of the release with the overrides applied
+	build := "2"
+	clone, err := client.CloneRelease(release.ID, &ct.CloneReleaseReq{Meta: map[string]*string{"author": nil, "build": &build}})
+	c.Assert(err, IsNil)
+	c.Assert(clone.Meta, DeepEquals, map[string]string{"git_sha": "release-meta-sha", "build": "2"})
+
+	res, err = s.Post("/releases", &ct.Release{ArtifactID: release.ArtifactID, Meta: map[string]string{"": "x"}}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestBatchGet(c *C) {
+	r1 := s.createTestRelease(c, &ct.Release{})
+	r2 := s.createTestRelease(c, &ct.Release{})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	releases, err := client.GetReleases([]string{r2.ID, utils.UUID(), r1.ID})
+	c.Assert(err, IsNil)
+	c.Assert(releases, DeepEquals, []*ct.Release{r2, r1})
+
+	artifacts, err := client.GetArtifacts([]string{r1.ArtifactID, r2.ArtifactID})
+	c.Assert(err, IsNil)
+	c.Assert(artifacts, HasLen, 2)
+	c.Assert(artifacts[0].ID, Equals, r1.ArtifactID)
+	c.Assert(artifacts[1].ID, Equals, r2.ArtifactID)
+
+	for _, ids := range [][]string{nil, {"foo"}, make([]string, maxBatchGet+1)} {
+		res, err := s.send("POST", "/releases/get", &ct.BatchGetReq{IDs: ids}, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
 func (s *S) TestCreateFormation(c *C) {
 	for i, useName := range []bool{false, true} {
 		release := s.createTestRelease(c, &ct.Release{})
@@ -327,6 +1443,21 @@ func (s *S) TestCreateFormation(c *C) {
 	}
 }
 
+func (s *S) TestGetExpandedFormation(c *C) {
+	release := s.createTestRelease(c, &ct.Release{})
+	app := s.createTestApp(c, &ct.App{Name: "expanded-formation"})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID, Processes: map[string]int{"web": 2}})
+
+	expanded := &ct.ExpandedFormation{}
+	res, err := s.Get(formationPath(app.Name, release.ID)+"?expand=true", expanded)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(expanded.App.ID, Equals, app.ID)
+	c.Assert(expanded.Release, DeepEquals, release)
+	c.Assert(expanded.Artifact.ID, Equals, release.ArtifactID)
+	c.Assert(expanded.Processes, DeepEquals, map[string]int{"web": 2})
+}
+
 func (s *S) createTestFormation(c *C, formation *ct.Formation) *ct.Formation {
 	path := formationPath(formation.AppID, formation.ReleaseID)
 	formation.AppID = ""
@@ -430,6 +1561,7 @@ func (s *S) TestAppList(c *C) {
 
 	c.Assert(len(list) > 0, Equals, true)
 	c.Assert(list[0].ID, Not(Equals), "")
+
 }
 
 func (s *S) TestReleaseList(c *C) {
@@ -442,6 +1574,7 @@ func (s *S) TestReleaseList(c *C) {
 
 	c.Assert(len(list) > 0, Equals, true)
 	c.Assert(list[0].ID, Not(Equals), "")
+
 }
 
 func (s *S) TestKeyList(c *C) {
@@ -475,6 +1608,35 @@ func (s *S) TestArtifactList(c *C) {
 
 	c.Assert(len(list) > 0, Equals, true)
 	c.Assert(list[0].ID, Not(Equals), "")
+
+	a1 := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://registry.example.com/artifact-list?id=1"})
+	a2 := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://registry.example.com/artifact-list?id=2"})
+	a3 := s.createTestArtifact(c, &ct.Artifact{Type: "artifact-list", URI: "https://other.example.com/artifact-list"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	ids := func(filter url.Values, limit int) ([]string, int) {
+		artifacts, total, err := client.ArtifactList(filter, limit, 0)
+		c.Assert(err, IsNil)
+		res := make([]string, len(artifacts))
+		for i, a := range artifacts {
+			res[i] = a.ID
+		}
+		return res, total
+	}
+	got, total := ids(url.Values{"uri_prefix": {"https://registry.example.com/artifact-list"}}, 1)
+	c.Assert(got, DeepEquals, []string{a2.ID})
+	c.Assert(total, Equals, 2)
+	got, total = ids(url.Values{"uri": {a1.URI}}, 10)
+	c.Assert(got, DeepEquals, []string{a1.ID})
+	c.Assert(total, Equals, 1)
+	got, total = ids(url.Values{"type": {"artifact-list"}}, 10)
+	c.Assert(got, DeepEquals, []string{a3.ID})
+	c.Assert(total, Equals, 1)
+	// LIKE wildcards in the prefix match literally
+	got, total = ids(url.Values{"uri_prefix": {"https://registry.example.com/artifact%"}}, 10)
+	c.Assert(got, HasLen, 0)
+	c.Assert(total, Equals, 0)
 }
 
 func (s *S) TestFormationList(c *C) {
@@ -491,6 +1653,22 @@ func (s *S) TestFormationList(c *C) {
 	c.Assert(len(list) > 0, Equals, true)
 	c.Assert(list[0].ReleaseID, Not(Equals), "")
 
+	// formations of every release of the app are listed, newest first
+	release2 := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release2.ID, AppID: app.ID, Processes: map[string]int{"web": 2}})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	formations, err := client.FormationList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formations, HasLen, 2)
+	c.Assert(formations[0].ReleaseID, Equals, release2.ID)
+	c.Assert(formations[0].Processes, DeepEquals, map[string]int{"web": 2})
+	c.Assert(formations[1].ReleaseID, Equals, release.ID)
+	_, err = client.FormationList("nonexistent")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	res, err = s.Get(path, &list)
+	c.Assert(err, IsNil)
 	for _, f := range list {
 		s.Delete(formationPath(f.AppID, f.ReleaseID))
 	}
@@ -553,10 +1731,12 @@ func (s *S) createTestProvider(c *C, provider *ct.Provider) *ct.Provider {
 }
 
 func (s *S) TestCreateProvider(c *C) {
-	provider := s.createTestProvider(c, &ct.Provider{URL: "https://example.com", Name: "foo"})
+	url := s.testProviderURL("example-com")
+	provider := s.createTestProvider(c, &ct.Provider{URL: url, Name: "foo"})
 	c.Assert(provider.Name, Equals, "foo")
-	c.Assert(provider.URL, Equals, "https://example.com")
+	c.Assert(provider.URL, Equals, url)
 	c.Assert(provider.ID, Not(Equals), "")
+	c.Assert(provider.Capabilities, DeepEquals, &ct.ProviderCapabilities{ProtocolVersion: 2, Provision: true, Deprovision: true})
 
 	gotProvider := &ct.Provider{}
 	res, err := s.Get("/providers/"+provider.ID, gotProvider)
@@ -571,8 +1751,57 @@ func (s *S) TestCreateProvider(c *C) {
 	c.Assert(res.StatusCode, Equals, 404)
 }
 
+// fakeProviderHandler serves provider capabilities for every path, legacy
+// providers return 404 and incompatible providers return a newer version.
+func fakeProviderHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasSuffix(req.URL.Path, "/capabilities") {
+			w.WriteHeader(404)
+			return
+		}
+		caps := &ct.ProviderCapabilities{ProtocolVersion: 2, Provision: true, Deprovision: true}
+		switch {
+		case strings.Contains(req.URL.Path, "legacy"):
+			w.WriteHeader(404)
+			return
+		case strings.Contains(req.URL.Path, "future"):
+			caps.ProtocolVersion = 99
+		case strings.Contains(req.URL.Path, "noprovision"):
+			caps.Provision = false
+		}
+		json.NewEncoder(w).Encode(caps)
+	})
+}
+
+func (s *S) testProviderURL(name string) string {
+	return s.providers.URL + "/" + name
+}
+
+func (s *S) TestProviderProtocol(c *C) {
+	legacy := s.createTestProvider(c, &ct.Provider{URL: s.testProviderURL("legacy"), Name: "protocol-legacy"})
+	c.Assert(legacy.Capabilities, DeepEquals, &ct.ProviderCapabilities{ProtocolVersion: 1, Provision: true})
+
+	for _, t := range []struct {
+		url   string
+		field string
+	}{
+		{s.testProviderURL("future"), "url"},
+		{s.testProviderURL("noprovision"), "url"},
+		{"http://127.0.0.1:0/unreachable", "url"},
+		{"", "url"},
+	} {
+		var e ct.ValidationError
+		res, err := s.send("POST", "/providers", &ct.Provider{URL: t.url, Name: "protocol-invalid"}, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+		c.Assert(json.NewDecoder(res.Body).Decode(&e), IsNil)
+		res.Body.Close()
+		c.Assert(e.Field, Equals, t.field)
+	}
+}
+
 func (s *S) TestProviderList(c *C) {
-	s.createTestProvider(c, &ct.Provider{URL: "https://example.org", Name: "list-test"})
+	s.createTestProvider(c, &ct.Provider{URL: s.testProviderURL("example-org"), Name: "list-test"})
 
 	var list []ct.Provider
 	res, err := s.Get("/providers", &list)
@@ -581,4 +1810,25 @@ func (s *S) TestProviderList(c *C) {
 
 	c.Assert(len(list) > 0, Equals, true)
 	c.Assert(list[0].ID, Not(Equals), "")
+
+}
+
+func (s *S) TestClientHeaders(c *C) {
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	client, err := controller.NewClient(srv.URL, authKey)
+	c.Assert(err, IsNil)
+	client.SetUserAgent("scheduler", "v1")
+	client.Header = http.Header{"X-Request-Source": {"ci"}}
+	_, err = client.GetApp("foo")
+	c.Assert(err, IsNil)
+	h := <-headers
+	c.Assert(h.Get("User-Agent"), Equals, "scheduler/v1 flynn-controller-client")
+	c.Assert(h.Get("X-Request-Source"), Equals, "ci")
+	c.Assert(h.Get("Authorization"), Not(Equals), "")
 }
@@ -1,53 +1,171 @@
 package main
 
 import (
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	ct "github.com/flynn/flynn-controller/types"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
 )
 
 type Repository interface {
-	Add(thing interface{}) error
 	Get(id string) (interface{}, error)
 	List() (interface{}, error)
 }
 
+type Adder interface {
+	Add(thing interface{}) error
+}
+
 type Remover interface {
 	Remove(string) error
 }
 
+// Filterer is implemented by repositories that can filter lists by query
+// parameters.
+type Filterer interface {
+	Filter(url.Values) (interface{}, error)
+}
+
+// Pager is implemented by repositories that can list a page of results. It
+// returns the page along with the total number of results.
+type Pager interface {
+	Page(q url.Values, limit, offset int) (interface{}, int, error)
+}
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageParams parses the limit and offset query parameters.
+func pageParams(q url.Values) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, ct.ValidationError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxPageLimit)}
+		}
+	}
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, ct.ValidationError{Field: "offset", Message: "must not be negative"}
+		}
+	}
+	return limit, offset, nil
+}
+
+// listRepo lists the repository, using the Pager if the query has limit or
+// offset parameters, or else the Filterer if implemented. The total number of
+// results is returned for paged lists, otherwise total is -1.
+func listRepo(repo Repository, q url.Values) (list interface{}, total int, err error) {
+	if pager, ok := repo.(Pager); ok && (q.Get("limit") != "" || q.Get("offset") != "") {
+		var limit, offset int
+		if limit, offset, err = pageParams(q); err != nil {
+			return nil, -1, err
+		}
+		return pager.Page(q, limit, offset)
+	}
+	if filterer, ok := repo.(Filterer); ok {
+		list, err = filterer.Filter(q)
+	} else {
+		list, err = repo.List()
+	}
+	return list, -1, err
+}
+
 type Updater interface {
 	Update(string, map[string]interface{}) (interface{}, error)
 }
 
-func crud(resource string, example interface{}, repo Repository, r martini.Router) interface{} {
+// ConditionalUpdater is implemented by repositories which can update a
+// resource only if its ETag matches the If-Match header of the request,
+// returning ErrPreconditionFailed otherwise.
+type ConditionalUpdater interface {
+	UpdateIfMatch(id, ifMatch string, data map[string]interface{}) (interface{}, error)
+}
+
+// ETagger is implemented by repositories which derive the ETag of a resource
+// from its state, rather than from its JSON encoding.
+type ETagger interface {
+	ETag(thing interface{}) string
+}
+
+// LastModifier is implemented by repositories which know when a resource was
+// last modified, allowing conditional GETs with If-Modified-Since.
+type LastModifier interface {
+	LastModified(thing interface{}) time.Time
+}
+
+// CreateChecker is implemented by repositories which check new resources
+// against the request creating them, such as for overrides set in headers.
+// Resources are checked after admission hooks have mutated them.
+type CreateChecker interface {
+	CheckCreate(thing interface{}, req *http.Request) error
+}
+
+// ErrPreconditionFailed is returned when updating a resource which has
+// changed since the ETag in the If-Match header was read.
+var ErrPreconditionFailed = errors.New("controller: precondition failed")
+
+func resourceETag(repo Repository, thing interface{}) (string, error) {
+	if e, ok := repo.(ETagger); ok {
+		return e.ETag(thing), nil
+	}
+	return jsonETag(thing)
+}
+
+// crud registers the routes of a resource and returns the middleware which
+// looks up the resource of a request. Updates run the resource through
+// updateChecks, such as checking that an app is not locked, before the
+// update is applied.
+func crud(resource string, example interface{}, repo Repository, r martini.Router, updateChecks ...martini.Handler) interface{} {
 	resourceType := reflect.TypeOf(example)
 	resourcePtr := reflect.PtrTo(resourceType)
 	prefix := "/" + resource
 
-	r.Post(prefix, func(req *http.Request, r render.Render) {
-		thing := reflect.New(resourceType).Interface()
-		err := json.NewDecoder(req.Body).Decode(thing)
-		if err != nil {
-			// 400?
-			return
-		}
+	if adder, ok := repo.(Adder); ok {
+		r.Post(prefix, func(req *http.Request, admitter *Admitter, r render.Render) {
+			thing := reflect.New(resourceType).Interface()
+			err := json.NewDecoder(req.Body).Decode(thing)
+			if err != nil {
+				// 400?
+				return
+			}
 
-		err = repo.Add(thing)
-		if err != nil {
-			log.Println(err)
-			r.JSON(500, struct{}{})
-			return
-		}
-		r.JSON(200, thing)
-	})
+			if err := admitter.Admit(resource, "create", thing); err != nil {
+				respondWithError(r, err)
+				return
+			}
+			if checker, ok := repo.(CreateChecker); ok {
+				if err := checker.CheckCreate(thing, req); err != nil {
+					respondWithError(r, err)
+					return
+				}
+			}
+			err = adder.Add(thing)
+			if err != nil {
+				respondWithError(r, err)
+				return
+			}
+			r.JSON(200, thing)
+		})
+	}
 
-	lookup := func(c martini.Context, params martini.Params, req *http.Request, w http.ResponseWriter) {
+	lookup := func(c martini.Context, params martini.Params, req *http.Request, w http.ResponseWriter, shadow *ShadowReader) {
 		thing, err := repo.Get(params[resource+"_id"])
+		if req.Method == "GET" {
+			shadow.Get(resource, params[resource+"_id"], thing, err)
+		}
 		if err != nil {
 			if err == ErrNotFound {
 				w.WriteHeader(404)
@@ -61,17 +179,38 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	}
 
 	singletonPath := prefix + "/:" + resource + "_id"
-	r.Get(singletonPath, lookup, func(c martini.Context, r render.Render) {
-		r.JSON(200, c.Get(resourcePtr).Interface())
+	r.Get(singletonPath, lookup, func(c martini.Context, req *http.Request, w http.ResponseWriter, r render.Render) {
+		thing := c.Get(resourcePtr).Interface()
+		if etag, err := resourceETag(repo, thing); err == nil {
+			w.Header().Set("ETag", etag)
+			if etagMatch(req.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(304)
+				return
+			}
+		}
+		if lm, ok := repo.(LastModifier); ok {
+			if modified := lm.LastModified(thing); !modified.IsZero() {
+				w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+				if notModifiedSince(req, modified) {
+					w.WriteHeader(304)
+					return
+				}
+			}
+		}
+		r.JSON(200, thing)
 	})
 
-	r.Get(prefix, func(r render.Render) {
-		list, err := repo.List()
+	r.Get(prefix, func(req *http.Request, w http.ResponseWriter, r render.Render, shadow *ShadowReader) {
+		q := req.URL.Query()
+		list, total, err := listRepo(repo, q)
+		shadow.List(resource, q, list, err)
 		if err != nil {
-			log.Println(err)
-			r.JSON(500, struct{}{})
+			respondWithError(r, err)
 			return
 		}
+		if total >= 0 {
+			w.Header().Set(ct.TotalCountHeader, strconv.Itoa(total))
+		}
 		r.JSON(200, list)
 	})
 
@@ -86,21 +225,66 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	}
 
 	if updater, ok := repo.(Updater); ok {
-		r.Post(singletonPath, func(params martini.Params, req *http.Request, r render.Render) {
+		var handlers []martini.Handler
+		if len(updateChecks) > 0 {
+			handlers = append([]martini.Handler{lookup}, updateChecks...)
+		}
+		r.Post(singletonPath, append(handlers, func(params martini.Params, req *http.Request, w http.ResponseWriter, r render.Render) {
 			var data map[string]interface{}
 			if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
 				r.JSON(400, struct{}{})
 				return
 			}
-			app, err := updater.Update(params[resource+"_id"], data)
+			var thing interface{}
+			var err error
+			if cu, ok := repo.(ConditionalUpdater); ok && req.Header.Get("If-Match") != "" {
+				thing, err = cu.UpdateIfMatch(params[resource+"_id"], req.Header.Get("If-Match"), data)
+			} else {
+				thing, err = updater.Update(params[resource+"_id"], data)
+			}
 			if err != nil {
-				log.Println(err)
-				r.JSON(500, struct{}{})
+				respondWithError(r, err)
 				return
 			}
-			r.JSON(200, app)
-		})
+			if etag, err := resourceETag(repo, thing); err == nil {
+				w.Header().Set("ETag", etag)
+			}
+			r.JSON(200, thing)
+		})...)
 	}
 
 	return lookup
 }
+
+// jsonETag returns a strong ETag computed from the JSON encoding of v.
+func jsonETag(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x"`, sha1.Sum(data)), nil
+}
+
+// notModifiedSince reports whether the resource has not been modified since
+// the If-Modified-Since header of the request. The header is ignored if the
+// request has an If-None-Match header, which takes precedence.
+func notModifiedSince(req *http.Request, modified time.Time) bool {
+	if req.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of one second
+	return !modified.Truncate(time.Second).After(since)
+}
+
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+const deploymentTask = "deployment"
+
+var (
+	// deploymentTimeout is how long a deployment waits for the processes of
+	// the new release to be running before failing.
+	deploymentTimeout  = 10 * time.Minute
+	deploymentInterval = time.Second
+	// deploymentMaxCrashes is the number of jobs of a process type of the
+	// new release which may crash or fail before the deployment fails.
+	deploymentMaxCrashes = 3
+)
+
+// ErrDeploymentInProgress is returned when deploying an app which already
+// has a queued, pending or running deployment.
+var ErrDeploymentInProgress = errors.New("controller: a deployment of the app is in progress")
+
+// DeploymentRepo stores deployments. New deployments are queued, and start
+// once the deployments running across the cluster and in the org of their
+// app are within the limits.
+type DeploymentRepo struct {
+	db     *DB
+	limits DeploymentLimits
+}
+
+func NewDeploymentRepo(db *DB, limits DeploymentLimits) *DeploymentRepo {
+	return &DeploymentRepo{db: db, limits: limits}
+}
+
+const deploymentColumns = "deployment_id, app_id, old_release_id, new_release_id, strategy, process_type, status, error, org, queue_position, created_at, finished_at"
+
+func scanDeployment(s Scanner) (*ct.Deployment, error) {
+	d := &ct.Deployment{}
+	var oldReleaseID, processType, deployErr, org sql.NullString
+	var position sql.NullInt64
+	err := s.Scan(&d.ID, &d.AppID, &oldReleaseID, &d.NewReleaseID, &d.Strategy, &processType, &d.Status, &deployErr, &org, &position, &d.CreatedAt, &d.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	d.ID = cleanUUID(d.ID)
+	d.AppID = cleanUUID(d.AppID)
+	d.OldReleaseID = cleanUUID(oldReleaseID.String)
+	d.NewReleaseID = cleanUUID(d.NewReleaseID)
+	d.ProcessType = processType.String
+	d.Error = deployErr.String
+	d.Org = org.String
+	d.QueuePosition = int(position.Int64)
+	return d, nil
+}
+
+// Add queues a deployment, starting it straight away if the limits allow,
+// and returns the deployments which were started, which need running. It
+// returns ErrDeploymentInProgress if the app has an unfinished deployment.
+func (r *DeploymentRepo) Add(d *ct.Deployment) ([]*ct.Deployment, error) {
+	var oldReleaseID, processType *string
+	if d.OldReleaseID != "" {
+		oldReleaseID = &d.OldReleaseID
+	}
+	if d.ProcessType != "" {
+		processType = &d.ProcessType
+	}
+	tx, err := r.begin()
+	if err != nil {
+		return nil, err
+	}
+	var id string
+	err = tx.QueryRow(`INSERT INTO deployments (app_id, old_release_id, new_release_id, strategy, process_type, status, org)
+SELECT $1, $2, $3, $4, $5, $6, meta -> $7 FROM apps WHERE app_id = $1 RETURNING deployment_id`,
+		d.AppID, oldReleaseID, d.NewReleaseID, d.Strategy, processType, ct.DeploymentStatusQueued, ct.AppMetaOrg).Scan(&id)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		tx.Rollback()
+		return nil, ErrDeploymentInProgress
+	}
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	started, err := r.dispatch(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	added, err := scanDeployment(tx.QueryRow("SELECT "+deploymentColumns+" FROM deployments WHERE deployment_id = $1", id))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	*d = *added
+	return started, tx.Commit()
+}
+
+// Dispatch starts the queued deployments which the limits allow, returning
+// them so that they can be run.
+func (r *DeploymentRepo) Dispatch() ([]*ct.Deployment, error) {
+	tx, err := r.begin()
+	if err != nil {
+		return nil, err
+	}
+	started, err := r.dispatch(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return started, tx.Commit()
+}
+
+func (r *DeploymentRepo) begin() (*dbTx, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// deployments are locked so that concurrent dispatches count the same
+	// running deployments
+	if _, err := tx.Exec("LOCK TABLE deployments IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// dispatch starts queued deployments oldest first while the limits allow.
+// Deployments of an org at its limit are skipped, so they do not hold up
+// other orgs. The remaining deployments are renumbered, recording an event
+// for each whose position changed.
+func (r *DeploymentRepo) dispatch(tx *dbTx) ([]*ct.Deployment, error) {
+	rows, err := tx.Query("SELECT org, count(*) FROM deployments WHERE status IN ('pending', 'running') GROUP BY org")
+	if err != nil {
+		return nil, err
+	}
+	var total int
+	orgs := make(map[string]int)
+	for rows.Next() {
+		var org sql.NullString
+		var n int
+		if err := rows.Scan(&org, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		total += n
+		if org.Valid {
+			orgs[org.String] = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query("SELECT " + deploymentColumns + " FROM deployments WHERE status = 'queued' ORDER BY created_at, deployment_id")
+	if err != nil {
+		return nil, err
+	}
+	var queued []*ct.Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		queued = append(queued, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var started []*ct.Deployment
+	position := 0
+	for _, d := range queued {
+		if r.limits.allow(total, orgs[d.Org], d.Org) {
+			total++
+			if d.Org != "" {
+				orgs[d.Org]++
+			}
+			d.Status, d.QueuePosition = ct.DeploymentStatusPending, 0
+			started = append(started, d)
+		} else {
+			position++
+			if d.QueuePosition == position {
+				continue
+			}
+			d.QueuePosition = position
+		}
+		var pos *int
+		if d.QueuePosition > 0 {
+			pos = &d.QueuePosition
+		}
+		if _, err := tx.Exec("UPDATE deployments SET status = $2, queue_position = $3 WHERE deployment_id = $1", d.ID, d.Status, pos); err != nil {
+			return nil, err
+		}
+		if err := addDeploymentEvent(tx, d); err != nil {
+			return nil, err
+		}
+	}
+	return started, nil
+}
+
+func (r *DeploymentRepo) Get(id string) (*ct.Deployment, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	return scanDeployment(r.db.QueryRow("SELECT "+deploymentColumns+" FROM deployments WHERE deployment_id = $1", id))
+}
+
+// InProgress reports whether an app has an unfinished deployment.
+func (r *DeploymentRepo) InProgress(appID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM deployments WHERE app_id = $1 AND finished_at IS NULL)", appID).Scan(&exists)
+	return exists, err
+}
+
+// List returns the deployments of an app, newest first.
+func (r *DeploymentRepo) List(appID string) ([]*ct.Deployment, error) {
+	rows, err := r.db.Query("SELECT "+deploymentColumns+" FROM deployments WHERE app_id = $1 ORDER BY created_at DESC", appID)
+	if err != nil {
+		return nil, err
+	}
+	deployments := []*ct.Deployment{}
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, rows.Err()
+}
+
+// SetStatus updates the status of a deployment, setting the finish time once
+// it is complete or failed.
+func (r *DeploymentRepo) SetStatus(id, status string, deployErr error) error {
+	var msg *string
+	if deployErr != nil {
+		s := deployErr.Error()
+		msg = &s
+	}
+	finished := status == ct.DeploymentStatusComplete || status == ct.DeploymentStatusFailed
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	d, err := scanDeployment(tx.QueryRow("UPDATE deployments SET status = $2, error = $3, queue_position = NULL, finished_at = CASE WHEN $4 THEN now() END WHERE deployment_id = $1 RETURNING "+deploymentColumns,
+		id, status, msg, finished))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := addDeploymentEvent(tx, d); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddProgress records the progress of the processes of a running deployment
+// in the app log.
+func (r *DeploymentRepo) AddProgress(d *ct.Deployment, processes map[string]*ct.DeploymentProcess) error {
+	data, err := appLogData(&ct.DeploymentEvent{Deployment: d, Processes: processes})
+	if err != nil {
+		return err
+	}
+	return r.db.Exec(appLogInsert, d.AppID, string(ct.EventTypeDeployment), d.ID, data)
+}
+
+// addDeploymentEvent records a change of a deployment in the app log.
+func addDeploymentEvent(tx *dbTx, d *ct.Deployment) error {
+	data, err := appLogData(d)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(appLogInsert, d.AppID, string(ct.EventTypeDeployment), d.ID, data)
+	return err
+}
+
+type deploymentData struct {
+	ID string `json:"id"`
+}
+
+// Deployer runs deployments as tasks. The formation of the old release is
+// moved to the new release, and the deployment completes once as many
+// processes of the new release are running as the formation asks for. If
+// they do not start in time or keep crashing, the old release and formation
+// are restored and the deployment fails. App restarts are run as deployments
+// too, so that they queue and fail the same way. Finished deployments make
+// room for queued ones, so the queue is triggered once each deployment finishes.
+type Deployer struct {
+	repo       *DeploymentRepo
+	releases   *ReleaseRepo
+	formations *FormationRepo
+	cc         clusterClient
+	queue      *DeploymentQueue
+}
+
+func NewDeployer(repo *DeploymentRepo, releases *ReleaseRepo, formations *FormationRepo, cc clusterClient, queue *DeploymentQueue) *Deployer {
+	return &Deployer{repo: repo, releases: releases, formations: formations, cc: cc, queue: queue}
+}
+
+func (d *Deployer) Run(task *ct.Task) (interface{}, error) {
+	var data deploymentData
+	if task.Data == nil {
+		return nil, errors.New("controller: missing deployment data")
+	}
+	if err := json.Unmarshal(*task.Data, &data); err != nil {
+		return nil, err
+	}
+	deployment, err := d.repo.Get(data.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer d.queue.Trigger()
+	// releases are not pruned while the deployment runs, so the old release
+	// is kept for a rollback until it finishes
+	defer d.formations.PruneReleases(deployment.AppID)
+	if err := d.repo.SetStatus(deployment.ID, ct.DeploymentStatusRunning, nil); err != nil {
+		return nil, err
+	}
+	deployment.Status = ct.DeploymentStatusRunning
+	if err := d.deploy(deployment); err != nil {
+		if serr := d.repo.SetStatus(deployment.ID, ct.DeploymentStatusFailed, err); serr != nil {
+			log.Printf("error failing deployment %s: %s", deployment.ID, serr)
+		}
+		return nil, err
+	}
+	if err := d.repo.SetStatus(deployment.ID, ct.DeploymentStatusComplete, nil); err != nil {
+		return nil, err
+	}
+	return d.repo.Get(deployment.ID)
+}
+
+// errReleaseChanged fails deployments of apps which were deployed by other
+// means since the deployment was created.
+var errReleaseChanged = errors.New("controller: the release of the app changed during the deployment")
+
+// deploy deploys the new release of a deployment with its strategy. All at
+// once deployments move the whole formation to the new release, whose
+// process types the scheduler starts in dependency order. Apps whose old
+// release has no formation have no processes to replace one by one, so they
+// are deployed all at once. Restarts keep the release, see restart.
+func (d *Deployer) deploy(deployment *ct.Deployment) error {
+	began := time.Now()
+	if deployment.Strategy == ct.DeployRestart {
+		return d.restart(deployment, began)
+	}
+	if deployment.Strategy == ct.DeployOneByOne && deployment.OldReleaseID != "" {
+		old, err := d.formations.Get(deployment.AppID, deployment.OldReleaseID)
+		if err == nil {
+			return d.deployOneByOne(deployment, old, began)
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+	if err := d.formations.DeployFrom(deployment.AppID, deployment.NewReleaseID, deployment.OldReleaseID); err != nil {
+		if err == ErrPreconditionFailed {
+			return errReleaseChanged
+		}
+		return err
+	}
+	formation, err := d.formations.Get(deployment.AppID, deployment.NewReleaseID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := d.wait(deployment, formation, began, nil); err != nil {
+		return d.rollback(deployment, err)
+	}
+	return nil
+}
+
+// deployOneByOne replaces the processes of the old formation one at a time,
+// starting a process of the new release and waiting for it to be running
+// before stopping one of the old release. Process types are replaced in
+// dependency order, see utils.ProcessOrder, and types the new release does
+// not have are stopped once the others have been replaced.
+func (d *Deployer) deployOneByOne(deployment *ct.Deployment, old *ct.Formation, began time.Time) error {
+	release, err := d.releases.GetForApp(deployment.AppID, deployment.NewReleaseID)
+	if err != nil {
+		return err
+	}
+	order, err := utils.ProcessOrder(release.Processes)
+	if err != nil {
+		return err
+	}
+	if err := d.formations.SetRelease(deployment.AppID, deployment.NewReleaseID, deployment.OldReleaseID); err != nil {
+		if err == ErrPreconditionFailed {
+			return errReleaseChanged
+		}
+		return err
+	}
+
+	next := &ct.Formation{AppID: deployment.AppID, ReleaseID: deployment.NewReleaseID, Processes: make(map[string]int), Spread: old.Spread}
+	prev := &ct.Formation{AppID: deployment.AppID, ReleaseID: deployment.OldReleaseID, Processes: make(map[string]int, len(old.Processes)), Spread: old.Spread}
+	for typ, n := range old.Processes {
+		prev.Processes[typ] = n
+	}
+	for _, typ := range order {
+		for next.Processes[typ] < old.Processes[typ] {
+			next.Processes[typ]++
+			if err := d.formations.Scale(next); err != nil {
+				return d.rollbackOneByOne(deployment, old, err)
+			}
+			if err := d.wait(deployment, next, began, nil); err != nil {
+				return d.rollbackOneByOne(deployment, old, err)
+			}
+			prev.Processes[typ]--
+			if err := d.formations.Scale(prev); err != nil {
+				return d.rollbackOneByOne(deployment, old, err)
+			}
+		}
+	}
+	return d.formations.Remove(deployment.AppID, deployment.OldReleaseID)
+}
+
+// wait waits for the processes of a formation of the new release to be
+// running, recording their progress. Only jobs started since began count as
+// crashed, so that crashes of an earlier attempt to deploy the release are
+// ignored, and jobs in stopped are not counted at all.
+func (d *Deployer) wait(deployment *ct.Deployment, formation *ct.Formation, began time.Time, stopped map[string]bool) error {
+	var last map[string]*ct.DeploymentProcess
+	for deadline := time.Now().Add(deploymentTimeout); ; time.Sleep(deploymentInterval) {
+		processes, err := d.progress(deployment, formation, began, stopped)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(processes, last) {
+			if err := d.repo.AddProgress(deployment, processes); err != nil {
+				return err
+			}
+			last = processes
+		}
+		types := make([]string, 0, len(processes))
+		for typ := range processes {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+		done := true
+		for _, typ := range types {
+			p := processes[typ]
+			if p.Down >= deploymentMaxCrashes {
+				return fmt.Errorf("controller: %d %s jobs of release %s crashed", p.Down, typ, deployment.NewReleaseID)
+			}
+			if p.Up < p.Desired {
+				done = false
+			}
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("controller: timed out waiting for the processes of release %s", deployment.NewReleaseID)
+		}
+	}
+}
+
+// rollback restores the old release and formation of a deployment which
+// failed with cause, unless the app has been deployed by other means since,
+// and returns the error the deployment fails with.
+func (d *Deployer) rollback(deployment *ct.Deployment, cause error) error {
+	if deployment.OldReleaseID == "" {
+		return cause
+	}
+	if err := d.formations.DeployFrom(deployment.AppID, deployment.OldReleaseID, deployment.NewReleaseID); err != nil {
+		log.Printf("error rolling back deployment %s: %s", deployment.ID, err)
+		return fmt.Errorf("%s, rolling back to release %s failed: %s", cause, deployment.OldReleaseID, err)
+	}
+	return fmt.Errorf("%s, rolled back to release %s", cause, deployment.OldReleaseID)
+}
+
+// rollbackOneByOne is like rollback for deployments which replace processes
+// one by one, restoring the old formation in full and removing the new one.
+func (d *Deployer) rollbackOneByOne(deployment *ct.Deployment, old *ct.Formation, cause error) error {
+	err := d.formations.SetRelease(deployment.AppID, deployment.OldReleaseID, deployment.NewReleaseID)
+	if err == nil {
+		err = d.formations.Scale(old)
+	}
+	if err == nil {
+		err = d.formations.Remove(deployment.AppID, deployment.NewReleaseID)
+	}
+	if err != nil {
+		log.Printf("error rolling back deployment %s: %s", deployment.ID, err)
+		return fmt.Errorf("%s, rolling back to release %s failed: %s", cause, deployment.OldReleaseID, err)
+	}
+	return fmt.Errorf("%s, rolled back to release %s", cause, deployment.OldReleaseID)
+}
+
+// progress counts the jobs of the new release of each process type of the
+// formation. Jobs which crashed or failed only count as down if they were
+// started since began, and jobs in stopped, which are keyed by their
+// formatted ID, are skipped.
+func (d *Deployer) progress(deployment *ct.Deployment, formation *ct.Formation, began time.Time, stopped map[string]bool) (map[string]*ct.DeploymentProcess, error) {
+	processes := make(map[string]*ct.DeploymentProcess, len(formation.Processes))
+	for typ, n := range formation.Processes {
+		processes[typ] = &ct.DeploymentProcess{Desired: n}
+	}
+	hosts, err := d.cc.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	for hostID := range hosts {
+		client, err := d.cc.DialHost(hostID)
+		if err != nil {
+			return nil, err
+		}
+		jobs, err := client.ListJobs()
+		client.Close()
+		if err != nil {
+			return nil, err
+		}
+		for jobID, j := range jobs {
+			if j.Job == nil || stopped[utils.FormatJobID(hostID, jobID)] {
+				continue
+			}
+			attrs := j.Job.Attributes
+			if attrs["flynn-controller.app"] != deployment.AppID || attrs["flynn-controller.release"] != deployment.NewReleaseID {
+				continue
+			}
+			p, ok := processes[attrs["flynn-controller.type"]]
+			if !ok {
+				continue
+			}
+			switch jobStates[j.Status] {
+			case ct.JobStateUp:
+				p.Up++
+			case ct.JobStateCrashed, ct.JobStateFailed:
+				if !j.StartedAt.Before(began) {
+					p.Down++
+				}
+			}
+		}
+	}
+	return processes, nil
+}
+
+// createDeployment starts deploying a release to an app and responds with the
+// pending deployment, or the queued deployment if the deployment limits are
+// reached.
+func createDeployment(app *ct.App, dr ct.DeployReq, apps *AppRepo, releases *ReleaseRepo, queue *DeploymentQueue, req *http.Request, r render.Render) {
+	var oldReleaseID string
+	if current, err := apps.GetRelease(app.ID); err == nil {
+		// the first release of a protected app may be deployed without an
+		// override
+		if app.Protected && !protectedOverride(req) {
+			respondWithError(r, ErrAppProtected)
+			return
+		}
+		oldReleaseID = current.ID
+	} else if err != ErrNotFound {
+		respondWithError(r, err)
+		return
+	}
+	if dr.Base != "" {
+		base, err := releases.ResolveID(app.ID, dr.Base)
+		if err != nil && err != ErrNotFound {
+			respondWithError(r, err)
+			return
+		}
+		if base != oldReleaseID {
+			respondWithError(r, ErrPreconditionFailed)
+			return
+		}
+	}
+	release, err := releases.GetForApp(app.ID, dr.ReleaseID)
+	if err == ErrNotFound {
+		r.JSON(400, ct.ValidationError{Field: "id", Message: "does not refer to a release"})
+		return
+	} else if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := releases.CheckRunnable(release); err != nil {
+		respondWithError(r, err)
+		return
+	}
+
+	deployment := &ct.Deployment{
+		AppID:        app.ID,
+		OldReleaseID: oldReleaseID,
+		NewReleaseID: release.ID,
+		Strategy:     app.Strategy,
+	}
+	if err := queue.Add(deployment); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, deployment)
+}
+
+func getDeployment(app *ct.App, repo *DeploymentRepo, params martini.Params, r render.Render) {
+	deployment, err := repo.Get(params["deployment_id"])
+	if err == nil && deployment.AppID != app.ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, deployment)
+}
+
+func listDeployments(app *ct.App, repo *DeploymentRepo, r render.Render) {
+	deployments, err := repo.List(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, deployments)
+}
+
+// streamDeploymentEvents responds with the events of a deployment after the
+// ID in the Last-Event-ID header or since parameter, so that clients can show
+// the progress of its processes. Clients accepting text/event-stream are sent
+// new events until the deployment finishes, followed by an eof event, others
+// receive a JSON list of up to maxAppEvents events.
+func streamDeploymentEvents(app *ct.App, repo *DeploymentRepo, events *AppEventRepo, params martini.Params, req *http.Request, w http.ResponseWriter, r render.Render) {
+	deployment, err := repo.Get(params["deployment_id"])
+	if err == nil && deployment.AppID != app.ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	after, err := lastEventID(req)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		list, err := events.ListObject(app.ID, ct.EventTypeDeployment, deployment.ID, after, maxAppEvents)
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		res := make([]*ct.DeploymentEvent, len(list))
+		for i, e := range list {
+			res[i] = &ct.DeploymentEvent{}
+			if err := json.Unmarshal(*e.Data, res[i]); err != nil {
+				respondWithError(r, err)
+				return
+			}
+		}
+		r.JSON(200, res)
+		return
+	}
+
+	ch, err := events.Subscribe(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	defer events.Unsubscribe(app.ID, ch)
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	keepalive := time.NewTicker(appEventKeepalive)
+	defer keepalive.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(200)
+	flush()
+	// the final event of a finished deployment may be before the requested
+	// ID, in which case only eof is sent
+	finished := deployment.FinishedAt != nil
+	for {
+		list, err := events.ListObject(app.ID, ct.EventTypeDeployment, deployment.ID, after, maxAppEvents)
+		if err != nil {
+			log.Println("error listing deployment events:", err)
+			return
+		}
+		for _, e := range list {
+			var event ct.Deployment
+			if err := json.Unmarshal(*e.Data, &event); err != nil {
+				log.Println("error decoding deployment event:", err)
+				return
+			}
+			if event.FinishedAt != nil {
+				finished = true
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.ObjectType, *e.Data); err != nil {
+				return
+			}
+			after = e.ID
+		}
+		flush()
+		if len(list) == maxAppEvents {
+			continue
+		}
+		if finished {
+			w.Write([]byte("event: eof\ndata: {}\n\n"))
+			flush()
+			return
+		}
+		select {
+		case <-ch:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+			flush()
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+const (
+	deploymentQueueTask     = "deployment_queue"
+	deploymentQueueInterval = 10 * time.Second
+)
+
+// DeploymentLimits caps how many deployments run at once across the cluster
+// and within each org, to bound image pulls and scheduler churn. The org of
+// a deployment is the org meta value of its app, which only admins can set,
+// see ct.AppMetaOrg. Apps without one are only subject to the cluster limit.
+// Zero limits are unlimited.
+type DeploymentLimits struct {
+	Cluster int
+	Org     int
+}
+
+// deploymentLimitsFromEnv reads the limits from DEPLOY_CONCURRENCY and
+// DEPLOY_ORG_CONCURRENCY.
+func deploymentLimitsFromEnv() DeploymentLimits {
+	var limits DeploymentLimits
+	if n, err := strconv.Atoi(os.Getenv("DEPLOY_CONCURRENCY")); err == nil && n > 0 {
+		limits.Cluster = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("DEPLOY_ORG_CONCURRENCY")); err == nil && n > 0 {
+		limits.Org = n
+	}
+	return limits
+}
+
+// allow reports whether another deployment of org may start while total
+// deployments are running, of which running are in org.
+func (l DeploymentLimits) allow(total, running int, org string) bool {
+	if l.Cluster > 0 && total >= l.Cluster {
+		return false
+	}
+	return org == "" || l.Org == 0 || running < l.Org
+}
+
+// DeploymentQueue runs deployments as they leave the queue. Queued
+// deployments are dispatched when deployments finish, and by a periodic task
+// in case a dispatch was missed.
+type DeploymentQueue struct {
+	repo   *DeploymentRepo
+	runner *TaskRunner
+}
+
+func NewDeploymentQueue(repo *DeploymentRepo, runner *TaskRunner) *DeploymentQueue {
+	return &DeploymentQueue{repo: repo, runner: runner}
+}
+
+// Trigger dispatches queued deployments without waiting for the next
+// periodic dispatch.
+func (q *DeploymentQueue) Trigger() {
+	q.runner.Trigger(deploymentQueueTask)
+}
+
+// Run dispatches queued deployments as a periodic task.
+func (q *DeploymentQueue) Run(*ct.Task) (interface{}, error) {
+	started, err := q.repo.Dispatch()
+	if err != nil {
+		return nil, err
+	}
+	q.run(started)
+	return nil, nil
+}
+
+// Add queues a deployment, running it and any other deployments which were
+// dispatched with it. An error is returned if the deployment could not be
+// run, in which case it has failed.
+func (q *DeploymentQueue) Add(d *ct.Deployment) error {
+	started, err := q.repo.Add(d)
+	if err != nil {
+		return err
+	}
+	return q.run(started)[d.ID]
+}
+
+// run enqueues the tasks of started deployments, failing those which could
+// not be enqueued, and returns their errors by deployment ID.
+func (q *DeploymentQueue) run(started []*ct.Deployment) map[string]error {
+	errs := make(map[string]error)
+	for _, d := range started {
+		if _, err := q.runner.Enqueue(deploymentTask, &deploymentData{ID: d.ID}, 1); err != nil {
+			log.Printf("error running deployment %s: %s", d.ID, err)
+			if serr := q.repo.SetStatus(d.ID, ct.DeploymentStatusFailed, err); serr != nil {
+				log.Printf("error failing deployment %s: %s", d.ID, serr)
+			}
+			errs[d.ID] = err
+		}
+	}
+	return errs
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-host/types"
+	. "github.com/titanous/gocheck"
+)
+
+func waitDeployment(c *C, client *controller.Client, appID, id string) *ct.Deployment {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		deployment, err := client.GetDeployment(appID, id)
+		c.Assert(err, IsNil)
+		if deployment.FinishedAt != nil {
+			return deployment
+		}
+	}
+	c.Fatalf("timed out waiting for deployment %s", id)
+	return nil
+}
+
+func (s *S) TestDeployment(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "deployment"})
+	release1 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release1.ID, Processes: map[string]int{"web": 1}})
+	s.setAppRelease(c, app.ID, release1.ID)
+	release2 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"web0": {Job: &host.Job{ID: "web0", Attributes: map[string]string{
+			"flynn-controller.app":     app.ID,
+			"flynn-controller.release": release2.ID,
+			"flynn-controller.type":    "web",
+		}}, Status: host.StatusRunning},
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+	defer s.cc.setHosts(nil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	deployment, err := client.Deploy(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(deployment.OldReleaseID, Equals, release1.ID)
+	c.Assert(deployment.NewReleaseID, Equals, release2.ID)
+	c.Assert(deployment.Strategy, Equals, ct.DeployAllAtOnce)
+
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusComplete)
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release2.ID)
+	formation, err := client.GetFormation(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 1})
+
+	deployments, err := client.Deployments(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(deployments, HasLen, 1)
+	c.Assert(deployments[0].ID, Equals, deployment.ID)
+
+	// each status of the deployment and the progress of its processes is
+	// recorded
+	events, err := client.DeploymentEvents(app.ID, deployment.ID)
+	c.Assert(err, IsNil)
+	var statuses []string
+	for _, e := range events {
+		c.Assert(e.ID, Equals, deployment.ID)
+		if e.Processes != nil {
+			c.Assert(e.Status, Equals, ct.DeploymentStatusRunning)
+			c.Assert(e.Processes, DeepEquals, map[string]*ct.DeploymentProcess{"web": {Desired: 1, Up: 1}})
+			statuses = append(statuses, "progress")
+			continue
+		}
+		statuses = append(statuses, e.Status)
+	}
+	c.Assert(statuses, DeepEquals, []string{ct.DeploymentStatusPending, ct.DeploymentStatusRunning, "progress", ct.DeploymentStatusComplete})
+
+	// the event stream of a finished deployment ends after its events
+	stream, streamErr := client.StreamDeploymentEvents(app.ID, deployment.ID)
+	var streamed []*ct.DeploymentEvent
+	for e := range stream {
+		streamed = append(streamed, e)
+	}
+	c.Assert(*streamErr, IsNil)
+	c.Assert(streamed, HasLen, len(events))
+	c.Assert(streamed[len(streamed)-1].Status, Equals, ct.DeploymentStatusComplete)
+
+	_, err = client.Deploy(app.ID, "missing")
+	c.Assert(err, NotNil)
+	other := s.createTestApp(c, &ct.App{Name: "deployment-other"})
+	_, err = client.GetDeployment(other.ID, deployment.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = client.DeploymentEvents(other.ID, deployment.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestDeploymentRollback(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "deployment-rollback"})
+	release1 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release1.ID, Processes: map[string]int{"web": 2}})
+	s.setAppRelease(c, app.ID, release1.ID)
+	release2 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+
+	hc := newFakeHostClient()
+	stoppedJobs := func(status host.JobStatus, startedAt time.Time) map[string]host.ActiveJob {
+		jobs := make(map[string]host.ActiveJob)
+		for i := 0; i < deploymentMaxCrashes; i++ {
+			id := fmt.Sprintf("web%d", i)
+			jobs[id] = host.ActiveJob{Job: &host.Job{ID: id, Attributes: map[string]string{
+				"flynn-controller.app":     app.ID,
+				"flynn-controller.release": release2.ID,
+				"flynn-controller.type":    "web",
+			}}, Status: status, StartedAt: startedAt}
+		}
+		return jobs
+	}
+	// the jobs crash once the deployment has begun
+	hc.jobs = stoppedJobs(host.StatusCrashed, time.Now().Add(time.Hour))
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+	defer s.cc.setHosts(nil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	assertRolledBack := func(deployment *ct.Deployment) {
+		c.Assert(deployment.Status, Equals, ct.DeploymentStatusFailed)
+		c.Assert(strings.HasSuffix(deployment.Error, "rolled back to release "+release1.ID), Equals, true, Commentf(deployment.Error))
+		current, err := client.GetAppRelease(app.ID)
+		c.Assert(err, IsNil)
+		c.Assert(current.ID, Equals, release1.ID)
+		formation, err := client.GetFormation(app.ID, release1.ID)
+		c.Assert(err, IsNil)
+		c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	}
+
+	// the new jobs keep crashing
+	deployment, err := client.Deploy(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(strings.Contains(deployment.Error, "jobs of release "+release2.ID+" crashed"), Equals, true, Commentf(deployment.Error))
+	assertRolledBack(deployment)
+
+	// the new jobs never start
+	hc.jobs = nil
+	defer func(timeout time.Duration) { deploymentTimeout = timeout }(deploymentTimeout)
+	deploymentTimeout = 0
+	deployment, err = client.Deploy(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(strings.Contains(deployment.Error, "timed out"), Equals, true, Commentf(deployment.Error))
+	assertRolledBack(deployment)
+
+	// jobs which crashed before the deployment began or stopped cleanly do
+	// not fail it
+	for _, jobs := range []map[string]host.ActiveJob{
+		stoppedJobs(host.StatusCrashed, time.Now().Add(-time.Hour)),
+		stoppedJobs(host.StatusDone, time.Now().Add(time.Hour)),
+	} {
+		hc.jobs = jobs
+		deployment, err = client.Deploy(app.ID, release2.ID)
+		c.Assert(err, IsNil)
+		deployment = waitDeployment(c, client, app.ID, deployment.ID)
+		c.Assert(strings.Contains(deployment.Error, "timed out"), Equals, true, Commentf(deployment.Error))
+		assertRolledBack(deployment)
+	}
+}
+
+func (s *S) TestDeploymentOneByOne(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "deployment-one-by-one", Strategy: ct.DeployOneByOne})
+	procs := map[string]ct.ProcessType{"web": {DependsOn: []string{"worker"}}, "worker": {}}
+	release1 := s.createTestRelease(c, &ct.Release{Processes: procs})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release1.ID, Processes: map[string]int{"web": 2, "worker": 1}})
+	s.setAppRelease(c, app.ID, release1.ID)
+	release2 := s.createTestRelease(c, &ct.Release{Processes: procs})
+
+	job := func(typ string, status host.JobStatus) host.ActiveJob {
+		return host.ActiveJob{Job: &host.Job{Attributes: map[string]string{
+			"flynn-controller.app":     app.ID,
+			"flynn-controller.release": release2.ID,
+			"flynn-controller.type":    typ,
+		}}, Status: status, StartedAt: time.Now().Add(time.Hour)}
+	}
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"worker0": job("worker", host.StatusRunning),
+		"web0":    job("web", host.StatusRunning),
+		"web1":    job("web", host.StatusRunning),
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+	defer s.cc.setHosts(nil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	deployment, err := client.Deploy(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(deployment.Strategy, Equals, ct.DeployOneByOne)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusComplete, Commentf(deployment.Error))
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release2.ID)
+	formation, err := client.GetFormation(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2, "worker": 1})
+	_, err = client.GetFormation(app.ID, release1.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// the processes are replaced one at a time, after the types they
+	// depend on
+	events, err := client.DeploymentEvents(app.ID, deployment.ID)
+	c.Assert(err, IsNil)
+	var desired []map[string]int
+	for _, e := range events {
+		if e.Processes == nil {
+			continue
+		}
+		d := make(map[string]int, len(e.Processes))
+		for typ, p := range e.Processes {
+			d[typ] = p.Desired
+		}
+		desired = append(desired, d)
+	}
+	c.Assert(desired, DeepEquals, []map[string]int{
+		{"worker": 1},
+		{"worker": 1, "web": 1},
+		{"worker": 1, "web": 2},
+	})
+
+	// a failed deployment restores the old formation in full
+	s.setAppRelease(c, app.ID, release1.ID)
+	hc.jobs = map[string]host.ActiveJob{"worker0": job("worker", host.StatusRunning)}
+	for i := 0; i < deploymentMaxCrashes; i++ {
+		hc.jobs[fmt.Sprintf("web%d", i)] = job("web", host.StatusCrashed)
+	}
+	deployment, err = client.Deploy(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusFailed)
+	c.Assert(strings.HasSuffix(deployment.Error, "rolled back to release "+release1.ID), Equals, true, Commentf(deployment.Error))
+	current, err = client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release1.ID)
+	formation, err = client.GetFormation(app.ID, release1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2, "worker": 1})
+	_, err = client.GetFormation(app.ID, release2.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestDeploymentRollbackAfterPrune(c *C) {
+	// the old release is beyond the retention of the app once the new one is
+	// deployed, but is kept until the deployment finishes
+	app := s.createTestApp(c, &ct.App{Name: "deployment-rollback-prune", ReleaseRetention: 1})
+	release1 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release1.ID, Processes: map[string]int{"web": 1}})
+	s.setAppRelease(c, app.ID, release1.ID)
+	release2 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+
+	defer func(timeout time.Duration) { deploymentTimeout = timeout }(deploymentTimeout)
+	deploymentTimeout = 0
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	deployment, err := client.Deploy(app.ID, release2.ID)
+	c.Assert(err, IsNil)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusFailed)
+	c.Assert(strings.HasSuffix(deployment.Error, "rolled back to release "+release1.ID), Equals, true, Commentf(deployment.Error))
+
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release1.ID)
+	formation, err := client.GetFormation(app.ID, release1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 1})
+}
+
+func (s *S) TestDeploymentQueue(c *C) {
+	repo := s.m.Get(reflect.TypeOf((*DeploymentRepo)(nil))).Interface().(*DeploymentRepo)
+	repo.limits = DeploymentLimits{Cluster: 1}
+	defer func() { repo.limits = DeploymentLimits{} }()
+	defer func(timeout time.Duration) { deploymentTimeout = timeout }(deploymentTimeout)
+	deploymentTimeout = 2 * time.Second
+
+	deploy := func(name string) (*ct.App, *ct.Release) {
+		app := s.createTestApp(c, &ct.App{Name: name})
+		release1 := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+		s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release1.ID, Processes: map[string]int{"web": 1}})
+		s.setAppRelease(c, app.ID, release1.ID)
+		return app, s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	}
+	app1, release1 := deploy("deployment-queue-1")
+	app2, release2 := deploy("deployment-queue-2")
+
+	// only the jobs of the second app start, so the first deployment holds
+	// up the queue until it times out
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"web0": {Job: &host.Job{ID: "web0", Attributes: map[string]string{
+			"flynn-controller.app":     app2.ID,
+			"flynn-controller.release": release2.ID,
+			"flynn-controller.type":    "web",
+		}}, Status: host.StatusRunning},
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+	defer s.cc.setHosts(nil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	first, err := client.Deploy(app1.ID, release1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(first.Status, Equals, ct.DeploymentStatusPending)
+	second, err := client.Deploy(app2.ID, release2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(second.Status, Equals, ct.DeploymentStatusQueued)
+	c.Assert(second.QueuePosition, Equals, 1)
+
+	first = waitDeployment(c, client, app1.ID, first.ID)
+	c.Assert(first.Status, Equals, ct.DeploymentStatusFailed)
+	second = waitDeployment(c, client, app2.ID, second.ID)
+	c.Assert(second.Status, Equals, ct.DeploymentStatusComplete)
+	c.Assert(second.QueuePosition, Equals, 0)
+
+	// the queue position is recorded in the events of the deployment
+	events, err := client.DeploymentEvents(app2.ID, second.ID)
+	c.Assert(err, IsNil)
+	c.Assert(len(events) > 2, Equals, true)
+	c.Assert(events[0].Status, Equals, ct.DeploymentStatusQueued)
+	c.Assert(events[0].QueuePosition, Equals, 1)
+	c.Assert(events[1].Status, Equals, ct.DeploymentStatusPending)
+}
+
+func (s *S) TestDeploymentLimits(c *C) {
+	for _, t := range []struct {
+		limits         DeploymentLimits
+		total, running int
+		org            string
+		allow          bool
+	}{
+		{DeploymentLimits{}, 100, 100, "acme", true},
+		{DeploymentLimits{Cluster: 2}, 1, 0, "", true},
+		{DeploymentLimits{Cluster: 2}, 2, 0, "", false},
+		{DeploymentLimits{Org: 1}, 5, 0, "acme", true},
+		{DeploymentLimits{Org: 1}, 5, 1, "acme", false},
+		{DeploymentLimits{Org: 1}, 5, 1, "", true},
+		{DeploymentLimits{Cluster: 5, Org: 2}, 5, 1, "acme", false},
+	} {
+		c.Assert(t.limits.allow(t.total, t.running, t.org), Equals, t.allow, Commentf("%+v", t))
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/flynn/pq/hstore"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+type EnvGroupRepo struct {
+	db *DB
+}
+
+func NewEnvGroupRepo(db *DB) *EnvGroupRepo {
+	return &EnvGroupRepo{db}
+}
+
+func (r *EnvGroupRepo) Add(g *ct.EnvGroup) error {
+	if g.Name == "" {
+		return ct.ValidationError{Field: "name", Message: "must not be blank"}
+	}
+	if len(g.Name) > 30 || !appNamePattern.MatchString(g.Name) {
+		return ct.ValidationError{Field: "name", Message: "is invalid"}
+	}
+	err := r.db.QueryRow("INSERT INTO env_groups (name, env) VALUES ($1, $2) RETURNING env_group_id, created_at, updated_at",
+		g.Name, envHstore(g.Env)).Scan(&g.ID, &g.CreatedAt, &g.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return ct.ValidationError{Field: "name", Message: "is already taken"}
+	}
+	g.ID = cleanUUID(g.ID)
+	return err
+}
+
+func scanEnvGroup(s Scanner) (*ct.EnvGroup, error) {
+	g := &ct.EnvGroup{}
+	var env hstore.Hstore
+	err := s.Scan(&g.ID, &g.Name, &env, &g.CreatedAt, &g.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	g.ID = cleanUUID(g.ID)
+	g.Env = make(map[string]string, len(env.Map))
+	for k, v := range env.Map {
+		g.Env[k] = v.String
+	}
+	return g, err
+}
+
+func (r *EnvGroupRepo) Get(id string) (*ct.EnvGroup, error) {
+	var row Scanner
+	query := "SELECT env_group_id, name, env, created_at, updated_at FROM env_groups WHERE deleted_at IS NULL AND "
+	if idPattern.MatchString(id) {
+		row = r.db.QueryRow(query+"(env_group_id = $1 OR name = $2) LIMIT 1", id, id)
+	} else {
+		row = r.db.QueryRow(query+"name = $1", id)
+	}
+	return scanEnvGroup(row)
+}
+
+func (r *EnvGroupRepo) list(query string, args ...interface{}) ([]*ct.EnvGroup, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	groups := []*ct.EnvGroup{}
+	for rows.Next() {
+		g, err := scanEnvGroup(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (r *EnvGroupRepo) List() ([]*ct.EnvGroup, error) {
+	return r.list("SELECT env_group_id, name, env, created_at, updated_at FROM env_groups WHERE deleted_at IS NULL ORDER BY name")
+}
+
+// AppList returns the env groups referenced by an app.
+func (r *EnvGroupRepo) AppList(appID string) ([]*ct.EnvGroup, error) {
+	return r.list(`SELECT g.env_group_id, g.name, g.env, g.created_at, g.updated_at
+				   FROM env_groups g JOIN app_env_groups a USING (env_group_id)
+				   WHERE a.app_id = $1 AND g.deleted_at IS NULL ORDER BY a.created_at`, appID)
+}
+
+// AppIDs returns the IDs of the apps which reference an env group.
+func (r *EnvGroupRepo) AppIDs(groupID string) ([]string, error) {
+	rows, err := r.db.Query("SELECT g.app_id FROM app_env_groups g JOIN apps a USING (app_id) WHERE g.env_group_id = $1 AND a.deleted_at IS NULL", groupID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, cleanUUID(id))
+	}
+	return ids, rows.Err()
+}
+
+func (r *EnvGroupRepo) SetEnv(g *ct.EnvGroup) error {
+	return r.db.QueryRow("UPDATE env_groups SET env = $2, updated_at = now() WHERE env_group_id = $1 RETURNING updated_at",
+		g.ID, envHstore(g.Env)).Scan(&g.UpdatedAt)
+}
+
+// AddApp references an env group from an app, returning false if the app
+// already referenced it.
+func (r *EnvGroupRepo) AddApp(groupID, appID string) (bool, error) {
+	err := r.db.Exec("INSERT INTO app_env_groups (app_id, env_group_id) VALUES ($1, $2)", appID, groupID)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *EnvGroupRepo) RemoveApp(groupID, appID string) error {
+	return r.db.Exec("DELETE FROM app_env_groups WHERE app_id = $1 AND env_group_id = $2", appID, groupID)
+}
+
+// AppliedEnv returns the env of a group last applied to the release of an
+// app which references it, which is nil if none has been applied.
+func (r *EnvGroupRepo) AppliedEnv(groupID, appID string) (map[string]string, error) {
+	var env hstore.Hstore
+	err := r.db.QueryRow("SELECT env FROM app_env_groups WHERE app_id = $1 AND env_group_id = $2", appID, groupID).Scan(&env)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if env.Map == nil {
+		return nil, nil
+	}
+	res := make(map[string]string, len(env.Map))
+	for k, v := range env.Map {
+		res[k] = v.String
+	}
+	return res, nil
+}
+
+// SetAppliedEnv records the env of a group applied to the release of an app.
+func (r *EnvGroupRepo) SetAppliedEnv(groupID, appID string, env map[string]string) error {
+	return r.db.Exec("UPDATE app_env_groups SET env = $3 WHERE app_id = $1 AND env_group_id = $2", appID, groupID, envHstore(env))
+}
+
+// EnvGroupApplier applies the env of groups to the apps which reference
+// them by creating and deploying new releases of the apps. The releases are
+// sent to the admission hooks like any other.
+type EnvGroupApplier struct {
+	repo        *EnvGroupRepo
+	apps        *AppRepo
+	releases    *ReleaseRepo
+	formations  *FormationRepo
+	locks       *AppLockRepo
+	deployments *DeploymentRepo
+	admitter    *Admitter
+}
+
+func NewEnvGroupApplier(repo *EnvGroupRepo, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, locks *AppLockRepo, deployments *DeploymentRepo, admitter *Admitter) *EnvGroupApplier {
+	return &EnvGroupApplier{repo: repo, apps: apps, releases: releases, formations: formations, locks: locks, deployments: deployments, admitter: admitter}
+}
+
+// ApplyMember applies a group being updated to one of the apps which
+// reference it. Apps which are protected or locked may only be released by
+// their owner, so they are skipped with ErrAppProtected or ErrAppLocked, as
+// are apps in maintenance mode or being deployed. The applied env of a
+// skipped app is left as it was, so updating the group again releases it.
+func (a *EnvGroupApplier) ApplyMember(appID string, group *ct.EnvGroup) error {
+	app, err := selectApp(a.apps.db, appID, false)
+	if err != nil {
+		return err
+	}
+	if app.Protected {
+		return ErrAppProtected
+	}
+	if _, err := a.locks.Get(appID); err == nil {
+		return ErrAppLocked
+	} else if err != ErrNotFound {
+		return err
+	}
+	return a.Apply(appID, group)
+}
+
+// Apply applies the current env of a group to an app which references it,
+// recording it as applied. A change which failed part way through is
+// resumed by applying the group again.
+func (a *EnvGroupApplier) Apply(appID string, group *ct.EnvGroup) error {
+	prev, err := a.repo.AppliedEnv(group.ID, appID)
+	if err != nil {
+		return err
+	}
+	if err := a.applyChange(appID, prev, group.Env); err != nil {
+		return err
+	}
+	return a.repo.SetAppliedEnv(group.ID, appID, group.Env)
+}
+
+// applyChange creates and deploys a new release of an app with the env vars
+// of a group changed from prev to env. Vars the release sets to other values
+// than prev are overrides of the app, which are applied last so that they
+// win over the group, and are kept when removed from the group. Apps without
+// a release or whose env is unchanged are left alone, while apps in
+// maintenance mode or being deployed are not released.
+func (a *EnvGroupApplier) applyChange(appID string, prev, env map[string]string) error {
+	app, err := selectApp(a.apps.db, appID, false)
+	if err != nil {
+		return err
+	}
+	if app.Maintenance {
+		return ErrAppMaintenance
+	}
+	if deploying, err := a.deployments.InProgress(appID); err != nil {
+		return err
+	} else if deploying {
+		return ErrDeploymentInProgress
+	}
+	current, err := a.apps.GetRelease(appID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	newEnv := make(map[string]string, len(current.Env)+len(env))
+	overrides := make(map[string]string)
+	for k, v := range current.Env {
+		if p, ok := prev[k]; !ok || p != v {
+			overrides[k] = v
+		}
+	}
+	for k, v := range env {
+		newEnv[k] = v
+	}
+	for k, v := range overrides {
+		newEnv[k] = v
+	}
+	if envEqual(current.Env, newEnv) {
+		return nil
+	}
+
+	release := *current
+	release.ID = ""
+	release.CreatedAt = nil
+	release.Env = newEnv
+	if err := a.admitter.Admit("releases", "create", &release); err != nil {
+		return err
+	}
+	if err := a.releases.Add(&release); err != nil {
+		return err
+	}
+	return deployRelease(appID, &release, a.formations)
+}
+
+func envEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func getEnvGroupMiddleware(c martini.Context, params martini.Params, repo *EnvGroupRepo, w http.ResponseWriter) {
+	group, err := repo.Get(params["group_id"])
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(404)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	c.Map(group)
+}
+
+func createEnvGroup(group ct.EnvGroup, repo *EnvGroupRepo, r render.Render) {
+	if err := repo.Add(&group); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, &group)
+}
+
+func listEnvGroups(repo *EnvGroupRepo, r render.Render) {
+	groups, err := repo.List()
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, groups)
+}
+
+func getEnvGroup(group *ct.EnvGroup, r render.Render) {
+	r.JSON(200, group)
+}
+
+// envGroupSkipReasons are the reasons reported in ct.EnvGroup.SkippedApps for
+// the errors with which EnvGroupApplier.ApplyMember skips apps.
+var envGroupSkipReasons = map[error]string{
+	ErrAppProtected:         "is protected",
+	ErrAppLocked:            "is locked",
+	ErrAppMaintenance:       "is in maintenance mode",
+	ErrDeploymentInProgress: "has a deployment in progress",
+}
+
+// updateEnvGroup replaces the env of a group and creates a new release for
+// each app that references it. Apps which are skipped are listed in the
+// response, and if releasing an app fails, repeating the update releases the
+// apps which were not released yet.
+func updateEnvGroup(group *ct.EnvGroup, req ct.EnvGroup, repo *EnvGroupRepo, applier *EnvGroupApplier, r render.Render) {
+	group.Env = req.Env
+	if err := repo.SetEnv(group); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	appIDs, err := repo.AppIDs(group.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	for _, appID := range appIDs {
+		err := applier.ApplyMember(appID, group)
+		if reason, ok := envGroupSkipReasons[err]; ok {
+			if group.SkippedApps == nil {
+				group.SkippedApps = make(map[string]string)
+			}
+			group.SkippedApps[appID] = reason
+			continue
+		}
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+	}
+	r.JSON(200, group)
+}
+
+func getAppEnvGroups(app *ct.App, repo *EnvGroupRepo, r render.Render) {
+	groups, err := repo.AppList(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, groups)
+}
+
+func addAppEnvGroup(app *ct.App, group *ct.EnvGroup, repo *EnvGroupRepo, applier *EnvGroupApplier, r render.Render) {
+	// the group is applied even if the app already referenced it, in case
+	// applying it failed before
+	if _, err := repo.AddApp(group.ID, app.ID); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := applier.Apply(app.ID, group); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, group)
+}
+
+// removeAppEnvGroup removes the env of a group from an app before removing
+// the reference, so that a failed removal can be repeated.
+func removeAppEnvGroup(app *ct.App, group *ct.EnvGroup, repo *EnvGroupRepo, applier *EnvGroupApplier, w http.ResponseWriter) {
+	prev, err := repo.AppliedEnv(group.ID, app.ID)
+	if err == ErrNotFound {
+		w.WriteHeader(200)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	if err := applier.applyChange(app.ID, prev, nil); err == ErrAppMaintenance || err == ErrDeploymentInProgress {
+		w.WriteHeader(409)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	if err := repo.RemoveApp(group.ID, app.ID); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
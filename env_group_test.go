@@ -0,0 +1,172 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) createTestEnvGroup(c *C, in *ct.EnvGroup) *ct.EnvGroup {
+	out := &ct.EnvGroup{}
+	res, err := s.Post("/env-groups", in, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	return out
+}
+
+func (s *S) TestEnvGroups(c *C) {
+	group := s.createTestEnvGroup(c, &ct.EnvGroup{Name: "shared-keys", Env: map[string]string{"API_KEY": "1", "REGION": "us"}})
+	c.Assert(group.ID, Not(Equals), "")
+
+	res, err := s.send("POST", "/env-groups", &ct.EnvGroup{Name: "shared-keys"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	gotGroup := &ct.EnvGroup{}
+	_, err = s.Get("/env-groups/"+group.Name, gotGroup)
+	c.Assert(err, IsNil)
+	c.Assert(gotGroup, DeepEquals, group)
+
+	app := s.createTestApp(c, &ct.App{Name: "env-group-app"})
+	release := s.createTestRelease(c, &ct.Release{Env: map[string]string{"REGION": "eu", "PORT": "80"}})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+
+	getRelease := func() *ct.Release {
+		out := &ct.Release{}
+		_, err := s.Get("/apps/"+app.ID+"/release", out)
+		c.Assert(err, IsNil)
+		return out
+	}
+
+	// referencing the group creates a release with the group env, the env
+	// the app sets itself overrides the group
+	_, err = s.Put("/apps/"+app.ID+"/env-groups/"+group.ID, nil, &ct.EnvGroup{})
+	c.Assert(err, IsNil)
+	current := getRelease()
+	c.Assert(current.ID, Not(Equals), release.ID)
+	c.Assert(current.ArtifactID, Equals, release.ArtifactID)
+	c.Assert(current.Env, DeepEquals, map[string]string{"API_KEY": "1", "REGION": "eu", "PORT": "80"})
+
+	// referencing it again changes nothing
+	_, err = s.Put("/apps/"+app.ID+"/env-groups/"+group.ID, nil, &ct.EnvGroup{})
+	c.Assert(err, IsNil)
+	c.Assert(getRelease().ID, Equals, current.ID)
+
+	var formations []*ct.Formation
+	_, err = s.Get("/apps/"+app.ID+"/formations", &formations)
+	c.Assert(err, IsNil)
+	c.Assert(formations, HasLen, 1)
+	c.Assert(formations[0].ReleaseID, Equals, current.ID)
+	c.Assert(formations[0].Processes, DeepEquals, map[string]int{"web": 2})
+
+	var groups []*ct.EnvGroup
+	_, err = s.Get("/apps/"+app.Name+"/env-groups", &groups)
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 1)
+	c.Assert(groups[0].ID, Equals, group.ID)
+
+	// updating the group releases the referencing app
+	_, err = s.Put("/env-groups/"+group.ID, &ct.EnvGroup{Env: map[string]string{"API_KEY": "2"}}, gotGroup)
+	c.Assert(err, IsNil)
+	updated := getRelease()
+	c.Assert(updated.ID, Not(Equals), current.ID)
+	c.Assert(updated.Env, DeepEquals, map[string]string{"API_KEY": "2", "REGION": "eu", "PORT": "80"})
+
+	// an update which failed to release an app is resumed by repeating it
+	repo := s.m.Get(reflect.TypeOf((*EnvGroupRepo)(nil))).Interface().(*EnvGroupRepo)
+	c.Assert(repo.SetAppliedEnv(group.ID, app.ID, map[string]string{"API_KEY": "1", "REGION": "us"}), IsNil)
+	stale := s.createTestRelease(c, &ct.Release{ArtifactID: updated.ArtifactID, Env: map[string]string{"API_KEY": "1", "REGION": "eu", "PORT": "80"}})
+	s.setAppRelease(c, app.ID, stale.ID)
+	_, err = s.Put("/env-groups/"+group.ID, &ct.EnvGroup{Env: map[string]string{"API_KEY": "2"}}, gotGroup)
+	c.Assert(err, IsNil)
+	updated = getRelease()
+	c.Assert(updated.ID, Not(Equals), stale.ID)
+	c.Assert(updated.Env, DeepEquals, map[string]string{"API_KEY": "2", "REGION": "eu", "PORT": "80"})
+
+	// removing the reference removes the group env
+	res, err = s.Delete("/apps/" + app.ID + "/env-groups/" + group.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(getRelease().Env, DeepEquals, map[string]string{"REGION": "eu", "PORT": "80"})
+
+	res, err = s.Get("/env-groups/unknown-group", gotGroup)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestEnvGroupSkippedApps(c *C) {
+	group := s.createTestEnvGroup(c, &ct.EnvGroup{Name: "skipped-apps", Env: map[string]string{"API_KEY": "1"}})
+	member := func(app *ct.App) *ct.App {
+		app = s.createTestApp(c, app)
+		release := s.createTestRelease(c, &ct.Release{})
+		s.setAppRelease(c, app.ID, release.ID)
+		_, err := s.Put("/apps/"+app.ID+"/env-groups/"+group.ID, nil, &ct.EnvGroup{})
+		c.Assert(err, IsNil)
+		return app
+	}
+	protected := member(&ct.App{Name: "skipped-protected"})
+	locked := member(&ct.App{Name: "skipped-locked"})
+	maintenance := member(&ct.App{Name: "skipped-maintenance"})
+	deploying := member(&ct.App{Name: "skipped-deploying"})
+	released := member(&ct.App{Name: "skipped-released"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	_, _, err = client.UpdateApp(protected.ID, "", map[string]interface{}{"protected": true})
+	c.Assert(err, IsNil)
+	lock, err := client.AcquireAppLock(locked.ID, &ct.AppLock{Holder: "alice", TTL: 30})
+	c.Assert(err, IsNil)
+	_, err = client.SetAppMaintenance(maintenance.ID, true)
+	c.Assert(err, IsNil)
+	deployments := s.m.Get(reflect.TypeOf((*DeploymentRepo)(nil))).Interface().(*DeploymentRepo)
+	current, err := client.GetAppRelease(deploying.ID)
+	c.Assert(err, IsNil)
+	deployment := &ct.Deployment{AppID: deploying.ID, OldReleaseID: current.ID, NewReleaseID: current.ID, Strategy: ct.DeployAllAtOnce}
+	_, err = deployments.Add(deployment)
+	c.Assert(err, IsNil)
+
+	releaseID := func(app *ct.App) string {
+		release, err := client.GetAppRelease(app.ID)
+		c.Assert(err, IsNil)
+		return release.ID
+	}
+	before := make(map[string]string)
+	for _, app := range []*ct.App{protected, locked, maintenance, deploying, released} {
+		before[app.ID] = releaseID(app)
+	}
+
+	// the skipped apps are reported and keep their release
+	updated := &ct.EnvGroup{}
+	_, err = s.Put("/env-groups/"+group.ID, &ct.EnvGroup{Env: map[string]string{"API_KEY": "2"}}, updated)
+	c.Assert(err, IsNil)
+	c.Assert(updated.SkippedApps, DeepEquals, map[string]string{
+		protected.ID:   "is protected",
+		locked.ID:      "is locked",
+		maintenance.ID: "is in maintenance mode",
+		deploying.ID:   "has a deployment in progress",
+	})
+	for _, app := range []*ct.App{protected, locked, maintenance, deploying} {
+		c.Assert(releaseID(app), Equals, before[app.ID])
+	}
+	c.Assert(releaseID(released), Not(Equals), before[released.ID])
+
+	// repeating the update releases the apps which are no longer skipped
+	c.Assert(client.ReleaseAppLock(locked.ID, lock.ID), IsNil)
+	_, err = client.SetAppMaintenance(maintenance.ID, false)
+	c.Assert(err, IsNil)
+	c.Assert(deployments.SetStatus(deployment.ID, ct.DeploymentStatusComplete, nil), IsNil)
+	after := releaseID(released)
+	updated = &ct.EnvGroup{}
+	_, err = s.Put("/env-groups/"+group.ID, &ct.EnvGroup{Env: map[string]string{"API_KEY": "2"}}, updated)
+	c.Assert(err, IsNil)
+	c.Assert(updated.SkippedApps, DeepEquals, map[string]string{protected.ID: "is protected"})
+	for _, app := range []*ct.App{locked, maintenance, deploying} {
+		release, err := client.GetAppRelease(app.ID)
+		c.Assert(err, IsNil)
+		c.Assert(release.ID, Not(Equals), before[app.ID])
+		c.Assert(release.Env, DeepEquals, map[string]string{"API_KEY": "2"})
+	}
+	c.Assert(releaseID(released), Equals, after)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	ct "github.com/flynn/flynn-controller/types"
+	strowgerc "github.com/flynn/strowger/client"
+	"github.com/flynn/strowger/types"
+	"github.com/martini-contrib/render"
+)
+
+// exportApp responds with a bundle of an app and its current release,
+// artifact, formation, env and routes, which can be imported into another
+// cluster with POST /apps/import.
+func exportApp(app *ct.App, apps *AppRepo, artifacts *ArtifactRepo, formations *FormationRepo, router strowgerc.Client, r render.Render) {
+	bundle := &ct.AppExport{App: app}
+	release, err := apps.GetRelease(app.ID)
+	if err != nil && err != ErrNotFound {
+		respondWithError(r, err)
+		return
+	}
+	if err == nil {
+		bundle.Release = release
+		artifact, err := artifacts.Get(release.ArtifactID)
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		bundle.Artifact = artifact.(*ct.Artifact)
+		formation, err := formations.Get(app.ID, release.ID)
+		if err != nil && err != ErrNotFound {
+			respondWithError(r, err)
+			return
+		}
+		bundle.Formation = formation
+	}
+	if bundle.Env, err = apps.GetEnv(app.ID); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if bundle.Routes, err = router.ListRoutes(routeParentRef(app)); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, bundle)
+}
+
+// importApp creates an app from an exported bundle. The app is given a new
+// ID, while the artifact and release keep theirs so that a release imported
+// into several clusters is the same everywhere. Each resource of the bundle
+// is admitted before any is created, and the app is recorded in a single
+// transaction so that a failed import leaves nothing behind. Routes are
+// created in the router once the app is recorded.
+func importApp(bundle ct.AppExport, apps *AppRepo, artifacts *ArtifactRepo, releases *ReleaseRepo, router strowgerc.Client, admitter *Admitter, req *http.Request, r render.Render) {
+	app := bundle.App
+	if app == nil {
+		respondWithError(r, ct.ValidationError{Field: "app", Message: "must be set"})
+		return
+	}
+	if bundle.Release != nil && bundle.Artifact == nil {
+		respondWithError(r, ct.ValidationError{Field: "artifact", Message: "must be set with the release"})
+		return
+	}
+	app.ID = ""
+	app.CreatedAt, app.UpdatedAt, app.DeletedAt = nil, nil, nil
+	if err := admitter.Admit("apps", "create", app); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := apps.validate(app); err != nil {
+		respondWithError(r, err)
+		return
+	}
+
+	if release := bundle.Release; release != nil {
+		// the release uses the artifact, so checking the artifact against
+		// the image allowlist covers both
+		if err := artifacts.CheckCreate(bundle.Artifact, req); err != nil {
+			respondWithError(r, err)
+			return
+		}
+		// existing artifacts are reused, so the ID may change
+		bundle.Artifact.CreatedAt = nil
+		release.ArtifactID = bundle.Artifact.ID
+		release.CreatedAt = nil
+		if err := admitter.Admit("artifacts", "create", bundle.Artifact); err != nil {
+			respondWithError(r, err)
+			return
+		}
+		if err := admitter.Admit("releases", "create", release); err != nil {
+			respondWithError(r, err)
+			return
+		}
+		if f := bundle.Formation; f != nil {
+			f.AppID, f.ReleaseID = app.ID, release.ID
+			// the app has no processes yet, so any process of an app
+			// in maintenance mode is a scale up
+			if app.Maintenance {
+				for _, n := range f.Processes {
+					if n > 0 {
+						respondWithError(r, ErrAppMaintenance)
+						return
+					}
+				}
+			}
+			// formations are admitted as updates, like PUT
+			// /apps/:apps_id/formations/:releases_id
+			if err := admitter.Admit("formations", "update", f); err != nil {
+				respondWithError(r, err)
+				return
+			}
+		}
+	} else {
+		bundle.Formation = nil
+	}
+	routes := make([]*strowger.Route, len(bundle.Routes))
+	for i, route := range bundle.Routes {
+		rt := *route
+		rt.ID = ""
+		rt.ParentRef = routeParentRef(app)
+		rt.CreatedAt, rt.UpdatedAt = nil, nil
+		if err := admitter.Admit("routes", "create", &rt); err != nil {
+			respondWithError(r, err)
+			return
+		}
+		routes[i] = &rt
+	}
+
+	if err := apps.Import(&bundle, artifacts, releases); err != nil {
+		respondWithError(r, err)
+		return
+	}
+
+	for i, rt := range routes {
+		if err := router.CreateRoute(rt); err != nil {
+			log.Printf("Error importing route %s for %s: %s", bundle.Routes[i].ID, app.Name, err)
+			continue
+		}
+		bundle.Routes[i] = rt
+	}
+	r.JSON(200, &bundle)
+}
+
+// Import records the artifact, release, app, env and formation of an
+// admitted bundle in a single transaction, and creates the default route of
+// the app.
+func (r *AppRepo) Import(bundle *ct.AppExport, artifacts *ArtifactRepo, releases *ReleaseRepo) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := importAppTx(tx, bundle, artifacts, releases); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.createDefaultRoute(bundle.App)
+	return nil
+}
+
+func importAppTx(tx *dbTx, bundle *ct.AppExport, artifacts *ArtifactRepo, releases *ReleaseRepo) error {
+	app, release := bundle.App, bundle.Release
+	if release != nil {
+		if err := artifacts.AddTx(tx, bundle.Artifact); err != nil {
+			return err
+		}
+		release.ArtifactID = bundle.Artifact.ID
+		// the release was previously imported
+		if err := releases.AddTx(tx, release); err != nil && err != ErrReleaseImmutable {
+			return err
+		}
+	}
+	if err := insertApp(tx, app); err != nil {
+		return err
+	}
+	if len(bundle.Env) > 0 {
+		if _, err := tx.Exec("UPDATE apps SET env = $2 WHERE app_id = $1", app.ID, envHstore(bundle.Env)); err != nil {
+			return err
+		}
+	}
+	if release == nil {
+		return nil
+	}
+	// the app is new, so it has no formations to move to the release
+	if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", app.ID, release.ID); err != nil {
+		return err
+	}
+	if f := bundle.Formation; f != nil {
+		f.AppID, f.ReleaseID = app.ID, release.ID
+		spread, err := spreadJSON(f.Spread)
+		if err != nil {
+			return err
+		}
+		if err := tx.QueryRow("INSERT INTO formations (app_id, release_id, processes, spread) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at",
+			f.AppID, f.ReleaseID, procsHstore(f.Processes), spread).Scan(&f.CreatedAt, &f.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/strowger/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestExportImportApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "export-app", Meta: map[string]string{"team": "a"}})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+	c.Assert(client.SetAppEnv(app.ID, map[string]string{"FOO": "bar"}), IsNil)
+	s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "export-app"}).ToRoute())
+
+	bundle, err := client.ExportApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(bundle.App.ID, Equals, app.ID)
+	c.Assert(bundle.Release.ID, Equals, release.ID)
+	c.Assert(bundle.Artifact.ID, Equals, release.ArtifactID)
+	c.Assert(bundle.Formation.Processes, DeepEquals, map[string]int{"web": 2})
+	c.Assert(bundle.Env, DeepEquals, map[string]string{"FOO": "bar"})
+	c.Assert(bundle.Routes, HasLen, 1)
+
+	// the name is taken by the exported app, and the failed import leaves
+	// no artifact or release behind
+	orphan := *bundle
+	orphan.Artifact = &ct.Artifact{Type: "docker", URI: "docker://export-app-orphan"}
+	orphan.Release = &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}
+	_, err = client.ImportApp(&orphan)
+	c.Assert(err, NotNil)
+	apps := s.m.Get(reflect.TypeOf((*AppRepo)(nil))).Interface().(*AppRepo)
+	var orphans int
+	c.Assert(apps.db.QueryRow("SELECT count(*) FROM artifacts WHERE uri = $1", orphan.Artifact.URI).Scan(&orphans), IsNil)
+	c.Assert(orphans, Equals, 0)
+
+	bundle.App.Name = "export-app-copy"
+	imported, err := client.ImportApp(bundle)
+	c.Assert(err, IsNil)
+	c.Assert(imported.App.ID, Not(Equals), app.ID)
+
+	copy, err := client.GetApp("export-app-copy")
+	c.Assert(err, IsNil)
+	c.Assert(copy.Meta, DeepEquals, map[string]string{"team": "a"})
+	gotRelease, err := client.GetAppRelease(copy.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.ID, Equals, release.ID)
+	formation, err := client.GetFormation(copy.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	env, err := client.GetAppEnv(copy.ID)
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, map[string]string{"FOO": "bar"})
+	routes, err := client.RouteList(copy.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Type, Equals, bundle.Routes[0].Type)
+	c.Assert(routes[0].ID, Not(Equals), bundle.Routes[0].ID)
+
+	_, err = client.ImportApp(&ct.AppExport{})
+	c.Assert(err, NotNil)
+}
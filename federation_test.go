@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestFederation(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "federated"})
+
+	remoteApp := &ct.App{ID: "00000000000000000000000000000001", Name: "remote"}
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/apps":
+			json.NewEncoder(w).Encode([]*ct.App{remoteApp})
+		case "/apps/" + remoteApp.ID, "/apps/" + remoteApp.Name:
+			json.NewEncoder(w).Encode(remoteApp)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer remote.Close()
+
+	local, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	other, err := controller.NewClient(remote.URL, authKey)
+	c.Assert(err, IsNil)
+	f := controller.NewFederation(map[string]*controller.Client{"us-east": local, "eu-west": other})
+
+	apps, err := f.AppList()
+	c.Assert(err, IsNil)
+	clusters := make(map[string]string)
+	for _, a := range apps {
+		clusters[a.ID] = a.Cluster
+	}
+	c.Assert(clusters[app.ID], Equals, "us-east")
+	c.Assert(clusters[remoteApp.ID], Equals, "eu-west")
+	c.Assert(apps[0].Cluster, Equals, "eu-west")
+
+	name, client, err := f.Cluster("remote")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "eu-west")
+	c.Assert(client, Equals, other)
+
+	fa, err := f.GetApp(app.Name)
+	c.Assert(err, IsNil)
+	c.Assert(fa.ID, Equals, app.ID)
+	c.Assert(fa.Cluster, Equals, "us-east")
+
+	_, err = f.App("nonexistent")
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
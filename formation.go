@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,23 +24,33 @@ type FormationRepo struct {
 	apps      *AppRepo
 	releases  *ReleaseRepo
 	artifacts *ArtifactRepo
+	registry  *RegistryConfigRepo
+	admitter  *Admitter
 
-	subscriptions map[chan<- *ct.ExpandedFormation]struct{}
+	subscriptions map[chan<- *ct.ExpandedFormation]*subscriberStats
 	stopListener  chan struct{}
 	subMtx        sync.RWMutex
+	nextSubID     uint64
 }
 
-func NewFormationRepo(db *DB, appRepo *AppRepo, releaseRepo *ReleaseRepo, artifactRepo *ArtifactRepo) *FormationRepo {
+func NewFormationRepo(db *DB, appRepo *AppRepo, releaseRepo *ReleaseRepo, artifactRepo *ArtifactRepo, registryRepo *RegistryConfigRepo) *FormationRepo {
 	return &FormationRepo{
 		db:            db,
 		apps:          appRepo,
 		releases:      releaseRepo,
 		artifacts:     artifactRepo,
-		subscriptions: make(map[chan<- *ct.ExpandedFormation]struct{}),
+		registry:      registryRepo,
+		subscriptions: make(map[chan<- *ct.ExpandedFormation]*subscriberStats),
 		stopListener:  make(chan struct{}),
 	}
 }
 
+// SetAdmitter sets the admission hooks which formations moved to a new
+// release by a deploy are sent to.
+func (r *FormationRepo) SetAdmitter(admitter *Admitter) {
+	r.admitter = admitter
+}
+
 func procsHstore(m map[string]int) hstore.Hstore {
 	res := hstore.Hstore{Map: make(map[string]sql.NullString, len(m))}
 	for k, v := range m {
@@ -48,14 +60,32 @@ func procsHstore(m map[string]int) hstore.Hstore {
 
 }
 
+// spreadJSON encodes the spread hints of a formation, which are stored as
+// NULL if unset.
+func spreadJSON(spread map[string]ct.Spread) (*string, error) {
+	if len(spread) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(spread)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
 func (r *FormationRepo) Add(f *ct.Formation) error {
 	// TODO: actually validate
 	procs := procsHstore(f.Processes)
-	err := r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
-		f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	spread, err := spreadJSON(f.Spread)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes, spread) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at",
+		f.AppID, f.ReleaseID, procs, spread).Scan(&f.CreatedAt, &f.UpdatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE formations SET processes = $3, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
-			f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+		err = r.db.QueryRow("UPDATE formations SET processes = $3, spread = $4, updated_at = now(), deleted_at = NULL, replaces = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
+			f.AppID, f.ReleaseID, procs, spread).Scan(&f.CreatedAt, &f.UpdatedAt)
 	}
 	if err != nil {
 		return err
@@ -63,16 +93,24 @@ func (r *FormationRepo) Add(f *ct.Formation) error {
 	return nil
 }
 
+const formationColumns = "app_id, release_id, processes, spread, created_at, updated_at"
+
 func scanFormation(s Scanner) (*ct.Formation, error) {
 	f := &ct.Formation{}
 	var procs hstore.Hstore
-	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &f.CreatedAt, &f.UpdatedAt)
+	var spread sql.NullString
+	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &spread, &f.CreatedAt, &f.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
 		return nil, err
 	}
+	if spread.Valid {
+		if err := json.Unmarshal([]byte(spread.String), &f.Spread); err != nil {
+			return nil, err
+		}
+	}
 	f.Processes = make(map[string]int, len(procs.Map))
 	for k, v := range procs.Map {
 		n, _ := strconv.Atoi(v.String)
@@ -86,12 +124,12 @@ func scanFormation(s Scanner) (*ct.Formation, error) {
 }
 
 func (r *FormationRepo) Get(appID, releaseID string) (*ct.Formation, error) {
-	row := r.db.QueryRow("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
+	row := r.db.QueryRow("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
 	return scanFormation(row)
 }
 
 func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
+	rows, err := r.db.Query("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
 	if err != nil {
 		return nil, err
 	}
@@ -104,20 +142,233 @@ func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
 		}
 		formations = append(formations, formation)
 	}
-	return formations, nil
+	return formations, rows.Err()
+}
+
+// SnapshotTime returns the database time to take a snapshot of the
+// formations at, see Snapshot.
+func (r *FormationRepo) SnapshotTime() (time.Time, error) {
+	var t time.Time
+	return t, r.db.QueryRow("SELECT now()").Scan(&t)
+}
+
+// Snapshot returns up to limit active formations which were last updated
+// before since, ordered by app and release ID and starting after the
+// formation identified by after, along with whether there are more.
+func (r *FormationRepo) Snapshot(since time.Time, after *formationKey, limit int) ([]*ct.ExpandedFormation, bool, error) {
+	query := "SELECT " + formationColumns + " FROM formations WHERE deleted_at IS NULL AND updated_at < $1"
+	args := []interface{}{since}
+	if after != nil {
+		query += " AND (app_id, release_id) > ($2, $3)"
+		args = append(args, after.AppID, after.ReleaseID)
+	}
+	args = append(args, limit+1)
+	rows, err := r.db.Query(query+fmt.Sprintf(" ORDER BY app_id, release_id LIMIT $%d", len(args)), args...)
+	if err != nil {
+		return nil, false, err
+	}
+	var formations []*ct.Formation
+	for rows.Next() {
+		formation, err := scanFormation(rows)
+		if err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		formations = append(formations, formation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	more := len(formations) > limit
+	if more {
+		formations = formations[:limit]
+	}
+	list := make([]*ct.ExpandedFormation, len(formations))
+	for i, formation := range formations {
+		if list[i], err = r.expandFormation(formation); err != nil {
+			return nil, false, err
+		}
+	}
+	return list, more, nil
 }
 
 func (r *FormationRepo) Remove(appID, releaseID string) error {
-	err := r.db.Exec("UPDATE formations SET deleted_at = now(), updated_at = current_timestamp, processes = NULL WHERE app_id = $1 AND release_id = $2", appID, releaseID)
+	err := r.db.Exec("UPDATE formations SET deleted_at = now(), updated_at = current_timestamp, processes = NULL, spread = NULL WHERE app_id = $1 AND release_id = $2", appID, releaseID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r *FormationRepo) publish(appID, releaseID string) {
+// Scale admits and records a formation changed by a deployment, see
+// Deployer.deployOneByOne.
+func (r *FormationRepo) Scale(f *ct.Formation) error {
+	if err := r.admitter.Admit("formations", "update", f); err != nil {
+		return err
+	}
+	return r.Add(f)
+}
+
+// SetRelease sets the current release of an app without moving its
+// formations, returning ErrPreconditionFailed unless the current release of
+// the app is fromReleaseID. The Deployer moves the processes over itself
+// when replacing them one by one.
+func (r *FormationRepo) SetRelease(appID, releaseID, fromReleaseID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := selectApp(tx, appID, true); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var current sql.NullString
+	if err := tx.QueryRow("SELECT release_id FROM apps WHERE app_id = $1", appID).Scan(&current); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if cleanUUID(current.String) != cleanUUID(fromReleaseID) {
+		tx.Rollback()
+		return ErrPreconditionFailed
+	}
+	if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", appID, releaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Deploy sets the current release of an app and, if the app has a single
+// formation for another release, moves it over to the new release. All
+// changes are made in one transaction, and the formation switch is published
+// as a single update with Replaces set to the previous release.
+func (r *FormationRepo) Deploy(appID, releaseID string) error {
+	return r.deploy(appID, releaseID, nil)
+}
+
+// DeployFrom is like Deploy, but returns ErrPreconditionFailed unless the
+// current release of the app is fromReleaseID, which is empty if the app has
+// no release.
+func (r *FormationRepo) DeployFrom(appID, releaseID, fromReleaseID string) error {
+	return r.deploy(appID, releaseID, &fromReleaseID)
+}
+
+func (r *FormationRepo) deploy(appID, releaseID string, from *string) error {
+	if err := r.switchRelease(appID, releaseID, from); err != nil {
+		return err
+	}
+	// releases beyond the retention of the app are pruned once a new one has
+	// been deployed, unless a deployment of the app is running as it may roll
+	// back to the old release, in which case the Deployer prunes them once
+	// it finishes
+	var deploying bool
+	if err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM deployments WHERE app_id = $1 AND status = $2)", appID, ct.DeploymentStatusRunning).Scan(&deploying); err != nil {
+		log.Printf("error checking deployments of app %s: %s", appID, err)
+	} else if !deploying {
+		r.PruneReleases(appID)
+	}
+	return nil
+}
+
+// PruneReleases prunes the releases of an app beyond its retention, see
+// ReleaseRepo.Prune. Failing to do so is logged rather than returned, as it
+// does not fail the deploy which triggered it.
+func (r *FormationRepo) PruneReleases(appID string) {
+	if releases, artifacts, err := r.releases.Prune(appID); err != nil {
+		log.Printf("error pruning releases of app %s: %s", appID, err)
+	} else if len(releases) > 0 {
+		log.Printf("pruned %d releases and %d artifacts of app %s", len(releases), len(artifacts), appID)
+	}
+}
+
+func (r *FormationRepo) switchRelease(appID, releaseID string, from *string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := selectApp(tx, appID, true); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if from != nil {
+		var current sql.NullString
+		if err := tx.QueryRow("SELECT release_id FROM apps WHERE app_id = $1", appID).Scan(&current); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if cleanUUID(current.String) != cleanUUID(*from) {
+			tx.Rollback()
+			return ErrPreconditionFailed
+		}
+	}
+	if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", appID, releaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	rows, err := tx.Query("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND deleted_at IS NULL FOR UPDATE", appID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var fs []*ct.Formation
+	for rows.Next() {
+		f, err := scanFormation(rows)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		fs = append(fs, f)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(fs) != 1 || fs[0].ReleaseID == cleanUUID(releaseID) {
+		return tx.Commit()
+	}
+
+	// the formation of the new release is admitted like any other, the hooks
+	// are called with the app locked so that it cannot change meanwhile
+	next := &ct.Formation{AppID: appID, ReleaseID: cleanUUID(releaseID), Processes: fs[0].Processes, Spread: fs[0].Spread}
+	if err := r.admitter.Admit("formations", "update", next); err != nil {
+		tx.Rollback()
+		return err
+	}
+	prev := fs[0]
+	procs := procsHstore(next.Processes)
+	spread, err := spreadJSON(next.Spread)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec("UPDATE formations SET processes = $3, spread = $5, updated_at = now(), deleted_at = NULL, replaces = $4 WHERE app_id = $1 AND release_id = $2",
+		appID, releaseID, procs, prev.ReleaseID, spread)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			_, err = tx.Exec("INSERT INTO formations (app_id, release_id, processes, replaces, spread) VALUES ($1, $2, $3, $4, $5)", appID, releaseID, procs, prev.ReleaseID, spread)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE formations SET deleted_at = now(), updated_at = now(), processes = NULL, spread = NULL WHERE app_id = $1 AND release_id = $2", appID, prev.ReleaseID)
+	}
+	if err == nil {
+		// the replacement has been published along with the delete of the
+		// previous formation, so it must not suppress later deletes of it
+		_, err = tx.Exec("UPDATE formations SET replaces = NULL WHERE app_id = $1 AND release_id = $2", appID, releaseID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *FormationRepo) publish(appID, releaseID, replaces string) {
 	formation, err := r.Get(appID, releaseID)
-	if err == ErrNotFound {
+	deleted := err == ErrNotFound
+	if deleted {
 		// formation delete event
 		formation = &ct.Formation{AppID: appID, ReleaseID: releaseID}
 	} else if err != nil {
@@ -126,15 +377,22 @@ func (r *FormationRepo) publish(appID, releaseID string) {
 	}
 
 	f, err := r.expandFormation(formation)
+	if err == ErrNotFound && deleted {
+		// the formations of deleted apps are deleted with them, and can
+		// no longer be expanded, but the scheduler must still stop their
+		// jobs
+		f, err = &ct.ExpandedFormation{App: &ct.App{ID: cleanUUID(appID)}, Release: &ct.Release{ID: cleanUUID(releaseID)}}, nil
+	}
 	if err != nil {
 		// TODO: log error
 		return
 	}
+	f.Replaces = cleanUUID(replaces)
 	r.subMtx.RLock()
 	defer r.subMtx.RUnlock()
 
-	for ch := range r.subscriptions {
-		ch <- f
+	for ch, stats := range r.subscriptions {
+		sendFormation(ch, stats, f)
 	}
 }
 
@@ -151,11 +409,23 @@ func (r *FormationRepo) expandFormation(formation *ct.Formation) (*ct.ExpandedFo
 	if err != nil {
 		return nil, err
 	}
+	env, err := r.apps.GetEnv(formation.AppID)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := r.registry.Effective(formation.AppID)
+	if err != nil {
+		return nil, err
+	}
 	f := &ct.ExpandedFormation{
-		App:       app.(*ct.App),
-		Release:   release.(*ct.Release),
-		Artifact:  artifact.(*ct.Artifact),
-		Processes: formation.Processes,
+		AppEnv:         env,
+		RegistryConfig: registry,
+		App:            app.(*ct.App),
+		Release:        release.(*ct.Release),
+		Artifact:       artifact.(*ct.Artifact),
+		Processes:      formation.Processes,
+		Spread:         formation.Spread,
+		Strategy:       app.(*ct.App).Strategy,
 	}
 	return f, nil
 }
@@ -176,8 +446,13 @@ func (r *FormationRepo) startListener() error {
 		for {
 			select {
 			case n := <-listener.Notify:
-				ids := strings.SplitN(n.Extra, ":", 2)
-				go r.publish(ids[0], ids[1])
+				// app_id:release_id[:replaced_release_id]
+				ids := strings.SplitN(n.Extra, ":", 3)
+				var replaces string
+				if len(ids) == 3 {
+					replaces = ids[2]
+				}
+				go r.publish(ids[0], ids[1], replaces)
 			case <-r.stopListener:
 				listener.Close()
 				return
@@ -193,7 +468,8 @@ func (r *FormationRepo) Subscribe(ch chan<- *ct.ExpandedFormation, since time.Ti
 	if len(r.subscriptions) == 0 {
 		startListener = true
 	}
-	r.subscriptions[ch] = struct{}{}
+	r.nextSubID++
+	r.subscriptions[ch] = newSubscriberStats(r.nextSubID, ch)
 	r.subMtx.Unlock()
 	if startListener {
 		if err := r.startListener(); err != nil {
@@ -204,7 +480,7 @@ func (r *FormationRepo) Subscribe(ch chan<- *ct.ExpandedFormation, since time.Ti
 }
 
 func (r *FormationRepo) sendUpdatedSince(ch chan<- *ct.ExpandedFormation, since time.Time) error {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE updated_at >= $1 ORDER BY updated_at DESC", since)
+	rows, err := r.db.Query("SELECT "+formationColumns+" FROM formations WHERE updated_at >= $1 ORDER BY updated_at DESC", since)
 	if err != nil {
 		return err
 	}
@@ -233,3 +509,56 @@ func (r *FormationRepo) Unsubscribe(ch chan<- *ct.ExpandedFormation) {
 		r.stopListener <- struct{}{}
 	}
 }
+
+type pendingFormation struct {
+	key      formationKey
+	deadline time.Time
+}
+
+// coalesceFormations copies formation updates from in to out, holding each
+// update for up to window and replacing it with any later update to the same
+// app and release that arrives in the meantime. Formations are sent in the
+// order their first pending update arrived, the latest update to a formation
+// is never dropped, and sentinels flush all pending updates before being
+// forwarded. out is closed once in is closed and drained.
+func coalesceFormations(in <-chan *ct.ExpandedFormation, out chan<- *ct.ExpandedFormation, window time.Duration) {
+	pending := make(map[formationKey]*ct.ExpandedFormation)
+	var queue []pendingFormation
+
+	flush := func(now time.Time, all bool) {
+		for len(queue) > 0 && (all || !queue[0].deadline.After(now)) {
+			k := queue[0].key
+			queue = queue[1:]
+			out <- pending[k]
+			delete(pending, k)
+		}
+	}
+
+	for {
+		var timeout <-chan time.Time
+		if len(queue) > 0 {
+			timeout = time.After(queue[0].deadline.Sub(time.Now()))
+		}
+		select {
+		case f, ok := <-in:
+			if !ok {
+				flush(time.Now(), true)
+				close(out)
+				return
+			}
+			if f.App == nil || f.Release == nil {
+				// sentinel
+				flush(time.Now(), true)
+				out <- f
+				continue
+			}
+			k := formationKey{f.App.ID, f.Release.ID}
+			if _, ok := pending[k]; !ok {
+				queue = append(queue, pendingFormation{key: k, deadline: time.Now().Add(window)})
+			}
+			pending[k] = f
+		case now := <-timeout:
+			flush(now, false)
+		}
+	}
+}
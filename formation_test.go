@@ -0,0 +1,235 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+type CoalesceSuite struct{}
+
+var _ = Suite(&CoalesceSuite{})
+
+func coalesceTestFormation(appID, releaseID string, n int) *ct.ExpandedFormation {
+	return &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   &ct.Release{ID: releaseID},
+		Processes: map[string]int{"web": n},
+	}
+}
+
+func receiveFormations(c *C, out <-chan *ct.ExpandedFormation) []*ct.ExpandedFormation {
+	var res []*ct.ExpandedFormation
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case f, ok := <-out:
+			if !ok {
+				return res
+			}
+			res = append(res, f)
+		case <-timeout:
+			c.Fatal("timed out waiting for coalesced formations")
+			return nil
+		}
+	}
+}
+
+func (CoalesceSuite) TestLastWriteWins(c *C) {
+	in := make(chan *ct.ExpandedFormation)
+	out := make(chan *ct.ExpandedFormation)
+	go coalesceFormations(in, out, 50*time.Millisecond)
+
+	for i := 1; i <= 10; i++ {
+		in <- coalesceTestFormation("app", "release", i)
+	}
+	close(in)
+
+	res := receiveFormations(c, out)
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].Processes["web"], Equals, 10)
+}
+
+func (CoalesceSuite) TestOrdering(c *C) {
+	in := make(chan *ct.ExpandedFormation)
+	out := make(chan *ct.ExpandedFormation)
+	go coalesceFormations(in, out, time.Hour)
+
+	in <- coalesceTestFormation("a", "r1", 1)
+	in <- coalesceTestFormation("b", "r1", 1)
+	in <- coalesceTestFormation("a", "r1", 2)
+	in <- coalesceTestFormation("a", "r2", 1)
+	in <- coalesceTestFormation("b", "r1", 2)
+	close(in)
+
+	res := receiveFormations(c, out)
+	c.Assert(res, HasLen, 3)
+	// formations are sent in the order they first became pending, with their
+	// latest state
+	c.Assert(res[0].App.ID, Equals, "a")
+	c.Assert(res[0].Release.ID, Equals, "r1")
+	c.Assert(res[0].Processes["web"], Equals, 2)
+	c.Assert(res[1].App.ID, Equals, "b")
+	c.Assert(res[1].Processes["web"], Equals, 2)
+	c.Assert(res[2].App.ID, Equals, "a")
+	c.Assert(res[2].Release.ID, Equals, "r2")
+}
+
+func (CoalesceSuite) TestSentinelFlushes(c *C) {
+	in := make(chan *ct.ExpandedFormation)
+	out := make(chan *ct.ExpandedFormation)
+	go coalesceFormations(in, out, time.Hour)
+
+	in <- coalesceTestFormation("a", "r1", 1)
+	in <- &ct.ExpandedFormation{}
+
+	select {
+	case f := <-out:
+		c.Assert(f.App.ID, Equals, "a")
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for flush")
+	}
+	select {
+	case f := <-out:
+		c.Assert(f.App, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for sentinel")
+	}
+	close(in)
+	c.Assert(receiveFormations(c, out), HasLen, 0)
+}
+
+func (CoalesceSuite) TestWindowElapses(c *C) {
+	in := make(chan *ct.ExpandedFormation)
+	out := make(chan *ct.ExpandedFormation)
+	go coalesceFormations(in, out, 10*time.Millisecond)
+	defer close(in)
+
+	for i := 1; i <= 2; i++ {
+		in <- coalesceTestFormation("a", "r1", i)
+		select {
+		case f := <-out:
+			c.Assert(f.Processes["web"], Equals, i)
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for window to elapse")
+		}
+	}
+}
+
+func (s *S) TestStreamStats(c *C) {
+	repo := s.m.Get(reflect.TypeOf((*FormationRepo)(nil))).Interface().(*FormationRepo)
+	ch := make(chan *ct.ExpandedFormation, 1)
+	go repo.Subscribe(ch, time.Now())
+	c.Assert(<-ch, DeepEquals, &ct.ExpandedFormation{})
+	defer repo.Unsubscribe(ch)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	latest := func() *ct.StreamSubscriber {
+		stats, err := client.StreamStats()
+		c.Assert(err, IsNil)
+		subs := stats["formations"]
+		c.Assert(len(subs) > 0, Equals, true)
+		return subs[len(subs)-1]
+	}
+	c.Assert(latest().Buffered, Equals, 0)
+
+	// the first update fills the buffer of the channel and the second waits
+	// for room in it
+	app := s.createTestApp(c, &ct.App{Name: "stream-stats"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	other := s.createTestApp(c, &ct.App{Name: "stream-stats-other"})
+	s.createTestFormation(c, &ct.Formation{AppID: other.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	var sub *ct.StreamSubscriber
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if sub = latest(); sub.Buffered > 1 {
+			break
+		}
+	}
+	c.Assert(sub.Buffered, Equals, 2)
+	c.Assert(sub.Lag > 0, Equals, true)
+
+	c.Assert((<-ch).App.ID, Equals, app.ID)
+	c.Assert((<-ch).App.ID, Equals, other.ID)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if sub = latest(); sub.Buffered == 0 {
+			break
+		}
+	}
+	c.Assert(sub.Buffered, Equals, 0)
+	c.Assert(sub.Sent, Equals, uint64(2))
+}
+
+func (s *S) TestFormationThrottle(c *C) {
+	throttle := s.m.Get(reflect.TypeOf((*FormationThrottle)(nil))).Interface().(*FormationThrottle)
+	conf := throttle.conf
+	throttle.conf = FormationRateLimit{Limit: 3, Cooldown: time.Minute}
+	defer func() { throttle.conf = conf }()
+
+	app := s.createTestApp(c, &ct.App{Name: "formation-throttle"})
+	release := s.createTestRelease(c, &ct.Release{})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	for i := 1; i <= 3; i++ {
+		c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": i}}), IsNil)
+	}
+	err = client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 4}})
+	c.Assert(err, FitsTypeOf, &controller.FormationThrottledError{})
+	c.Assert(err.(*controller.FormationThrottledError).RetryAfter, Equals, time.Minute)
+
+	// the alert is recorded once per cooldown
+	var alerts int
+	c.Assert(throttle.db.QueryRow("SELECT count(*) FROM app_logs WHERE app_id = $1 AND event = 'formation_throttled'", app.ID).Scan(&alerts), IsNil)
+	c.Assert(alerts, Equals, 1)
+	res, err := s.Delete(formationPath(app.ID, release.ID))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 429)
+	c.Assert(res.Header.Get("Retry-After"), Not(Equals), "")
+	c.Assert(throttle.db.QueryRow("SELECT count(*) FROM app_logs WHERE app_id = $1 AND event = 'formation_throttled'", app.ID).Scan(&alerts), IsNil)
+	c.Assert(alerts, Equals, 1)
+
+	// other apps are not affected
+	other := s.createTestApp(c, &ct.App{Name: "formation-throttle-other"})
+	c.Assert(client.PutFormation(&ct.Formation{AppID: other.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}}), IsNil)
+}
+
+func (s *S) TestFormationSpread(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-spread"})
+	procs := map[string]ct.ProcessType{"web": {}, "worker": {}}
+	release := s.createTestRelease(c, &ct.Release{Processes: procs})
+	spread := map[string]ct.Spread{"web": {MaxPerHost: 1}, "worker": {HostAttribute: "rack"}}
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2, "worker": 2}, Spread: spread})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	formation, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Spread, DeepEquals, spread)
+
+	repo := s.m.Get(reflect.TypeOf((*FormationRepo)(nil))).Interface().(*FormationRepo)
+	expanded, err := repo.expandFormation(formation)
+	c.Assert(err, IsNil)
+	c.Assert(expanded.Spread, DeepEquals, spread)
+
+	// the spread moves to the new release on deploy
+	newRelease := s.createTestRelease(c, &ct.Release{Processes: procs})
+	s.setAppRelease(c, app.ID, newRelease.ID)
+	formation, err = client.GetFormation(app.ID, newRelease.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Spread, DeepEquals, spread)
+
+	for _, invalid := range []map[string]ct.Spread{
+		{"db": {MaxPerHost: 1}},
+		{"web": {MaxPerHost: -1}},
+	} {
+		res, err := s.Put(formationPath(app.ID, newRelease.ID), &ct.Formation{Processes: map[string]int{"web": 1}, Spread: invalid}, &ct.Formation{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
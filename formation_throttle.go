@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/martini-contrib/render"
+)
+
+// FormationRateLimit throttles apps whose formations change more than Limit
+// times a minute, which is usually a misbehaving autoscaler, to protect the
+// scheduler from thrashing.
+type FormationRateLimit struct {
+	// Limit is the number of formation changes allowed per app per minute,
+	// if negative changes are not limited.
+	Limit int
+
+	// Cooldown is how long changes are rejected once the limit is exceeded.
+	Cooldown time.Duration
+}
+
+var defaultFormationRateLimit = FormationRateLimit{Limit: 60, Cooldown: time.Minute}
+
+func formationRateLimitFromEnv() FormationRateLimit {
+	conf := defaultFormationRateLimit
+	if n, err := strconv.Atoi(os.Getenv("FORMATION_RATE_LIMIT")); err == nil {
+		conf.Limit = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("FORMATION_RATE_COOLDOWN")); err == nil && d > 0 {
+		conf.Cooldown = d
+	}
+	return conf
+}
+
+// FormationThrottle counts the formation changes of an app in the app log,
+// so that the limit applies across controller instances. Throttling an app
+// records a formation_throttled event in the app log as an alert.
+type FormationThrottle struct {
+	db   *DB
+	conf FormationRateLimit
+}
+
+func NewFormationThrottle(db *DB, conf FormationRateLimit) *FormationThrottle {
+	return &FormationThrottle{db: db, conf: conf}
+}
+
+// Check returns how long formation changes of an app are rejected for, or
+// zero if they are allowed.
+func (t *FormationThrottle) Check(appID string) (time.Duration, error) {
+	if t.conf.Limit < 0 {
+		return 0, nil
+	}
+	cooldown := int(t.conf.Cooldown / time.Second)
+	var remaining float64
+	err := t.db.QueryRow("SELECT extract(epoch FROM created_at + $2 * interval '1 second' - now()) FROM app_logs WHERE app_id = $1 AND event = 'formation_throttled' AND created_at > now() - $2 * interval '1 second' ORDER BY log_id DESC LIMIT 1", appID, cooldown).Scan(&remaining)
+	if err == nil {
+		return time.Duration(remaining * float64(time.Second)), nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var changes int
+	if err := t.db.QueryRow("SELECT count(*) FROM app_logs WHERE app_id = $1 AND event = 'formation' AND created_at > now() - interval '1 minute'", appID).Scan(&changes); err != nil {
+		return 0, err
+	}
+	if changes < t.conf.Limit {
+		return 0, nil
+	}
+	data, err := json.Marshal(&ct.FormationThrottled{Limit: t.conf.Limit, RetryAfter: cooldown})
+	if err != nil {
+		return 0, err
+	}
+	if err := t.db.Exec("INSERT INTO app_logs (app_id, log_id, event, data) VALUES ($1, next_log_id($1), $2, $3)", appID, string(ct.EventTypeFormationThrottled), string(data)); err != nil {
+		return 0, err
+	}
+	log.Printf("formation changes of app %s exceeded %d per minute, throttling for %s", appID, t.conf.Limit, t.conf.Cooldown)
+	return t.conf.Cooldown, nil
+}
+
+// checkFormationRate rejects formation changes of throttled apps with 429.
+func checkFormationRate(app *ct.App, throttle *FormationThrottle, w http.ResponseWriter, r render.Render) {
+	retryAfter, err := throttle.Check(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if retryAfter <= 0 {
+		return
+	}
+	// round up so that clients do not retry before the cooldown has passed
+	secs := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	r.JSON(429, &ct.FormationThrottled{Limit: throttle.conf.Limit, RetryAfter: secs})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/martini-contrib/render"
+)
+
+const (
+	appGCTask     = "app_gc"
+	releaseGCTask = "release_gc"
+
+	defaultAppRetention     = 30 * 24 * time.Hour
+	defaultReleaseRetention = 90 * 24 * time.Hour
+	appGCInterval           = time.Hour
+)
+
+// releaseRetentionFromEnv returns the RELEASE_RETENTION duration, or the
+// default.
+func releaseRetentionFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RELEASE_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultReleaseRetention
+}
+
+// appRetentionFromEnv returns the APP_RETENTION duration, or the default.
+func appRetentionFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("APP_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultAppRetention
+}
+
+// appPurgeQueries remove the rows belonging to an app, children first.
+var appPurgeQueries = []string{
+	"DELETE FROM app_logs WHERE app_id = $1",
+	"DELETE FROM app_log_ids WHERE app_id = $1",
+	"DELETE FROM app_locks WHERE app_id = $1",
+	"DELETE FROM app_env_groups WHERE app_id = $1",
+	"DELETE FROM app_resources WHERE app_id = $1",
+	"DELETE FROM network_policies WHERE app_id = $1",
+	"DELETE FROM adopted_jobs WHERE app_id = $1",
+	"DELETE FROM job_reservations WHERE app_id = $1",
+	"DELETE FROM deployments WHERE app_id = $1",
+	"DELETE FROM job_index WHERE app_id = $1",
+	"DELETE FROM job_logs WHERE app_id = $1",
+	"DELETE FROM route_index WHERE app_id = $1",
+	"DELETE FROM registry_configs WHERE app_id = $1",
+	"DELETE FROM release_tags WHERE app_id = $1",
+	"DELETE FROM formations WHERE app_id = $1",
+	"DELETE FROM apps WHERE app_id = $1",
+}
+
+// AppGC permanently removes apps which were deleted longer than the
+// retention period ago, along with the releases and artifacts no longer used
+// by any other app. It runs as a periodic task on the controller leader.
+type AppGC struct {
+	db        *DB
+	retention time.Duration
+}
+
+func NewAppGC(db *DB, retention time.Duration) *AppGC {
+	return &AppGC{db: db, retention: retention}
+}
+
+// Run purges the apps deleted before the retention period, returning the
+// report of the purge.
+func (g *AppGC) Run(*ct.Task) (interface{}, error) {
+	report, err := g.Purge(time.Now().Add(-g.retention), false)
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Apps) > 0 {
+		log.Printf("gc: purged %d apps, %d releases and %d artifacts", len(report.Apps), len(report.Releases), len(report.Artifacts))
+	}
+	return report, nil
+}
+
+// Purge removes apps deleted before the given time. If dryRun is true the
+// purge is rolled back, so the report previews what would be removed.
+func (g *AppGC) Purge(before time.Time, dryRun bool) (*ct.AppGCReport, error) {
+	report := &ct.AppGCReport{DryRun: dryRun, Before: &before, Apps: []string{}, Releases: []string{}, Artifacts: []string{}}
+	tx, err := g.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := g.purge(tx, report); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if dryRun {
+		return report, tx.Rollback()
+	}
+	return report, tx.Commit()
+}
+
+func (g *AppGC) purge(tx *dbTx, report *ct.AppGCReport) error {
+	apps, err := queryIDs(tx, "SELECT app_id FROM apps WHERE deleted_at < $1 ORDER BY deleted_at FOR UPDATE", report.Before)
+	if err != nil {
+		return err
+	}
+
+	// releases used by the purged apps are removed if no other app uses them
+	releases := make(map[string]struct{})
+	for _, appID := range apps {
+		ids, err := queryIDs(tx, `SELECT release_id FROM apps WHERE app_id = $1 AND release_id IS NOT NULL
+			UNION SELECT release_id FROM formations WHERE app_id = $1
+			UNION SELECT release_id FROM adopted_jobs WHERE app_id = $1`, appID)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			releases[id] = struct{}{}
+		}
+		for _, q := range appPurgeQueries {
+			if _, err := tx.Exec(q, appID); err != nil {
+				return err
+			}
+		}
+		report.Apps = append(report.Apps, cleanUUID(appID))
+	}
+
+	artifacts := make(map[string]struct{})
+	for releaseID := range releases {
+		var artifactID string
+		err := tx.QueryRow(`DELETE FROM releases WHERE release_id = $1
+			AND NOT EXISTS (SELECT 1 FROM apps WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM formations WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM adopted_jobs WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM job_reservations WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM release_tags WHERE release_id = $1)
+			RETURNING artifact_id`, releaseID).Scan(&artifactID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		report.Releases = append(report.Releases, cleanUUID(releaseID))
+		artifacts[artifactID] = struct{}{}
+	}
+
+	for artifactID := range artifacts {
+		var id string
+		err := tx.QueryRow("DELETE FROM artifacts WHERE artifact_id = $1 AND NOT EXISTS (SELECT 1 FROM releases WHERE artifact_id = $1) RETURNING artifact_id", artifactID).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		report.Artifacts = append(report.Artifacts, cleanUUID(id))
+	}
+	return nil
+}
+
+// ReleaseGC removes releases which have not been used for the retention
+// period. A release is in use while it is the release of an app, has an
+// active formation, adopted jobs or tags, and for the retention period after
+// it was deployed or its formation last changed. It runs as a periodic task
+// on the controller leader.
+type ReleaseGC struct {
+	db        *DB
+	retention time.Duration
+}
+
+func NewReleaseGC(db *DB, retention time.Duration) *ReleaseGC {
+	return &ReleaseGC{db: db, retention: retention}
+}
+
+// Run removes the releases unused for the retention period, returning their
+// IDs.
+func (g *ReleaseGC) Run(*ct.Task) (interface{}, error) {
+	releases, err := g.Sweep(time.Now().Add(-g.retention))
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) > 0 {
+		log.Printf("gc: removed %d unused releases", len(releases))
+	}
+	return releases, nil
+}
+
+// Sweep removes releases which have been unused since before the given time,
+// returning their IDs. Deleted formations of the releases are removed with
+// them.
+func (g *ReleaseGC) Sweep(before time.Time) ([]string, error) {
+	tx, err := g.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := queryIDs(tx, `SELECT release_id FROM releases r WHERE created_at < $1
+		AND NOT EXISTS (SELECT 1 FROM apps WHERE release_id = r.release_id)
+		AND NOT EXISTS (SELECT 1 FROM formations WHERE release_id = r.release_id AND (deleted_at IS NULL OR updated_at >= $1))
+		AND NOT EXISTS (SELECT 1 FROM adopted_jobs WHERE release_id = r.release_id)
+		AND NOT EXISTS (SELECT 1 FROM job_reservations WHERE release_id = r.release_id)
+		AND NOT EXISTS (SELECT 1 FROM release_tags WHERE release_id = r.release_id)
+		AND NOT EXISTS (SELECT 1 FROM deployments WHERE r.release_id IN (old_release_id, new_release_id) AND finished_at IS NULL)
+		AND NOT EXISTS (SELECT 1 FROM app_logs WHERE subject_id = r.release_id AND created_at >= $1)
+		FOR UPDATE`, before)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i, id := range ids {
+		for _, query := range []string{
+			"DELETE FROM formations WHERE release_id = $1",
+			"DELETE FROM releases WHERE release_id = $1",
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		ids[i] = cleanUUID(id)
+	}
+	return ids, tx.Commit()
+}
+
+func queryIDs(tx *dbTx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// previewAppGC responds with the apps, releases and artifacts which the next
+// garbage collection run would purge.
+func previewAppGC(gc *AppGC, r render.Render) {
+	report, err := gc.Purge(time.Now().Add(-gc.retention), true)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, report)
+}
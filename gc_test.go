@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestAppGC(c *C) {
+	gc := s.m.Get(reflect.TypeOf((*AppGC)(nil))).Interface().(*AppGC)
+
+	app := s.createTestApp(c, &ct.App{Name: "gc-app"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	// a release shared with a live app is kept
+	other := s.createTestApp(c, &ct.App{Name: "gc-other"})
+	shared := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: shared.ID})
+	s.createTestFormation(c, &ct.Formation{AppID: other.ID, ReleaseID: shared.ID})
+
+	res, err := s.Delete("/apps/" + app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	contains := func(ids []string, id string) bool {
+		for _, i := range ids {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the app is within the retention period
+	report := &ct.AppGCReport{}
+	_, err = s.Get("/gc/apps", report)
+	c.Assert(err, IsNil)
+	c.Assert(report.DryRun, Equals, true)
+	c.Assert(contains(report.Apps, app.ID), Equals, false)
+
+	before := time.Now().Add(time.Second)
+	report, err = gc.Purge(before, true)
+	c.Assert(err, IsNil)
+	c.Assert(contains(report.Apps, app.ID), Equals, true)
+	c.Assert(contains(report.Releases, release.ID), Equals, true)
+	c.Assert(contains(report.Releases, shared.ID), Equals, false)
+	c.Assert(contains(report.Artifacts, artifact.ID), Equals, false)
+
+	// a dry run leaves the app in place
+	var apps []*ct.App
+	_, err = s.Get("/apps?include_deleted=true&name_prefix=gc-app", &apps)
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 1)
+
+	report, err = gc.Purge(before, false)
+	c.Assert(err, IsNil)
+	c.Assert(contains(report.Apps, app.ID), Equals, true)
+	_, err = s.Get("/apps?include_deleted=true&name_prefix=gc-app", &apps)
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 0)
+
+	res, err = s.Get("/releases/"+release.ID, &ct.Release{})
+	c.Assert(res.StatusCode, Equals, 404)
+	_, err = s.Get("/releases/"+shared.ID, &ct.Release{})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestReleaseGC(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "release-gc"})
+	current := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, current.ID)
+	scaled := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: scaled.ID})
+	unused := s.createTestRelease(c, &ct.Release{})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	c.Assert(client.DeleteRelease(current.ID), NotNil)
+	c.Assert(client.DeleteRelease(scaled.ID), NotNil)
+	c.Assert(client.DeleteRelease(unused.ID), IsNil)
+	_, err = client.GetRelease(unused.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	gc := s.m.Get(reflect.TypeOf((*ReleaseGC)(nil))).Interface().(*ReleaseGC)
+	removed, err := gc.Sweep(time.Now())
+	c.Assert(err, IsNil)
+	var found bool
+	for _, id := range removed {
+		c.Assert(id, Not(Equals), current.ID)
+		c.Assert(id, Not(Equals), scaled.ID)
+		if id == unused.ID {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+}
+
+func (s *S) TestReleaseRetention(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "release-retention", ReleaseRetention: 2})
+	c.Assert(app.ReleaseRetention, Equals, 2)
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	releases := make([]*ct.Release, 4)
+	for i := range releases {
+		artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: fmt.Sprintf("docker://release-retention?id=%d", i)})
+		releases[i] = s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	}
+	// a tagged release is kept
+	_, err = client.SetReleaseTags(app.ID, releases[1].ID, []string{"release-retention"})
+	c.Assert(err, IsNil)
+	for _, release := range releases {
+		s.setAppRelease(c, app.ID, release.ID)
+	}
+
+	_, err = client.GetRelease(releases[0].ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = client.GetArtifact(releases[0].ArtifactID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	for _, release := range releases[1:] {
+		_, err = client.GetRelease(release.ID)
+		c.Assert(err, IsNil)
+		_, err = client.GetArtifact(release.ArtifactID)
+		c.Assert(err, IsNil)
+	}
+
+	res, err := s.Post("/apps", &ct.App{Name: "negative-retention", ReleaseRetention: -1}, &ct.App{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
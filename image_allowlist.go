@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+)
+
+// ImageAllowlist restricts artifacts to vetted registries and namespaces.
+// Entries are matched against the image reference of docker artifacts, such
+// as registry.example.com/flynn/slugrunner with docker.io as the registry of
+// Docker Hub images, and against the URI of other artifacts. An entry allows
+// the references it equals or continues with a slash, so
+// registry.example.com/flynn allows registry.example.com/flynn/redis but not
+// registry.example.com/flynn-forks/redis.
+//
+// Artifacts and releases which are not allowed are rejected unless an admin
+// sets the ImageAllowlistOverrideHeader. Registry mirrors rewrite the images
+// of allowed artifacts, so registry configs can only be changed by admins.
+type ImageAllowlist struct {
+	Entries []string
+}
+
+// imageAllowlistFromEnv returns the allowlist of the comma separated entries
+// of IMAGE_ALLOWLIST, or nil if it is not set.
+func imageAllowlistFromEnv() *ImageAllowlist {
+	entries := splitList(os.Getenv("IMAGE_ALLOWLIST"))
+	if len(entries) == 0 {
+		return nil
+	}
+	return &ImageAllowlist{Entries: entries}
+}
+
+// ImageNotAllowedError is returned when creating an artifact or release with
+// an image which the allowlist does not allow.
+type ImageNotAllowedError struct {
+	URI string
+}
+
+func (e ImageNotAllowedError) Error() string {
+	return fmt.Sprintf("controller: %s is not in the image allowlist", e.URI)
+}
+
+// imageReference returns the reference artifacts are matched against.
+func imageReference(a *ct.Artifact) string {
+	u, err := url.Parse(a.URI)
+	if err != nil || u.Scheme != "docker" {
+		return a.URI
+	}
+	registry, name := u.Host, strings.Trim(u.Path, "/")
+	if registry == "" {
+		registry = utils.DockerHub
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	return registry + "/" + name
+}
+
+// Allows reports whether the allowlist allows an artifact. A nil allowlist
+// allows every artifact.
+func (l *ImageAllowlist) Allows(a *ct.Artifact) bool {
+	if l == nil {
+		return true
+	}
+	ref := imageReference(a)
+	for _, entry := range l.Entries {
+		entry = strings.TrimSuffix(entry, "/")
+		if ref == entry || strings.HasPrefix(ref, entry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an ImageNotAllowedError if the allowlist does not allow an
+// artifact, unless the request overrides the allowlist.
+func (l *ImageAllowlist) Check(a *ct.Artifact, req *http.Request) error {
+	if l.Allows(a) || req.Header.Get(ct.ImageAllowlistOverrideHeader) == "true" {
+		return nil
+	}
+	return ImageNotAllowedError{URI: a.URI}
+}
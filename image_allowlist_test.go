@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestImageAllowlistAllows(c *C) {
+	allowlist := &ImageAllowlist{Entries: []string{"registry.example.com/flynn", "docker.io/library/ubuntu", "https://blobstore.example.com/"}}
+	for _, t := range []struct {
+		artifact *ct.Artifact
+		allowed  bool
+	}{
+		{&ct.Artifact{Type: "docker", URI: "docker://registry.example.com/flynn/redis?tag=v1"}, true},
+		{&ct.Artifact{Type: "docker", URI: "docker://registry.example.com/flynn"}, true},
+		{&ct.Artifact{Type: "docker", URI: "docker://registry.example.com/flynn-forks/redis"}, false},
+		{&ct.Artifact{Type: "docker", URI: "docker://other.example.com/flynn/redis"}, false},
+		{&ct.Artifact{Type: "docker", URI: "docker:///ubuntu"}, true},
+		{&ct.Artifact{Type: "docker", URI: "docker:///flynn/slugrunner"}, false},
+		{&ct.Artifact{Type: ct.ArtifactTypeFile, URI: "https://blobstore.example.com/slug.tgz"}, true},
+		{&ct.Artifact{Type: ct.ArtifactTypeFile, URI: "https://blobstore.example.com.evil.com/slug.tgz"}, false},
+	} {
+		c.Assert(allowlist.Allows(t.artifact), Equals, t.allowed, Commentf("%s", t.artifact.URI))
+	}
+	var none *ImageAllowlist
+	c.Assert(none.Allows(&ct.Artifact{URI: "docker:///anything"}), Equals, true)
+}
+
+func (s *S) TestImageAllowlist(c *C) {
+	allowlist := &ImageAllowlist{Entries: []string{"registry.example.com/vetted"}}
+	artifacts := s.m.Get(reflect.TypeOf((*ArtifactRepo)(nil))).Interface().(*ArtifactRepo)
+	releases := s.m.Get(reflect.TypeOf((*ReleaseRepo)(nil))).Interface().(*ReleaseRepo)
+	verifier := s.m.Get(reflect.TypeOf((*ArtifactVerifier)(nil))).Interface().(*ArtifactVerifier)
+
+	// created before the allowlist
+	unvetted := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://registry.example.com/unvetted/app?tag=before"})
+	unvettedRelease := s.createTestRelease(c, &ct.Release{ArtifactID: unvetted.ID})
+	app := s.createTestApp(c, &ct.App{Name: "image-allowlist"})
+	s.setAppRelease(c, app.ID, unvettedRelease.ID)
+
+	artifacts.SetImageAllowlist(allowlist)
+	releases.SetImageAllowlist(allowlist)
+	verifier.allowlist = allowlist
+	defer func() {
+		artifacts.SetImageAllowlist(nil)
+		releases.SetImageAllowlist(nil)
+		verifier.allowlist = nil
+	}()
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	override, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	override.Header = http.Header{ct.ImageAllowlistOverrideHeader: {"true"}}
+
+	c.Assert(client.CreateArtifact(&ct.Artifact{Type: "docker", URI: "docker://registry.example.com/vetted/app?tag=v1"}), IsNil)
+	res, err := s.Post("/artifacts", &ct.Artifact{Type: "docker", URI: "docker://registry.example.com/unvetted/app?tag=v1"}, &ct.Artifact{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 403)
+	c.Assert(override.CreateArtifact(&ct.Artifact{Type: "docker", URI: "docker://registry.example.com/unvetted/app?tag=v1"}), IsNil)
+
+	// releases cannot use artifacts outside the allowlist
+	res, err = s.Post("/releases", &ct.Release{ArtifactID: unvetted.ID}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 403)
+	c.Assert(override.CreateRelease(&ct.Release{ArtifactID: unvetted.ID}), IsNil)
+	_, err = client.CloneRelease(unvettedRelease.ID, &ct.CloneReleaseReq{})
+	c.Assert(err, NotNil)
+	_, err = client.CreateAppRelease(app.ID, &ct.AppReleaseReq{})
+	c.Assert(err, NotNil)
+	_, err = client.ImportApp(&ct.AppExport{
+		App:      &ct.App{Name: "image-allowlist-import"},
+		Artifact: &ct.Artifact{Type: "docker", URI: unvetted.URI},
+		Release:  &ct.Release{},
+	})
+	c.Assert(err, NotNil)
+
+	verification, err := client.VerifyArtifact(unvetted.ID)
+	c.Assert(err, IsNil)
+	c.Assert(verification.Status, Equals, ct.ArtifactNotAllowed)
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/flynn/go-flynn/demultiplex"
+	"github.com/flynn/go-sql"
+)
+
+const (
+	jobIndexTask     = "job_index"
+	jobIndexInterval = 10 * time.Second
+)
+
+var jobStates = map[host.JobStatus]ct.JobState{
+	host.StatusStarting: ct.JobStateStarting,
+	host.StatusRunning:  ct.JobStateUp,
+	host.StatusDone:     ct.JobStateDown,
+	host.StatusCrashed:  ct.JobStateCrashed,
+	host.StatusFailed:   ct.JobStateFailed,
+}
+
+// JobIndex is a snapshot of the jobs of all apps which is periodically
+// refreshed from the hosts by a periodic task, so that the jobs of
+// large apps can be summarized without listing every host. The logs of
+// one-off jobs are followed while they run, so that each chunk is stamped
+// with the time it was streamed, and stored once the jobs are seen to have
+// exited.
+type JobIndex struct {
+	db   *DB
+	cc   clusterClient
+	logs *JobLogRepo
+
+	followMtx sync.Mutex
+	followed  map[string]*followedLog
+}
+
+// followedLog is the log of a running one-off job read by JobIndex.follow.
+// tail and err are set once done is closed.
+type followedLog struct {
+	tail   *logTail
+	stream cluster.ReadWriteCloser
+	err    error
+	done   chan struct{}
+}
+
+func NewJobIndex(db *DB, cc clusterClient, logs *JobLogRepo) *JobIndex {
+	return &JobIndex{db: db, cc: cc, logs: logs, followed: make(map[string]*followedLog)}
+}
+
+// Run syncs the index as a periodic task.
+func (i *JobIndex) Run(*ct.Task) (interface{}, error) {
+	return nil, i.Sync()
+}
+
+type indexedJob struct {
+	appID, releaseID, typ string
+	state                 ct.JobState
+	startedAt             *time.Time
+}
+
+// Sync replaces the indexed jobs of each host with the jobs it is running.
+// Hosts which cannot be reached keep their previously indexed jobs.
+func (i *JobIndex) Sync() error {
+	hosts, err := i.cc.ListHosts()
+	if err != nil {
+		return err
+	}
+	adopted, err := i.adoptedJobs()
+	if err != nil {
+		return err
+	}
+	appNames := make(map[string]string)
+	for id := range hosts {
+		client, err := i.cc.DialHost(id)
+		if err != nil {
+			log.Printf("error indexing jobs of host %s: %s", id, err)
+			continue
+		}
+		jobs, err := client.ListJobs()
+		client.Close()
+		if err != nil {
+			log.Printf("error indexing jobs of host %s: %s", id, err)
+			continue
+		}
+		indexed := make(map[string]*indexedJob, len(jobs))
+		for jobID, j := range jobs {
+			if job, err := i.indexJob(id, jobID, j, adopted, appNames); err != nil {
+				return err
+			} else if job != nil {
+				indexed[jobID] = job
+			}
+		}
+		exitedJobs, err := i.replaceHost(id, indexed)
+		if err != nil {
+			return err
+		}
+		i.saveLogs(id, exitedJobs, indexed)
+		i.followHost(id, indexed)
+	}
+
+	indexedHosts, err := i.indexedHosts()
+	if err != nil {
+		return err
+	}
+	for _, id := range indexedHosts {
+		if _, ok := hosts[id]; !ok {
+			if _, err := i.replaceHost(id, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return i.logs.Prune()
+}
+
+// saveLogs stores the logs of the given one-off jobs of a host. Errors are
+// logged rather than returned so that a job which can no longer be attached
+// to does not stop the jobs of other hosts being indexed.
+func (i *JobIndex) saveLogs(hostID string, jobIDs []string, jobs map[string]*indexedJob) {
+	if len(jobIDs) == 0 {
+		return
+	}
+	var client cluster.Host
+	for _, jobID := range jobIDs {
+		id := utils.FormatJobID(hostID, jobID)
+		appID := cleanUUID(jobs[jobID].appID)
+		if tail := i.followedTail(id); tail != nil {
+			if err := i.logs.Add(id, appID, tail); err != nil {
+				log.Printf("error saving log of job %s: %s", id, err)
+			}
+			continue
+		}
+		if client == nil {
+			var err error
+			if client, err = i.cc.DialHost(hostID); err != nil {
+				log.Printf("error saving job logs of host %s: %s", hostID, err)
+				return
+			}
+			defer client.Close()
+		}
+		if err := i.saveLog(client, hostID, jobID, appID); err != nil {
+			log.Printf("error saving log of job %s: %s", id, err)
+		}
+	}
+}
+
+// saveLog reads the log of an exited job which was not followed. Its chunks
+// are all stamped with the time they are read.
+func (i *JobIndex) saveLog(client cluster.Host, hostID, jobID, appID string) error {
+	stream, _, err := client.Attach(&host.AttachReq{
+		JobID: jobID,
+		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs,
+	}, false)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	tail := newLogTail(i.logs.limit)
+	if err := demultiplex.Copy(tail.Stream("stdout"), tail.Stream("stderr"), stream); err != nil {
+		return err
+	}
+	return i.logs.Add(utils.FormatJobID(hostID, jobID), appID, tail)
+}
+
+// followLogTimeout is how long the log of an exited job which is being
+// followed is waited for before it is read again instead.
+const followLogTimeout = 10 * time.Second
+
+// follow starts following the log of a running one-off job, unless it is
+// already followed. The log is read from the start, with the output the job
+// logged before it was followed stamped with the time it was first read.
+func (i *JobIndex) follow(hostID, jobID string) {
+	id := utils.FormatJobID(hostID, jobID)
+	i.followMtx.Lock()
+	defer i.followMtx.Unlock()
+	if _, ok := i.followed[id]; ok {
+		return
+	}
+	f := &followedLog{tail: newLogTail(i.logs.limit), done: make(chan struct{})}
+	i.followed[id] = f
+	go func() {
+		defer close(f.done)
+		client, err := i.cc.DialHost(hostID)
+		if err != nil {
+			f.err = err
+			return
+		}
+		defer client.Close()
+		stream, _, err := client.Attach(&host.AttachReq{
+			JobID: jobID,
+			Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs | host.AttachFlagStream,
+		}, false)
+		if err != nil {
+			f.err = err
+			return
+		}
+		i.followMtx.Lock()
+		f.stream = stream
+		i.followMtx.Unlock()
+		defer stream.Close()
+		f.err = demultiplex.Copy(f.tail.Stream("stdout"), f.tail.Stream("stderr"), stream)
+	}()
+}
+
+// followedTail stops following the log of an exited job, returning it once
+// the stream has ended. nil is returned if the job was not followed, or its
+// log could not be read in full.
+func (i *JobIndex) followedTail(id string) *logTail {
+	i.followMtx.Lock()
+	f, ok := i.followed[id]
+	delete(i.followed, id)
+	i.followMtx.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-f.done:
+	case <-time.After(followLogTimeout):
+		i.followMtx.Lock()
+		if f.stream != nil {
+			f.stream.Close()
+		}
+		i.followMtx.Unlock()
+		return nil
+	}
+	if f.err != nil {
+		log.Printf("error following log of job %s: %s", id, f.err)
+		return nil
+	}
+	return f.tail
+}
+
+// followHost follows the logs of the running one-off jobs of a host, and
+// stops following the logs of jobs which the host no longer has.
+func (i *JobIndex) followHost(hostID string, jobs map[string]*indexedJob) {
+	for jobID, job := range jobs {
+		if job.typ == ct.JobTypeRun && !exited(job.state) {
+			i.follow(hostID, jobID)
+		}
+	}
+	i.followMtx.Lock()
+	defer i.followMtx.Unlock()
+	for id, f := range i.followed {
+		if h, jobID, err := utils.ParseJobID(id); err == nil && h == hostID && jobs[jobID] == nil {
+			if f.stream != nil {
+				f.stream.Close()
+			}
+			delete(i.followed, id)
+		}
+	}
+}
+
+// unfollowAll stops following the logs of all jobs. It is called when the
+// controller stops being the leader, as the new leader follows the logs.
+func (i *JobIndex) unfollowAll() {
+	i.followMtx.Lock()
+	defer i.followMtx.Unlock()
+	for id, f := range i.followed {
+		if f.stream != nil {
+			f.stream.Close()
+		}
+		delete(i.followed, id)
+	}
+}
+
+// exited reports whether a job in the given state has exited.
+func exited(state ct.JobState) bool {
+	return state == ct.JobStateDown || state == ct.JobStateCrashed || state == ct.JobStateFailed
+}
+
+// indexJob returns the indexed form of a job, or nil if it does not belong to
+// an app.
+func (i *JobIndex) indexJob(hostID, jobID string, j host.ActiveJob, adopted map[jobKey]*indexedJob, appNames map[string]string) (*indexedJob, error) {
+	job := &indexedJob{state: jobStates[j.Status]}
+	if !j.StartedAt.IsZero() {
+		job.startedAt = &j.StartedAt
+	}
+	var attrs map[string]string
+	if j.Job != nil {
+		attrs = j.Job.Attributes
+	}
+	if aj, ok := adopted[jobKey{hostID, jobID}]; ok && attrs["flynn-controller.app"] == "" {
+		job.appID, job.releaseID, job.typ = aj.appID, aj.releaseID, aj.typ
+	} else if appID := attrs["flynn-controller.app"]; appID != "" {
+		job.appID = appID
+	} else if name := attrs["flynn-controller.app_name"]; name != "" {
+		// jobs started before apps had IDs are matched by name
+		appID, ok := appNames[name]
+		if !ok {
+			err := i.db.QueryRow("SELECT app_id FROM apps WHERE name = $1 AND deleted_at IS NULL", name).Scan(&appID)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			appNames[name] = appID
+		}
+		job.appID = appID
+	}
+	if !idPattern.MatchString(job.appID) {
+		return nil, nil
+	}
+	if job.typ == "" {
+		job.releaseID = attrs["flynn-controller.release"]
+		job.typ = attrs["flynn-controller.type"]
+	}
+	if job.typ == "" {
+		job.typ = ct.JobTypeRun
+	}
+	return job, nil
+}
+
+func (i *JobIndex) adoptedJobs() (map[jobKey]*indexedJob, error) {
+	rows, err := i.db.Query("SELECT host_id, job_id, app_id, release_id, type FROM adopted_jobs")
+	if err != nil {
+		return nil, err
+	}
+	jobs := make(map[jobKey]*indexedJob)
+	for rows.Next() {
+		var k jobKey
+		j := &indexedJob{}
+		var typ sql.NullString
+		if err := rows.Scan(&k.hostID, &k.jobID, &j.appID, &j.releaseID, &typ); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		j.appID = cleanUUID(j.appID)
+		j.releaseID = cleanUUID(j.releaseID)
+		j.typ = typ.String
+		jobs[k] = j
+	}
+	return jobs, rows.Err()
+}
+
+func (i *JobIndex) indexedHosts() ([]string, error) {
+	rows, err := i.db.Query("SELECT DISTINCT host_id FROM job_index")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// replaceHost replaces the indexed jobs of a host, recording job events in
+// the app log for jobs which were added, removed or changed state. The IDs
+// of the one-off jobs which have exited since the host was last indexed are
+// returned.
+func (i *JobIndex) replaceHost(hostID string, jobs map[string]*indexedJob) ([]string, error) {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("DELETE FROM job_index WHERE host_id = $1 RETURNING job_id, app_id, state", hostID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	previous := make(map[string]*indexedJob)
+	for rows.Next() {
+		var jobID, state string
+		j := &indexedJob{}
+		if err := rows.Scan(&jobID, &j.appID, &state); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		j.appID = cleanUUID(j.appID)
+		j.state = ct.JobState(state)
+		previous[jobID] = j
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	apps := make(map[string]bool)
+	event := func(appID, jobID string, job *ct.Job) error {
+		// jobs may reference apps which do not exist or have been purged
+		exists, ok := apps[appID]
+		if !ok {
+			if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM apps WHERE app_id = $1)", appID).Scan(&exists); err != nil {
+				return err
+			}
+			apps[appID] = exists
+		}
+		if !exists {
+			return nil
+		}
+		data, err := appLogData(job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(appLogInsert, appID, string(ct.EventTypeJob), utils.FormatJobID(hostID, jobID), data)
+		return err
+	}
+	var exitedJobs []string
+	for jobID, j := range jobs {
+		if _, err := tx.Exec("INSERT INTO job_index (host_id, job_id, app_id, release_id, type, state, started_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			hostID, jobID, j.appID, j.releaseID, j.typ, string(j.state), j.startedAt); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		prev, ok := previous[jobID]
+		if j.typ == ct.JobTypeRun && exited(j.state) && (!ok || !exited(prev.state)) {
+			exitedJobs = append(exitedJobs, jobID)
+		}
+		if ok && prev.appID == cleanUUID(j.appID) && prev.state == j.state {
+			continue
+		}
+		job := &ct.Job{ID: utils.FormatJobID(hostID, jobID), Type: j.typ, ReleaseID: j.releaseID, State: j.state}
+		if err := event(cleanUUID(j.appID), jobID, job); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	for jobID, prev := range previous {
+		if _, ok := jobs[jobID]; ok {
+			continue
+		}
+		if err := event(prev.appID, jobID, nil); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return exitedJobs, nil
+}
+
+// AppID returns the ID of the app of a job, which is either indexed or has
+// a stored log.
+func (i *JobIndex) AppID(id string) (string, error) {
+	hostID, jobID, err := utils.ParseJobID(id)
+	if err != nil {
+		return "", ErrNotFound
+	}
+	var appID string
+	err = i.db.QueryRow(`SELECT app_id FROM job_index WHERE host_id = $1 AND job_id = $2
+UNION ALL SELECT app_id FROM job_logs WHERE job_id = $3 LIMIT 1`, hostID, jobID, id).Scan(&appID)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return cleanUUID(appID), err
+}
+
+// Summary counts the indexed jobs of an app by type and state.
+func (i *JobIndex) Summary(appID string) (*ct.JobSummary, error) {
+	rows, err := i.db.Query("SELECT type, state, count(*), min(indexed_at) FROM job_index WHERE app_id = $1 GROUP BY type, state", appID)
+	if err != nil {
+		return nil, err
+	}
+	summary := &ct.JobSummary{AppID: appID, Types: make(map[string]map[ct.JobState]int)}
+	for rows.Next() {
+		var typ, state string
+		var count int
+		var indexedAt time.Time
+		if err := rows.Scan(&typ, &state, &count, &indexedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if summary.Types[typ] == nil {
+			summary.Types[typ] = make(map[ct.JobState]int)
+		}
+		summary.Types[typ][ct.JobState(state)] = count
+		summary.Total += count
+		if summary.IndexedAt == nil || indexedAt.Before(*summary.IndexedAt) {
+			summary.IndexedAt = &indexedAt
+		}
+	}
+	return summary, rows.Err()
+}
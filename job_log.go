@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// jobLogRetention is how long the logs of finished one-off jobs are kept.
+const jobLogRetention = 7 * 24 * time.Hour
+
+// JobLogRepo stores the final output of one-off jobs, so that their logs can
+// still be read once their host has forgotten them. Logs are kept up to
+// limit bytes, older data is dropped.
+type JobLogRepo struct {
+	db    *DB
+	limit int
+}
+
+func NewJobLogRepo(db *DB, limit int) *JobLogRepo {
+	return &JobLogRepo{db: db, limit: limit}
+}
+
+// Add stores the log of a job of an app. The first log stored for a job is
+// kept, and logs of apps which do not exist are ignored.
+func (r *JobLogRepo) Add(jobID, appID string, tail *logTail) error {
+	data, err := json.Marshal(tail)
+	if err != nil {
+		return err
+	}
+	return r.db.Exec(`INSERT INTO job_logs (job_id, app_id, data) SELECT $1::text, $2::uuid, $3::text
+WHERE EXISTS (SELECT 1 FROM apps WHERE app_id = $2::uuid) AND NOT EXISTS (SELECT 1 FROM job_logs WHERE job_id = $1::text)`,
+		jobID, appID, string(data))
+}
+
+// Get returns the stored log of a job and the app it belongs to.
+func (r *JobLogRepo) Get(jobID string) (string, *logTail, error) {
+	var appID, data string
+	err := r.db.QueryRow("SELECT app_id, data FROM job_logs WHERE job_id = $1", jobID).Scan(&appID, &data)
+	if err == sql.ErrNoRows {
+		return "", nil, ErrNotFound
+	} else if err != nil {
+		return "", nil, err
+	}
+	tail := &logTail{}
+	if err := json.Unmarshal([]byte(data), tail); err != nil {
+		return "", nil, err
+	}
+	return cleanUUID(appID), tail, nil
+}
+
+// Prune removes the logs stored longer than the retention period ago.
+func (r *JobLogRepo) Prune() error {
+	return r.db.Exec("DELETE FROM job_logs WHERE created_at < $1", time.Now().Add(-jobLogRetention))
+}
+
+// storedJobLog serves the stored log of a finished job, leaving the request
+// to be served from the host of the job if there is none.
+func storedJobLog(req *http.Request, params martini.Params, logs *JobLogRepo, sseConf SSEConfig, w http.ResponseWriter, r render.Render) {
+	serveStoredJobLog("", req, params, logs, sseConf, w, r)
+}
+
+// storedAppJobLog is like storedJobLog, for jobs of an app. Stored logs of
+// jobs of other apps are not found.
+func storedAppJobLog(app *ct.App, req *http.Request, params martini.Params, logs *JobLogRepo, sseConf SSEConfig, w http.ResponseWriter, r render.Render) {
+	serveStoredJobLog(app.ID, req, params, logs, sseConf, w, r)
+}
+
+// serveStoredJobLog serves the stored log of a job. The chunks of a stored log
+// are stamped with the time they were streamed from the host while the job
+// ran, see JobIndex, so the since parameter drops output logged before since.
+func serveStoredJobLog(appID string, req *http.Request, params martini.Params, logs *JobLogRepo, sseConf SSEConfig, w http.ResponseWriter, r render.Render) {
+	jobAppID, tail, err := logs.Get(params["jobs_id"])
+	if err == ErrNotFound {
+		return
+	} else if err == nil && appID != "" && jobAppID != appID {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	since, err := logSince(req)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	w.Header().Set(ct.JobStateHeader, ct.JobLogStateDone)
+	writeLogTail(w, req, tail, sseConf, since)
+}
+
+// logSince parses the since parameter of a job log request.
+func logSince(req *http.Request) (time.Time, error) {
+	s := req.FormValue("since")
+	if s == "" {
+		return time.Time{}, nil
+	}
+	since, err := parseTimestamp(s)
+	if err != nil {
+		return time.Time{}, ct.ValidationError{Field: "since", Message: "must be an RFC 3339 time"}
+	}
+	return since, nil
+}
+
+// writeLogTail writes a buffered job log in the format accepted by the
+// client.
+func writeLogTail(w http.ResponseWriter, req *http.Request, tail *logTail, sseConf SSEConfig, since time.Time) {
+	if tail.Dropped > 0 {
+		w.Header().Set(ct.JobLogTruncatedHeader, strconv.FormatInt(tail.Dropped, 10))
+	}
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		if tail.Dropped > 0 {
+			fmt.Fprintf(w, "event: truncated\ndata: {\"dropped\":%d}\n\n", tail.Dropped)
+		}
+		ssew := NewSSELogWriter(w, sseConf, since)
+		tail.Replay(ssew)
+		ssew.Flush()
+		w.Write([]byte("event: eof\ndata: {}\n\n"))
+	case strings.Contains(accept, "application/x-ndjson"):
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		jw := NewJSONLogWriter(w, sseConf, since)
+		tail.Replay(jw)
+		jw.Flush()
+	default:
+		tail.WriteTo(w)
+	}
+}
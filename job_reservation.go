@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/martini-contrib/render"
+)
+
+// JobReservationRepo records the job IDs reserved for idempotency tokens so
+// that a retried run returns the original job instead of starting another.
+type JobReservationRepo struct {
+	db *DB
+}
+
+func NewJobReservationRepo(db *DB) *JobReservationRepo {
+	return &JobReservationRepo{db}
+}
+
+// Reserve returns the reservation of the token, creating it with a new job ID
+// if it does not exist yet.
+func (r *JobReservationRepo) Reserve(appID, token string) (*ct.JobReservation, error) {
+	res := &ct.JobReservation{Token: token, JobID: cluster.RandomJobID("")}
+	err := r.db.QueryRow("INSERT INTO job_reservations (app_id, token, job_id) VALUES ($1, $2, $3) RETURNING created_at",
+		appID, token, res.JobID).Scan(&res.CreatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return r.Get(appID, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *JobReservationRepo) Get(appID, token string) (*ct.JobReservation, error) {
+	res := &ct.JobReservation{Token: token}
+	var hostID sql.NullString
+	err := r.db.QueryRow("SELECT job_id, host_id, created_at FROM job_reservations WHERE app_id = $1 AND token = $2",
+		appID, token).Scan(&res.JobID, &hostID, &res.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.HostID = hostID.String
+	return res, nil
+}
+
+// Claim marks the reservation as run on hostID. It returns false if another
+// request has already claimed it.
+func (r *JobReservationRepo) Claim(appID, token, hostID string, job *ct.NewJob) (bool, error) {
+	cmd, err := json.Marshal(job.Cmd)
+	if err != nil {
+		return false, err
+	}
+	var jobID string
+	err = r.db.QueryRow("UPDATE job_reservations SET host_id = $3, release_id = $4, cmd = $5 WHERE app_id = $1 AND token = $2 AND host_id IS NULL RETURNING job_id",
+		appID, token, hostID, job.ReleaseID, string(cmd)).Scan(&jobID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Start marks the job of a claimed reservation as possibly started, after
+// which the token always returns it rather than running the job again.
+func (r *JobReservationRepo) Start(appID, token string) error {
+	return r.db.Exec("UPDATE job_reservations SET started = true WHERE app_id = $1 AND token = $2", appID, token)
+}
+
+// Release undoes a claim after the job definitely failed to be scheduled so
+// that the token can be retried.
+func (r *JobReservationRepo) Release(appID, token string) error {
+	return r.db.Exec("UPDATE job_reservations SET host_id = NULL, release_id = NULL, cmd = NULL WHERE app_id = $1 AND token = $2 AND NOT started", appID, token)
+}
+
+// ErrJobReservationPending is returned for a claimed reservation whose job
+// is still being scheduled by another request.
+var ErrJobReservationPending = errors.New("controller: job reservation is pending")
+
+// Job returns the job started for a claimed reservation, or
+// ErrJobReservationPending if it is still being scheduled.
+func (r *JobReservationRepo) Job(appID, token string) (*ct.Job, error) {
+	var jobID, hostID, releaseID string
+	var cmd sql.NullString
+	var started bool
+	err := r.db.QueryRow("SELECT job_id, host_id, release_id, cmd, started FROM job_reservations WHERE app_id = $1 AND token = $2 AND host_id IS NOT NULL",
+		appID, token).Scan(&jobID, &hostID, &releaseID, &cmd, &started)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !started {
+		return nil, ErrJobReservationPending
+	}
+	job := &ct.Job{ID: utils.FormatJobID(hostID, jobID), ReleaseID: cleanUUID(releaseID)}
+	if cmd.Valid {
+		if err := json.Unmarshal([]byte(cmd.String), &job.Cmd); err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+func reserveJob(app *ct.App, req ct.JobReservation, repo *JobReservationRepo, r render.Render) {
+	if req.Token == "" {
+		r.JSON(400, ct.ValidationError{Field: "token", Message: "must not be blank"})
+		return
+	}
+	res, err := repo.Reserve(app.ID, req.Token)
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	r.JSON(200, res)
+}
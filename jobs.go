@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
@@ -24,41 +31,311 @@ type clusterClient interface {
 	AddJobs(*host.AddJobsReq) (*host.AddJobsRes, error)
 }
 
-func jobList(app *ct.App, cc clusterClient, r render.Render) {
+func jobList(app *ct.App, cc clusterClient, adopted *AdoptedJobRepo, index *JobIndex, req *http.Request, r render.Render) {
+	if req.URL.Query().Get("summary") == "true" {
+		summary, err := index.Summary(app.ID)
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		r.JSON(200, summary)
+		return
+	}
 	hosts, err := cc.ListHosts()
 	if err != nil {
 		log.Println(err)
 		r.JSON(500, struct{}{})
 		return
 	}
+	adoptedJobs, err := adopted.AppList(app.ID)
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	r.JSON(200, appJobs(app, hosts, adoptedJobs))
+}
+
+// appJobs returns the jobs of an app running on the hosts.
+func appJobs(app *ct.App, hosts map[string]host.Host, adoptedJobs map[jobKey]adoptedJob) []ct.Job {
 	var jobs []ct.Job
 	for _, h := range hosts {
 		for _, j := range h.Jobs {
-			if j.Attributes["flynn-controller.app"] != app.ID {
+			job := ct.Job{ID: utils.FormatJobID(h.ID, j.ID)}
+			if aj, ok := adoptedJobs[jobKey{h.ID, j.ID}]; ok && j.Attributes["flynn-controller.app"] == "" {
+				job.Type = aj.Type
+				job.ReleaseID = aj.ReleaseID
+			} else if appID := j.Attributes["flynn-controller.app"]; appID == app.ID ||
+				appID == "" && j.Attributes["flynn-controller.app_name"] == app.Name {
+				job.Type = j.Attributes["flynn-controller.type"]
+				job.ReleaseID = j.Attributes["flynn-controller.release"]
+			} else {
 				continue
 			}
-
-			job := ct.Job{
-				ID:        h.ID + "-" + j.ID,
-				Type:      j.Attributes["flynn-controller.type"],
-				ReleaseID: j.Attributes["flynn-controller.release"],
-			}
-			if job.Type == "" {
+			if job.Type == "" && j.Config != nil {
 				job.Cmd = j.Config.Cmd
 			}
 			jobs = append(jobs, job)
 		}
 	}
+	return jobs
+}
+
+// maxJobListApps is the maximum number of apps whose jobs can be listed in a
+// single request.
+const maxJobListApps = 100
+
+// multiAppJobList responds with the jobs of the apps in the app_ids query
+// parameter keyed by app ID, listing the hosts of the cluster only once.
+func multiAppJobList(apps *AppRepo, cc clusterClient, adopted *AdoptedJobRepo, req *http.Request, r render.Render) {
+	var ids []string
+	for _, id := range strings.Split(req.URL.Query().Get("app_ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		r.JSON(400, ct.ValidationError{Field: "app_ids", Message: "must not be blank"})
+		return
+	}
+	if len(ids) > maxJobListApps {
+		r.JSON(400, ct.ValidationError{Field: "app_ids", Message: fmt.Sprintf("must not contain more than %d apps", maxJobListApps)})
+		return
+	}
+	list := make([]*ct.App, 0, len(ids))
+	for _, id := range ids {
+		data, err := apps.Get(id)
+		if err == ErrNotFound {
+			r.JSON(400, ct.ValidationError{Field: "app_ids", Message: fmt.Sprintf("app %q does not exist", id)})
+			return
+		} else if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		list = append(list, data.(*ct.App))
+	}
+
+	hosts, err := cc.ListHosts()
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	res := make(map[string][]ct.Job, len(list))
+	for _, app := range list {
+		adoptedJobs, err := adopted.AppList(app.ID)
+		if err != nil {
+			log.Println(err)
+			r.JSON(500, struct{}{})
+			return
+		}
+		jobs := appJobs(app, hosts, adoptedJobs)
+		if jobs == nil {
+			jobs = []ct.Job{}
+		}
+		res[app.ID] = jobs
+	}
+	r.JSON(200, res)
+}
+
+// getAppStats responds with counts of the releases, formations, running jobs
+// and resources of an app. Jobs are counted from the hosts of the cluster.
+func getAppStats(app *ct.App, apps *AppRepo, cc clusterClient, adopted *AdoptedJobRepo, r render.Render) {
+	stats, err := apps.Stats(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	hosts, err := cc.ListHosts()
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	adoptedJobs, err := adopted.AppList(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	stats.JobTypes = make(map[string]int)
+	for _, job := range appJobs(app, hosts, adoptedJobs) {
+		typ := job.Type
+		if typ == "" {
+			typ = ct.JobTypeRun
+		}
+		stats.JobTypes[typ]++
+		stats.Jobs++
+	}
+	r.JSON(200, stats)
+}
+
+// stopAppJobs stops all running jobs of the app, including adopted jobs.
+func stopAppJobs(app *ct.App, adopted *AdoptedJobRepo, cl clusterClient) error {
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		return err
+	}
+	adoptedJobs, err := adopted.AppList(app.ID)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, h := range hosts {
+		var ids []string
+		for _, j := range h.Jobs {
+			if _, ok := adoptedJobs[jobKey{h.ID, j.ID}]; ok || j.Attributes["flynn-controller.app"] == app.ID {
+				ids = append(ids, j.ID)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		client, err := cl.DialHost(h.ID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, id := range ids {
+			if err := client.StopJob(id); err != nil {
+				lastErr = err
+			}
+		}
+		client.Close()
+	}
+	return lastErr
+}
 
-	r.JSON(200, jobs)
+// jobFilter selects the jobs of an app stopped by stopJobs.
+type jobFilter struct {
+	typ       string
+	state     ct.JobState
+	olderThan time.Duration
 }
 
-func jobLog(req *http.Request, app *ct.App, params martini.Params, cluster cluster.Host, w http.ResponseWriter) {
+func parseJobFilter(q url.Values) (*jobFilter, error) {
+	f := &jobFilter{typ: q.Get("type"), state: ct.JobState(q.Get("state"))}
+	if s := q.Get("older_than"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, ct.ValidationError{Field: "older_than", Message: "must be a positive duration"}
+		}
+		f.olderThan = d
+	}
+	if f.state != "" && !f.state.Valid() {
+		return nil, ct.ValidationError{Field: "state", Message: "is not a valid job state"}
+	}
+	if f.typ == "" && f.state == "" && f.olderThan == 0 {
+		return nil, ct.ValidationError{Message: "at least one of type, state or older_than must be set"}
+	}
+	return f, nil
+}
+
+func (f *jobFilter) match(typ string, j host.ActiveJob) bool {
+	if f.typ != "" && typ != f.typ {
+		return false
+	}
+	if f.state != "" && jobStates[j.Status] != f.state {
+		return false
+	}
+	return f.olderThan == 0 || !j.StartedAt.IsZero() && time.Since(j.StartedAt) > f.olderThan
+}
+
+// stopJobs stops the jobs of an app matching the type, state and older_than
+// parameters, such as stuck one-off jobs with ?type=run&older_than=1h. Hosts
+// are stopped concurrently and the stopped and failed jobs are returned.
+func stopJobs(app *ct.App, req *http.Request, adopted *AdoptedJobRepo, cl clusterClient, r render.Render) {
+	filter, err := parseJobFilter(req.URL.Query())
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	adoptedJobs, err := adopted.AppList(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+
+	res := &ct.StopJobsRes{Stopped: []string{}, Failed: []*ct.StopJobError{}}
+	var mtx sync.Mutex
+	fail := func(id string, err error) {
+		mtx.Lock()
+		res.Failed = append(res.Failed, &ct.StopJobError{ID: id, Message: err.Error()})
+		mtx.Unlock()
+	}
+	var wg sync.WaitGroup
+	for hostID := range hosts {
+		wg.Add(1)
+		go func(hostID string) {
+			defer wg.Done()
+			client, err := cl.DialHost(hostID)
+			if err != nil {
+				fail(hostID, err)
+				return
+			}
+			defer client.Close()
+			jobs, err := client.ListJobs()
+			if err != nil {
+				fail(hostID, err)
+				return
+			}
+			for jobID, j := range jobs {
+				var attrs map[string]string
+				if j.Job != nil {
+					attrs = j.Job.Attributes
+				}
+				var typ string
+				if aj, ok := adoptedJobs[jobKey{hostID, jobID}]; ok && attrs["flynn-controller.app"] == "" {
+					typ = aj.Type
+				} else if appID := attrs["flynn-controller.app"]; appID == app.ID ||
+					appID == "" && attrs["flynn-controller.app_name"] == app.Name {
+					typ = attrs["flynn-controller.type"]
+				} else {
+					continue
+				}
+				if typ == "" {
+					typ = ct.JobTypeRun
+				}
+				if !filter.match(typ, j) {
+					continue
+				}
+				id := utils.FormatJobID(hostID, jobID)
+				if err := client.StopJob(jobID); err != nil {
+					fail(id, err)
+					continue
+				}
+				mtx.Lock()
+				res.Stopped = append(res.Stopped, id)
+				mtx.Unlock()
+			}
+		}(hostID)
+	}
+	wg.Wait()
+	sort.Strings(res.Stopped)
+	r.JSON(200, res)
+}
+
+// jobLog streams the log of a job from its host. SSE and JSON lines output
+// stamp each chunk with the time it was received, and are limited to chunks
+// received after the RFC 3339 time in the since parameter, which also
+// applies when following the log. The output the job logged before the
+// request is replayed by the host and stamped with the time of the request.
+func jobLog(req *http.Request, params martini.Params, cluster cluster.Host, sseConf SSEConfig, w http.ResponseWriter, r render.Render) {
+	since, err := logSince(req)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
 	attachReq := &host.AttachReq{
 		JobID: params["jobs_id"],
 		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs,
 	}
-	if tail := req.FormValue("tail"); tail != "" {
+	follow := req.FormValue("tail") != ""
+	if follow {
 		attachReq.Flags |= host.AttachFlagStream
 	}
 	stream, _, err := cluster.Attach(attachReq, false)
@@ -69,80 +346,242 @@ func jobLog(req *http.Request, app *ct.App, params martini.Params, cluster clust
 		return
 	}
 	defer stream.Close()
-	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+	accept := req.Header.Get("Accept")
+	sse := strings.Contains(accept, "text/event-stream")
+	ndjson := strings.Contains(accept, "application/x-ndjson")
+
+	if !follow {
+		// the log is read in full before responding, keeping only the most
+		// recent data so that a chatty job can't exhaust client memory
+		limited := newLogTail(sseConf.MaxLogSize)
+		demultiplex.Copy(limited.Stream("stdout"), limited.Stream("stderr"), stream)
+		writeLogTail(w, req, limited, sseConf, since)
+		return
+	}
+
+	switch {
+	case sse:
 		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-		ssew := NewSSELogWriter(w)
+		ssew := NewSSELogWriter(w, sseConf, since)
 		demultiplex.Copy(ssew.Stream("stdout"), ssew.Stream("stderr"), stream)
-		// TODO: include exit code here if tailing
+		ssew.Flush()
+		// TODO: include exit code here
 		w.Write([]byte("event: eof\ndata: {}\n\n"))
-	} else {
+	case ndjson:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		jw := NewJSONLogWriter(w, sseConf, since)
+		demultiplex.Copy(jw.Stream("stdout"), jw.Stream("stderr"), stream)
+		jw.Flush()
+	default:
 		io.Copy(w, stream)
 	}
 }
 
-type SSELogWriter interface {
+// auditJobLog records access to job logs through the admin endpoint, which
+// does not check which app the job belongs to, as an audit event of the app
+// of the job.
+func auditJobLog(req *http.Request, params martini.Params, jobs *JobIndex, events *AppEventRepo) {
+	id := params["jobs_id"]
+	e := &ct.AuditEvent{Subject: requestSubject(req), Action: "job_log", RemoteAddr: req.RemoteAddr, UserAgent: req.UserAgent()}
+	log.Printf("audit: subject=%s action=%s job=%s remote=%s agent=%q", e.Subject, e.Action, id, e.RemoteAddr, e.UserAgent)
+	appID, err := jobs.AppID(id)
+	if err == ErrNotFound {
+		return
+	} else if err != nil {
+		log.Printf("error finding the app of job %s: %s", id, err)
+		return
+	}
+	if err := events.Add(appID, ct.EventTypeAudit, id, e); err != nil {
+		log.Printf("error recording audit event of job %s: %s", id, err)
+	}
+}
+
+// LogWriter encodes demultiplexed job log streams as a series of JSON
+// events.
+type LogWriter interface {
 	Stream(string) io.Writer
+	WriteChunk(stream string, p []byte, t time.Time) error
+	Flush() error
+}
+
+// SSEConfig controls how job log events are written to SSE and JSON lines
+// clients.
+type SSEConfig struct {
+	// BufferSize is the size of the buffer events are encoded into before
+	// being written to the client.
+	BufferSize int
+
+	// FlushInterval is the maximum time an event is buffered before being
+	// flushed to the client. If zero, each event is flushed once written.
+	FlushInterval time.Duration
+
+	// MaxLogSize is the most log data returned when a job log is not
+	// followed, older data is dropped. If zero the default is used.
+	MaxLogSize int
+}
+
+var defaultSSEConfig = SSEConfig{BufferSize: 4096, MaxLogSize: 4 << 20}
+
+// sseConfigFromEnv reads SSE_BUFFER_SIZE, SSE_FLUSH_INTERVAL and
+// JOB_LOG_MAX_SIZE, falling back to the defaults for unset or invalid values.
+func sseConfigFromEnv() SSEConfig {
+	conf := defaultSSEConfig
+	if n, err := strconv.Atoi(os.Getenv("SSE_BUFFER_SIZE")); err == nil && n > 0 {
+		conf.BufferSize = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("JOB_LOG_MAX_SIZE")); err == nil && n > 0 {
+		conf.MaxLogSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("SSE_FLUSH_INTERVAL")); err == nil && d > 0 {
+		conf.FlushInterval = d
+	}
+	return conf
+}
+
+// NewSSELogWriter returns a LogWriter that writes each chunk as a
+// server-sent event. Chunks received before since are discarded.
+func NewSSELogWriter(w io.Writer, conf SSEConfig, since time.Time) LogWriter {
+	return newLogWriter(w, conf, []byte("data: "), []byte("\n"), since)
+}
+
+// NewJSONLogWriter returns a LogWriter that writes each chunk as a line of
+// JSON. Chunks received before since are discarded.
+func NewJSONLogWriter(w io.Writer, conf SSEConfig, since time.Time) LogWriter {
+	return newLogWriter(w, conf, nil, nil, since)
 }
 
-func NewSSELogWriter(w io.Writer) SSELogWriter {
-	return &sseLogWriter{Writer: w, Encoder: json.NewEncoder(w)}
+func newLogWriter(w io.Writer, conf SSEConfig, prefix, suffix []byte, since time.Time) *logWriter {
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = defaultSSEConfig.BufferSize
+	}
+	buf := bufio.NewWriterSize(w, conf.BufferSize)
+	return &logWriter{
+		w:        w,
+		buf:      buf,
+		Encoder:  json.NewEncoder(buf),
+		prefix:   prefix,
+		suffix:   suffix,
+		since:    since,
+		interval: conf.FlushInterval,
+	}
 }
 
-type sseLogWriter struct {
-	io.Writer
+type logWriter struct {
+	w   io.Writer
+	buf *bufio.Writer
 	*json.Encoder
 	sync.Mutex
-}
 
-func (w *sseLogWriter) Stream(s string) io.Writer {
-	return &sseLogStreamWriter{w: w, s: s}
+	prefix, suffix []byte
+	since          time.Time
+
+	interval time.Duration
+	timer    *time.Timer
 }
 
-type sseLogStreamWriter struct {
-	w *sseLogWriter
-	s string
+func (w *logWriter) Stream(s string) io.Writer {
+	return &logStreamWriter{w: w, s: s}
 }
 
-type sseLogChunk struct {
-	Stream string `json:"stream"`
-	Data   string `json:"data"`
+// Flush writes any buffered events to the client.
+func (w *logWriter) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.flush()
 }
 
-func (w *sseLogStreamWriter) Write(p []byte) (int, error) {
-	w.w.Lock()
-	defer w.w.Unlock()
+func (w *logWriter) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
 
-	if _, err := w.w.Write([]byte("data: ")); err != nil {
-		return 0, err
+// written is called with the lock held after each event, and flushes
+// immediately or schedules a flush depending on the flush interval.
+func (w *logWriter) written() error {
+	if w.interval == 0 {
+		return w.flush()
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.interval, func() {
+			w.Lock()
+			defer w.Unlock()
+			if w.timer != nil {
+				w.timer = nil
+				w.flush()
+			}
+		})
 	}
-	if err := w.w.Encode(&sseLogChunk{Stream: w.s, Data: string(p)}); err != nil {
+	return nil
+}
+
+type logStreamWriter struct {
+	w *logWriter
+	s string
+}
+
+type logChunk struct {
+	Stream    string    `json:"stream"`
+	Data      string    `json:"data"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Write encodes p as a chunk. The attach protocol does not carry the time
+// output was produced, so chunks are stamped with the time they are received.
+func (w *logStreamWriter) Write(p []byte) (int, error) {
+	if err := w.w.WriteChunk(w.s, p, time.Now()); err != nil {
 		return 0, err
 	}
-	_, err := w.w.Write([]byte("\n"))
-	return len(p), err
+	return len(p), nil
 }
 
-func parseJobID(params martini.Params) (string, string) {
-	id := strings.SplitN(params["jobs_id"], "-", 2)
-	if len(id) != 2 || id[0] == "" || id[1] == "" {
-		return "", ""
+// WriteChunk encodes p as a chunk of the stream received at t, discarding it
+// if t is before since. t is when the controller read the chunk from the
+// host, which for the stored logs of one-off jobs is when the controller
+// leader followed it, see JobIndex.
+func (w *logWriter) WriteChunk(stream string, p []byte, t time.Time) error {
+	t = t.UTC()
+	if t.Before(w.since) {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	chunk := &logChunk{Stream: stream, Data: string(p), Timestamp: t}
+	if _, err := w.buf.Write(w.prefix); err != nil {
+		return err
+	}
+	if err := w.Encode(chunk); err != nil {
+		return err
 	}
-	return id[0], id[1]
+	if _, err := w.buf.Write(w.suffix); err != nil {
+		return err
+	}
+	return w.written()
 }
 
-func connectHostMiddleware(c martini.Context, params martini.Params, cl clusterClient, w http.ResponseWriter) {
-	hostID, jobID := parseJobID(params)
-	if hostID == "" {
-		log.Printf("Unable to parse hostID from %q", params["jobs_id"])
-		w.WriteHeader(404)
+func connectHostMiddleware(c martini.Context, params martini.Params, cl clusterClient, r render.Render) {
+	hostID, jobID, err := utils.ParseJobID(params["jobs_id"])
+	if err != nil {
+		r.JSON(400, ct.ValidationError{Field: "id", Message: "is invalid"})
 		return
 	}
 	params["jobs_id"] = jobID
+	params["host_id"] = hostID
 
 	client, err := cl.DialHost(hostID)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		r.JSON(500, struct{}{})
 		return
 	}
 	c.MapTo(client, (*cluster.Host)(nil))
@@ -151,6 +590,89 @@ func connectHostMiddleware(c martini.Context, params martini.Params, cl clusterC
 	client.Close()
 }
 
+// jobEnvDiff responds with the env vars of a job which differ from the app
+// env and env of the current release of the app. Variables set by the job
+// request or the scheduler, such as the job certificate, are only compared if
+// they are set in the env of the release the job was started with.
+func jobEnvDiff(app *ct.App, params martini.Params, client cluster.Host, apps *AppRepo, releases *ReleaseRepo, r render.Render) {
+	job, err := client.GetJob(params["jobs_id"])
+	if err != nil || job == nil || job.Job == nil {
+		if err != nil {
+			log.Println(err)
+		}
+		r.JSON(404, struct{}{})
+		return
+	}
+	if job.Job.Attributes["flynn-controller.app"] != app.ID {
+		r.JSON(404, struct{}{})
+		return
+	}
+
+	diff := &ct.JobEnvDiff{
+		JobID:     utils.FormatJobID(params["host_id"], params["jobs_id"]),
+		ReleaseID: job.Job.Attributes["flynn-controller.release"],
+		Env:       make(map[string]ct.EnvVarDiff),
+	}
+	current := make(map[string]string)
+	appEnv, err := apps.GetEnv(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	for k, v := range appEnv {
+		current[k] = v
+	}
+	release, err := apps.GetRelease(app.ID)
+	if err == nil {
+		diff.CurrentReleaseID = release.ID
+		for k, v := range release.Env {
+			current[k] = v
+		}
+	} else if err != ErrNotFound {
+		respondWithError(r, err)
+		return
+	}
+
+	jobEnv := make(map[string]string)
+	if job.Job.Config != nil {
+		for _, kv := range job.Job.Config.Env {
+			if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+				jobEnv[parts[0]] = parts[1]
+			}
+		}
+	}
+	keys := make(map[string]struct{}, len(current))
+	for k := range current {
+		keys[k] = struct{}{}
+	}
+	if diff.ReleaseID != "" {
+		if data, err := releases.Get(diff.ReleaseID); err == nil {
+			for k := range data.(*ct.Release).Env {
+				keys[k] = struct{}{}
+			}
+		} else if err != ErrNotFound {
+			respondWithError(r, err)
+			return
+		}
+	}
+	for k := range keys {
+		jobVal, inJob := jobEnv[k]
+		currentVal, inCurrent := current[k]
+		if inJob == inCurrent && jobVal == currentVal {
+			continue
+		}
+		var d ct.EnvVarDiff
+		if inJob {
+			d.Job = &jobVal
+		}
+		if inCurrent {
+			d.Current = &currentVal
+		}
+		diff.Env[k] = d
+	}
+	r.JSON(200, diff)
+}
+
 func killJob(app *ct.App, params martini.Params, client cluster.Host, w http.ResponseWriter) {
 	if err := client.StopJob(params["jobs_id"]); err != nil {
 		log.Println(err)
@@ -159,16 +681,79 @@ func killJob(app *ct.App, params martini.Params, client cluster.Host, w http.Res
 	}
 }
 
-func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *ArtifactRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r render.Render) {
-	data, err := releases.Get(newJob.ReleaseID)
+// checkExpectedRelease returns a mismatch if the current release of an app is
+// not the expected release.
+func checkExpectedRelease(appID, expected string, apps *AppRepo, releases *ReleaseRepo) (*ct.ReleaseMismatch, error) {
+	mismatch := &ct.ReleaseMismatch{Expected: expected}
+	current, err := apps.GetRelease(appID)
+	if err == ErrNotFound {
+		return mismatch, nil
+	} else if err != nil {
+		return nil, err
+	}
+	mismatch.Current = current.ID
+	id, err := releases.ResolveID(appID, expected)
+	if err == ErrNotFound {
+		return mismatch, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if id != current.ID {
+		return mismatch, nil
+	}
+	return nil, nil
+}
+
+func runJob(app *ct.App, newJob ct.NewJob, apps *AppRepo, releases *ReleaseRepo, artifacts *ArtifactRepo, registry *RegistryConfigRepo, ca *CARepo, reservations *JobReservationRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r render.Render) {
+	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
+	var previousHostID string
+	if newJob.PreviousJobID != "" {
+		var err error
+		if previousHostID, _, err = utils.ParseJobID(newJob.PreviousJobID); err != nil {
+			r.JSON(400, ct.ValidationError{Field: "previous_job_id", Message: "is invalid"})
+			return
+		}
+	}
+	token := newJob.IdempotencyToken
+	if token != "" {
+		if attach {
+			r.JSON(400, ct.ValidationError{Field: "idempotency_token", Message: "cannot be used with attached jobs"})
+			return
+		}
+		// a retried run returns the job started by the first request
+		if job, err := reservations.Job(app.ID, token); err == nil {
+			r.JSON(200, job)
+			return
+		} else if err == ErrJobReservationPending {
+			respondWithError(r, err)
+			return
+		} else if err != ErrNotFound {
+			log.Println("error getting job reservation", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	if newJob.ExpectedReleaseID != "" {
+		mismatch, err := checkExpectedRelease(app.ID, newJob.ExpectedReleaseID, apps, releases)
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		if mismatch != nil {
+			w.Header().Set(ct.ReleaseMismatchHeader, "true")
+			r.JSON(409, mismatch)
+			return
+		}
+	}
+	release, err := releases.GetForApp(app.ID, newJob.ReleaseID)
 	if err != nil {
 		// TODO: 400 on ErrNotFound
 		log.Println("error getting release", err)
 		w.WriteHeader(500)
 		return
 	}
-	release := data.(*ct.Release)
-	data, err = artifacts.Get(release.ArtifactID)
+	newJob.ReleaseID = release.ID
+	data, err := artifacts.Get(release.ArtifactID)
 	if err != nil {
 		// TODO: 400 on ErrNotFound
 		log.Println("error getting artifact", err)
@@ -176,23 +761,52 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 		return
 	}
 	artifact := data.(*ct.Artifact)
-	image, err := utils.DockerImage(artifact.URI)
+	appEnv, err := apps.GetEnv(app.ID)
+	if err != nil {
+		log.Println("error getting app env", err)
+		w.WriteHeader(500)
+		return
+	}
+	registryConf, err := registry.Effective(app.ID)
+	if err != nil {
+		log.Println("error getting registry config", err)
+		w.WriteHeader(500)
+		return
+	}
+	image, artifactEnv, err := utils.ArtifactImage(artifact, registryConf)
 	if err != nil {
 		log.Println("error parsing artifact uri", err)
 		w.WriteHeader(400)
 		return
 	}
-	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
+	cert, err := ca.Issue(&ct.CertificateReq{AppID: app.ID, ReleaseID: release.ID})
+	if err != nil {
+		log.Println("error issuing job certificate", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	jobID := cluster.RandomJobID("")
+	if token != "" {
+		reservation, err := reservations.Reserve(app.ID, token)
+		if err != nil {
+			log.Println("error reserving job", err)
+			w.WriteHeader(500)
+			return
+		}
+		jobID = reservation.JobID
+	}
 
 	job := &host.Job{
-		ID: cluster.RandomJobID(""),
+		ID: jobID,
 		Attributes: map[string]string{
-			"flynn-controller.app":     app.ID,
-			"flynn-controller.release": release.ID,
+			"flynn-controller.app":      app.ID,
+			"flynn-controller.app_name": app.Name,
+			"flynn-controller.release":  release.ID,
 		},
 		Config: &docker.Config{
 			Cmd:          newJob.Cmd,
-			Env:          utils.FormatEnv(release.Env, newJob.Env),
+			Env:          utils.FormatEnv(appEnv, release.Env, newJob.Env, artifactEnv, utils.CertEnv(cert)),
 			Image:        image,
 			AttachStdout: true,
 			AttachStderr: true,
@@ -213,16 +827,46 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 		w.WriteHeader(500)
 		return
 	}
-	// pick a random host
 	var hostID string
-	for hostID = range hosts {
-		break
+	if _, ok := hosts[previousHostID]; ok {
+		hostID = previousHostID
+	} else {
+		if previousHostID != "" {
+			log.Printf("host %s of job %s is gone, running job of app %s on another host", previousHostID, newJob.PreviousJobID, app.ID)
+			w.Header().Set("Warning", fmt.Sprintf(`199 flynn-controller "host of job %s is gone, running on another host"`, newJob.PreviousJobID))
+		}
+		// pick a random host
+		for hostID = range hosts {
+			break
+		}
 	}
 	if hostID == "" {
 		log.Println("no hosts found")
 		w.WriteHeader(500)
 		return
 	}
+	if token != "" {
+		claimed, err := reservations.Claim(app.ID, token, hostID, &newJob)
+		if err != nil {
+			log.Println("error claiming job reservation", err)
+			w.WriteHeader(500)
+			return
+		}
+		if !claimed {
+			// a concurrent request with the same token won the race
+			job, err := reservations.Job(app.ID, token)
+			if err == ErrJobReservationPending {
+				respondWithError(r, err)
+				return
+			} else if err != nil {
+				log.Println("error getting job reservation", err)
+				w.WriteHeader(500)
+				return
+			}
+			r.JSON(200, job)
+			return
+		}
+	}
 
 	var attachConn cluster.ReadWriteCloser
 	var attachWait func() error
@@ -250,6 +894,17 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 	}
 
 	_, err = cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {job}}})
+	if token != "" {
+		// the reservation is only released if the job definitely did not
+		// start, otherwise retries return it so that it runs at most once
+		if err == ErrBreakerOpen {
+			if err := reservations.Release(app.ID, token); err != nil {
+				log.Println("error releasing job reservation", err)
+			}
+		} else if err := reservations.Start(app.ID, token); err != nil {
+			log.Println("error starting job reservation", err)
+		}
+	}
 	if err != nil {
 		log.Println("schedule failed", err)
 		w.WriteHeader(500)
@@ -285,7 +940,7 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 		return
 	} else {
 		r.JSON(200, &ct.Job{
-			ID:        hostID + "-" + job.ID,
+			ID:        utils.FormatJobID(hostID, job.ID),
 			ReleaseID: newJob.ReleaseID,
 			Cmd:       newJob.Cmd,
 		})
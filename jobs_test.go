@@ -3,15 +3,22 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
 	"sort"
 	"strings"
+	"testing"
+	"time"
 
+	controller "github.com/flynn/flynn-controller/client"
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
 	"github.com/flynn/flynn-host/types"
@@ -27,6 +34,9 @@ func newFakeCluster() *fakeCluster {
 type fakeCluster struct {
 	hosts       map[string]host.Host
 	hostClients map[string]cluster.Host
+
+	// addJobsErr is returned by AddJobs if set
+	addJobsErr error
 }
 
 func (c *fakeCluster) ListHosts() (map[string]host.Host, error) {
@@ -42,6 +52,9 @@ func (c *fakeCluster) DialHost(id string) (cluster.Host, error) {
 }
 
 func (c *fakeCluster) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
+	if c.addJobsErr != nil {
+		return nil, c.addJobsErr
+	}
 	for hostID, jobs := range req.HostJobs {
 		host, ok := c.hosts[hostID]
 		if !ok {
@@ -70,12 +83,15 @@ func (s *S) TestJobList(c *C) {
 			{ID: "job1", Attributes: map[string]string{"flynn-controller.app": app.ID}, Config: &docker.Config{Cmd: []string{"bash"}}},
 			{ID: "job2", Attributes: map[string]string{"flynn-controller.app": "otherApp"}},
 			{ID: "job3"},
+			{ID: "job4", Attributes: map[string]string{"flynn-controller.app_name": app.Name, "flynn-controller.type": "worker"}},
+			{ID: "job5", Attributes: map[string]string{"flynn-controller.app": "otherApp", "flynn-controller.app_name": app.Name}},
 		},
 	}})
 
 	expected := []ct.Job{
 		{ID: "host0-job0", Type: "web", ReleaseID: "release0"},
 		{ID: "host0-job1", Cmd: []string{"bash"}},
+		{ID: "host0-job4", Type: "worker"},
 	}
 
 	var actual []ct.Job
@@ -85,6 +101,211 @@ func (s *S) TestJobList(c *C) {
 	c.Assert(actual, DeepEquals, expected)
 }
 
+func (s *S) TestMultiAppJobList(c *C) {
+	app0 := s.createTestApp(c, &ct.App{Name: "multi-job-list0"})
+	app1 := s.createTestApp(c, &ct.App{Name: "multi-job-list1"})
+	app2 := s.createTestApp(c, &ct.App{Name: "multi-job-list2"})
+	s.cc.setHosts(map[string]host.Host{"host0": {
+		ID: "host0",
+		Jobs: []*host.Job{
+			{ID: "job0", Attributes: map[string]string{"flynn-controller.app": app0.ID, "flynn-controller.type": "web"}},
+			{ID: "job1", Attributes: map[string]string{"flynn-controller.app": app1.ID, "flynn-controller.type": "worker"}},
+			{ID: "job2", Attributes: map[string]string{"flynn-controller.app": "otherApp"}},
+		},
+	}})
+	defer s.cc.setHosts(nil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	jobs, err := client.MultiAppJobList([]string{app0.ID, app1.Name, app2.ID})
+	c.Assert(err, IsNil)
+	c.Assert(jobs, DeepEquals, map[string][]*ct.Job{
+		app0.ID: {{ID: "host0-job0", Type: "web"}},
+		app1.ID: {{ID: "host0-job1", Type: "worker"}},
+		app2.ID: {},
+	})
+
+	for _, query := range []string{"", "?app_ids=", "?app_ids=" + app0.ID + ",nonexistent"} {
+		res, _ := s.Get("/jobs"+query, nil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+func (s *S) TestAppStats(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-stats"})
+	for i := 0; i < 2; i++ {
+		release := s.createTestRelease(c, &ct.Release{})
+		s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {
+		ID: "host0",
+		Jobs: []*host.Job{
+			{ID: "job0", Attributes: map[string]string{"flynn-controller.app": app.ID, "flynn-controller.type": "web"}},
+			{ID: "job1", Attributes: map[string]string{"flynn-controller.app": app.ID, "flynn-controller.type": "web"}},
+			{ID: "job2", Attributes: map[string]string{"flynn-controller.app": app.ID}},
+			{ID: "job3", Attributes: map[string]string{"flynn-controller.app": "otherApp", "flynn-controller.type": "web"}},
+		},
+	}})
+	defer s.cc.setHosts(nil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	stats, err := client.AppStats(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(stats.AppID, Equals, app.ID)
+	c.Assert(stats.Releases, Equals, 2)
+	c.Assert(stats.Formations, Equals, 2)
+	c.Assert(stats.Jobs, Equals, 3)
+	c.Assert(stats.JobTypes, DeepEquals, map[string]int{"web": 2, ct.JobTypeRun: 1})
+	c.Assert(stats.Resources, Equals, 0)
+}
+
+func (s *S) TestAdoptJob(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "adopt-job"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.cc.setHosts(map[string]host.Host{"host0": {
+		ID: "host0",
+		Jobs: []*host.Job{
+			{ID: "legacy0", Config: &docker.Config{Cmd: []string{"redis-server"}}},
+			{ID: "managed0", Attributes: map[string]string{"flynn-controller.app": "otherApp"}},
+		},
+	}})
+	path := "/apps/" + app.ID + "/jobs/adopt"
+
+	for _, t := range []struct {
+		req    *ct.AdoptJobReq
+		status int
+	}{
+		{&ct.AdoptJobReq{JobID: "nohyphen", ReleaseID: release.ID}, 400},
+		{&ct.AdoptJobReq{JobID: "host0-legacy0", ReleaseID: utils.UUID()}, 400},
+		{&ct.AdoptJobReq{JobID: "host1-legacy0", ReleaseID: release.ID}, 404},
+		{&ct.AdoptJobReq{JobID: "host0-managed0", ReleaseID: release.ID}, 409},
+		{&ct.AdoptJobReq{JobID: "host0-legacy0", ReleaseID: release.ID, Type: "redis"}, 200},
+		{&ct.AdoptJobReq{JobID: "host0-legacy0", ReleaseID: release.ID}, 409},
+	} {
+		res, err := s.Post(path, t.req, nil)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, t.status)
+	}
+
+	var actual []ct.Job
+	res, err := s.Get("/apps/"+app.ID+"/jobs", &actual)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(actual, DeepEquals, []ct.Job{{ID: "host0-legacy0", Type: "redis", ReleaseID: release.ID}})
+}
+
+func (s *S) TestJobSummary(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-summary"})
+	release := s.createTestRelease(c, &ct.Release{})
+	attrs := func(typ string) map[string]string {
+		return map[string]string{"flynn-controller.app": app.ID, "flynn-controller.release": release.ID, "flynn-controller.type": typ}
+	}
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"web0":    {Job: &host.Job{ID: "web0", Attributes: attrs("web")}, Status: host.StatusRunning},
+		"web1":    {Job: &host.Job{ID: "web1", Attributes: attrs("web")}, Status: host.StatusRunning},
+		"web2":    {Job: &host.Job{ID: "web2", Attributes: attrs("web")}, Status: host.StatusCrashed},
+		"run0":    {Job: &host.Job{ID: "run0", Attributes: attrs("")}, Status: host.StatusStarting},
+		"legacy0": {Job: &host.Job{ID: "legacy0", Attributes: map[string]string{"flynn-controller.app_name": app.Name, "flynn-controller.type": "worker"}}, Status: host.StatusDone},
+		"other0":  {Job: &host.Job{ID: "other0", Attributes: map[string]string{"flynn-controller.app": "otherApp"}}, Status: host.StatusRunning},
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+
+	index := s.m.Get(reflect.TypeOf((*JobIndex)(nil))).Interface().(*JobIndex)
+	c.Assert(index.Sync(), IsNil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	summary, err := client.JobSummary(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(summary.Total, Equals, 5)
+	c.Assert(summary.Types, DeepEquals, map[string]map[ct.JobState]int{
+		"web":         {ct.JobStateUp: 2, ct.JobStateCrashed: 1},
+		ct.JobTypeRun: {ct.JobStateStarting: 1},
+		"worker":      {ct.JobStateDown: 1},
+	})
+	c.Assert(summary.IndexedAt, NotNil)
+
+	// jobs of hosts which have left the cluster are removed
+	s.cc.setHosts(map[string]host.Host{})
+	c.Assert(index.Sync(), IsNil)
+	summary, err = client.JobSummary(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(summary.Total, Equals, 0)
+}
+
+func (s *S) TestJobEnvDiff(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-env-diff"})
+	old := s.createTestRelease(c, &ct.Release{Env: map[string]string{"FOO": "bar", "REMOVED": "1", "SAME": "x"}})
+	current := s.createTestRelease(c, &ct.Release{Env: map[string]string{"FOO": "baz", "ADDED": "2", "SAME": "x"}})
+	s.setAppRelease(c, app.ID, current.ID)
+
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"web0": {Job: &host.Job{
+			ID:         "web0",
+			Attributes: map[string]string{"flynn-controller.app": app.ID, "flynn-controller.release": old.ID},
+			Config:     &docker.Config{Env: []string{"FOO=bar", "REMOVED=1", "SAME=x", "PORT=8080"}},
+		}},
+		"other0": {Job: &host.Job{ID: "other0", Attributes: map[string]string{"flynn-controller.app": "otherApp"}}},
+	}
+	s.cc.setHostClient("host0", hc)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	diff, err := client.JobEnvDiff(app.ID, "host0-web0")
+	c.Assert(err, IsNil)
+	c.Assert(diff.JobID, Equals, "host0-web0")
+	c.Assert(diff.ReleaseID, Equals, old.ID)
+	c.Assert(diff.CurrentReleaseID, Equals, current.ID)
+	str := func(s string) *string { return &s }
+	c.Assert(diff.Env, DeepEquals, map[string]ct.EnvVarDiff{
+		"FOO":     {Job: str("bar"), Current: str("baz")},
+		"ADDED":   {Current: str("2")},
+		"REMOVED": {Job: str("1")},
+	})
+
+	for _, id := range []string{"host0-other0", "host0-missing"} {
+		_, err = client.JobEnvDiff(app.ID, id)
+		c.Assert(err, Equals, controller.ErrNotFound)
+	}
+}
+
+func (s *S) TestStopJobsByFilter(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "stop-jobs"})
+	attrs := func(typ string) map[string]string {
+		return map[string]string{"flynn-controller.app": app.ID, "flynn-controller.type": typ}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"run0": {Job: &host.Job{ID: "run0", Attributes: attrs("")}, Status: host.StatusRunning, StartedAt: old},
+		"run1": {Job: &host.Job{ID: "run1", Attributes: attrs("")}, Status: host.StatusRunning, StartedAt: time.Now()},
+		"web0": {Job: &host.Job{ID: "web0", Attributes: attrs("web")}, Status: host.StatusRunning, StartedAt: old},
+		"run2": {Job: &host.Job{ID: "run2", Attributes: map[string]string{"flynn-controller.app": "otherApp"}}, Status: host.StatusRunning, StartedAt: old},
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	res, err := client.StopJobs(app.ID, url.Values{"type": {"run"}, "older_than": {"1h"}, "state": {string(ct.JobStateUp)}})
+	c.Assert(err, IsNil)
+	c.Assert(res.Stopped, DeepEquals, []string{"host0-run0"})
+	c.Assert(res.Failed, HasLen, 0)
+	c.Assert(hc.isStopped("run0"), Equals, true)
+	c.Assert(hc.isStopped("run1"), Equals, false)
+	c.Assert(hc.isStopped("web0"), Equals, false)
+	c.Assert(hc.isStopped("run2"), Equals, false)
+
+	// a filter is required
+	_, err = client.StopJobs(app.ID, url.Values{})
+	c.Assert(err, NotNil)
+}
+
 func newFakeHostClient() *fakeHostClient {
 	return &fakeHostClient{
 		stopped: make(map[string]bool),
@@ -95,10 +316,16 @@ func newFakeHostClient() *fakeHostClient {
 type fakeHostClient struct {
 	stopped map[string]bool
 	attach  map[string]attachFunc
+	jobs    map[string]host.ActiveJob
 }
 
-func (c *fakeHostClient) ListJobs() (map[string]host.ActiveJob, error)                 { return nil, nil }
-func (c *fakeHostClient) GetJob(id string) (*host.ActiveJob, error)                    { return nil, nil }
+func (c *fakeHostClient) ListJobs() (map[string]host.ActiveJob, error) { return c.jobs, nil }
+func (c *fakeHostClient) GetJob(id string) (*host.ActiveJob, error) {
+	if job, ok := c.jobs[id]; ok {
+		return &job, nil
+	}
+	return nil, nil
+}
 func (c *fakeHostClient) StreamEvents(id string, ch chan<- *host.Event) cluster.Stream { return nil }
 func (c *fakeHostClient) Close() error                                                 { return nil }
 func (c *fakeHostClient) Attach(req *host.AttachReq, wait bool) (cluster.ReadWriteCloser, func() error, error) {
@@ -106,6 +333,9 @@ func (c *fakeHostClient) Attach(req *host.AttachReq, wait bool) (cluster.ReadWri
 	if !ok {
 		f = c.attach["*"]
 	}
+	if f == nil {
+		return nil, nil, ErrNotFound
+	}
 	return f(req, wait)
 }
 
@@ -138,6 +368,27 @@ type fakeLog struct {
 	io.Reader
 }
 
+// multiplexLog frames data as a stream of a multiplexed job log.
+func multiplexLog(stream, data string) []byte {
+	frame := make([]byte, 8, 8+len(data))
+	frame[0] = logStreamID(stream)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// demultiplexLog returns the data of the frames of a multiplexed job log.
+func demultiplexLog(c *C, data []byte) string {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		c.Assert(len(data) >= 8, Equals, true)
+		size := int(binary.BigEndian.Uint32(data[4:8]))
+		c.Assert(len(data) >= 8+size, Equals, true)
+		buf.Write(data[8 : 8+size])
+		data = data[8+size:]
+	}
+	return buf.String()
+}
+
 func (l *fakeLog) Close() error      { return nil }
 func (l *fakeLog) CloseWrite() error { return nil }
 func (l *fakeLog) Write([]byte) (int, error) {
@@ -150,17 +401,23 @@ func (s *S) TestKillJob(c *C) {
 	hostID, jobID := utils.UUID(), utils.UUID()
 	s.cc.setHostClient(hostID, hc)
 
-	res, err := s.Delete("/apps/" + app.ID + "/jobs/" + hostID + "-" + jobID)
+	res, err := s.Delete("/apps/" + app.ID + "/jobs/" + utils.FormatJobID(hostID, jobID))
 	c.Assert(err, IsNil)
 	c.Assert(res.StatusCode, Equals, 200)
 	c.Assert(hc.isStopped(jobID), Equals, true)
+
+	for _, id := range []string{hostID, "-" + jobID, "host0-job%2520"} {
+		res, err = s.Delete("/apps/" + app.ID + "/jobs/" + id)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
 }
 
 func (s *S) TestJobLog(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "joblog"})
 	hc := newFakeHostClient()
 	hostID, jobID := utils.UUID(), utils.UUID()
-	hc.setAttach(jobID, newFakeLog(strings.NewReader("foo")))
+	hc.setAttach(jobID, newFakeLog(bytes.NewReader(multiplexLog("stdout", "foo"))))
 	s.cc.setHostClient(hostID, hc)
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log", s.srv.URL, app.ID, hostID, jobID), nil)
@@ -173,7 +430,154 @@ func (s *S) TestJobLog(c *C) {
 	res.Body.Close()
 	c.Assert(err, IsNil)
 
-	c.Assert(buf.String(), Equals, "foo")
+	c.Assert(buf.Bytes(), DeepEquals, multiplexLog("stdout", "foo"))
+}
+
+func (s *S) TestJobLogTruncated(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "joblog-truncated"})
+	hc := newFakeHostClient()
+	hostID, jobID := utils.UUID(), utils.UUID()
+	limit := defaultSSEConfig.MaxLogSize
+	logData := append(multiplexLog("stdout", strings.Repeat("a", limit)), multiplexLog("stderr", "tail")...)
+	hc.setAttach(jobID, newFakeLog(bytes.NewReader(logData)))
+	s.cc.setHostClient(hostID, hc)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log", s.srv.URL, app.ID, hostID, jobID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+
+	// the output is multiplexed in whole frames after the oldest data is
+	// dropped
+	c.Assert(res.Header.Get(ct.JobLogTruncatedHeader), Equals, "4")
+	payload := demultiplexLog(c, data)
+	c.Assert(payload, HasLen, limit)
+	c.Assert(strings.HasSuffix(payload, "tail"), Equals, true)
+}
+
+func (s *S) TestLogTail(c *C) {
+	t := newLogTail(8)
+	io.WriteString(t.Stream("stdout"), "hello ")
+	io.WriteString(t.Stream("stderr"), "world")
+	c.Assert(t.Dropped, Equals, int64(3))
+	var buf bytes.Buffer
+	t.WriteTo(&buf)
+	c.Assert(buf.Bytes(), DeepEquals, append(multiplexLog("stdout", "lo "), multiplexLog("stderr", "world")...))
+
+	io.WriteString(t.Stream("stdout"), "0123456789")
+	c.Assert(t.Dropped, Equals, int64(13))
+	buf.Reset()
+	t.WriteTo(&buf)
+	c.Assert(buf.Bytes(), DeepEquals, multiplexLog("stdout", "23456789"))
+}
+
+func (s *S) TestLogTailJSON(c *C) {
+	t := newLogTail(8)
+	io.WriteString(t.Stream("stdout"), "hello ")
+	io.WriteString(t.Stream("stderr"), "world")
+	data, err := json.Marshal(t)
+	c.Assert(err, IsNil)
+
+	decoded := &logTail{}
+	c.Assert(json.Unmarshal(data, decoded), IsNil)
+	c.Assert(decoded.Dropped, Equals, int64(3))
+	c.Assert(decoded.chunks, HasLen, 2)
+	c.Assert(decoded.chunks[1].stream, Equals, "stderr")
+	var buf bytes.Buffer
+	decoded.WriteTo(&buf)
+	c.Assert(demultiplexLog(c, buf.Bytes()), Equals, "lo world")
+}
+
+func (s *S) TestJobLogStored(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "joblog-stored"})
+	other := s.createTestApp(c, &ct.App{Name: "joblog-stored-other"})
+	hostID := "joblogstored"
+	attrs := map[string]string{"flynn-controller.app": app.ID}
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"run0": {Job: &host.Job{ID: "run0", Attributes: attrs}, Status: host.StatusRunning},
+	}
+	hc.setAttach("run0", newFakeLog(bytes.NewReader(multiplexLog("stdout", "foo"))))
+	s.cc.setHosts(map[string]host.Host{hostID: {ID: hostID}})
+	s.cc.setHostClient(hostID, hc)
+	defer s.cc.setHosts(map[string]host.Host{})
+
+	index := s.m.Get(reflect.TypeOf((*JobIndex)(nil))).Interface().(*JobIndex)
+	c.Assert(index.Sync(), IsNil)
+	jobID := utils.FormatJobID(hostID, "run0")
+
+	// the log is stored once the job exits, and served after the host has
+	// forgotten the job
+	hc.jobs["run0"] = host.ActiveJob{Job: &host.Job{ID: "run0", Attributes: attrs}, Status: host.StatusDone}
+	c.Assert(index.Sync(), IsNil)
+	hc.jobs = nil
+	hc.setAttachFunc("run0", func(*host.AttachReq, bool) (cluster.ReadWriteCloser, func() error, error) {
+		return nil, nil, ErrNotFound
+	})
+	c.Assert(index.Sync(), IsNil)
+
+	for _, path := range []string{"/apps/" + app.ID + "/jobs/" + jobID + "/log", "/jobs/" + jobID + "/log"} {
+		req, err := http.NewRequest("GET", s.srv.URL+path, nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth("", authKey)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		c.Assert(res.Header.Get(ct.JobStateHeader), Equals, ct.JobLogStateDone)
+		c.Assert(demultiplexLog(c, data), Equals, "foo")
+	}
+
+	// reading the log through the admin endpoint is audited in the app log
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	events, err := client.AppEvents(app.ID, 0)
+	c.Assert(err, IsNil)
+	var audit *ct.AuditEvent
+	for _, e := range events {
+		if e.ObjectType == ct.EventTypeAudit {
+			c.Assert(e.ObjectID, Equals, jobID)
+			audit = &ct.AuditEvent{}
+			c.Assert(json.Unmarshal(*e.Data, audit), IsNil)
+		}
+	}
+	c.Assert(audit, NotNil)
+	c.Assert(audit.Subject, Equals, SubjectAdmin)
+	c.Assert(audit.Action, Equals, "job_log")
+
+	// the log is not served for other apps
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s/log", s.srv.URL, other.ID, jobID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+	c.Assert(res.Header.Get(ct.JobStateHeader), Equals, "")
+}
+
+func (s *S) TestJobLogAdmin(c *C) {
+	hc := newFakeHostClient()
+	hostID, jobID := utils.UUID(), utils.UUID()
+	hc.setAttach(jobID, newFakeLog(bytes.NewReader(multiplexLog("stdout", "foo"))))
+	s.cc.setHostClient(hostID, hc)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	res, err := client.GetJobLogByID(utils.FormatJobID(hostID, jobID))
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(res)
+	res.Close()
+	c.Assert(err, IsNil)
+
+	c.Assert(demultiplexLog(c, buf.Bytes()), Equals, "foo")
 }
 
 func (s *S) TestJobLogSSE(c *C) {
@@ -197,9 +601,114 @@ func (s *S) TestJobLogSSE(c *C) {
 	res.Body.Close()
 	c.Assert(err, IsNil)
 
+	timestamps := regexp.MustCompile(`,"timestamp":"[^"]+"`)
+	c.Assert(timestamps.FindAllString(buf.String(), -1), HasLen, 3)
 	expected := "data: {\"stream\":\"stdout\",\"data\":\"Listening on 55007\\n\"}\n\ndata: {\"stream\":\"stdout\",\"data\":\"hello stdout\\n\"}\n\ndata: {\"stream\":\"stderr\",\"data\":\"hello stderr\\n\"}\n\nevent: eof\ndata: {}\n\n"
 
-	c.Assert(buf.String(), Equals, expected)
+	c.Assert(timestamps.ReplaceAllString(buf.String(), ""), Equals, expected)
+}
+
+func (s *S) TestJobLogNDJSON(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "joblog-ndjson"})
+	hc := newFakeHostClient()
+	hostID, jobID := utils.UUID(), utils.UUID()
+	logData, err := base64.StdEncoding.DecodeString("AQAAAAAAABNMaXN0ZW5pbmcgb24gNTUwMDcKAQAAAAAAAA1oZWxsbyBzdGRvdXQKAgAAAAAAAA1oZWxsbyBzdGRlcnIK")
+	c.Assert(err, IsNil)
+	hc.setAttach(jobID, newFakeLog(bytes.NewReader(logData)))
+	s.cc.setHostClient(hostID, hc)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log", s.srv.URL, app.ID, hostID, jobID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.Header.Get("Content-Type"), Equals, "application/x-ndjson")
+
+	type chunk struct {
+		Stream    string    `json:"stream"`
+		Data      string    `json:"data"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	var chunks []chunk
+	dec := json.NewDecoder(res.Body)
+	for {
+		var ch chunk
+		if err := dec.Decode(&ch); err == io.EOF {
+			break
+		} else {
+			c.Assert(err, IsNil)
+		}
+		c.Assert(ch.Timestamp.IsZero(), Equals, false)
+		ch.Timestamp = time.Time{}
+		chunks = append(chunks, ch)
+	}
+	c.Assert(chunks, DeepEquals, []chunk{
+		{Stream: "stdout", Data: "Listening on 55007\n"},
+		{Stream: "stdout", Data: "hello stdout\n"},
+		{Stream: "stderr", Data: "hello stderr\n"},
+	})
+}
+
+func (s *S) TestJobLogSince(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "joblog-since"})
+	hostID := "joblogsince"
+	attrs := map[string]string{"flynn-controller.app": app.ID}
+	hc := newFakeHostClient()
+	hc.jobs = map[string]host.ActiveJob{
+		"run0": {Job: &host.Job{ID: "run0", Attributes: attrs}, Status: host.StatusRunning},
+	}
+	hc.setAttachFunc("run0", func(*host.AttachReq, bool) (cluster.ReadWriteCloser, func() error, error) {
+		return newFakeLog(bytes.NewReader(multiplexLog("stdout", "foo"))), nil, nil
+	})
+	s.cc.setHosts(map[string]host.Host{hostID: {ID: hostID}})
+	s.cc.setHostClient(hostID, hc)
+	defer s.cc.setHosts(map[string]host.Host{})
+	jobID := utils.FormatJobID(hostID, "run0")
+
+	query := ""
+	get := func(since string) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s/log?since=%s%s", s.srv.URL, app.ID, jobID, since, query), nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth("", authKey)
+		req.Header.Set("Accept", "application/x-ndjson")
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	res := get("yesterday")
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	read := func(since time.Time) string {
+		res := get(since.UTC().Format(time.RFC3339))
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		return string(data)
+	}
+
+	// since filters the log of a running job, including when following it
+	for _, query = range []string{"", "&tail=true"} {
+		c.Assert(read(time.Now().Add(-time.Hour)), Not(Equals), "")
+		c.Assert(read(time.Now().Add(time.Hour)), Equals, "")
+	}
+	query = ""
+
+	// the log is stamped as it is followed by the index, not when the job
+	// exits, so since filters the stored log by when the job logged it
+	index := s.m.Get(reflect.TypeOf((*JobIndex)(nil))).Interface().(*JobIndex)
+	c.Assert(index.Sync(), IsNil)
+	time.Sleep(1100 * time.Millisecond)
+	followed := time.Now()
+	hc.jobs["run0"] = host.ActiveJob{Job: &host.Job{ID: "run0", Attributes: attrs}, Status: host.StatusDone}
+	c.Assert(index.Sync(), IsNil)
+
+	c.Assert(read(time.Now().Add(-time.Hour)), Not(Equals), "")
+	c.Assert(read(followed), Equals, "")
 }
 
 type fakeAttachStream struct {
@@ -210,6 +719,22 @@ type fakeAttachStream struct {
 func (l *fakeAttachStream) CloseWrite() error { return l.WriteCloser.Close() }
 func (l *fakeAttachStream) Close() error      { return l.CloseWrite() }
 
+// stripCertEnv asserts that the job identity certificate was injected and
+// returns the remaining env.
+func stripCertEnv(c *C, env []string) []string {
+	res := make([]string, 0, len(env))
+	var found int
+	for _, e := range env {
+		if strings.HasPrefix(e, "FLYNN_TLS_") {
+			found++
+			continue
+		}
+		res = append(res, e)
+	}
+	c.Assert(found, Equals, 3)
+	return res
+}
+
 func (s *S) TestRunJobDetached(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "run-detached"})
 
@@ -239,12 +764,14 @@ func (s *S) TestRunJobDetached(c *C) {
 	job := s.cc.hosts[hostID].Jobs[0]
 	c.Assert(res.ID, Equals, hostID+"-"+job.ID)
 	c.Assert(job.Attributes, DeepEquals, map[string]string{
-		"flynn-controller.app":     app.ID,
-		"flynn-controller.release": release.ID,
+		"flynn-controller.app":      app.ID,
+		"flynn-controller.app_name": app.Name,
+		"flynn-controller.release":  release.ID,
 	})
 	c.Assert(job.Config.Cmd, DeepEquals, []string{"foo", "bar"})
-	sort.Strings(job.Config.Env)
-	c.Assert(job.Config.Env, DeepEquals, []string{"FOO=baz", "JOB=true", "RELEASE=true"})
+	env := stripCertEnv(c, job.Config.Env)
+	sort.Strings(env)
+	c.Assert(env, DeepEquals, []string{"FOO=baz", "JOB=true", "RELEASE=true"})
 	c.Assert(job.Config.AttachStdout, Equals, true)
 	c.Assert(job.Config.AttachStderr, Equals, true)
 	c.Assert(job.Config.AttachStdin, Equals, false)
@@ -252,6 +779,156 @@ func (s *S) TestRunJobDetached(c *C) {
 	c.Assert(job.Config.OpenStdin, Equals, false)
 }
 
+func (s *S) TestRunJobPreviousHost(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-previous-host"})
+	s.cc.setHosts(map[string]host.Host{"host-a": {}, "host-b": {}, "host-c": {}})
+	defer s.cc.setHosts(map[string]host.Host{})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+
+	for i := 0; i < 5; i++ {
+		res := &ct.Job{}
+		req := &ct.NewJob{ReleaseID: release.ID, PreviousJobID: utils.FormatJobID("host-b", "job0")}
+		httpRes, err := s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), req, res)
+		c.Assert(err, IsNil)
+		c.Assert(httpRes.StatusCode, Equals, 200)
+		c.Assert(httpRes.Header.Get("Warning"), Equals, "")
+		hostID, _, err := utils.ParseJobID(res.ID)
+		c.Assert(err, IsNil)
+		c.Assert(hostID, Equals, "host-b")
+	}
+
+	// another host is used if the host of the previous job is gone
+	res := &ct.Job{}
+	req := &ct.NewJob{ReleaseID: release.ID, PreviousJobID: utils.FormatJobID("host-d", "job0")}
+	httpRes, err := s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), req, res)
+	c.Assert(err, IsNil)
+	c.Assert(httpRes.StatusCode, Equals, 200)
+	c.Assert(httpRes.Header.Get("Warning"), Not(Equals), "")
+	hostID, _, err := utils.ParseJobID(res.ID)
+	c.Assert(err, IsNil)
+	c.Assert(hostID, Not(Equals), "host-d")
+
+	req.PreviousJobID = "foo"
+	httpRes, err = s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), req, &ct.Job{})
+	c.Assert(err, IsNil)
+	c.Assert(httpRes.StatusCode, Equals, 400)
+}
+
+func (s *S) TestRunJobExpectedRelease(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-expected-release"})
+	s.cc.setHosts(map[string]host.Host{"host0": {}})
+	defer s.cc.setHosts(map[string]host.Host{})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release1 := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	release2 := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	req := &ct.NewJob{ReleaseID: release1.ID, Cmd: []string{"migrate"}, ExpectedReleaseID: release1.ID}
+
+	// the app has no release yet
+	_, err = client.RunJobDetached(app.ID, req)
+	c.Assert(err, DeepEquals, &controller.ReleaseMismatchError{Expected: release1.ID})
+
+	s.setAppRelease(c, app.ID, release1.ID)
+	_, err = client.RunJobDetached(app.ID, req)
+	c.Assert(err, IsNil)
+
+	// a newer release was deployed
+	s.setAppRelease(c, app.ID, release2.ID)
+	_, err = client.RunJobDetached(app.ID, req)
+	c.Assert(err, DeepEquals, &controller.ReleaseMismatchError{Expected: release1.ID, Current: release2.ID})
+	res, err := s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), req, &ct.Job{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 409)
+	c.Assert(res.Header.Get(ct.ReleaseMismatchHeader), Equals, "true")
+}
+
+func (s *S) TestRunJobIdempotent(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-idempotent"})
+
+	hostID := utils.UUID()
+	s.cc.setHosts(map[string]host.Host{hostID: host.Host{}})
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	reservation, err := client.ReserveJob(app.ID, "migrate-1")
+	c.Assert(err, IsNil)
+	c.Assert(reservation.JobID, Not(Equals), "")
+	again, err := client.ReserveJob(app.ID, "migrate-1")
+	c.Assert(err, IsNil)
+	c.Assert(again.JobID, Equals, reservation.JobID)
+
+	req := &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"migrate"}, IdempotencyToken: "migrate-1"}
+	job, err := client.RunJobDetached(app.ID, req)
+	c.Assert(err, IsNil)
+	c.Assert(job.ID, Equals, hostID+"-"+reservation.JobID)
+
+	// retrying returns the original job without starting another
+	retry, err := client.RunJobDetached(app.ID, req)
+	c.Assert(err, IsNil)
+	c.Assert(retry, DeepEquals, job)
+	c.Assert(s.cc.hosts[hostID].Jobs, HasLen, 1)
+
+	// runs without a prior reservation reserve an ID implicitly
+	req.IdempotencyToken = "migrate-2"
+	other, err := client.RunJobDetached(app.ID, req)
+	c.Assert(err, IsNil)
+	c.Assert(other.ID, Not(Equals), job.ID)
+	c.Assert(s.cc.hosts[hostID].Jobs, HasLen, 2)
+
+	// a failed schedule which may have started the job is not retried
+	s.cc.addJobsErr = ErrCallTimeout
+	req.IdempotencyToken = "migrate-3"
+	_, err = client.RunJobDetached(app.ID, req)
+	c.Assert(err, NotNil)
+	s.cc.addJobsErr = nil
+	timedOut, err := client.RunJobDetached(app.ID, req)
+	c.Assert(err, IsNil)
+	c.Assert(timedOut.ID, Not(Equals), other.ID)
+	c.Assert(s.cc.hosts[hostID].Jobs, HasLen, 2)
+
+	// a schedule which definitely failed can be retried
+	s.cc.addJobsErr = ErrBreakerOpen
+	req.IdempotencyToken = "migrate-4"
+	_, err = client.RunJobDetached(app.ID, req)
+	c.Assert(err, NotNil)
+	s.cc.addJobsErr = nil
+	_, err = client.RunJobDetached(app.ID, req)
+	c.Assert(err, IsNil)
+	c.Assert(s.cc.hosts[hostID].Jobs, HasLen, 3)
+}
+
+func (s *S) TestRunJobAppEnv(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-app-env"})
+
+	hostID := utils.UUID()
+	s.cc.setHosts(map[string]host.Host{hostID: host.Host{}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	c.Assert(client.SetAppEnv(app.ID, map[string]string{"SHARED": "app", "FOO": "app"}), IsNil)
+	env, err := client.GetAppEnv(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, map[string]string{"SHARED": "app", "FOO": "app"})
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"FOO": "release"},
+	})
+	_, err = s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), &ct.NewJob{ReleaseID: release.ID}, &ct.Job{})
+	c.Assert(err, IsNil)
+
+	job := s.cc.hosts[hostID].Jobs[0]
+	jobEnv := stripCertEnv(c, job.Config.Env)
+	sort.Strings(jobEnv)
+	c.Assert(jobEnv, DeepEquals, []string{"FOO=release", "SHARED=app"})
+}
+
 func (s *S) TestRunJobAttached(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "run-attached"})
 	hc := newFakeHostClient()
@@ -315,15 +992,43 @@ func (s *S) TestRunJobAttached(c *C) {
 	job := s.cc.hosts[hostID].Jobs[0]
 	c.Assert(job.ID, Equals, jobID)
 	c.Assert(job.Attributes, DeepEquals, map[string]string{
-		"flynn-controller.app":     app.ID,
-		"flynn-controller.release": release.ID,
+		"flynn-controller.app":      app.ID,
+		"flynn-controller.app_name": app.Name,
+		"flynn-controller.release":  release.ID,
 	})
 	c.Assert(job.Config.Cmd, DeepEquals, []string{"foo", "bar"})
-	sort.Strings(job.Config.Env)
-	c.Assert(job.Config.Env, DeepEquals, []string{"FOO=baz", "JOB=true", "RELEASE=true"})
+	env := stripCertEnv(c, job.Config.Env)
+	sort.Strings(env)
+	c.Assert(env, DeepEquals, []string{"FOO=baz", "JOB=true", "RELEASE=true"})
 	c.Assert(job.Config.AttachStdout, Equals, true)
 	c.Assert(job.Config.AttachStderr, Equals, true)
 	c.Assert(job.Config.AttachStdin, Equals, true)
 	c.Assert(job.Config.StdinOnce, Equals, true)
 	c.Assert(job.Config.OpenStdin, Equals, true)
 }
+
+type flushCounter struct {
+	io.Writer
+	flushes int
+}
+
+func (f *flushCounter) Flush() { f.flushes++ }
+
+func benchmarkSSELogWriter(b *testing.B, conf SSEConfig) {
+	w := &flushCounter{Writer: ioutil.Discard}
+	stream := NewSSELogWriter(w, conf, time.Time{}).Stream("stdout")
+	line := []byte("2014/06/01 12:00:00 GET /apps 200 1.234ms\n")
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream.Write(line)
+	}
+}
+
+func BenchmarkSSELogWriterFlushEach(b *testing.B) {
+	benchmarkSSELogWriter(b, defaultSSEConfig)
+}
+
+func BenchmarkSSELogWriterFlushInterval(b *testing.B) {
+	benchmarkSSELogWriter(b, SSEConfig{BufferSize: 32 * 1024, FlushInterval: 50 * time.Millisecond})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// logTail buffers the most recent chunks of a job log up to a limit in
+// bytes, dropping the oldest data once the limit is reached.
+type logTail struct {
+	limit  int
+	size   int
+	chunks []*logTailChunk
+
+	// Dropped is the number of bytes dropped.
+	Dropped int64
+}
+
+type logTailChunk struct {
+	stream string
+	data   []byte
+	time   time.Time
+}
+
+func newLogTail(limit int) *logTail {
+	if limit <= 0 {
+		limit = defaultSSEConfig.MaxLogSize
+	}
+	return &logTail{limit: limit}
+}
+
+// Stream returns a writer adding chunks of the named stream.
+func (t *logTail) Stream(s string) io.Writer {
+	return &logTailStream{t: t, s: s}
+}
+
+func (t *logTail) add(stream string, p []byte) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	t.chunks = append(t.chunks, &logTailChunk{stream: stream, data: data, time: time.Now()})
+	t.size += len(data)
+	for t.size > t.limit {
+		first := t.chunks[0]
+		if excess := t.size - t.limit; excess < len(first.data) {
+			first.data = first.data[excess:]
+			t.size -= excess
+			t.Dropped += int64(excess)
+			break
+		}
+		t.chunks = t.chunks[1:]
+		t.size -= len(first.data)
+		t.Dropped += int64(len(first.data))
+	}
+}
+
+// Replay writes the buffered chunks to lw with the times they were received.
+func (t *logTail) Replay(lw LogWriter) {
+	for _, c := range t.chunks {
+		if err := lw.WriteChunk(c.stream, c.data, c.time); err != nil {
+			return
+		}
+	}
+}
+
+// logStreamID returns the ID of a stream in the header of a frame of a
+// multiplexed job log.
+func logStreamID(stream string) byte {
+	if stream == "stderr" {
+		return 2
+	}
+	return 1
+}
+
+// WriteTo writes the buffered chunks to w multiplexed in the format of the
+// attach stream of a job, which clients read with demultiplex.Copy. Each
+// chunk is written as a frame, so trimming the oldest data never leaves a
+// partial frame.
+func (t *logTail) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	header := make([]byte, 8)
+	for _, c := range t.chunks {
+		if len(c.data) == 0 {
+			continue
+		}
+		header[0] = logStreamID(c.stream)
+		binary.BigEndian.PutUint32(header[4:], uint32(len(c.data)))
+		for _, p := range [][]byte{header, c.data} {
+			n, err := w.Write(p)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+type logTailJSON struct {
+	Chunks  []logTailChunkJSON `json:"chunks"`
+	Dropped int64              `json:"dropped,omitempty"`
+}
+
+type logTailChunkJSON struct {
+	Stream string    `json:"stream,omitempty"`
+	Data   []byte    `json:"data"`
+	Time   time.Time `json:"time"`
+}
+
+// MarshalJSON encodes the buffered chunks so that the log can be stored.
+func (t *logTail) MarshalJSON() ([]byte, error) {
+	v := logTailJSON{Chunks: make([]logTailChunkJSON, len(t.chunks)), Dropped: t.Dropped}
+	for i, c := range t.chunks {
+		v.Chunks[i] = logTailChunkJSON{Stream: c.stream, Data: c.data, Time: c.time}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes a stored log, which is limited to the size of the
+// decoded data.
+func (t *logTail) UnmarshalJSON(data []byte) error {
+	var v logTailJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	t.chunks = make([]*logTailChunk, len(v.Chunks))
+	t.size = 0
+	for i, c := range v.Chunks {
+		t.chunks[i] = &logTailChunk{stream: c.Stream, data: c.Data, time: c.Time}
+		t.size += len(c.Data)
+	}
+	t.limit = t.size
+	t.Dropped = v.Dropped
+	return nil
+}
+
+type logTailStream struct {
+	t *logTail
+	s string
+}
+
+func (s *logTailStream) Write(p []byte) (int, error) {
+	s.t.add(s.s, p)
+	return len(p), nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+const onlineMigrationBackfillTask = "online_migration_backfill"
+
+var (
+	// onlineMigrationBatchSize is the number of rows copied by each
+	// backfill statement, and onlineMigrationBatchPause the pause between
+	// them to leave room for other writes to the table.
+	onlineMigrationBatchSize  = 500
+	onlineMigrationBatchPause = 100 * time.Millisecond
+)
+
+// defaultOnlineMigrations are the online migrations known to the controller.
+// The new column of a migration is added by a regular schema migration, and
+// the repo owning the column reads the column returned by
+// OnlineMigrator.Column. Writes keep going to the old column, which the dual
+// write trigger copies to the new one, until a later schema migration drops
+// the old column and the trigger along with it once the code writes the new
+// column.
+var defaultOnlineMigrations []*onlineMigration
+
+// ErrOnlineMigrationState is returned when an online migration step is not
+// valid in the current state of the migration.
+var ErrOnlineMigrationState = errors.New("controller: invalid online migration state")
+
+var sqlIdentPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// onlineMigration moves a column of a hot table to a new column without a
+// maintenance window. While dual writing, a trigger sets the new column on
+// every write of a row, a backfill task copies the rows which have not been
+// written since in small batches, and the cutover switches readers over to
+// the new column. The trigger is kept after the cutover so that writes to the
+// old column keep reaching the new one.
+type onlineMigration struct {
+	name      string
+	table     string
+	key       string
+	oldColumn string
+	newColumn string
+	// convert is the SQL expression computing the new column, with %s in
+	// place of the old column. If empty the value is copied as is.
+	convert string
+}
+
+func (m *onlineMigration) validate() error {
+	for _, ident := range []string{m.name, m.table, m.key, m.oldColumn, m.newColumn} {
+		if !sqlIdentPattern.MatchString(ident) {
+			return fmt.Errorf("controller: invalid identifier %q in online migration %q", ident, m.name)
+		}
+	}
+	return nil
+}
+
+func (m *onlineMigration) expr(column string) string {
+	if m.convert == "" {
+		return column
+	}
+	return fmt.Sprintf(m.convert, column)
+}
+
+func (m *onlineMigration) trigger() string {
+	return "online_migration_" + m.name
+}
+
+// stale is the condition matching the rows whose new column is not up to
+// date.
+func (m *onlineMigration) stale() string {
+	return fmt.Sprintf("%s IS DISTINCT FROM %s", m.newColumn, m.expr(m.oldColumn))
+}
+
+// OnlineMigrator tracks the state of the online migrations in the database,
+// which acts as the feature flag switching dual writes and the column in use.
+type OnlineMigrator struct {
+	db         *DB
+	migrations map[string]*onlineMigration
+	names      []string
+}
+
+// NewOnlineMigrator panics if a migration has an invalid identifier, as the
+// identifiers are interpolated into SQL.
+func NewOnlineMigrator(db *DB, migrations []*onlineMigration) *OnlineMigrator {
+	m := &OnlineMigrator{db: db, migrations: make(map[string]*onlineMigration, len(migrations))}
+	for _, migration := range migrations {
+		if err := migration.validate(); err != nil {
+			panic(err)
+		}
+		m.migrations[migration.name] = migration
+		m.names = append(m.names, migration.name)
+	}
+	return m
+}
+
+func (m *OnlineMigrator) lookup(name string) (*onlineMigration, error) {
+	migration, ok := m.migrations[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return migration, nil
+}
+
+// Get returns the state of a migration, which is pending until dual writes
+// are first enabled.
+func (m *OnlineMigrator) Get(name string) (*ct.OnlineMigration, error) {
+	migration, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	res := &ct.OnlineMigration{
+		Name:      migration.name,
+		Table:     migration.table,
+		OldColumn: migration.oldColumn,
+		NewColumn: migration.newColumn,
+		State:     ct.OnlineMigrationPending,
+	}
+	err = m.db.QueryRow("SELECT state, backfilled, updated_at FROM online_migrations WHERE name = $1", name).Scan(&res.State, &res.Backfilled, &res.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (m *OnlineMigrator) List() ([]*ct.OnlineMigration, error) {
+	list := make([]*ct.OnlineMigration, 0, len(m.names))
+	for _, name := range m.names {
+		migration, err := m.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, migration)
+	}
+	return list, nil
+}
+
+// Column returns the column of a migration which is in use, the old column
+// until the cutover and the new one after it.
+func (m *OnlineMigrator) Column(name string) (string, error) {
+	migration, err := m.Get(name)
+	if err != nil {
+		return "", err
+	}
+	if migration.State == ct.OnlineMigrationCutover {
+		return migration.NewColumn, nil
+	}
+	return migration.OldColumn, nil
+}
+
+// transition runs f in a transaction if the migration is in one of the from
+// states, and then moves it to the to state.
+func (m *OnlineMigrator) transition(name string, from []string, to string, f func(*dbTx, *onlineMigration) error) error {
+	migration, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO online_migrations (name, state) SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM online_migrations WHERE name = $1)", name, ct.OnlineMigrationPending); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var state string
+	if err := tx.QueryRow("SELECT state FROM online_migrations WHERE name = $1 FOR UPDATE", name).Scan(&state); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var ok bool
+	for _, s := range from {
+		if s == state {
+			ok = true
+		}
+	}
+	if !ok {
+		tx.Rollback()
+		return ErrOnlineMigrationState
+	}
+	if f != nil {
+		if err := f(tx, migration); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE online_migrations SET state = $2, updated_at = now() WHERE name = $1", name, to); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// DualWrite installs the trigger writing the new column of a pending
+// migration.
+func (m *OnlineMigrator) DualWrite(name string) error {
+	return m.transition(name, []string{ct.OnlineMigrationPending}, ct.OnlineMigrationDualWrite, func(tx *dbTx, migration *onlineMigration) error {
+		for _, query := range []string{
+			fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS TRIGGER AS $$
+    BEGIN
+        NEW.%s := %s;
+        RETURN NEW;
+    END;
+$$ LANGUAGE plpgsql`, migration.trigger(), migration.newColumn, migration.expr("NEW."+migration.oldColumn)),
+			fmt.Sprintf("CREATE TRIGGER %[1]s BEFORE INSERT OR UPDATE ON %[2]s FOR EACH ROW EXECUTE PROCEDURE %[1]s()", migration.trigger(), migration.table),
+		} {
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Abort removes the dual write trigger of a migration which has not been cut
+// over, returning it to pending.
+func (m *OnlineMigrator) Abort(name string) error {
+	return m.transition(name, []string{ct.OnlineMigrationDualWrite, ct.OnlineMigrationBackfilled}, ct.OnlineMigrationPending, dropOnlineMigrationTrigger)
+}
+
+// Cutover switches the readers of a backfilled migration over to the new
+// column once no row is left to copy. The dual write trigger is kept, as
+// writers still write the old column until it is dropped.
+func (m *OnlineMigrator) Cutover(name string) error {
+	return m.transition(name, []string{ct.OnlineMigrationBackfilled}, ct.OnlineMigrationCutover, func(tx *dbTx, migration *onlineMigration) error {
+		// lock out writes so that no row goes stale before the migration
+		// is cut over
+		if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN SHARE MODE", migration.table)); err != nil {
+			return err
+		}
+		var stale int
+		if err := tx.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", migration.table, migration.stale())).Scan(&stale); err != nil {
+			return err
+		}
+		if stale > 0 {
+			return ErrOnlineMigrationState
+		}
+		return nil
+	})
+}
+
+func dropOnlineMigrationTrigger(tx *dbTx, migration *onlineMigration) error {
+	for _, query := range []string{
+		fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", migration.trigger(), migration.table),
+		fmt.Sprintf("DROP FUNCTION IF EXISTS %s()", migration.trigger()),
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type onlineMigrationBackfillData struct {
+	Name string `json:"name"`
+}
+
+// Backfill is the task copying the old column of the rows of a dual writing
+// migration in batches, after which the migration is backfilled.
+func (m *OnlineMigrator) Backfill(task *ct.Task) (interface{}, error) {
+	var data onlineMigrationBackfillData
+	if task.Data == nil {
+		return nil, errors.New("controller: missing backfill data")
+	}
+	if err := json.Unmarshal(*task.Data, &data); err != nil {
+		return nil, err
+	}
+	migration, err := m.lookup(data.Name)
+	if err != nil {
+		return nil, err
+	}
+	update := fmt.Sprintf(`WITH updated AS (
+		UPDATE %[1]s SET %[2]s = %[3]s WHERE %[4]s IN (SELECT %[4]s FROM %[1]s WHERE %[5]s LIMIT $1) RETURNING 1
+	) SELECT count(*) FROM updated`, migration.table, migration.newColumn, migration.expr(migration.oldColumn), migration.key, migration.stale())
+	for {
+		// stop if the migration was aborted in the meantime
+		current, err := m.Get(migration.name)
+		if err != nil {
+			return nil, err
+		}
+		if current.State != ct.OnlineMigrationDualWrite {
+			return nil, ErrOnlineMigrationState
+		}
+		var n int64
+		if err := m.db.QueryRow(update, onlineMigrationBatchSize).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if err := m.db.Exec("UPDATE online_migrations SET backfilled = backfilled + $2, updated_at = now() WHERE name = $1", migration.name, n); err != nil {
+			return nil, err
+		}
+		time.Sleep(onlineMigrationBatchPause)
+	}
+	if err := m.transition(migration.name, []string{ct.OnlineMigrationDualWrite}, ct.OnlineMigrationBackfilled, nil); err != nil {
+		return nil, err
+	}
+	return m.Get(migration.name)
+}
+
+func listOnlineMigrations(migrator *OnlineMigrator, r render.Render) {
+	list, err := migrator.List()
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+func getOnlineMigration(migrator *OnlineMigrator, params martini.Params, r render.Render) {
+	migration, err := migrator.Get(params["migration_name"])
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, migration)
+}
+
+// updateOnlineMigration performs a step of a migration, responding with the
+// migration, or with the task for a backfill.
+func updateOnlineMigration(migrator *OnlineMigrator, runner *TaskRunner, params martini.Params, r render.Render) {
+	name := params["migration_name"]
+	var err error
+	switch strings.Replace(params["step"], "-", "_", -1) {
+	case ct.OnlineMigrationDualWrite:
+		err = migrator.DualWrite(name)
+	case "backfill":
+		if _, err := migrator.lookup(name); err != nil {
+			respondWithError(r, err)
+			return
+		}
+		task, err := runner.Enqueue(onlineMigrationBackfillTask, &onlineMigrationBackfillData{Name: name}, 1)
+		if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		r.JSON(200, task)
+		return
+	case ct.OnlineMigrationCutover:
+		err = migrator.Cutover(name)
+	case "abort":
+		err = migrator.Abort(name)
+	default:
+		r.JSON(404, struct{}{})
+		return
+	}
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	getOnlineMigration(migrator, params, r)
+}
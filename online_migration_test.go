@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+var testOnlineMigrations = []*onlineMigration{{
+	name:      "test_lower_name",
+	table:     "online_migration_test",
+	key:       "id",
+	oldColumn: "name",
+	newColumn: "lower_name",
+	convert:   "lower(%s)",
+}}
+
+func (s *S) TestOnlineMigration(c *C) {
+	migrator := s.m.Get(reflect.TypeOf((*OnlineMigrator)(nil))).Interface().(*OnlineMigrator)
+	db := migrator.db
+	c.Assert(db.Exec("CREATE TABLE online_migration_test (id serial PRIMARY KEY, name text, lower_name text)"), IsNil)
+	c.Assert(db.Exec("INSERT INTO online_migration_test (name) VALUES ('Foo'), ('BAR')"), IsNil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	migration, err := client.GetOnlineMigration("test_lower_name")
+	c.Assert(err, IsNil)
+	c.Assert(migration.State, Equals, ct.OnlineMigrationPending)
+	_, err = client.CutoverOnlineMigration("test_lower_name")
+	c.Assert(err, NotNil)
+
+	migration, err = client.StartOnlineMigration("test_lower_name")
+	c.Assert(err, IsNil)
+	c.Assert(migration.State, Equals, ct.OnlineMigrationDualWrite)
+	column, err := migrator.Column("test_lower_name")
+	c.Assert(err, IsNil)
+	c.Assert(column, Equals, "name")
+
+	// writes during the dual write window reach the new column
+	c.Assert(db.Exec("INSERT INTO online_migration_test (name) VALUES ('Baz')"), IsNil)
+	var lower string
+	c.Assert(db.QueryRow("SELECT lower_name FROM online_migration_test WHERE name = 'Baz'").Scan(&lower), IsNil)
+	c.Assert(lower, Equals, "baz")
+
+	task, err := client.BackfillOnlineMigration("test_lower_name")
+	c.Assert(err, IsNil)
+	task = s.waitTask(c, task.ID)
+	c.Assert(task.Status, Equals, ct.TaskStatusSucceeded)
+	migration, err = client.GetOnlineMigration("test_lower_name")
+	c.Assert(err, IsNil)
+	c.Assert(migration.State, Equals, ct.OnlineMigrationBackfilled)
+	c.Assert(migration.Backfilled, Equals, int64(2))
+
+	migration, err = client.CutoverOnlineMigration("test_lower_name")
+	c.Assert(err, IsNil)
+	c.Assert(migration.State, Equals, ct.OnlineMigrationCutover)
+	column, err = migrator.Column("test_lower_name")
+	c.Assert(err, IsNil)
+	c.Assert(column, Equals, "lower_name")
+	var stale int
+	c.Assert(db.QueryRow("SELECT count(*) FROM online_migration_test WHERE lower_name IS DISTINCT FROM lower(name)").Scan(&stale), IsNil)
+	c.Assert(stale, Equals, 0)
+
+	// writes to the old column keep reaching the new one after the cutover
+	c.Assert(db.Exec("UPDATE online_migration_test SET name = 'Qux' WHERE name = 'Baz'"), IsNil)
+	c.Assert(db.QueryRow("SELECT lower_name FROM online_migration_test WHERE name = 'Qux'").Scan(&lower), IsNil)
+	c.Assert(lower, Equals, "qux")
+
+	_, err = client.AbortOnlineMigration("test_lower_name")
+	c.Assert(err, NotNil)
+	_, err = client.GetOnlineMigration("missing")
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
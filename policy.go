@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/martini-contrib/render"
+)
+
+type PolicyRepo struct {
+	db   *DB
+	apps *AppRepo
+
+	subscriptions map[chan<- *ct.PolicySet]struct{}
+	stopListener  chan struct{}
+	subMtx        sync.RWMutex
+}
+
+func NewPolicyRepo(db *DB, apps *AppRepo) *PolicyRepo {
+	return &PolicyRepo{
+		db:            db,
+		apps:          apps,
+		subscriptions: make(map[chan<- *ct.PolicySet]struct{}),
+		stopListener:  make(chan struct{}),
+	}
+}
+
+func (r *PolicyRepo) validate(p *ct.NetworkPolicy) error {
+	for i, src := range p.Ingress {
+		if (src.App == "") == (src.Service == "") {
+			return ct.ValidationError{Field: "ingress", Message: "sources must specify exactly one of app or service"}
+		}
+		if src.App == "" {
+			continue
+		}
+		app, err := r.apps.Get(src.App)
+		if err == ErrNotFound {
+			return ct.ValidationError{Field: "ingress", Message: "unknown app " + src.App}
+		} else if err != nil {
+			return err
+		}
+		p.Ingress[i].App = app.(*ct.App).ID
+	}
+	return nil
+}
+
+func (r *PolicyRepo) Set(p *ct.NetworkPolicy) error {
+	if err := r.validate(p); err != nil {
+		return err
+	}
+	data, err := json.Marshal(p.Ingress)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRow("INSERT INTO network_policies (app_id, ingress) VALUES ($1, $2) RETURNING created_at, updated_at",
+		p.AppID, data).Scan(&p.CreatedAt, &p.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		err = r.db.QueryRow("UPDATE network_policies SET ingress = $2, updated_at = now(), deleted_at = NULL WHERE app_id = $1 RETURNING created_at, updated_at",
+			p.AppID, data).Scan(&p.CreatedAt, &p.UpdatedAt)
+	}
+	return err
+}
+
+func scanPolicy(s Scanner) (*ct.NetworkPolicy, error) {
+	p := &ct.NetworkPolicy{}
+	var data []byte
+	err := s.Scan(&p.AppID, &data, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	p.AppID = cleanUUID(p.AppID)
+	err = json.Unmarshal(data, &p.Ingress)
+	return p, err
+}
+
+func (r *PolicyRepo) Get(appID string) (*ct.NetworkPolicy, error) {
+	row := r.db.QueryRow("SELECT app_id, ingress, created_at, updated_at FROM network_policies WHERE app_id = $1 AND deleted_at IS NULL", appID)
+	return scanPolicy(row)
+}
+
+func (r *PolicyRepo) Remove(appID string) error {
+	return r.db.Exec("UPDATE network_policies SET deleted_at = now(), updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL", appID)
+}
+
+func (r *PolicyRepo) List() ([]*ct.NetworkPolicy, error) {
+	rows, err := r.db.Query("SELECT p.app_id, p.ingress, p.created_at, p.updated_at FROM network_policies p JOIN apps a USING (app_id) WHERE p.deleted_at IS NULL AND a.deleted_at IS NULL ORDER BY p.created_at")
+	if err != nil {
+		return nil, err
+	}
+	policies := []*ct.NetworkPolicy{}
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// Compile returns the full set of policies in the form consumed by
+// enforcement agents. Apps without a policy accept all connections.
+func (r *PolicyRepo) Compile() (*ct.PolicySet, error) {
+	policies, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	set := &ct.PolicySet{Policies: make(map[string]*ct.CompiledPolicy, len(policies))}
+	for _, p := range policies {
+		apps := make(map[string]struct{})
+		services := make(map[string]struct{})
+		for _, src := range p.Ingress {
+			if src.App != "" {
+				apps[cleanUUID(src.App)] = struct{}{}
+			} else {
+				services[src.Service] = struct{}{}
+			}
+		}
+		set.Policies[p.AppID] = &ct.CompiledPolicy{
+			AppID:         p.AppID,
+			AllowApps:     sortedKeys(apps),
+			AllowServices: sortedKeys(services),
+		}
+		if set.UpdatedAt == nil || p.UpdatedAt.After(*set.UpdatedAt) {
+			set.UpdatedAt = p.UpdatedAt
+		}
+	}
+	return set, nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (r *PolicyRepo) publish() {
+	set, err := r.Compile()
+	if err != nil {
+		log.Println("error compiling network policies:", err)
+		return
+	}
+	r.subMtx.RLock()
+	defer r.subMtx.RUnlock()
+	for ch := range r.subscriptions {
+		ch <- set
+	}
+}
+
+func (r *PolicyRepo) startListener() error {
+	listener := pq.NewListener(r.db.DSN(), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("policy listener error:", err)
+		}
+	})
+	if err := listener.Listen("network_policies"); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-listener.Notify:
+				go r.publish()
+			case <-r.stopListener:
+				listener.Close()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *PolicyRepo) Subscribe(ch chan<- *ct.PolicySet) error {
+	var startListener bool
+	r.subMtx.Lock()
+	if len(r.subscriptions) == 0 {
+		startListener = true
+	}
+	r.subscriptions[ch] = struct{}{}
+	r.subMtx.Unlock()
+	if startListener {
+		return r.startListener()
+	}
+	return nil
+}
+
+func (r *PolicyRepo) Unsubscribe(ch chan<- *ct.PolicySet) {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	delete(r.subscriptions, ch)
+	if len(r.subscriptions) == 0 {
+		r.stopListener <- struct{}{}
+	}
+}
+
+func getPolicy(app *ct.App, repo *PolicyRepo, r render.Render) {
+	policy, err := repo.Get(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, policy)
+}
+
+func putPolicy(app *ct.App, policy ct.NetworkPolicy, repo *PolicyRepo, r render.Render) {
+	policy.AppID = app.ID
+	if err := repo.Set(&policy); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, &policy)
+}
+
+func deletePolicy(app *ct.App, repo *PolicyRepo, w http.ResponseWriter) {
+	if err := repo.Remove(app.ID); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func getPolicySet(repo *PolicyRepo, r render.Render) {
+	set, err := repo.Compile()
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, set)
+}
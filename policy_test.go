@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestNetworkPolicy(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "policy-app"})
+	peer := s.createTestApp(c, &ct.App{Name: "policy-peer"})
+	path := "/apps/" + app.ID + "/policies"
+
+	res, err := s.Put(path, &ct.NetworkPolicy{Ingress: []ct.PolicySource{{App: "policy-missing"}}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, err = s.Put(path, &ct.NetworkPolicy{Ingress: []ct.PolicySource{{App: peer.ID, Service: "pg"}}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	out := &ct.NetworkPolicy{}
+	res, err = s.Put(path, &ct.NetworkPolicy{Ingress: []ct.PolicySource{{App: peer.Name}, {Service: "pg"}}}, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.AppID, Equals, app.ID)
+	c.Assert(out.Ingress, DeepEquals, []ct.PolicySource{{App: peer.ID}, {Service: "pg"}})
+
+	gotPolicy := &ct.NetworkPolicy{}
+	_, err = s.Get(path, gotPolicy)
+	c.Assert(err, IsNil)
+	c.Assert(gotPolicy, DeepEquals, out)
+
+	set := &ct.PolicySet{}
+	_, err = s.Get("/policies", set)
+	c.Assert(err, IsNil)
+	c.Assert(set.Policies[app.ID], DeepEquals, &ct.CompiledPolicy{
+		AppID:         app.ID,
+		AllowApps:     []string{peer.ID},
+		AllowServices: []string{"pg"},
+	})
+
+	res, err = s.Delete(path)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Get(path, gotPolicy)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestNetworkPolicyStreaming(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "policy-stream"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	ch, _ := client.StreamPolicies()
+	select {
+	case set := <-ch:
+		c.Assert(set.Policies[app.ID], IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for initial policy set")
+	}
+
+	_, err = s.Put("/apps/"+app.ID+"/policies", &ct.NetworkPolicy{Ingress: []ct.PolicySource{{Service: "redis"}}}, nil)
+	c.Assert(err, IsNil)
+
+	select {
+	case set := <-ch:
+		c.Assert(set.Policies[app.ID], Not(IsNil))
+		c.Assert(set.Policies[app.ID].AllowServices, DeepEquals, []string{"redis"})
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for policy update")
+	}
+}
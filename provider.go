@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-flynn/resource"
 	"github.com/flynn/go-sql"
+	"github.com/martini-contrib/render"
 )
 
 type ProviderRepo struct {
@@ -15,8 +24,7 @@ func NewProviderRepo(db *DB) *ProviderRepo {
 	return &ProviderRepo{db}
 }
 
-func (r *ProviderRepo) Add(data interface{}) error {
-	p := data.(*ct.Provider)
+func (r *ProviderRepo) Add(p *ct.Provider) error {
 	if p.Name == "" {
 		return errors.New("controller: name must not be blank")
 	}
@@ -24,24 +32,48 @@ func (r *ProviderRepo) Add(data interface{}) error {
 		return errors.New("controler: url must not be blank")
 	}
 	// TODO: validate url
-	err := r.db.QueryRow("INSERT INTO providers (name, url) VALUES ($1, $2) RETURNING provider_id, created_at, updated_at", p.Name, p.URL).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+	if p.Capabilities == nil {
+		p.Capabilities = &ct.ProviderCapabilities{ProtocolVersion: 1, Provision: true}
+	}
+	caps, err := json.Marshal(p.Capabilities)
+	if err != nil {
+		return err
+	}
+	plans, err := json.Marshal(p.Plans)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRow("INSERT INTO providers (name, url, protocol_version, capabilities, plans) VALUES ($1, $2, $3, $4, $5) RETURNING provider_id, created_at, updated_at",
+		p.Name, p.URL, p.Capabilities.ProtocolVersion, caps, plans).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
 	p.ID = cleanUUID(p.ID)
 	return err
 }
 
 func scanProvider(s Scanner) (*ct.Provider, error) {
 	p := &ct.Provider{}
-	err := s.Scan(&p.ID, &p.Name, &p.URL, &p.CreatedAt, &p.UpdatedAt)
+	var caps, plans []byte
+	err := s.Scan(&p.ID, &p.Name, &p.URL, &caps, &plans, &p.CreatedAt, &p.UpdatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
 	p.ID = cleanUUID(p.ID)
+	if len(caps) > 0 {
+		p.Capabilities = &ct.ProviderCapabilities{}
+		if jsonErr := json.Unmarshal(caps, p.Capabilities); jsonErr != nil && err == nil {
+			err = jsonErr
+		}
+	}
+	if len(plans) > 0 {
+		if jsonErr := json.Unmarshal(plans, &p.Plans); jsonErr != nil && err == nil {
+			err = jsonErr
+		}
+	}
 	return p, err
 }
 
 func (r *ProviderRepo) Get(id string) (interface{}, error) {
 	var row Scanner
-	query := "SELECT provider_id, name, url, created_at, updated_at FROM providers WHERE deleted_at IS NULL AND "
+	query := "SELECT provider_id, name, url, capabilities, plans, created_at, updated_at FROM providers WHERE deleted_at IS NULL AND "
 	if idPattern.MatchString(id) {
 		row = r.db.QueryRow(query+"(provider_id = $1 OR name = $2) LIMIT 1", id, id)
 	} else {
@@ -51,7 +83,7 @@ func (r *ProviderRepo) Get(id string) (interface{}, error) {
 }
 
 func (r *ProviderRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT provider_id, name, url, created_at, updated_at FROM providers WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	rows, err := r.db.Query("SELECT provider_id, name, url, capabilities, plans, created_at, updated_at FROM providers WHERE deleted_at IS NULL ORDER BY created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -66,3 +98,211 @@ func (r *ProviderRepo) List() (interface{}, error) {
 	}
 	return providers, rows.Err()
 }
+
+// Provider protocol versions understood by the controller. Version 1
+// providers only support provisioning and do not serve capabilities, version
+// 2 providers serve their capabilities at GET <url>/capabilities.
+const (
+	minProviderProtocol = 1
+	maxProviderProtocol = 2
+)
+
+var providerHTTPClient = &http.Client{Transport: &http.Transport{
+	Dial: func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, addr, 5*time.Second)
+	},
+	ResponseHeaderTimeout: 10 * time.Second,
+}}
+
+// providerBaseURL resolves a provider URL into an http URL, looking up an
+// instance of the provider in discoverd if necessary.
+func providerBaseURL(uri string, dc resource.DiscoverdClient) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "discoverd+http" {
+		return uri, nil
+	}
+	set, err := dc.NewServiceSet(u.Host)
+	if err != nil {
+		return "", err
+	}
+	defer set.Close()
+	services := set.Services()
+	if len(services) == 0 {
+		return "", fmt.Errorf("controller: no instances of %s found", u.Host)
+	}
+	u.Scheme = "http"
+	u.Host = services[0].Addr
+	return u.String(), nil
+}
+
+// discoverProviderCapabilities fetches the capabilities of a provider and
+// checks that it speaks a protocol version supported by the controller.
+func discoverProviderCapabilities(uri string, dc resource.DiscoverdClient) (*ct.ProviderCapabilities, error) {
+	invalid := func(format string, v ...interface{}) error {
+		return ct.ValidationError{Field: "url", Message: fmt.Sprintf(format, v...)}
+	}
+	base, err := providerBaseURL(uri, dc)
+	if err != nil {
+		return nil, invalid("could not be resolved: %s", err)
+	}
+	res, err := providerHTTPClient.Get(base + "/capabilities")
+	if err != nil {
+		return nil, invalid("is unreachable: %s", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		// providers predating capability discovery
+		return &ct.ProviderCapabilities{ProtocolVersion: 1, Provision: true}, nil
+	default:
+		return nil, invalid("returned unexpected status %d during capability discovery", res.StatusCode)
+	}
+
+	caps := &ct.ProviderCapabilities{}
+	if err := json.NewDecoder(res.Body).Decode(caps); err != nil {
+		return nil, invalid("returned invalid capabilities: %s", err)
+	}
+	if caps.ProtocolVersion < minProviderProtocol || caps.ProtocolVersion > maxProviderProtocol {
+		return nil, invalid("uses provider protocol version %d, supported versions are %d to %d",
+			caps.ProtocolVersion, minProviderProtocol, maxProviderProtocol)
+	}
+	if !caps.Provision {
+		return nil, invalid("does not support provisioning")
+	}
+	return caps, nil
+}
+
+func createProvider(p ct.Provider, repo *ProviderRepo, dc resource.DiscoverdClient, r render.Render) {
+	if p.Name == "" {
+		r.JSON(400, ct.ValidationError{Field: "name", Message: "must not be blank"})
+		return
+	}
+	if p.URL == "" {
+		r.JSON(400, ct.ValidationError{Field: "url", Message: "must not be blank"})
+		return
+	}
+	if err := validatePlans(p.Plans); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	caps, err := discoverProviderCapabilities(p.URL, dc)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	p.Capabilities = caps
+	if err := repo.Add(&p); err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	r.JSON(200, &p)
+}
+
+var planParameterTypes = map[string]bool{"string": true, "number": true, "integer": true, "boolean": true}
+
+func validatePlans(plans []ct.ProviderPlan) error {
+	names := make(map[string]bool, len(plans))
+	for _, plan := range plans {
+		if plan.Name == "" {
+			return ct.ValidationError{Field: "plans", Message: "names must not be blank"}
+		}
+		if names[plan.Name] {
+			return ct.ValidationError{Field: "plans", Message: fmt.Sprintf("%q is defined more than once", plan.Name)}
+		}
+		names[plan.Name] = true
+		for name, param := range plan.Schema {
+			if !planParameterTypes[param.Type] {
+				return ct.ValidationError{Field: "plans", Message: fmt.Sprintf("parameter %q of plan %q has invalid type %q", name, plan.Name, param.Type)}
+			}
+			if param.Default != nil {
+				if err := checkPlanParameter(name, param, param.Default); err != nil {
+					return ct.ValidationError{Field: "plans", Message: fmt.Sprintf("default of %s", err.(ct.ValidationError).Message)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func checkPlanParameter(name string, param ct.PlanParameter, v interface{}) error {
+	var ok bool
+	switch param.Type {
+	case "string":
+		_, ok = v.(string)
+	case "boolean":
+		_, ok = v.(bool)
+	case "number":
+		_, ok = v.(float64)
+	case "integer":
+		var f float64
+		f, ok = v.(float64)
+		ok = ok && f == float64(int64(f))
+	}
+	if !ok {
+		return ct.ValidationError{Field: "config", Message: fmt.Sprintf("parameter %q must be of type %s", name, param.Type)}
+	}
+	return nil
+}
+
+// planConfig validates the config in a resource request against the plan
+// schema and returns the config to send to the provider. Providers without
+// plans receive the request config unchanged.
+func planConfig(p *ct.Provider, req *ct.ResourceReq) ([]byte, error) {
+	if len(p.Plans) == 0 {
+		if req.Plan != "" {
+			return nil, ct.ValidationError{Field: "plan", Message: "provider does not offer plans"}
+		}
+		if req.Config == nil {
+			return []byte(`{}`), nil
+		}
+		return *req.Config, nil
+	}
+
+	var plan *ct.ProviderPlan
+	if req.Plan == "" && len(p.Plans) == 1 {
+		req.Plan = p.Plans[0].Name
+	}
+	for i := range p.Plans {
+		if p.Plans[i].Name == req.Plan {
+			plan = &p.Plans[i]
+			break
+		}
+	}
+	if plan == nil {
+		return nil, ct.ValidationError{Field: "plan", Message: fmt.Sprintf("%q is not offered by %s", req.Plan, p.Name)}
+	}
+
+	params := make(map[string]interface{})
+	if req.Config != nil {
+		if err := json.Unmarshal(*req.Config, &params); err != nil {
+			return nil, ct.ValidationError{Field: "config", Message: "must be a JSON object"}
+		}
+	}
+	for name, v := range params {
+		param, ok := plan.Schema[name]
+		if !ok {
+			return nil, ct.ValidationError{Field: "config", Message: fmt.Sprintf("unknown parameter %q", name)}
+		}
+		if err := checkPlanParameter(name, param, v); err != nil {
+			return nil, err
+		}
+	}
+	for name, param := range plan.Schema {
+		if _, ok := params[name]; ok {
+			continue
+		}
+		if param.Default != nil {
+			params[name] = param.Default
+		} else if param.Required {
+			return nil, ct.ValidationError{Field: "config", Message: fmt.Sprintf("parameter %q is required", name)}
+		}
+	}
+	params["plan"] = plan.Name
+	return json.Marshal(params)
+}
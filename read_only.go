@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/martini-contrib/render"
+)
+
+type ReadOnlyRepo struct {
+	db *DB
+}
+
+func NewReadOnlyRepo(db *DB) *ReadOnlyRepo {
+	return &ReadOnlyRepo{db}
+}
+
+func (r *ReadOnlyRepo) Get() (*ct.ReadOnlyMode, error) {
+	mode := &ct.ReadOnlyMode{}
+	var reason sql.NullString
+	err := r.db.QueryRow("SELECT enabled, reason, updated_at FROM cluster_read_only").Scan(&mode.Enabled, &reason, &mode.UpdatedAt)
+	mode.Reason = reason.String
+	return mode, err
+}
+
+func (r *ReadOnlyRepo) Set(mode *ct.ReadOnlyMode) error {
+	if !mode.Enabled {
+		mode.Reason = ""
+	}
+	return r.db.QueryRow("UPDATE cluster_read_only SET enabled = $1, reason = $2, updated_at = now() RETURNING updated_at",
+		mode.Enabled, mode.Reason).Scan(&mode.UpdatedAt)
+}
+
+const readOnlyPath = "/cluster/read-only"
+
+// readOnlyExemptPaths are the paths of requests which are allowed in
+// read-only mode although they are not reads: changing the mode, and issuing
+// job certificates, which stores nothing.
+var readOnlyExemptPaths = map[string]bool{
+	readOnlyPath:       true,
+	"/ca/certificates": true,
+}
+
+// readOnlyHandler rejects mutations with 503 while the cluster is in
+// read-only mode. Reads, and requests to readOnlyExemptPaths, are passed
+// through.
+func readOnlyHandler(h http.Handler, repo *ReadOnlyRepo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isReadRequest(req) || readOnlyExemptPaths[req.URL.Path] {
+			h.ServeHTTP(w, req)
+			return
+		}
+		mode, err := repo.Get()
+		if err != nil {
+			// fail open so that a database failover does not lock out the API
+			h.ServeHTTP(w, req)
+			return
+		}
+		if mode.Enabled {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set(ct.ReadOnlyHeader, "true")
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(normalizeTimes(mode))
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func getReadOnly(repo *ReadOnlyRepo, r render.Render) {
+	mode, err := repo.Get()
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, mode)
+}
+
+func setReadOnly(mode ct.ReadOnlyMode, repo *ReadOnlyRepo, r render.Render) {
+	if err := repo.Set(&mode); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, &mode)
+}
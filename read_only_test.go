@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestReadOnlyMode(c *C) {
+	mode := &ct.ReadOnlyMode{}
+	_, err := s.Put("/cluster/read-only", &ct.ReadOnlyMode{Enabled: true, Reason: "database failover"}, mode)
+	c.Assert(err, IsNil)
+	c.Assert(mode.Enabled, Equals, true)
+	defer s.Put("/cluster/read-only", &ct.ReadOnlyMode{Enabled: false}, mode)
+
+	res, err := s.send("POST", "/apps", &ct.App{Name: "read-only"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(res.Header.Get(ct.ReadOnlyHeader), Equals, "true")
+	rejected := &ct.ReadOnlyMode{}
+	c.Assert(json.NewDecoder(res.Body).Decode(rejected), IsNil)
+	res.Body.Close()
+	c.Assert(rejected.Reason, Equals, "database failover")
+
+	var apps []*ct.App
+	res, err = s.Get("/apps", &apps)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	_, err = s.Put("/cluster/read-only", &ct.ReadOnlyMode{Enabled: false, Reason: "ignored"}, mode)
+	c.Assert(err, IsNil)
+	c.Assert(mode.Enabled, Equals, false)
+	c.Assert(mode.Reason, Equals, "")
+
+	s.createTestApp(c, &ct.App{Name: "read-only"})
+}
+
+func (s *S) TestIsReadRequest(c *C) {
+	for _, t := range []struct {
+		method, path string
+		read         bool
+	}{
+		{"GET", "/apps", true},
+		{"HEAD", "/apps/foo", true},
+		{"POST", "/releases/get", true},
+		{"POST", "/artifacts/get", true},
+		{"POST", "/apps/get", false},
+		{"POST", "/apps/foo/releases/get", false},
+		{"POST", "/artifacts/foo/verify", true},
+		{"POST", "/artifacts/foo/verify/bar", false},
+		{"PUT", "/releases/get", false},
+	} {
+		req, err := http.NewRequest(t.method, "http://localhost"+t.path, nil)
+		c.Assert(err, IsNil)
+		c.Assert(isReadRequest(req), Equals, t.read, Commentf("%s %s", t.method, t.path))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+const defaultRegistryTimeout = 10 * time.Second
+
+// ArtifactResolver looks up the content digest and size of artifacts which
+// are created without them.
+type ArtifactResolver interface {
+	Resolve(a *ct.Artifact) error
+}
+
+// registryResolver resolves the digests of docker artifacts by requesting
+// the manifest they refer to from their registry with a HEAD request, using
+// the v2 registry API. Artifacts without a registry host, such as images on
+// the Docker Hub which requires token authentication, are not resolved.
+//
+// Artifact URIs are chosen by API clients, so like ArtifactVerifier, only
+// registries on the configured hosts are contacted, and artifacts on other
+// hosts are not resolved.
+type registryResolver struct {
+	client *http.Client
+	hosts  hostAllowlist
+}
+
+func newRegistryResolver(timeout time.Duration, hosts []string) *registryResolver {
+	r := &registryResolver{hosts: hosts}
+	r.client = r.hosts.client(timeout)
+	return r
+}
+
+// artifactResolverFromEnv returns a registry resolver for the hosts in
+// ARTIFACT_VERIFY_HOSTS if ARTIFACT_RESOLVE_DIGESTS is true, or nil.
+func artifactResolverFromEnv() ArtifactResolver {
+	if os.Getenv("ARTIFACT_RESOLVE_DIGESTS") != "true" {
+		return nil
+	}
+	return newRegistryResolver(defaultRegistryTimeout, artifactVerifyHostsFromEnv())
+}
+
+const manifestV2MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+// manifestURL returns the URL of the manifest a docker artifact refers to,
+// or an empty string if it does not name a registry host.
+func manifestURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "docker" || u.Host == "" {
+		return ""
+	}
+	ref := u.Query().Get("tag")
+	if ref == "" {
+		ref = "latest"
+	}
+	return fmt.Sprintf("https://%s/v2/%s/manifests/%s", u.Host, strings.Trim(u.Path, "/"), ref)
+}
+
+// headManifest requests a manifest with a HEAD request.
+func headManifest(client *http.Client, manifestURL string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifestV2MediaType)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+func (r *registryResolver) Resolve(a *ct.Artifact) error {
+	manifestURL := manifestURL(a.URI)
+	if manifestURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(manifestURL); err != nil || !r.hosts.allows(u) {
+		return nil
+	}
+	res, err := headManifest(r.client, manifestURL)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("controller: unexpected status %d from %s", res.StatusCode, manifestURL)
+	}
+	digest := res.Header.Get("Docker-Content-Digest")
+	if !artifactDigestPattern.MatchString(digest) {
+		return fmt.Errorf("controller: invalid digest %q from %s", digest, manifestURL)
+	}
+	a.Digest = digest
+	if res.ContentLength > 0 {
+		a.Size = res.ContentLength
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	"github.com/martini-contrib/render"
+)
+
+// RegistryConfigRepo stores the registry config of the cluster and the
+// overrides of apps. Changes touch the affected formations so that the
+// scheduler starts new jobs with the new config.
+type RegistryConfigRepo struct {
+	db *DB
+}
+
+func NewRegistryConfigRepo(db *DB) *RegistryConfigRepo {
+	return &RegistryConfigRepo{db: db}
+}
+
+var registryHostPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]+)?$`)
+
+func validateRegistryConfig(conf *ct.RegistryConfig, override bool) error {
+	for registry, mirror := range conf.Mirrors {
+		if !registryHostPattern.MatchString(registry) {
+			return ct.ValidationError{Field: "mirrors", Message: "keys must be registry hosts such as docker.io"}
+		}
+		if mirror == "" && override {
+			continue
+		}
+		if !registryHostPattern.MatchString(mirror) {
+			return ct.ValidationError{Field: "mirrors", Message: "values must be mirror hosts such as mirror.example.com:5000"}
+		}
+	}
+	return nil
+}
+
+// registryScope returns the condition selecting the config of an app, or of
+// the cluster if appID is empty.
+func registryScope(appID string) (string, []interface{}) {
+	if appID == "" {
+		return "app_id IS NULL", nil
+	}
+	return "app_id = $1", []interface{}{appID}
+}
+
+// Get returns the registry config of the cluster if appID is empty, or the
+// overrides of an app.
+func (r *RegistryConfigRepo) Get(appID string) (*ct.RegistryConfig, error) {
+	scope, args := registryScope(appID)
+	conf := &ct.RegistryConfig{}
+	var mirrors string
+	err := r.db.QueryRow("SELECT mirrors, updated_at FROM registry_configs WHERE "+scope, args...).Scan(&mirrors, &conf.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return conf, json.Unmarshal([]byte(mirrors), &conf.Mirrors)
+}
+
+// Set replaces the registry config of the cluster if appID is empty, or the
+// overrides of an app.
+func (r *RegistryConfigRepo) Set(appID string, conf *ct.RegistryConfig) error {
+	if err := validateRegistryConfig(conf, appID != ""); err != nil {
+		return err
+	}
+	if conf.Mirrors == nil {
+		conf.Mirrors = map[string]string{}
+	}
+	mirrors, err := json.Marshal(conf.Mirrors)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	// configs are locked so that concurrent sets of a new config do not
+	// both insert it
+	if _, err := tx.Exec("LOCK TABLE registry_configs IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	scope, args := registryScope(appID)
+	args = append(args, string(mirrors))
+	err = tx.QueryRow(fmt.Sprintf("UPDATE registry_configs SET mirrors = $%d, updated_at = now() WHERE %s RETURNING updated_at", len(args), scope), args...).Scan(&conf.UpdatedAt)
+	if err == sql.ErrNoRows {
+		var app *string
+		if appID != "" {
+			app = &appID
+		}
+		err = tx.QueryRow("INSERT INTO registry_configs (app_id, mirrors) VALUES ($1, $2) RETURNING updated_at", app, string(mirrors)).Scan(&conf.UpdatedAt)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := r.touchFormations(tx, appID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove removes the registry config of the cluster if appID is empty, or
+// the overrides of an app.
+func (r *RegistryConfigRepo) Remove(appID string) error {
+	scope, args := registryScope(appID)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM registry_configs WHERE "+scope, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := r.touchFormations(tx, appID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *RegistryConfigRepo) touchFormations(tx *dbTx, appID string) error {
+	if appID != "" {
+		return touchFormations(tx, appID)
+	}
+	_, err := tx.Exec("UPDATE formations SET updated_at = now() WHERE deleted_at IS NULL")
+	return err
+}
+
+// Effective returns the registry config of an app, which is the cluster
+// config with the overrides of the app applied, or nil if neither is set.
+func (r *RegistryConfigRepo) Effective(appID string) (*ct.RegistryConfig, error) {
+	rows, err := r.db.Query("SELECT app_id IS NULL, mirrors, updated_at FROM registry_configs WHERE app_id IS NULL OR app_id = $1", appID)
+	if err != nil {
+		return nil, err
+	}
+	var cluster, app *ct.RegistryConfig
+	for rows.Next() {
+		var isCluster bool
+		var mirrors string
+		conf := &ct.RegistryConfig{}
+		if err := rows.Scan(&isCluster, &mirrors, &conf.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(mirrors), &conf.Mirrors); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if isCluster {
+			cluster = conf
+		} else {
+			app = conf
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return mergeRegistryConfig(cluster, app), nil
+}
+
+// mergeRegistryConfig applies the overrides of an app to the cluster config.
+func mergeRegistryConfig(cluster, app *ct.RegistryConfig) *ct.RegistryConfig {
+	if app == nil {
+		return cluster
+	}
+	conf := &ct.RegistryConfig{Mirrors: make(map[string]string), UpdatedAt: app.UpdatedAt}
+	if cluster != nil {
+		for registry, mirror := range cluster.Mirrors {
+			conf.Mirrors[registry] = mirror
+		}
+		if cluster.UpdatedAt.After(*conf.UpdatedAt) {
+			conf.UpdatedAt = cluster.UpdatedAt
+		}
+	}
+	for registry, mirror := range app.Mirrors {
+		if mirror == "" {
+			delete(conf.Mirrors, registry)
+			continue
+		}
+		conf.Mirrors[registry] = mirror
+	}
+	return conf
+}
+
+func getClusterRegistryConfig(repo *RegistryConfigRepo, r render.Render) {
+	getRegistryConfig("", repo, r)
+}
+
+func putClusterRegistryConfig(conf ct.RegistryConfig, repo *RegistryConfigRepo, r render.Render) {
+	putRegistryConfig("", &conf, repo, r)
+}
+
+func deleteClusterRegistryConfig(repo *RegistryConfigRepo, w http.ResponseWriter, r render.Render) {
+	deleteRegistryConfig("", repo, w, r)
+}
+
+func getAppRegistryConfig(app *ct.App, repo *RegistryConfigRepo, r render.Render) {
+	getRegistryConfig(app.ID, repo, r)
+}
+
+func putAppRegistryConfig(app *ct.App, conf ct.RegistryConfig, repo *RegistryConfigRepo, r render.Render) {
+	putRegistryConfig(app.ID, &conf, repo, r)
+}
+
+func deleteAppRegistryConfig(app *ct.App, repo *RegistryConfigRepo, w http.ResponseWriter, r render.Render) {
+	deleteRegistryConfig(app.ID, repo, w, r)
+}
+
+func getRegistryConfig(appID string, repo *RegistryConfigRepo, r render.Render) {
+	conf, err := repo.Get(appID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, conf)
+}
+
+func putRegistryConfig(appID string, conf *ct.RegistryConfig, repo *RegistryConfigRepo, r render.Render) {
+	if err := repo.Set(appID, conf); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, conf)
+}
+
+func deleteRegistryConfig(appID string, repo *RegistryConfigRepo, w http.ResponseWriter, r render.Render) {
+	if err := repo.Remove(appID); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	w.WriteHeader(200)
+}
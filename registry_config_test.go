@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestRegistryConfig(c *C) {
+	release := s.createTestRelease(c, &ct.Release{})
+	app := s.createTestApp(c, &ct.App{Name: "registry-config"})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID, Processes: map[string]int{"web": 1}})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	_, err = client.GetRegistryConfig()
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	for _, mirrors := range []map[string]string{
+		{"docker.io": ""},
+		{"docker.io": "http://mirror.example.com"},
+		{"docker.io/flynn": "mirror.example.com"},
+	} {
+		res, err := s.Put("/cluster/registry-config", &ct.RegistryConfig{Mirrors: mirrors}, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+
+	conf := &ct.RegistryConfig{Mirrors: map[string]string{"docker.io": "mirror.example.com:5000", "registry.example.com": "mirror.example.com:5001"}}
+	c.Assert(client.PutRegistryConfig(conf), IsNil)
+	defer client.DeleteRegistryConfig()
+	got, err := client.GetRegistryConfig()
+	c.Assert(err, IsNil)
+	c.Assert(got.Mirrors, DeepEquals, conf.Mirrors)
+
+	expanded, err := client.GetExpandedFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(expanded.RegistryConfig.Mirrors, DeepEquals, conf.Mirrors)
+
+	// app overrides replace or disable the mirrors of the cluster
+	override := &ct.RegistryConfig{Mirrors: map[string]string{"docker.io": "", "quay.io": "quay-mirror.example.com"}}
+	c.Assert(client.PutAppRegistryConfig(app.ID, override), IsNil)
+	got, err = client.GetAppRegistryConfig(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Mirrors, DeepEquals, override.Mirrors)
+	expanded, err = client.GetExpandedFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(expanded.RegistryConfig.Mirrors, DeepEquals, map[string]string{
+		"registry.example.com": "mirror.example.com:5001",
+		"quay.io":              "quay-mirror.example.com",
+	})
+
+	c.Assert(client.DeleteAppRegistryConfig(app.ID), IsNil)
+	_, err = client.GetAppRegistryConfig(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	c.Assert(client.DeleteRegistryConfig(), IsNil)
+	expanded, err = client.GetExpandedFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(expanded.RegistryConfig, IsNil)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestRegistryResolver(c *C) {
+	digest := "sha256:" + strings.Repeat("c", 64)
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		c.Assert(req.Header.Get("Accept"), Equals, manifestV2MediaType)
+		switch req.URL.Path {
+		case "/v2/missing/manifests/latest":
+			w.WriteHeader(404)
+			return
+		case "/v2/redirect/manifests/latest":
+			http.Redirect(w, req, "https://10.0.0.1/v2/flynn/slugrunner/manifests/latest", 302)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", "528")
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+	resolver := newRegistryResolver(defaultRegistryTimeout, []string{host})
+	resolver.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	a := &ct.Artifact{Type: "docker", URI: "docker://" + host + "/flynn/slugrunner?tag=v1"}
+	c.Assert(resolver.Resolve(a), IsNil)
+	c.Assert(a.Digest, Equals, digest)
+	c.Assert(a.Size, Equals, int64(528))
+
+	c.Assert(resolver.Resolve(&ct.Artifact{Type: "docker", URI: "docker://" + host + "/missing"}), NotNil)
+
+	// images without a registry host are not resolved
+	a = &ct.Artifact{Type: "docker", URI: "docker:///flynn/slugrunner"}
+	c.Assert(resolver.Resolve(a), IsNil)
+	c.Assert(a.Digest, Equals, "")
+
+	// only the configured hosts are contacted, including by redirects
+	a = &ct.Artifact{Type: "docker", URI: "docker://registry.example.com/flynn/slugrunner"}
+	c.Assert(resolver.Resolve(a), IsNil)
+	c.Assert(a.Digest, Equals, "")
+	c.Assert(resolver.Resolve(&ct.Artifact{Type: "docker", URI: "docker://" + host + "/redirect"}), NotNil)
+
+	c.Assert(requests, DeepEquals, []string{"HEAD /v2/flynn/slugrunner/manifests/v1", "HEAD /v2/missing/manifests/latest", "HEAD /v2/redirect/manifests/latest"})
+}
+
+func (s *S) TestArtifactVerifier(c *C) {
+	digest := "sha256:" + strings.Repeat("e", 64)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/flynn/slugrunner/manifests/v1":
+			w.Header().Set("Docker-Content-Digest", digest)
+		case "/v2/private/manifests/latest":
+			w.WriteHeader(401)
+		case "/v2/broken/manifests/latest":
+			w.WriteHeader(500)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/slug.tgz" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", "1024")
+	}))
+	defer files.Close()
+	verifier := NewArtifactVerifier(defaultArtifactVerifyTimeout, nil, []string{host, strings.TrimPrefix(files.URL, "http://")})
+	verifier.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	for _, t := range []struct {
+		artifact *ct.Artifact
+		status   ct.ArtifactStatus
+	}{
+		{&ct.Artifact{Type: "docker", URI: "docker://" + host + "/flynn/slugrunner?tag=v1"}, ct.ArtifactAvailable},
+		{&ct.Artifact{Type: "docker", URI: "docker://" + host + "/flynn/slugrunner?tag=v1", Digest: digest}, ct.ArtifactAvailable},
+		{&ct.Artifact{Type: "docker", URI: "docker://" + host + "/flynn/slugrunner?tag=v1", Digest: "sha256:" + strings.Repeat("f", 64)}, ct.ArtifactMismatch},
+		{&ct.Artifact{Type: "docker", URI: "docker://" + host + "/missing"}, ct.ArtifactMissing},
+		{&ct.Artifact{Type: "docker", URI: "docker://" + host + "/private"}, ct.ArtifactUnverifiable},
+		{&ct.Artifact{Type: "docker", URI: "docker://" + host + "/broken"}, ct.ArtifactUnreachable},
+		{&ct.Artifact{Type: "docker", URI: "docker:///flynn/slugrunner"}, ct.ArtifactUnverifiable},
+		{&ct.Artifact{Type: ct.ArtifactTypeFile, URI: files.URL + "/slug.tgz"}, ct.ArtifactAvailable},
+		{&ct.Artifact{Type: ct.ArtifactTypeFile, URI: files.URL + "/slug.tgz", Size: 512}, ct.ArtifactMismatch},
+		{&ct.Artifact{Type: ct.ArtifactTypeFile, URI: files.URL + "/missing.tgz"}, ct.ArtifactMissing},
+		// only the configured hosts are contacted
+		{&ct.Artifact{Type: "docker", URI: "docker://registry.example.com/flynn/slugrunner"}, ct.ArtifactUnverifiable},
+		{&ct.Artifact{Type: ct.ArtifactTypeFile, URI: "http://10.0.0.1:8080/slug.tgz"}, ct.ArtifactUnverifiable},
+	} {
+		res := verifier.Verify(t.artifact)
+		c.Assert(res.Status, Equals, t.status, Commentf("%s %s", t.artifact.URI, res.Error))
+		c.Assert(res.CheckedAt, NotNil)
+	}
+}
@@ -2,24 +2,93 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
 	"github.com/flynn/go-sql"
+	"github.com/flynn/pq"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
 )
 
 type ReleaseRepo struct {
-	db *DB
+	db        *DB
+	allowlist *ImageAllowlist
 }
 
 func NewReleaseRepo(db *DB) *ReleaseRepo {
-	return &ReleaseRepo{db}
+	return &ReleaseRepo{db: db}
+}
+
+// SetImageAllowlist restricts the artifacts of the releases which can be
+// created, nil allows every artifact.
+func (r *ReleaseRepo) SetImageAllowlist(allowlist *ImageAllowlist) {
+	r.allowlist = allowlist
+}
+
+// CheckCreate rejects releases whose artifact is outside the image
+// allowlist, so that artifacts created before the allowlist cannot be used
+// by new releases.
+func (r *ReleaseRepo) CheckCreate(data interface{}, req *http.Request) error {
+	release := data.(*ct.Release)
+	if r.allowlist == nil || release.ArtifactID == "" {
+		return nil
+	}
+	artifact, err := scanArtifact(r.db.QueryRow("SELECT "+artifactColumns+" FROM artifacts WHERE artifact_id = $1", release.ArtifactID))
+	if err == ErrNotFound {
+		// missing artifacts are reported when the release is added
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return r.allowlist.Check(artifact, req)
+}
+
+// releaseUpgrades convert release data between schema versions, the
+// function for version n converts data of version n to version n+1. Each
+// change to the release data format must bump ct.ReleaseSchemaVersion and add
+// an upgrade here so that existing releases are converted when read.
+var releaseUpgrades = map[int]func(map[string]*json.RawMessage) error{}
+
+// upgradeReleaseData converts release data of the given schema version to
+// the current version.
+func upgradeReleaseData(version int, data []byte) ([]byte, error) {
+	if version > ct.ReleaseSchemaVersion {
+		return nil, ct.ValidationError{Field: "schema_version", Message: fmt.Sprintf("%d is newer than the supported version %d", version, ct.ReleaseSchemaVersion)}
+	}
+	if version == ct.ReleaseSchemaVersion {
+		return data, nil
+	}
+	var fields map[string]*json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for ; version < ct.ReleaseSchemaVersion; version++ {
+		upgrade, ok := releaseUpgrades[version]
+		if !ok {
+			return nil, fmt.Errorf("controller: no upgrade for release schema version %d", version)
+		}
+		if err := upgrade(fields); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
 }
 
 func scanRelease(s Scanner) (*ct.Release, error) {
 	release := &ct.Release{}
 	var data []byte
-	err := s.Scan(&release.ID, &release.ArtifactID, &data, &release.CreatedAt)
+	var version int
+	err := s.Scan(&release.ID, &release.ArtifactID, &data, &version, &release.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
@@ -28,39 +97,428 @@ func scanRelease(s Scanner) (*ct.Release, error) {
 	}
 	release.ID = cleanUUID(release.ID)
 	release.ArtifactID = cleanUUID(release.ArtifactID)
+	if data, err = upgradeReleaseData(version, data); err != nil {
+		return nil, err
+	}
 	err = json.Unmarshal(data, release)
+	release.SchemaVersion = ct.ReleaseSchemaVersion
 	return release, err
 }
 
 func (r *ReleaseRepo) Add(data interface{}) error {
 	release := data.(*ct.Release)
+	// the release is added in a transaction so that the artifact cannot be
+	// deleted between checking it and inserting the release
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = r.AddTx(tx, release)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		err = ErrReleaseImmutable
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddTx is like Add, in a transaction.
+func (r *ReleaseRepo) AddTx(tx *dbTx, release *ct.Release) error {
+	releaseData, err := encodeRelease(release)
+	if err != nil {
+		return err
+	}
+	// the existing release is looked up first, as a failed insert would
+	// abort the transaction
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM releases WHERE release_id = $1)", release.ID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrReleaseImmutable
+	}
+	if err := checkReleaseArtifact(tx, release.ArtifactID); err != nil {
+		return err
+	}
+	err = tx.QueryRow("INSERT INTO releases (release_id, artifact_id, data, schema_version) VALUES ($1, $2, $3, $4) RETURNING created_at",
+		release.ID, release.ArtifactID, releaseData, release.SchemaVersion).Scan(&release.CreatedAt)
+	release.ID = cleanUUID(release.ID)
+	release.ArtifactID = cleanUUID(release.ArtifactID)
+	return err
+}
+
+// encodeRelease validates a release being added and returns its data in the
+// current schema version, giving it an ID if it has none.
+func encodeRelease(release *ct.Release) ([]byte, error) {
+	if err := validateRelease(release); err != nil {
+		return nil, err
+	}
+	if _, err := utils.ProcessOrder(release.Processes); err != nil {
+		return nil, ct.ValidationError{Field: "processes", Message: err.Error()}
+	}
 	releaseCopy := *release
 
 	releaseCopy.ID = ""
 	releaseCopy.ArtifactID = ""
 	releaseCopy.CreatedAt = nil
-	data, err := json.Marshal(&releaseCopy)
+	releaseCopy.SchemaVersion = 0
+	releaseData, err := json.Marshal(&releaseCopy)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if release.SchemaVersion == 0 {
+		release.SchemaVersion = ct.ReleaseSchemaVersion
+	}
+	if releaseData, err = upgradeReleaseData(release.SchemaVersion, releaseData); err != nil {
+		return nil, err
 	}
+	release.SchemaVersion = ct.ReleaseSchemaVersion
 	if release.ID == "" {
 		release.ID = utils.UUID()
 	}
+	return releaseData, nil
+}
 
-	err = r.db.QueryRow("INSERT INTO releases (release_id, artifact_id, data) VALUES ($1, $2, $3) RETURNING created_at",
-		release.ID, release.ArtifactID, data).Scan(&release.CreatedAt)
-	release.ID = cleanUUID(release.ID)
-	release.ArtifactID = cleanUUID(release.ArtifactID)
-	return err
+// checkReleaseArtifact returns a ValidationError if the artifact of a
+// release has been deleted, so that releases and deployments of it fail up
+// front rather than timing out once their jobs
+// are scheduled. In a transaction the artifact is locked against being
+// deleted until it finishes.
+func checkReleaseArtifact(db rowQueryer, artifactID string) error {
+	if !idPattern.MatchString(artifactID) {
+		return nil
+	}
+	var deleted bool
+	err := db.QueryRow("SELECT deleted_at IS NOT NULL FROM artifacts WHERE artifact_id = $1 FOR SHARE", artifactID).Scan(&deleted)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if deleted {
+		return ct.ValidationError{Field: "artifact", Message: "has been deleted"}
+	}
+	return nil
+}
+
+// CheckRunnable returns a ValidationError if the artifact of an existing
+// release has been deleted.
+func (r *ReleaseRepo) CheckRunnable(release *ct.Release) error {
+	return checkReleaseArtifact(r.db, release.ArtifactID)
 }
 
+var (
+	// processTypePattern matches the process type names which can be used
+	// as the flynn-controller.type attribute of jobs.
+	processTypePattern = regexp.MustCompile(`^[a-z\d][a-z\d_-]{0,62}$`)
+	envKeyPattern      = regexp.MustCompile(`^[A-Za-z_][A-Za-z\d_]*$`)
+)
+
+// validateRelease checks the process types and env of a release, which
+// would otherwise only fail once a job is run.
+func validateRelease(release *ct.Release) error {
+	if err := validateEnv("env", release.Env); err != nil {
+		return err
+	}
+	if _, ok := release.Meta[""]; ok {
+		return ct.ValidationError{Field: "meta", Message: "must not have an empty key"}
+	}
+	types := make([]string, 0, len(release.Processes))
+	for typ := range release.Processes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		field := "processes." + typ
+		if !processTypePattern.MatchString(typ) {
+			return ct.ValidationError{Field: field, Message: "is not a valid process type, which must be lowercase letters, digits, dashes and underscores"}
+		}
+		proc := release.Processes[typ]
+		for i, arg := range proc.Cmd {
+			if arg == "" {
+				return ct.ValidationError{Field: fmt.Sprintf("%s.cmd.%d", field, i), Message: "must not be empty"}
+			}
+		}
+		if err := validateEnv(field+".env", proc.Env); err != nil {
+			return err
+		}
+		if proc.Ports.TCP < 0 || proc.Ports.UDP < 0 {
+			return ct.ValidationError{Field: field + ".ports", Message: "must not be negative"}
+		}
+	}
+	return nil
+}
+
+func validateEnv(field string, env map[string]string) error {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !envKeyPattern.MatchString(k) {
+			return ct.ValidationError{Field: field + "." + k, Message: "is not a valid env var name"}
+		}
+	}
+	return nil
+}
+
+// ErrReleaseImmutable is returned when attempting to modify an existing
+// release. Releases are changed by creating a new one, see cloneRelease.
+var ErrReleaseImmutable = errors.New("controller: releases are immutable")
+
 func (r *ReleaseRepo) Get(id string) (interface{}, error) {
-	row := r.db.QueryRow("SELECT release_id, artifact_id, data, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	row := r.db.QueryRow("SELECT release_id, artifact_id, data, schema_version, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
+	return scanRelease(row)
+}
+
+// GetForApp returns a release by ID, or by one of the tags it has in an app.
+func (r *ReleaseRepo) GetForApp(appID, id string) (*ct.Release, error) {
+	if idPattern.MatchString(id) {
+		release, err := r.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		return release.(*ct.Release), nil
+	}
+	row := r.db.QueryRow("SELECT release_id, artifact_id, data, schema_version, r.created_at FROM releases r JOIN release_tags t USING (release_id) WHERE t.app_id = $1 AND t.tag = $2 AND deleted_at IS NULL", appID, id)
 	return scanRelease(row)
 }
 
+// Prune removes the releases of an app beyond its release retention, newest
+// first, which are not otherwise in use, along with the artifacts no longer
+// used by any release. It returns the IDs of the removed releases and
+// artifacts. Apps without a release retention keep all of their releases.
+func (r *ReleaseRepo) Prune(appID string) ([]string, []string, error) {
+	var keep int
+	if err := r.db.QueryRow("SELECT release_retention FROM apps WHERE app_id = $1", appID).Scan(&keep); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, nil, err
+	}
+	if keep <= 0 {
+		return nil, nil, nil
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates, err := queryIDs(tx, `SELECT release_id FROM releases WHERE release_id IN (
+			SELECT subject_id FROM app_logs WHERE app_id = $1 AND event IN ('release', 'formation')
+			UNION SELECT release_id FROM formations WHERE app_id = $1
+		) ORDER BY created_at DESC, release_id OFFSET $2 FOR UPDATE`, appID, keep)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	var releases []string
+	artifacts := make(map[string]struct{})
+	for _, id := range candidates {
+		// a release which another app has used, or which is still in use by
+		// this app, is kept
+		var artifactID string
+		err := tx.QueryRow(`SELECT artifact_id FROM releases WHERE release_id = $1
+			AND NOT EXISTS (SELECT 1 FROM apps WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM formations WHERE release_id = $1 AND (app_id <> $2 OR deleted_at IS NULL))
+			AND NOT EXISTS (SELECT 1 FROM app_logs WHERE subject_id = $1 AND app_id <> $2)
+			AND NOT EXISTS (SELECT 1 FROM adopted_jobs WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM job_reservations WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM release_tags WHERE release_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM deployments WHERE $1 IN (old_release_id, new_release_id) AND finished_at IS NULL)`, id, appID).Scan(&artifactID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		for _, query := range []string{
+			"DELETE FROM formations WHERE release_id = $1",
+			"DELETE FROM releases WHERE release_id = $1",
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
+		}
+		releases = append(releases, cleanUUID(id))
+		artifacts[artifactID] = struct{}{}
+	}
+
+	var removed []string
+	for artifactID := range artifacts {
+		var id string
+		err := tx.QueryRow("DELETE FROM artifacts WHERE artifact_id = $1 AND NOT EXISTS (SELECT 1 FROM releases WHERE artifact_id = $1) RETURNING artifact_id", artifactID).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		removed = append(removed, cleanUUID(id))
+	}
+	return releases, removed, tx.Commit()
+}
+
+// LastModified returns the time the release was created, as releases are
+// immutable.
+func (r *ReleaseRepo) LastModified(thing interface{}) time.Time {
+	if release := thing.(*ct.Release); release.CreatedAt != nil {
+		return *release.CreatedAt
+	}
+	return time.Time{}
+}
+
+// ResolveID returns the ID of the release with the given ID, or with the
+// given tag in an app.
+func (r *ReleaseRepo) ResolveID(appID, id string) (string, error) {
+	if idPattern.MatchString(id) {
+		return cleanUUID(id), nil
+	}
+	release, err := r.GetForApp(appID, id)
+	if err != nil {
+		return "", err
+	}
+	return release.ID, nil
+}
+
+var releaseTagPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// Tags returns the tags of a release in an app in alphabetical order.
+func (r *ReleaseRepo) Tags(appID, releaseID string) ([]string, error) {
+	rows, err := r.db.Query("SELECT tag FROM release_tags WHERE app_id = $1 AND release_id = $2 ORDER BY tag", appID, releaseID)
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// SetTags replaces the tags of a release in an app. Tags of the app which
+// belong to another release are moved to this one, and the tags of other apps
+// are unaffected.
+func (r *ReleaseRepo) SetTags(appID, releaseID string, tags []string) error {
+	for _, tag := range tags {
+		if !releaseTagPattern.MatchString(tag) || idPattern.MatchString(tag) {
+			return ct.ValidationError{Field: "tags", Message: fmt.Sprintf("%q is not a valid tag", tag)}
+		}
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM release_tags WHERE app_id = $1 AND release_id = $2", appID, releaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec("DELETE FROM release_tags WHERE app_id = $1 AND tag = $2", appID, tag); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO release_tags (app_id, tag, release_id) VALUES ($1, $2, $3)", appID, tag, releaseID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (r *ReleaseRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT release_id, artifact_id, data, created_at FROM releases WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	return r.list("", "")
+}
+
+// Filter lists the releases matching the artifact_id, app_id and since query
+// parameters, see releaseFilter.
+func (r *ReleaseRepo) Filter(q url.Values) (interface{}, error) {
+	filter, args, err := releaseFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	return r.list(filter, "", args...)
+}
+
+// Page lists a page of releases matching the query parameters like Filter
+// and returns the total number of matching releases.
+func (r *ReleaseRepo) Page(q url.Values, limit, offset int) (interface{}, int, error) {
+	filter, args, err := releaseFilter(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := r.db.QueryRow("SELECT count(*) FROM releases WHERE deleted_at IS NULL"+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, limit, offset)
+	releases, err := r.list(filter, fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args...)
+	return releases, total, err
+}
+
+// releaseFilter returns the conditions selecting the releases of an artifact,
+// the releases an app has been deployed with or had formations for, the
+// releases created since a time, and the releases matching meta parameters,
+// which are either key=value or key like app labels.
+func releaseFilter(q url.Values) (string, []interface{}, error) {
+	var filter string
+	var args []interface{}
+	if id := q.Get("artifact_id"); id != "" {
+		if !idPattern.MatchString(id) {
+			return "", nil, ct.ValidationError{Field: "artifact_id", Message: "is invalid"}
+		}
+		args = append(args, id)
+		filter += fmt.Sprintf(" AND artifact_id = $%d", len(args))
+	}
+	if id := q.Get("app_id"); id != "" {
+		if !idPattern.MatchString(id) {
+			return "", nil, ct.ValidationError{Field: "app_id", Message: "is invalid"}
+		}
+		args = append(args, id)
+		filter += fmt.Sprintf(` AND release_id IN (
+			SELECT subject_id FROM app_logs WHERE app_id = $%[1]d AND event IN ('release', 'formation')
+			UNION SELECT release_id FROM apps WHERE app_id = $%[1]d
+			UNION SELECT release_id FROM formations WHERE app_id = $%[1]d
+		)`, len(args))
+	}
+	if since := q.Get("since"); since != "" {
+		t, err := parseTimestamp(since)
+		if err != nil {
+			return "", nil, ct.ValidationError{Field: "since", Message: "must be an RFC 3339 timestamp"}
+		}
+		args = append(args, t)
+		filter += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	for _, meta := range q["meta"] {
+		kv := strings.SplitN(meta, "=", 2)
+		if kv[0] == "" {
+			return "", nil, ct.ValidationError{Field: "meta", Message: fmt.Sprintf("%q must be of the form key=value or key", meta)}
+		}
+		args = append(args, kv[0])
+		if len(kv) == 2 {
+			args = append(args, kv[1])
+			filter += fmt.Sprintf(" AND (data::json->'meta'->>$%d) = $%d", len(args)-1, len(args))
+		} else {
+			filter += fmt.Sprintf(" AND (data::json->'meta'->>$%d) IS NOT NULL", len(args))
+		}
+	}
+	return filter, args, nil
+}
+
+func (r *ReleaseRepo) list(filter, page string, args ...interface{}) (interface{}, error) {
+	rows, err := r.db.Query("SELECT release_id, artifact_id, data, schema_version, created_at FROM releases WHERE deleted_at IS NULL"+filter+" ORDER BY created_at DESC, release_id"+page, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -75,3 +533,218 @@ func (r *ReleaseRepo) List() (interface{}, error) {
 	}
 	return releases, rows.Err()
 }
+
+// GetMany returns the releases with the given IDs in the order requested,
+// omitting any that do not exist.
+func (r *ReleaseRepo) GetMany(ids []string) ([]*ct.Release, error) {
+	rows, err := r.db.Query("SELECT release_id, artifact_id, data, schema_version, created_at FROM releases WHERE release_id = ANY($1::uuid[]) AND deleted_at IS NULL", uuidArray(ids))
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]*ct.Release, len(ids))
+	for rows.Next() {
+		release, err := scanRelease(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found[release.ID] = release
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	releases := make([]*ct.Release, 0, len(found))
+	for _, id := range ids {
+		if release, ok := found[cleanUUID(id)]; ok {
+			releases = append(releases, release)
+			delete(found, release.ID)
+		}
+	}
+	return releases, nil
+}
+
+// ErrReleaseInUse is returned when deleting a release which is the release of
+// an app or has an active formation.
+var ErrReleaseInUse = errors.New("controller: release is in use")
+
+// Delete soft deletes a release unless it is in use. Deleted releases are
+// removed by the ReleaseGC.
+func (r *ReleaseRepo) Delete(id string) error {
+	var deleted string
+	err := r.db.QueryRow(`UPDATE releases SET deleted_at = now() WHERE release_id = $1 AND deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM apps WHERE release_id = $1)
+		AND NOT EXISTS (SELECT 1 FROM formations WHERE release_id = $1 AND deleted_at IS NULL)
+		RETURNING release_id`, id).Scan(&deleted)
+	if err == sql.ErrNoRows {
+		if _, err := r.Get(id); err != nil {
+			return err
+		}
+		return ErrReleaseInUse
+	} else if err != nil {
+		return err
+	}
+	// the tags of a deleted release may be reused
+	return r.db.Exec("DELETE FROM release_tags WHERE release_id = $1", id)
+}
+
+// getAppReleaseMiddleware maps the release of a request by ID, or by one of
+// its tags in the app.
+func getAppReleaseMiddleware(c martini.Context, app *ct.App, params martini.Params, repo *ReleaseRepo, w http.ResponseWriter) {
+	release, err := repo.GetForApp(app.ID, params["releases_id"])
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(404)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	c.Map(release)
+}
+
+func getReleaseTags(app *ct.App, release *ct.Release, repo *ReleaseRepo, r render.Render) {
+	tags, err := repo.Tags(app.ID, release.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, tags)
+}
+
+func setReleaseTags(app *ct.App, release *ct.Release, repo *ReleaseRepo, req *http.Request, r render.Render) {
+	var tags []string
+	if err := json.NewDecoder(req.Body).Decode(&tags); err != nil {
+		r.JSON(400, ct.ValidationError{Message: "body must be an array of tags"})
+		return
+	}
+	if err := repo.SetTags(app.ID, release.ID, tags); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	getReleaseTags(app, release, repo, r)
+}
+
+func deleteRelease(release *ct.Release, repo *ReleaseRepo, w http.ResponseWriter, r render.Render) {
+	if err := repo.Delete(release.ID); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func rejectReleaseMutation(r render.Render) {
+	respondWithError(r, ErrReleaseImmutable)
+}
+
+// cloneRelease creates a new release from an existing one with the env and
+// process overrides in the request applied. A null value removes the env
+// variable or process type.
+func cloneRelease(release *ct.Release, req ct.CloneReleaseReq, repo *ReleaseRepo, admitter *Admitter, httpReq *http.Request, r render.Render) {
+	clone := applyReleaseOverrides(release, &req)
+	if err := repo.CheckCreate(clone, httpReq); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := admitter.Admit("releases", "create", clone); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := repo.Add(clone); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, clone)
+}
+
+// applyReleaseOverrides returns a copy of release with the overrides of req
+// applied.
+func applyReleaseOverrides(release *ct.Release, req *ct.CloneReleaseReq) *ct.Release {
+	clone := &ct.Release{
+		ArtifactID: release.ArtifactID,
+		Env:        make(map[string]string, len(release.Env)),
+		Processes:  make(map[string]ct.ProcessType, len(release.Processes)),
+	}
+	for k, v := range release.Env {
+		clone.Env[k] = v
+	}
+	for k, v := range req.Env {
+		if v == nil {
+			delete(clone.Env, k)
+		} else {
+			clone.Env[k] = *v
+		}
+	}
+	for k, v := range release.Processes {
+		clone.Processes[k] = v
+	}
+	for k, v := range req.Processes {
+		if v == nil {
+			delete(clone.Processes, k)
+		} else {
+			clone.Processes[k] = *v
+		}
+	}
+	if len(release.Meta) > 0 || len(req.Meta) > 0 {
+		clone.Meta = make(map[string]string, len(release.Meta))
+		for k, v := range release.Meta {
+			clone.Meta[k] = v
+		}
+		for k, v := range req.Meta {
+			if v == nil {
+				delete(clone.Meta, k)
+			} else {
+				clone.Meta[k] = *v
+			}
+		}
+	}
+	return clone
+}
+
+// createAppRelease creates a release from the current release of an app with
+// the overrides in the request applied and deploys it, which is how config
+// changes are made. If the request has a base release, the release is only
+// deployed if the base is still the current release of the app.
+func createAppRelease(app *ct.App, req ct.AppReleaseReq, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, admitter *Admitter, httpReq *http.Request, r render.Render) {
+	if app.Protected && !protectedOverride(httpReq) {
+		respondWithError(r, ErrAppProtected)
+		return
+	}
+	current, err := apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		r.JSON(400, ct.ValidationError{Field: "app", Message: "has no release to base the new release on"})
+		return
+	} else if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if req.Base != "" {
+		base, err := releases.ResolveID(app.ID, req.Base)
+		if err != nil && err != ErrNotFound {
+			respondWithError(r, err)
+			return
+		}
+		if base != current.ID {
+			respondWithError(r, ErrPreconditionFailed)
+			return
+		}
+	}
+	release := applyReleaseOverrides(current, &req.CloneReleaseReq)
+	if err := releases.CheckCreate(release, httpReq); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := admitter.Admit("releases", "create", release); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := releases.Add(release); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	if err := formations.DeployFrom(app.ID, release.ID, current.ID); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, release)
+}
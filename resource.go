@@ -25,10 +25,10 @@ func (rr *ResourceRepo) Add(r *ct.Resource) error {
 	if err != nil {
 		return err
 	}
-	err = tx.QueryRow(`INSERT INTO resources (resource_id, provider_id, external_id, env)
-					   VALUES ($1, $2, $3, $4)
+	err = tx.QueryRow(`INSERT INTO resources (resource_id, provider_id, external_id, plan, env)
+					   VALUES ($1, $2, $3, $4, $5)
 					   RETURNING created_at`,
-		r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env)).Scan(&r.CreatedAt)
+		r.ID, r.ProviderID, r.ExternalID, r.Plan, envHstore(r.Env)).Scan(&r.CreatedAt)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -74,7 +74,9 @@ func scanResource(s Scanner) (*ct.Resource, error) {
 	r := &ct.Resource{}
 	var env hstore.Hstore
 	var appIDs string
-	err := s.Scan(&r.ID, &r.ProviderID, &r.ExternalID, &env, &appIDs, &r.CreatedAt)
+	var plan sql.NullString
+	err := s.Scan(&r.ID, &r.ProviderID, &r.ExternalID, &plan, &env, &appIDs, &r.CreatedAt)
+	r.Plan = plan.String
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -94,7 +96,7 @@ func scanResource(s Scanner) (*ct.Resource, error) {
 }
 
 func (r *ResourceRepo) Get(id string) (*ct.Resource, error) {
-	row := r.db.QueryRow(`SELECT resource_id, provider_id, external_id, env,
+	row := r.db.QueryRow(`SELECT resource_id, provider_id, external_id, plan, env,
 								 ARRAY(SELECT app_id
 								       FROM app_resources a
 									   WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
@@ -106,7 +108,7 @@ func (r *ResourceRepo) Get(id string) (*ct.Resource, error) {
 }
 
 func (r *ResourceRepo) ProviderList(providerID string) ([]*ct.Resource, error) {
-	rows, err := r.db.Query(`SELECT resource_id, provider_id, external_id, env,
+	rows, err := r.db.Query(`SELECT resource_id, provider_id, external_id, plan, env,
 									ARRAY(SELECT a.app_id
 								          FROM app_resources a
                                           WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
@@ -135,7 +137,7 @@ func resourceList(rows *sql.Rows) ([]*ct.Resource, error) {
 }
 
 func (r *ResourceRepo) AppList(appID string) ([]*ct.Resource, error) {
-	rows, err := r.db.Query(`SELECT DISTINCT(r.resource_id), r.provider_id, r.external_id, r.env,
+	rows, err := r.db.Query(`SELECT DISTINCT(r.resource_id), r.provider_id, r.external_id, r.plan, r.env,
 									ARRAY(SELECT a.app_id
 									      FROM app_resources a 
 										  WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-flynn/resource"
+	"github.com/martini-contrib/render"
+)
+
+const resourceStatusTTL = 30 * time.Second
+
+// ResourceStatusCache caches resource statuses fetched from providers so that
+// repeated requests do not hit the provider each time.
+type ResourceStatusCache struct {
+	ttl      time.Duration
+	statuses map[string]*ct.ResourceStatus
+	mtx      sync.Mutex
+}
+
+func NewResourceStatusCache(ttl time.Duration) *ResourceStatusCache {
+	return &ResourceStatusCache{ttl: ttl, statuses: make(map[string]*ct.ResourceStatus)}
+}
+
+func (c *ResourceStatusCache) Get(p *ct.Provider, r *ct.Resource, dc resource.DiscoverdClient) *ct.ResourceStatus {
+	c.mtx.Lock()
+	status, ok := c.statuses[r.ID]
+	c.mtx.Unlock()
+	if ok && time.Since(*status.CheckedAt) < c.ttl {
+		return status
+	}
+
+	status, ok = fetchResourceStatus(p, r, dc)
+	if !ok {
+		// don't cache failures so the provider is retried on the next request
+		return status
+	}
+	c.mtx.Lock()
+	c.statuses[r.ID] = status
+	c.mtx.Unlock()
+	return status
+}
+
+// fetchResourceStatus queries GET <external id>/status on the provider host.
+// External IDs are paths which already include the path of the provider URL.
+// Errors are reported as an unavailable status rather than failing the
+// request, with ok set to false.
+func fetchResourceStatus(p *ct.Provider, r *ct.Resource, dc resource.DiscoverdClient) (status *ct.ResourceStatus, ok bool) {
+	now := time.Now()
+	status = &ct.ResourceStatus{ResourceID: r.ID, CheckedAt: &now}
+	unavailable := func(format string, v ...interface{}) (*ct.ResourceStatus, bool) {
+		status.State = ct.ResourceStateUnavailable
+		status.Message = fmt.Sprintf(format, v...)
+		return status, false
+	}
+
+	base, err := providerBaseURL(p.URL, dc)
+	if err != nil {
+		return unavailable("provider could not be resolved: %s", err)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return unavailable("provider url is invalid: %s", err)
+	}
+	ref, err := url.Parse(r.ExternalID + "/status")
+	if err != nil {
+		return unavailable("resource external id is invalid: %s", err)
+	}
+	res, err := providerHTTPClient.Get(u.ResolveReference(ref).String())
+	if err != nil {
+		return unavailable("provider is unreachable: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return unavailable("provider returned unexpected status %d", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(status); err != nil {
+		return unavailable("provider returned invalid status: %s", err)
+	}
+	switch status.State {
+	case ct.ResourceStateHealthy, ct.ResourceStateDegraded, ct.ResourceStateUnavailable:
+	default:
+		return unavailable("provider returned unknown state %q", status.State)
+	}
+	status.ResourceID = r.ID
+	status.CheckedAt = &now
+	return status, true
+}
+
+func getResourceStatus(p *ct.Provider, res *ct.Resource, cache *ResourceStatusCache, dc resource.DiscoverdClient, r render.Render) {
+	if p.Capabilities == nil || !p.Capabilities.Status {
+		r.JSON(501, struct{}{})
+		return
+	}
+	r.JSON(200, cache.Get(p, res, dc))
+}
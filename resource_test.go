@@ -51,6 +51,10 @@ func (d *resourceDiscoverd) NewServiceSet(name string) (discoverd.ServiceSet, er
 func (s *S) provisionTestResource(c *C, name string, apps []string) (*ct.Resource, *ct.Provider) {
 	data := []byte(`{"foo":"bar"}`)
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/things/capabilities" {
+			w.Write([]byte(`{"protocol_version":2,"provision":true}`))
+			return
+		}
 		c.Assert(req.URL.Path, Equals, "/things")
 		in, err := ioutil.ReadAll(req.Body)
 		c.Assert(err, IsNil)
@@ -103,7 +107,7 @@ func (s *S) TestProvisionResource(c *C) {
 
 func (s *S) TestPutResource(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "put-resource"})
-	provider := s.createTestProvider(c, &ct.Provider{URL: "https://example.ca", Name: "put-resource"})
+	provider := s.createTestProvider(c, &ct.Provider{URL: s.testProviderURL("example-ca"), Name: "put-resource"})
 
 	resource := &ct.Resource{
 		ExternalID: "/foo/bar",
@@ -153,3 +157,146 @@ func (s *S) TestResourceLists(c *C) {
 		c.Assert(list[0].Apps, DeepEquals, apps)
 	}
 }
+
+func (s *S) TestProvisionResourcePlan(c *C) {
+	var provisioned map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/postgres/capabilities" {
+			w.Write([]byte(`{"protocol_version":2,"provision":true}`))
+			return
+		}
+		provisioned = nil
+		c.Assert(json.NewDecoder(req.Body).Decode(&provisioned), IsNil)
+		w.Write([]byte(`{"id":"/postgres/db","env":{"PGDATABASE":"db"}}`))
+	}))
+	defer srv.Close()
+	s.m.MapTo(&resourceDiscoverd{
+		fn: func() []*discoverd.Service {
+			return []*discoverd.Service{{Addr: srv.Listener.Addr().String()}}
+		},
+	}, (*resource.DiscoverdClient)(nil))
+
+	provider := s.createTestProvider(c, &ct.Provider{
+		URL:  "discoverd+http://provision-plan/postgres",
+		Name: "provision-plan",
+		Plans: []ct.ProviderPlan{
+			{Name: "small", Description: "Shared instance"},
+			{Name: "large", Description: "Dedicated instance", Schema: map[string]ct.PlanParameter{
+				"storage_gb": {Type: "integer", Default: float64(100)},
+				"region":     {Type: "string", Required: true},
+			}},
+		},
+	})
+	c.Assert(provider.Plans, HasLen, 2)
+
+	path := "/providers/" + provider.ID + "/resources"
+	conf := json.RawMessage(`{"region":"us-east"}`)
+	out := &ct.Resource{}
+	res, err := s.Post(path, &ct.ResourceReq{Plan: "large", Config: &conf}, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.Plan, Equals, "large")
+	c.Assert(provisioned, DeepEquals, map[string]interface{}{"plan": "large", "region": "us-east", "storage_gb": float64(100)})
+
+	gotResource := &ct.Resource{}
+	_, err = s.Get(path+"/"+out.ID, gotResource)
+	c.Assert(err, IsNil)
+	c.Assert(gotResource.Plan, Equals, "large")
+
+	for _, t := range []struct {
+		plan   string
+		config string
+		field  string
+	}{
+		{"", `{}`, "plan"},
+		{"huge", `{}`, "plan"},
+		{"large", `{}`, "config"},
+		{"large", `{"region":1}`, "config"},
+		{"large", `{"region":"us-east","storage_gb":1.5}`, "config"},
+		{"small", `{"region":"us-east"}`, "config"},
+	} {
+		conf := json.RawMessage(t.config)
+		var e ct.ValidationError
+		res, err := s.send("POST", path, &ct.ResourceReq{Plan: t.plan, Config: &conf}, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+		c.Assert(json.NewDecoder(res.Body).Decode(&e), IsNil)
+		res.Body.Close()
+		c.Assert(e.Field, Equals, t.field)
+	}
+
+	res, err = s.send("POST", "/providers", &ct.Provider{
+		URL:   s.testProviderURL("invalid-plans"),
+		Name:  "invalid-plans",
+		Plans: []ct.ProviderPlan{{Name: "small", Schema: map[string]ct.PlanParameter{"size": {Type: "object"}}}},
+	}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	res.Body.Close()
+}
+
+func (s *S) TestResourceStatus(c *C) {
+	var requests, failures int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/capabilities", "/base/capabilities":
+			w.Write([]byte(`{"protocol_version":2,"provision":true,"status":true}`))
+		case "/dbs/status-db/status":
+			requests++
+			w.Write([]byte(`{"state":"healthy","usage":{"size_bytes":1024,"connections":3},"limits":{"connections":20}}`))
+		case "/base/dbs/based/status":
+			w.Write([]byte(`{"state":"degraded"}`))
+		default:
+			failures++
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	provider := s.createTestProvider(c, &ct.Provider{URL: srv.URL, Name: "resource-status"})
+	path := fmt.Sprintf("/providers/%s/resources/%s", provider.ID, utils.UUID())
+	resource := &ct.Resource{}
+	_, err := s.Put(path, &ct.Resource{ExternalID: "/dbs/status-db"}, resource)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		status := &ct.ResourceStatus{}
+		res, err := s.Get(path+"/status", status)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		c.Assert(status.ResourceID, Equals, resource.ID)
+		c.Assert(status.State, Equals, ct.ResourceStateHealthy)
+		c.Assert(status.Usage, DeepEquals, map[string]int64{"size_bytes": 1024, "connections": 3})
+		c.Assert(status.Limits, DeepEquals, map[string]int64{"connections": 20})
+	}
+	c.Assert(requests, Equals, 1)
+
+	path = fmt.Sprintf("/providers/%s/resources/%s", provider.ID, utils.UUID())
+	_, err = s.Put(path, &ct.Resource{ExternalID: "/dbs/missing"}, resource)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		status := &ct.ResourceStatus{}
+		_, err = s.Get(path+"/status", status)
+		c.Assert(err, IsNil)
+		c.Assert(status.State, Equals, ct.ResourceStateUnavailable)
+	}
+	// failures are not cached
+	c.Assert(failures, Equals, 2)
+
+	based := s.createTestProvider(c, &ct.Provider{URL: srv.URL + "/base", Name: "resource-status-based"})
+	path = fmt.Sprintf("/providers/%s/resources/%s", based.ID, utils.UUID())
+	// external IDs include the path of the provider URL
+	_, err = s.Put(path, &ct.Resource{ExternalID: "/base/dbs/based"}, resource)
+	c.Assert(err, IsNil)
+	status := &ct.ResourceStatus{}
+	_, err = s.Get(path+"/status", status)
+	c.Assert(err, IsNil)
+	c.Assert(status.State, Equals, ct.ResourceStateDegraded)
+
+	legacy := s.createTestProvider(c, &ct.Provider{URL: s.testProviderURL("legacy"), Name: "resource-status-legacy"})
+	path = fmt.Sprintf("/providers/%s/resources/%s", legacy.ID, utils.UUID())
+	_, err = s.Put(path, &ct.Resource{ExternalID: "/dbs/legacy"}, resource)
+	c.Assert(err, IsNil)
+	res, err := s.Get(path+"/status", status)
+	c.Assert(res.StatusCode, Equals, 501)
+}
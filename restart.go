@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/martini-contrib/render"
+)
+
+// restart performs a rolling restart of the jobs of the release of a
+// deployment. Jobs are stopped one at a time so that the scheduler replaces
+// them, process types in dependency order, and the next job is only stopped
+// once as many jobs of each type are running again. Like deployments,
+// restarts fail if the replacements crash or do not start in time, but there
+// is no release to roll back to.
+func (d *Deployer) restart(deployment *ct.Deployment, began time.Time) error {
+	release, err := d.releases.GetForApp(deployment.AppID, deployment.NewReleaseID)
+	if err != nil {
+		return err
+	}
+	order, err := utils.ProcessOrder(release.Processes)
+	if err != nil {
+		return err
+	}
+	jobs, err := d.runningJobs(deployment)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string][]string)
+	target := &ct.Formation{AppID: deployment.AppID, ReleaseID: deployment.NewReleaseID, Processes: make(map[string]int)}
+	for id, typ := range jobs {
+		ids[typ] = append(ids[typ], id)
+		target.Processes[typ]++
+	}
+
+	stopped := make(map[string]bool, len(jobs))
+	for _, typ := range order {
+		sort.Strings(ids[typ])
+		for _, id := range ids[typ] {
+			hostID, jobID, _ := utils.ParseJobID(id)
+			client, err := d.cc.DialHost(hostID)
+			if err != nil {
+				return err
+			}
+			err = client.StopJob(jobID)
+			client.Close()
+			if err != nil {
+				return err
+			}
+			stopped[id] = true
+			if err := d.wait(deployment, target, began, stopped); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runningJobs returns the types of the running jobs of the release of a
+// restart keyed by job ID, omitting one-off jobs and jobs of other types if
+// the restart is limited to a process type.
+func (d *Deployer) runningJobs(deployment *ct.Deployment) (map[string]string, error) {
+	hosts, err := d.cc.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make(map[string]string)
+	for hostID := range hosts {
+		client, err := d.cc.DialHost(hostID)
+		if err != nil {
+			return nil, err
+		}
+		active, err := client.ListJobs()
+		client.Close()
+		if err != nil {
+			return nil, err
+		}
+		for jobID, j := range active {
+			if j.Job == nil || j.Status != host.StatusRunning {
+				continue
+			}
+			attrs := j.Job.Attributes
+			typ := attrs["flynn-controller.type"]
+			if attrs["flynn-controller.app"] != deployment.AppID || attrs["flynn-controller.release"] != deployment.NewReleaseID ||
+				typ == "" || deployment.ProcessType != "" && typ != deployment.ProcessType {
+				continue
+			}
+			jobs[utils.FormatJobID(hostID, jobID)] = typ
+		}
+	}
+	return jobs, nil
+}
+
+// restartApp queues a rolling restart of the jobs of the current release of
+// an app, optionally limited to a process type, as a deployment which keeps
+// the release, and responds with the deployment.
+func restartApp(app *ct.App, apps *AppRepo, queue *DeploymentQueue, req *http.Request, r render.Render) {
+	release, err := apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		r.JSON(400, ct.ValidationError{Field: "app", Message: "has no release"})
+		return
+	} else if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	typ := req.URL.Query().Get("type")
+	if _, ok := release.Processes[typ]; typ != "" && !ok {
+		r.JSON(400, ct.ValidationError{Field: "type", Message: fmt.Sprintf("%q is not a process type of the release", typ)})
+		return
+	}
+	deployment := &ct.Deployment{
+		AppID:        app.ID,
+		OldReleaseID: release.ID,
+		NewReleaseID: release.ID,
+		Strategy:     ct.DeployRestart,
+		ProcessType:  typ,
+	}
+	if err := queue.Add(deployment); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, deployment)
+}
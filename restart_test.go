@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	controller "github.com/flynn/flynn-controller/client"
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-host/types"
+	. "github.com/titanous/gocheck"
+)
+
+// restartHostClient replaces stopped jobs with a running copy, like the
+// scheduler does, or a crashed one if crash is set.
+type restartHostClient struct {
+	*fakeHostClient
+	mtx     sync.Mutex
+	crash   bool
+	stopped []string
+}
+
+func (c *restartHostClient) ListJobs() (map[string]host.ActiveJob, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	jobs := make(map[string]host.ActiveJob, len(c.jobs))
+	for id, j := range c.jobs {
+		jobs[id] = j
+	}
+	return jobs, nil
+}
+
+func (c *restartHostClient) StopJob(id string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	j := c.jobs[id]
+	delete(c.jobs, id)
+	status := host.StatusRunning
+	if c.crash {
+		status = host.StatusCrashed
+	}
+	c.jobs[id+"-new"] = host.ActiveJob{Job: &host.Job{ID: id + "-new", Attributes: j.Job.Attributes}, Status: status, StartedAt: time.Now()}
+	c.stopped = append(c.stopped, id)
+	return c.fakeHostClient.StopJob(id)
+}
+
+func (c *restartHostClient) stops() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	stopped := c.stopped
+	c.stopped = nil
+	return stopped
+}
+
+func (s *S) TestRestartApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "restart-app"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {DependsOn: []string{"worker"}}, "worker": {}}})
+	s.setAppRelease(c, app.ID, release.ID)
+	attrs := func(typ string) map[string]string {
+		return map[string]string{"flynn-controller.app": app.ID, "flynn-controller.release": release.ID, "flynn-controller.type": typ}
+	}
+	hc := &restartHostClient{fakeHostClient: newFakeHostClient()}
+	hc.jobs = map[string]host.ActiveJob{
+		"web0":    {Job: &host.Job{ID: "web0", Attributes: attrs("web")}, Status: host.StatusRunning},
+		"web1":    {Job: &host.Job{ID: "web1", Attributes: attrs("web")}, Status: host.StatusRunning},
+		"worker0": {Job: &host.Job{ID: "worker0", Attributes: attrs("worker")}, Status: host.StatusRunning},
+		"run0":    {Job: &host.Job{ID: "run0", Attributes: attrs("")}, Status: host.StatusRunning},
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.cc.setHostClient("host0", hc)
+	defer s.cc.setHosts(nil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	deployment, err := client.RestartApp(app.ID, "web")
+	c.Assert(err, IsNil)
+	c.Assert(deployment.Strategy, Equals, ct.DeployRestart)
+	c.Assert(deployment.ProcessType, Equals, "web")
+	c.Assert(deployment.OldReleaseID, Equals, release.ID)
+	c.Assert(deployment.NewReleaseID, Equals, release.ID)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusComplete, Commentf(deployment.Error))
+	c.Assert(hc.stops(), DeepEquals, []string{"web0", "web1"})
+
+	// without a type, all process types are restarted in dependency order
+	// and one-off jobs are left alone
+	deployment, err = client.RestartApp(app.ID, "")
+	c.Assert(err, IsNil)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusComplete, Commentf(deployment.Error))
+	c.Assert(hc.stops(), DeepEquals, []string{"worker0", "web0-new", "web1-new"})
+
+	// restarts fail once the replacements keep crashing
+	defer func(n int) { deploymentMaxCrashes = n }(deploymentMaxCrashes)
+	deploymentMaxCrashes = 1
+	hc.mtx.Lock()
+	hc.crash = true
+	hc.mtx.Unlock()
+	deployment, err = client.RestartApp(app.ID, "web")
+	c.Assert(err, IsNil)
+	deployment = waitDeployment(c, client, app.ID, deployment.ID)
+	c.Assert(deployment.Status, Equals, ct.DeploymentStatusFailed)
+	c.Assert(strings.Contains(deployment.Error, "crashed"), Equals, true, Commentf(deployment.Error))
+	c.Assert(hc.stops(), DeepEquals, []string{"web0-new-new"})
+
+	_, err = client.RestartApp(app.ID, "db")
+	c.Assert(err, NotNil)
+}
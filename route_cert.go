@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	strowgerc "github.com/flynn/strowger/client"
+	"github.com/flynn/strowger/types"
+)
+
+const (
+	routeCertTask          = "route_certs"
+	routeCertInterval      = time.Hour
+	routeCertRenewBefore   = 30 * 24 * time.Hour
+	defaultCertHookTimeout = 2 * time.Minute
+)
+
+// CertificateProvider issues TLS certificates for the domains of routes with
+// managed TLS, for example using ACME.
+type CertificateProvider interface {
+	Certificate(domain string) (*ct.Certificate, error)
+}
+
+// RouteUpdater is implemented by router clients which can change existing
+// routes. Managed certificates cannot be installed without it.
+type RouteUpdater interface {
+	UpdateRoute(route *strowger.Route) error
+}
+
+var errRouteUpdateUnsupported = errors.New("controller: the router does not support updating routes")
+
+// updatesRoutes reports whether router can update routes, looking through
+// the circuit breaker which wraps the router client.
+func updatesRoutes(router strowgerc.Client) bool {
+	if b, ok := router.(*breakerRouter); ok {
+		router = b.Client
+	}
+	_, ok := router.(RouteUpdater)
+	return ok
+}
+
+// hookCertProvider requests certificates from an external service, such as
+// an ACME client, by posting a ct.RouteCertificateReq to its URL. The service
+// responds with a ct.Certificate once the certificate has been issued.
+type hookCertProvider struct {
+	url    string
+	client *http.Client
+}
+
+func newHookCertProvider(url string) *hookCertProvider {
+	return &hookCertProvider{url: url, client: &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: defaultCertHookTimeout}}}
+}
+
+// certProviderFromEnv returns a hook provider for CERT_PROVIDER_URL, or nil
+// if it is not set.
+func certProviderFromEnv() CertificateProvider {
+	url := os.Getenv("CERT_PROVIDER_URL")
+	if url == "" {
+		return nil
+	}
+	return newHookCertProvider(url)
+}
+
+func (p *hookCertProvider) Certificate(domain string) (*ct.Certificate, error) {
+	body, err := json.Marshal(&ct.RouteCertificateReq{Domain: domain})
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("certificate provider unavailable: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("certificate provider responded with status %d", res.StatusCode)
+	}
+	cert := &ct.Certificate{}
+	if err := json.NewDecoder(res.Body).Decode(cert); err != nil {
+		return nil, fmt.Errorf("invalid certificate provider response: %s", err)
+	}
+	return cert, nil
+}
+
+// RouteCertManager issues the TLS certificates of HTTP routes with managed
+// TLS, and renews them before they expire. Routes are checked by a periodic
+// task, which is triggered when routes with managed TLS are created.
+// The outcome of each renewal is recorded as a certificate event of the app.
+type RouteCertManager struct {
+	db       *DB
+	router   strowgerc.Client
+	routes   *RouteIndex
+	Provider CertificateProvider
+	runner   *TaskRunner
+}
+
+func NewRouteCertManager(db *DB, router strowgerc.Client, routes *RouteIndex, provider CertificateProvider, runner *TaskRunner) *RouteCertManager {
+	return &RouteCertManager{db: db, router: router, routes: routes, Provider: provider, runner: runner}
+}
+
+// Trigger checks the routes without waiting for the next periodic check.
+func (m *RouteCertManager) Trigger() {
+	m.runner.Trigger(routeCertTask)
+}
+
+// Run checks the routes as a periodic task.
+func (m *RouteCertManager) Run(*ct.Task) (interface{}, error) {
+	return nil, m.Check()
+}
+
+// Check renews the certificates of routes with managed TLS which have no
+// valid certificate or whose certificate expires soon. Failed renewals are
+// recorded and retried on the next check.
+func (m *RouteCertManager) Check() error {
+	if m.Provider == nil {
+		return nil
+	}
+	routes, err := m.router.ListRoutes("")
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		appID := routeAppID(route)
+		if route.Type != "http" || appID == "" {
+			continue
+		}
+		config, err := decodeHTTPRoute(route)
+		if err != nil || !config.ManagedTLS {
+			continue
+		}
+		if expires, err := certExpiry(config.TLSCert, config.TLSKey); err == nil && time.Now().Add(routeCertRenewBefore).Before(expires) {
+			continue
+		}
+		if err := m.renew(appID, route, config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renew installs a new certificate for a route, returning an error only if
+// the outcome could not be recorded.
+func (m *RouteCertManager) renew(appID string, route *strowger.Route, config *ct.HTTPRoute) error {
+	e := &ct.CertificateEvent{RouteID: route.ID, Domain: config.Domain, Status: ct.CertificateRenewed}
+	expires, err := m.install(route, config)
+	if err != nil {
+		log.Printf("error renewing certificate of route %s: %s", route.ID, err)
+		e.Status, e.Error = ct.CertificateFailed, err.Error()
+	} else {
+		e.Expires = &expires
+		if err := m.routes.Add(route); err != nil {
+			log.Println("error recording route event:", err)
+		}
+	}
+	data, err := appLogData(e)
+	if err != nil {
+		return err
+	}
+	return m.db.Exec(`INSERT INTO app_logs (app_id, log_id, event, object_id, data)
+SELECT $1::uuid, next_log_id($1::uuid), $2, $3, $4 WHERE EXISTS (SELECT 1 FROM apps WHERE app_id = $1::uuid)`,
+		appID, string(ct.EventTypeCertificate), route.ID, data)
+}
+
+func (m *RouteCertManager) install(route *strowger.Route, config *ct.HTTPRoute) (time.Time, error) {
+	updater, ok := m.router.(RouteUpdater)
+	if !ok {
+		return time.Time{}, errRouteUpdateUnsupported
+	}
+	cert, err := m.Provider.Certificate(config.Domain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expires, err := certExpiry(cert.Cert, cert.Key)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid certificate from provider: %s", err)
+	}
+	config.TLSCert, config.TLSKey = cert.Cert, cert.Key
+	data, err := json.Marshal(config)
+	if err != nil {
+		return time.Time{}, err
+	}
+	raw := json.RawMessage(data)
+	route.Config = &raw
+	return expires, updater.UpdateRoute(route)
+}
+
+// certExpiry returns when a PEM encoded certificate expires, checking that
+// it matches the key.
+func certExpiry(certPEM, keyPEM string) (time.Time, error) {
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+	strowgerc "github.com/flynn/strowger/client"
+	"github.com/flynn/strowger/types"
+)
+
+const (
+	routeIndexTask     = "route_index"
+	routeIndexInterval = 10 * time.Second
+)
+
+// RouteIndex records the routes of apps, adding route events to the app log
+// when routes are created, updated or deleted. Routes changed through the
+// controller are recorded as they change, and a periodic task syncs the
+// index with the router to pick up routes changed directly in the router.
+type RouteIndex struct {
+	db     *DB
+	router strowgerc.Client
+}
+
+func NewRouteIndex(db *DB, router strowgerc.Client) *RouteIndex {
+	return &RouteIndex{db: db, router: router}
+}
+
+// Run syncs the index as a periodic task.
+func (i *RouteIndex) Run(*ct.Task) (interface{}, error) {
+	return nil, i.Sync()
+}
+
+type indexedRoute struct {
+	appID string
+	data  string
+}
+
+// routeAppID returns the ID of the app a route belongs to, or an empty
+// string if it was not created for an app.
+func routeAppID(route *strowger.Route) string {
+	if !strings.HasPrefix(route.ParentRef, routeParentRefPrefix) {
+		return ""
+	}
+	id := strings.TrimPrefix(route.ParentRef, routeParentRefPrefix)
+	if !idPattern.MatchString(id) {
+		return ""
+	}
+	return cleanUUID(id)
+}
+
+// redactRoute returns a copy of a route without the TLS certificate and
+// private key of its config, which are not recorded in the index or in route
+// events.
+func redactRoute(route *strowger.Route) (*strowger.Route, error) {
+	if route.Config == nil {
+		return route, nil
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(*route.Config, &config); err != nil || config == nil {
+		// not an object, so it cannot contain TLS fields
+		return route, nil
+	}
+	if _, ok := config["tls_key"]; !ok {
+		if _, ok := config["tls_cert"]; !ok {
+			return route, nil
+		}
+	}
+	delete(config, "tls_key")
+	delete(config, "tls_cert")
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(data)
+	redacted := *route
+	redacted.Config = &raw
+	return &redacted, nil
+}
+
+// Sync replaces the index with the routes of the router.
+func (i *RouteIndex) Sync() error {
+	tx, err := i.begin()
+	if err != nil {
+		return err
+	}
+	// routes are listed with the index locked so that routes changed
+	// through the controller meanwhile are recorded once
+	routes, err := i.router.ListRoutes("")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	current := make(map[string]*strowger.Route, len(routes))
+	for _, route := range routes {
+		if routeAppID(route) != "" {
+			current[route.ID] = route
+		}
+	}
+
+	rows, err := tx.Query("SELECT route_id, app_id, data FROM route_index")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	previous := make(map[string]*indexedRoute)
+	for rows.Next() {
+		var id string
+		r := &indexedRoute{}
+		if err := rows.Scan(&id, &r.appID, &r.data); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		r.appID = cleanUUID(r.appID)
+		previous[id] = r
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for id, route := range current {
+		if err := i.add(tx, previous[id], route); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for id, prev := range previous {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		if err := i.remove(tx, id, prev); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Add records a route which was created or updated.
+func (i *RouteIndex) Add(route *strowger.Route) error {
+	tx, err := i.begin()
+	if err != nil {
+		return err
+	}
+	prev, err := i.get(tx, route.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := i.add(tx, prev, route); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove records a route which was deleted.
+func (i *RouteIndex) Remove(routeID string) error {
+	tx, err := i.begin()
+	if err != nil {
+		return err
+	}
+	prev, err := i.get(tx, routeID)
+	if err != nil || prev == nil {
+		tx.Rollback()
+		return err
+	}
+	if err := i.remove(tx, routeID, prev); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (i *RouteIndex) begin() (*dbTx, error) {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// changes are serialized so that each is recorded once
+	if _, err := tx.Exec("LOCK TABLE route_index IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (i *RouteIndex) get(tx *dbTx, routeID string) (*indexedRoute, error) {
+	r := &indexedRoute{}
+	err := tx.QueryRow("SELECT app_id, data FROM route_index WHERE route_id = $1", routeID).Scan(&r.appID, &r.data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r.appID = cleanUUID(r.appID)
+	return r, nil
+}
+
+// add indexes a route, recording a created or updated event unless it is
+// indexed as is.
+func (i *RouteIndex) add(tx *dbTx, prev *indexedRoute, route *strowger.Route) error {
+	appID := routeAppID(route)
+	route, err := redactRoute(route)
+	if err != nil {
+		return err
+	}
+	data, err := appLogData(route)
+	if err != nil {
+		return err
+	}
+	action := ct.RouteCreated
+	if prev != nil {
+		if prev.appID == appID && prev.data == data {
+			return nil
+		}
+		action = ct.RouteUpdated
+		_, err = tx.Exec("UPDATE route_index SET app_id = $2, data = $3, indexed_at = now() WHERE route_id = $1", route.ID, appID, data)
+	} else {
+		_, err = tx.Exec("INSERT INTO route_index (route_id, app_id, data) VALUES ($1, $2, $3)", route.ID, appID, data)
+	}
+	if err != nil {
+		return err
+	}
+	return routeEvent(tx, appID, &ct.RouteEvent{Action: action, Route: route})
+}
+
+// remove removes a route from the index, recording a deleted event with the
+// route as it was last indexed.
+func (i *RouteIndex) remove(tx *dbTx, routeID string, prev *indexedRoute) error {
+	if _, err := tx.Exec("DELETE FROM route_index WHERE route_id = $1", routeID); err != nil {
+		return err
+	}
+	route := &strowger.Route{}
+	if err := json.Unmarshal([]byte(prev.data), route); err != nil {
+		return err
+	}
+	return routeEvent(tx, prev.appID, &ct.RouteEvent{Action: ct.RouteDeleted, Route: route})
+}
+
+// routeEvent records a route event, unless the app does not exist, as routes
+// may outlive the apps they were created for.
+func routeEvent(tx *dbTx, appID string, e *ct.RouteEvent) error {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM apps WHERE app_id = $1)", appID).Scan(&exists); err != nil || !exists {
+		return err
+	}
+	data, err := appLogData(e)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(appLogInsert, appID, string(ct.EventTypeRoute), e.Route.ID, data)
+	return err
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"path"
+	"regexp"
+	"strings"
 
 	ct "github.com/flynn/flynn-controller/types"
 	strowgerc "github.com/flynn/strowger/client"
@@ -11,22 +17,223 @@ import (
 	"github.com/martini-contrib/render"
 )
 
-func createRoute(app *ct.App, router strowgerc.Client, route strowger.Route, r render.Render) {
+func createRoute(app *ct.App, router strowgerc.Client, route strowger.Route, admitter *Admitter, routes *RouteIndex, certs *RouteCertManager, w http.ResponseWriter, r render.Render) {
+	route.ParentRef = routeParentRef(app)
+	managedTLS := false
+	if route.Type == "http" {
+		err := prepareHTTPRoute(app, router, &route)
+		if e, ok := err.(RouteConflictError); ok {
+			w.Header().Set(ct.RouteConflictHeader, "true")
+			r.JSON(409, &e.Conflict)
+			return
+		} else if err != nil {
+			respondWithError(r, err)
+			return
+		}
+		config, _ := decodeHTTPRoute(&route)
+		if managedTLS = config.ManagedTLS; managedTLS && certs.Provider == nil {
+			respondWithError(r, ct.ValidationError{Field: "managed_tls", Message: "cannot be set, no certificate provider is configured"})
+			return
+		} else if managedTLS && !updatesRoutes(router) {
+			respondWithError(r, ct.ValidationError{Field: "managed_tls", Message: "cannot be set, the router does not support updating routes"})
+			return
+		}
+	}
+	if err := admitter.Admit("routes", "create", &route); err != nil {
+		respondWithError(r, err)
+		return
+	}
 	route.ParentRef = routeParentRef(app)
 	if err := router.CreateRoute(&route); err != nil {
 		log.Println(err)
 		r.JSON(500, struct{}{})
 		return
 	}
+	if err := routes.Add(&route); err != nil {
+		log.Println("error recording route event:", err)
+	}
+	if managedTLS {
+		certs.Trigger()
+	}
 	r.JSON(200, &route)
 }
 
+// RouterCapabilities is implemented by router clients which support HTTP
+// routes matching more than an exact domain. Wildcard domains and path
+// prefixes are rejected unless the router client reports supporting them.
+type RouterCapabilities interface {
+	WildcardDomains() bool
+	PathPrefixes() bool
+}
+
+// RouteConflictError is returned when creating an HTTP route with the same
+// domain and path as an existing route.
+type RouteConflictError struct {
+	Conflict ct.RouteConflict
+}
+
+func (e RouteConflictError) Error() string {
+	return fmt.Sprintf("controller: a route for %s%s already exists", e.Conflict.Domain, e.Conflict.Path)
+}
+
+var domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// prepareHTTPRoute validates and normalizes the config of an HTTP route, and
+// checks that no route of any app has the same domain and path, so that
+// conflicts are reported clearly rather than failing in the router.
+func prepareHTTPRoute(app *ct.App, router strowgerc.Client, route *strowger.Route) error {
+	config, err := decodeHTTPRoute(route)
+	if err != nil {
+		return ct.ValidationError{Field: "config", Message: "is invalid"}
+	}
+	caps, _ := router.(RouterCapabilities)
+
+	domain := routeDomain(config.Domain)
+	if domain == "" {
+		return ct.ValidationError{Field: "domain", Message: "must be set"}
+	}
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if label == "*" && i == 0 && len(labels) > 1 {
+			continue
+		}
+		if strings.Contains(label, "*") {
+			return ct.ValidationError{Field: "domain", Message: "may only be a wildcard in the first label, such as *.example.com"}
+		}
+		if !domainLabelPattern.MatchString(label) {
+			return ct.ValidationError{Field: "domain", Message: "is invalid"}
+		}
+	}
+	if labels[0] == "*" && (caps == nil || !caps.WildcardDomains()) {
+		return ct.ValidationError{Field: "domain", Message: "cannot be a wildcard, the router does not support wildcard domains"}
+	}
+
+	p := config.Path
+	if p != "" && p != "/" {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#") || path.Clean(p) != strings.TrimSuffix(p, "/") {
+			return ct.ValidationError{Field: "path", Message: "must be an absolute path such as /api/"}
+		}
+		if caps == nil || !caps.PathPrefixes() {
+			return ct.ValidationError{Field: "path", Message: "cannot be set, the router does not support path prefixes"}
+		}
+	}
+	p = routePath(p)
+
+	routes, err := router.ListRoutes("")
+	if err != nil {
+		return err
+	}
+	for _, existing := range routes {
+		if existing.Type != "http" {
+			continue
+		}
+		other, err := decodeHTTPRoute(existing)
+		if err != nil || routeDomain(other.Domain) != domain || routePath(other.Path) != p {
+			continue
+		}
+		conflict := ct.RouteConflict{Domain: domain, Path: p}
+		if existing.ParentRef == routeParentRef(app) {
+			conflict.RouteID = existing.ID
+		}
+		return RouteConflictError{Conflict: conflict}
+	}
+
+	config.Domain, config.Path = domain, p
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	raw := json.RawMessage(data)
+	route.Config = &raw
+	return nil
+}
+
+func decodeHTTPRoute(route *strowger.Route) (*ct.HTTPRoute, error) {
+	config := &ct.HTTPRoute{}
+	if route.Config == nil {
+		return config, nil
+	}
+	return config, json.Unmarshal(*route.Config, config)
+}
+
+// routeDomain returns a domain in the form routes are compared in.
+func routeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// routePath returns a path prefix in the form routes are compared in, which
+// ends with a slash so that /api matches /api/users but not /apis, or the
+// empty string for routes matching every path.
+func routePath(p string) string {
+	if p == "" || p == "/" {
+		return ""
+	}
+	return strings.TrimSuffix(p, "/") + "/"
+}
+
+// RouteStatser is implemented by router clients which report the traffic of
+// routes, as requests and server errors per second. App statuses omit route
+// traffic if the router client does not.
+type RouteStatser interface {
+	RouteStats(id string) (requestRate, errorRate float64, err error)
+}
+
+var errRouteStatsUnsupported = errors.New("controller: the router does not report route stats")
+
+// statsRoutes reports whether router reports route traffic, looking through
+// the circuit breaker which wraps the router client.
+func statsRoutes(router strowgerc.Client) bool {
+	if b, ok := router.(*breakerRouter); ok {
+		router = b.Client
+	}
+	_, ok := router.(RouteStatser)
+	return ok
+}
+
+// getAppStatus responds with the job summary and routes of an app, including
+// the traffic of each route if the router reports it.
+func getAppStatus(app *ct.App, index *JobIndex, router strowgerc.Client, r render.Render) {
+	jobs, err := index.Summary(app.ID)
+	if err != nil {
+		respondWithError(r, err)
+		return
+	}
+	routes, err := router.ListRoutes(routeParentRef(app))
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	status := &ct.AppStatus{App: app, Jobs: jobs, Routes: make([]*ct.RouteStatus, len(routes))}
+	var statser RouteStatser
+	if statsRoutes(router) {
+		statser = router.(RouteStatser)
+	}
+	for i, route := range routes {
+		status.Routes[i] = &ct.RouteStatus{Route: route}
+		if statser == nil {
+			continue
+		}
+		// traffic is best effort, the status is still useful without it
+		requestRate, errorRate, err := statser.RouteStats(route.ID)
+		if err != nil {
+			log.Printf("error getting stats of route %s: %s", route.ID, err)
+			continue
+		}
+		status.Routes[i].Traffic = &ct.RouteTraffic{RequestRate: requestRate, ErrorRate: errorRate}
+	}
+	r.JSON(200, status)
+}
+
 func routeID(params martini.Params) string {
 	return params["routes_type"] + "/" + params["routes_id"]
 }
 
+// routeParentRefPrefix is the prefix of the parent refs of app routes.
+const routeParentRefPrefix = "controller/apps/"
+
 func routeParentRef(app *ct.App) string {
-	return "controller/apps/" + app.ID
+	return routeParentRefPrefix + app.ID
 }
 
 func getRouteMiddleware(app *ct.App, c martini.Context, params martini.Params, router strowgerc.Client, w http.ResponseWriter) {
@@ -56,7 +263,7 @@ func getRouteList(app *ct.App, router strowgerc.Client, r render.Render) {
 	r.JSON(200, routes)
 }
 
-func deleteRoute(route *strowger.Route, router strowgerc.Client, w http.ResponseWriter) {
+func deleteRoute(app *ct.App, route *strowger.Route, router strowgerc.Client, routes *RouteIndex, w http.ResponseWriter) {
 	err := router.DeleteRoute(route.ID)
 	if err == strowgerc.ErrNotFound {
 		w.WriteHeader(404)
@@ -67,5 +274,8 @@ func deleteRoute(route *strowger.Route, router strowgerc.Client, w http.Response
 		w.WriteHeader(500)
 		return
 	}
+	if err := routes.Remove(route.ID); err != nil {
+		log.Println("error recording route event:", err)
+	}
 	w.WriteHeader(200)
 }
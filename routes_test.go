@@ -1,11 +1,23 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	controller "github.com/flynn/flynn-controller/client"
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
 	strowgerc "github.com/flynn/strowger/client"
@@ -20,6 +32,20 @@ func newFakeRouter() strowgerc.Client {
 type fakeRouter struct {
 	mtx    sync.RWMutex
 	routes map[string]*strowger.Route
+	stats  map[string]*ct.RouteTraffic
+}
+
+func (r *fakeRouter) RouteStats(id string) (float64, float64, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if _, ok := r.routes[id]; !ok {
+		return 0, 0, strowgerc.ErrNotFound
+	}
+	stats, ok := r.stats[id]
+	if !ok {
+		return 0, 0, errors.New("no stats")
+	}
+	return stats.RequestRate, stats.ErrorRate, nil
 }
 
 func (r *fakeRouter) CreateRoute(route *strowger.Route) error {
@@ -75,8 +101,27 @@ func (r *fakeRouter) ListRoutes(parentRef string) ([]*strowger.Route, error) {
 	return routes, nil
 }
 
+func (r *fakeRouter) UpdateRoute(route *strowger.Route) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	existing, ok := r.routes[route.ID]
+	if !ok {
+		return strowgerc.ErrNotFound
+	}
+	now := time.Now()
+	updated := *route
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = &now
+	r.routes[route.ID] = &updated
+	*route = updated
+	return nil
+}
+
 func (r *fakeRouter) Close() error { return nil }
 
+func (r *fakeRouter) WildcardDomains() bool { return true }
+func (r *fakeRouter) PathPrefixes() bool    { return true }
+
 func (s *S) createTestRoute(c *C, appID string, in *strowger.Route) *strowger.Route {
 	out := &strowger.Route{}
 	res, err := s.Post(fmt.Sprintf("/apps/%s/routes", appID), in, out)
@@ -97,6 +142,178 @@ func (s *S) TestCreateRoute(c *C) {
 	c.Assert(gotRoute, DeepEquals, route)
 }
 
+func (s *S) TestCreateHTTPRoute(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "create-http-route"})
+	other := s.createTestApp(c, &ct.App{Name: "create-http-route-other"})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	config := func(domain, path string) *ct.HTTPRoute {
+		return &ct.HTTPRoute{HTTPRoute: strowger.HTTPRoute{Service: "create-http-route", Domain: domain}, Path: path}
+	}
+
+	route, err := client.CreateHTTPRoute(app.ID, config("*.Create-HTTP-Route.example.com", "/api"))
+	c.Assert(err, IsNil)
+	got := &ct.HTTPRoute{}
+	c.Assert(json.Unmarshal(*route.Config, got), IsNil)
+	c.Assert(got.Domain, Equals, "*.create-http-route.example.com")
+	c.Assert(got.Path, Equals, "/api/")
+
+	// other paths of the domain can be routed
+	_, err = client.CreateHTTPRoute(other.ID, config("*.create-http-route.example.com", "/"))
+	c.Assert(err, IsNil)
+
+	_, err = client.CreateHTTPRoute(other.ID, config("*.create-http-route.example.com.", "/api/"))
+	c.Assert(err, DeepEquals, &controller.RouteConflictError{Domain: "*.create-http-route.example.com", Path: "/api/"})
+	_, err = client.CreateHTTPRoute(app.ID, config("*.create-http-route.example.com", "/api/"))
+	c.Assert(err, DeepEquals, &controller.RouteConflictError{Domain: "*.create-http-route.example.com", Path: "/api/", RouteID: route.ID})
+
+	for _, conf := range []*ct.HTTPRoute{
+		config("", ""),
+		config("foo.*.example.com", ""),
+		config("*foo.example.com", ""),
+		config("-foo.example.com", ""),
+		config("create-http-route.example.com", "api"),
+		config("create-http-route.example.com", "/api/../admin"),
+		config("create-http-route.example.com", "//api"),
+		config("create-http-route.example.com", "/api?foo"),
+	} {
+		data, err := json.Marshal(conf)
+		c.Assert(err, IsNil)
+		raw := json.RawMessage(data)
+		res, err := s.Post(fmt.Sprintf("/apps/%s/routes", app.ID), &strowger.Route{Type: "http", Config: &raw}, &strowger.Route{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400, Commentf("%s %s", conf.Domain, conf.Path))
+	}
+}
+
+func (s *S) TestHTTPRouteUnsupported(c *C) {
+	app := &ct.App{ID: utils.UUID()}
+	// hide the capabilities of the fake router
+	router := struct{ strowgerc.Client }{newFakeRouter()}
+	route := func(domain, path string) *strowger.Route {
+		data, err := json.Marshal(&ct.HTTPRoute{HTTPRoute: strowger.HTTPRoute{Domain: domain}, Path: path})
+		c.Assert(err, IsNil)
+		raw := json.RawMessage(data)
+		return &strowger.Route{Type: "http", Config: &raw}
+	}
+	c.Assert(prepareHTTPRoute(app, router, route("example.com", "/")), IsNil)
+	err := prepareHTTPRoute(app, router, route("*.example.com", ""))
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(err.(ct.ValidationError).Field, Equals, "domain")
+	err = prepareHTTPRoute(app, router, route("example.com", "/api/"))
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(err.(ct.ValidationError).Field, Equals, "path")
+}
+
+type fakeCertProvider struct {
+	expires time.Time
+	err     error
+	domains []string
+}
+
+func (p *fakeCertProvider) Certificate(domain string) (*ct.Certificate, error) {
+	p.domains = append(p.domains, domain)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return newTestCert(domain, p.expires)
+}
+
+func newTestCert(domain string, expires time.Time) (*ct.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     expires,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ct.Certificate{
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}, nil
+}
+
+func (s *S) TestManagedTLS(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "managed-tls"})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	config := &ct.HTTPRoute{HTTPRoute: strowger.HTTPRoute{Service: "managed-tls", Domain: "managed-tls.example.com"}, ManagedTLS: true}
+
+	certs := s.m.Get(reflect.TypeOf((*RouteCertManager)(nil))).Interface().(*RouteCertManager)
+	provider := certs.Provider
+	defer func() { certs.Provider = provider }()
+
+	// managed TLS requires a certificate provider
+	certs.Provider = nil
+	_, err = client.CreateHTTPRoute(app.ID, config)
+	c.Assert(err, NotNil)
+
+	p := &fakeCertProvider{expires: time.Now().Add(90 * 24 * time.Hour)}
+	certs.Provider = p
+	route, err := client.CreateHTTPRoute(app.ID, config)
+	c.Assert(err, IsNil)
+	c.Assert(certs.Check(), IsNil)
+	c.Assert(p.domains, DeepEquals, []string{"managed-tls.example.com"})
+
+	got := &strowger.Route{}
+	_, err = s.Get(fmt.Sprintf("/apps/%s/routes/%s", app.ID, route.ID), got)
+	c.Assert(err, IsNil)
+	gotConfig := &ct.HTTPRoute{}
+	c.Assert(json.Unmarshal(*got.Config, gotConfig), IsNil)
+	expires, err := certExpiry(gotConfig.TLSCert, gotConfig.TLSKey)
+	c.Assert(err, IsNil)
+	c.Assert(expires.Unix(), Equals, p.expires.Unix())
+
+	// valid certificates are not renewed until they expire soon
+	c.Assert(certs.Check(), IsNil)
+	c.Assert(p.domains, HasLen, 1)
+	p.expires = time.Now().Add(10 * 24 * time.Hour)
+	router := s.m.Get(reflect.TypeOf((*strowgerc.Client)(nil)).Elem()).Interface().(strowgerc.Client)
+	soon, err := newTestCert(gotConfig.Domain, p.expires)
+	c.Assert(err, IsNil)
+	gotConfig.TLSCert, gotConfig.TLSKey = soon.Cert, soon.Key
+	data, err := json.Marshal(gotConfig)
+	c.Assert(err, IsNil)
+	raw := json.RawMessage(data)
+	got.Config = &raw
+	c.Assert(router.(RouteUpdater).UpdateRoute(got), IsNil)
+	p.expires = time.Now().Add(90 * 24 * time.Hour)
+	p.err = errors.New("rate limited")
+	c.Assert(certs.Check(), IsNil)
+	c.Assert(p.domains, HasLen, 2)
+
+	events, err := client.AppEvents(app.ID, 0)
+	c.Assert(err, IsNil)
+	var statuses []ct.CertificateStatus
+	for _, e := range events {
+		// certificates and keys are not recorded in route events
+		c.Assert(strings.Contains(string(*e.Data), "tls_key"), Equals, false)
+		if e.ObjectType != ct.EventTypeCertificate {
+			continue
+		}
+		data := &ct.CertificateEvent{}
+		c.Assert(json.Unmarshal(*e.Data, data), IsNil)
+		c.Assert(data.RouteID, Equals, route.ID)
+		statuses = append(statuses, data.Status)
+		if data.Status == ct.CertificateFailed {
+			c.Assert(data.Error, Equals, "rate limited")
+		}
+	}
+	c.Assert(statuses, DeepEquals, []ct.CertificateStatus{ct.CertificateRenewed, ct.CertificateFailed})
+}
+
 func (s *S) TestDeleteRoute(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "delete-route"})
 	route := s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "foo"}).ToRoute())
@@ -128,3 +345,26 @@ func (s *S) TestListRoutes(c *C) {
 	c.Assert(routes[1].ID, Equals, route0.ID)
 	c.Assert(routes[0].ID, Equals, route1.ID)
 }
+
+func (s *S) TestAppStatus(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-status"})
+	busy := s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "app-status-busy"}).ToRoute())
+	idle := s.createTestRoute(c, app.ID, (&strowger.TCPRoute{Service: "app-status-idle"}).ToRoute())
+	router := s.m.Get(reflect.TypeOf((*strowgerc.Client)(nil)).Elem()).Interface().(*fakeRouter)
+	router.mtx.Lock()
+	router.stats = map[string]*ct.RouteTraffic{busy.ID: {RequestRate: 10, ErrorRate: 0.5}}
+	router.mtx.Unlock()
+	defer func() { router.stats = nil }()
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	status, err := client.AppStatus(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(status.App.ID, Equals, app.ID)
+	c.Assert(status.Jobs.Total, Equals, 0)
+	traffic := make(map[string]*ct.RouteTraffic)
+	for _, r := range status.Routes {
+		traffic[r.Route.ID] = r.Traffic
+	}
+	c.Assert(traffic, DeepEquals, map[string]*ct.RouteTraffic{busy.ID: {RequestRate: 10, ErrorRate: 0.5}, idle.ID: nil})
+}
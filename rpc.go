@@ -9,41 +9,59 @@ import (
 	rpc "github.com/flynn/rpcplus/comborpc"
 )
 
-func rpcHandler(repo *FormationRepo) http.Handler {
-	rpcplus.RegisterName("Controller", &ControllerRPC{formations: repo})
+func rpcHandler(formations *FormationRepo, policies *PolicyRepo) http.Handler {
+	rpcplus.RegisterName("Controller", &ControllerRPC{formations: formations, policies: policies})
 	return rpc.New(rpcplus.DefaultServer)
 }
 
 type ControllerRPC struct {
 	formations *FormationRepo
+	policies   *PolicyRepo
 }
 
 func (s *ControllerRPC) StreamFormations(since time.Time, stream rpcplus.Stream) error {
+	return s.StreamFormationUpdates(ct.StreamFormationsReq{Since: since}, stream)
+}
+
+// StreamFormationUpdates streams expanded formations updated since
+// req.Since. If req.CoalesceWindow is set, bursts of updates to the same
+// formation are coalesced and only the latest state is sent.
+func (s *ControllerRPC) StreamFormationUpdates(req ct.StreamFormationsReq, stream rpcplus.Stream) error {
 	ch := make(chan *ct.ExpandedFormation)
+	var updates <-chan *ct.ExpandedFormation = ch
+	if req.CoalesceWindow > 0 {
+		out := make(chan *ct.ExpandedFormation)
+		go coalesceFormations(ch, out, req.CoalesceWindow)
+		updates = out
+	}
+
 	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for {
 			select {
-			case f := <-ch:
+			case f, ok := <-updates:
+				if !ok {
+					return
+				}
 				select {
-				case stream.Send <- f:
+				case stream.Send <- normalizeTimes(f):
 				case <-stream.Error:
-					break
+					return
 				}
 			case <-stream.Error:
-				break
+				return
 			}
 		}
-		close(done)
 	}()
 
-	if err := s.formations.Subscribe(ch, since); err != nil {
+	if err := s.formations.Subscribe(ch, req.Since); err != nil {
 		return err
 	}
 	defer func() {
 		go func() {
 			// drain to prevent deadlock while removing the listener
-			for _ = range ch {
+			for _ = range updates {
 			}
 		}()
 		s.formations.Unsubscribe(ch)
@@ -53,3 +71,36 @@ func (s *ControllerRPC) StreamFormations(since time.Time, stream rpcplus.Stream)
 	<-done
 	return nil
 }
+
+func (s *ControllerRPC) StreamPolicies(arg struct{}, stream rpcplus.Stream) error {
+	ch := make(chan *ct.PolicySet)
+	if err := s.policies.Subscribe(ch); err != nil {
+		return err
+	}
+	defer func() {
+		go func() {
+			// drain to prevent deadlock while removing the listener
+			for _ = range ch {
+			}
+		}()
+		s.policies.Unsubscribe(ch)
+		close(ch)
+	}()
+
+	set, err := s.policies.Compile()
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case stream.Send <- set:
+		case <-stream.Error:
+			return nil
+		}
+		select {
+		case set = <-ch:
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
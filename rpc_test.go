@@ -64,3 +64,163 @@ func (s *S) TestFormationStreaming(c *C) {
 
 	client.Close()
 }
+
+func (s *S) TestFormationStreamingAppDelete(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "streamtest-app-delete"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	now := time.Now()
+	ch, _ := client.StreamFormations(&now)
+	for f := range ch {
+		if f.App == nil {
+			break
+		}
+	}
+
+	c.Assert(client.DeleteApp(app.ID), IsNil)
+
+	// the formation of the deleted app is deleted so that the scheduler
+	// stops its jobs
+	var out *ct.ExpandedFormation
+	select {
+	case out = <-ch:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for delete")
+	}
+	c.Assert(out.App.ID, Equals, app.ID)
+	c.Assert(out.Release.ID, Equals, release.ID)
+	c.Assert(out.Processes, IsNil)
+}
+
+func (s *S) TestFormationStreamingReleaseSwitch(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "streamtest-switch"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	now := time.Now()
+	ch, _ := client.StreamFormations(&now)
+	for f := range ch {
+		if f.App == nil {
+			break
+		}
+	}
+
+	newRelease := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, newRelease.ID)
+
+	var out *ct.ExpandedFormation
+	select {
+	case out = <-ch:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for release switch")
+	}
+	c.Assert(out.App.ID, Equals, app.ID)
+	c.Assert(out.Release.ID, Equals, newRelease.ID)
+	c.Assert(out.Processes, DeepEquals, map[string]int{"web": 2})
+	c.Assert(out.Replaces, Equals, release.ID)
+
+	// the removal of the previous formation is not sent separately
+	select {
+	case out = <-ch:
+		c.Fatalf("unexpected formation update for release %s", out.Release.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once published the replacement no longer hides a later delete of the
+	// previous formation
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	select {
+	case out = <-ch:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for formation update")
+	}
+	c.Assert(out.Release.ID, Equals, release.ID)
+	c.Assert(client.DeleteFormation(app.ID, release.ID), IsNil)
+	select {
+	case out = <-ch:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for delete")
+	}
+	c.Assert(out.Release.ID, Equals, release.ID)
+	c.Assert(out.Processes, IsNil)
+}
+
+func (s *S) TestFormationSnapshot(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-snapshot"})
+	releases := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		release := s.createTestRelease(c, &ct.Release{})
+		s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+		releases[release.ID] = true
+	}
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	// fetch one formation per page to walk the page tokens
+	formations, since, err := client.FormationSnapshot(1)
+	c.Assert(err, IsNil)
+	found := make(map[string]int)
+	for _, f := range formations {
+		if f.App.ID == app.ID {
+			found[f.Release.ID]++
+		}
+	}
+	c.Assert(found, HasLen, len(releases))
+	for id := range releases {
+		c.Assert(found[id], Equals, 1)
+	}
+
+	// changes made after the snapshot are streamed from its time
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	ch, _ := client.StreamFormations(&since)
+	var streamed bool
+	for f := range ch {
+		if f.App == nil {
+			break
+		}
+		if f.Release.ID == release.ID {
+			streamed = true
+		}
+	}
+	c.Assert(streamed, Equals, true)
+
+	res, _ := s.Get("/formations", nil)
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Get("/formations?expanded=true&page=foo", nil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestStreamHealth(c *C) {
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	events := make(chan *controller.StreamEvent, 10)
+	client.OnStreamEvent = func(e *controller.StreamEvent) { events <- e }
+
+	since := time.Now()
+	ch, _ := client.StreamFormations(&since)
+	e := <-events
+	c.Assert(e.Stream, Equals, controller.StreamNameFormations)
+	c.Assert(e.Type, Equals, controller.StreamConnected)
+
+	// the sentinel is the first event of the stream
+	<-ch
+	health := client.StreamHealth(controller.StreamNameFormations)
+	c.Assert(health.Connects, Equals, 1)
+	c.Assert(health.Events, Equals, int64(1))
+	c.Assert(health.LastEvent.IsZero(), Equals, false)
+
+	_, _ = client.StreamFormations(&since)
+	e = <-events
+	c.Assert(e.Type, Equals, controller.StreamReconnected)
+}
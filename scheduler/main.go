@@ -67,11 +67,77 @@ type clusterClient interface {
 	DialHost(id string) (cluster.Host, error)
 }
 
+const maxBatchGet = 100
+
+// prefetchReleases fetches the releases and artifacts of jobs without a known
+// formation in batches, so that syncCluster only falls back to fetching them
+// individually on error.
+func (c *context) prefetchReleases(hosts map[string]host.Host, releases map[string]*ct.Release, artifacts map[string]*ct.Artifact) {
+	g := grohl.NewContext(grohl.Data{"fn": "prefetchReleases"})
+
+	var releaseIDs []string
+	seen := make(map[string]struct{})
+	for _, h := range hosts {
+		for _, job := range h.Jobs {
+			appID := job.Attributes["flynn-controller.app"]
+			releaseID := job.Attributes["flynn-controller.release"]
+			if appID == "" || releaseID == "" || c.formations.Get(appID, releaseID) != nil {
+				continue
+			}
+			if _, ok := seen[releaseID]; !ok {
+				seen[releaseID] = struct{}{}
+				releaseIDs = append(releaseIDs, releaseID)
+			}
+		}
+	}
+
+	var artifactIDs []string
+	for _, ids := range batches(releaseIDs) {
+		list, err := c.GetReleases(ids)
+		if err != nil {
+			g.Log(grohl.Data{"at": "getReleases", "status": "error", "err": err})
+			return
+		}
+		for _, release := range list {
+			releases[release.ID] = release
+			if _, ok := seen[release.ArtifactID]; !ok {
+				seen[release.ArtifactID] = struct{}{}
+				artifactIDs = append(artifactIDs, release.ArtifactID)
+			}
+		}
+	}
+	for _, ids := range batches(artifactIDs) {
+		list, err := c.GetArtifacts(ids)
+		if err != nil {
+			g.Log(grohl.Data{"at": "getArtifacts", "status": "error", "err": err})
+			return
+		}
+		for _, artifact := range list {
+			artifacts[artifact.ID] = artifact
+		}
+	}
+}
+
+func batches(ids []string) [][]string {
+	var res [][]string
+	for len(ids) > maxBatchGet {
+		res = append(res, ids[:maxBatchGet])
+		ids = ids[maxBatchGet:]
+	}
+	if len(ids) > 0 {
+		res = append(res, ids)
+	}
+	return res
+}
+
 type controllerClient interface {
 	GetRelease(releaseID string) (*ct.Release, error)
 	GetArtifact(artifactID string) (*ct.Artifact, error)
+	GetReleases(releaseIDs []string) ([]*ct.Release, error)
+	GetArtifacts(artifactIDs []string) ([]*ct.Artifact, error)
 	GetFormation(appID, releaseID string) (*ct.Formation, error)
 	StreamFormations(since *time.Time) (<-chan *ct.ExpandedFormation, *error)
+	IssueCertificate(req *ct.CertificateReq) (*ct.Certificate, error)
 }
 
 func (c *context) syncCluster() {
@@ -86,6 +152,8 @@ func (c *context) syncCluster() {
 		// TODO: log/handle error
 	}
 
+	c.prefetchReleases(hosts, releases, artifacts)
+
 	for _, h := range hosts {
 		for _, job := range h.Jobs {
 			appID := job.Attributes["flynn-controller.app"]
@@ -129,7 +197,7 @@ func (c *context) syncCluster() {
 				}
 
 				f = NewFormation(c, &ct.ExpandedFormation{
-					App:       &ct.App{ID: appID},
+					App:       &ct.App{ID: appID, Name: job.Attributes["flynn-controller.app_name"]},
 					Release:   release,
 					Artifact:  artifact,
 					Processes: formation.Processes,
@@ -141,6 +209,9 @@ func (c *context) syncCluster() {
 			gg.Log(grohl.Data{"at": "addJob"})
 			j := f.jobs.Add(jobType, h.ID, job.ID)
 			j.Formation = f
+			// jobs which were started before the scheduler count as
+			// running for the types which depend on them
+			j.Running = true
 			c.jobs.Add(h.ID, job.ID, j)
 			rectify[f] = struct{}{}
 		}
@@ -163,16 +234,30 @@ func (c *context) watchFormations() {
 			// sentinel
 			continue
 		}
+		if ef.App.Maintenance {
+			// park the processes until maintenance mode is disabled
+			ef.Processes = nil
+		}
 		f := c.formations.Get(ef.App.ID, ef.Release.ID)
 		if f != nil {
 			g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "update"})
 			f.SetProcesses(ef.Processes)
+			f.SetAppEnv(ef.AppEnv)
+			f.SetRegistry(ef.RegistryConfig)
 		} else {
 			g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "new"})
 			f = NewFormation(c, ef)
 			c.formations.Add(f)
 		}
 		go f.Rectify()
+
+		if ef.Replaces != "" {
+			if prev := c.formations.Get(ef.App.ID, ef.Replaces); prev != nil {
+				g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Replaces, "at": "replaced"})
+				prev.SetProcesses(nil)
+				go prev.Rectify()
+			}
+		}
 	}
 
 	// TODO: log disconnect and restart
@@ -198,13 +283,17 @@ func (c *context) watchHost(id string) {
 	ch := make(chan *host.Event)
 	h.StreamEvents("all", ch)
 	for event := range ch {
-		if event.Event != "error" && event.Event != "stop" {
+		if event.Event != "start" && event.Event != "error" && event.Event != "stop" {
 			continue
 		}
 		job := c.jobs.Get(id, event.JobID)
 		if job == nil {
 			continue
 		}
+		if event.Event == "start" {
+			go job.Formation.JobStarted(job)
+			continue
+		}
 		g.Log(grohl.Data{"at": "remove", "job.id": event.JobID, "event": event.Event})
 
 		c.jobs.Remove(id, event.JobID)
@@ -319,9 +408,12 @@ func (fs *Formations) Delete(f *Formation) {
 func NewFormation(c *context, ef *ct.ExpandedFormation) *Formation {
 	return &Formation{
 		AppID:     ef.App.ID,
+		AppName:   ef.App.Name,
 		Release:   ef.Release,
 		Artifact:  ef.Artifact,
 		Processes: ef.Processes,
+		AppEnv:    ef.AppEnv,
+		Registry:  ef.RegistryConfig,
 		jobs:      make(jobTypeMap),
 		c:         c,
 	}
@@ -330,6 +422,10 @@ func NewFormation(c *context, ef *ct.ExpandedFormation) *Formation {
 type Job struct {
 	Type      string
 	Formation *Formation
+
+	// Running is set once the job has started, guarded by the mutex of
+	// the formation.
+	Running bool
 }
 
 type jobTypeMap map[string]map[jobKey]*Job
@@ -358,9 +454,12 @@ func (m jobTypeMap) Get(typ, host, id string) *Job {
 type Formation struct {
 	mtx       sync.Mutex
 	AppID     string
+	AppName   string
 	Release   *ct.Release
 	Artifact  *ct.Artifact
 	Processes map[string]int
+	AppEnv    map[string]string
+	Registry  *ct.RegistryConfig
 
 	jobs jobTypeMap
 	c    *context
@@ -376,6 +475,20 @@ func (f *Formation) SetProcesses(p map[string]int) {
 	f.mtx.Unlock()
 }
 
+// SetAppEnv sets the app-scoped environment used for new jobs.
+func (f *Formation) SetAppEnv(env map[string]string) {
+	f.mtx.Lock()
+	f.AppEnv = env
+	f.mtx.Unlock()
+}
+
+// SetRegistry sets the registry config used to pull the images of new jobs.
+func (f *Formation) SetRegistry(conf *ct.RegistryConfig) {
+	f.mtx.Lock()
+	f.Registry = conf
+	f.mtx.Unlock()
+}
+
 func (f *Formation) Rectify() {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
@@ -390,27 +503,99 @@ func (f *Formation) RemoveJob(typ, hostID, jobID string) {
 	f.rectify()
 }
 
+// JobStarted marks a job of the formation as running, starting the jobs of
+// the types which were waiting for it.
+func (f *Formation) JobStarted(job *Job) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	job.Running = true
+	f.rectify()
+}
+
 func (f *Formation) rectify() {
 	g := grohl.NewContext(grohl.Data{"fn": "rectify", "app.id": f.AppID, "release.id": f.Release.ID})
 
+	// start types after their dependencies and stop them before
+	order := f.processOrder()
+
+	// remove process types
+	for i := len(order) - 1; i >= 0; i-- {
+		t := order[i]
+		if _, exists := f.Processes[t]; !exists && len(f.jobs[t]) > 0 {
+			g.Log(grohl.Data{"at": "cleanup", "type": t, "count": len(f.jobs[t])})
+			f.remove(len(f.jobs[t]), t)
+		}
+	}
+
 	// update job counts
-	for t, expected := range f.Processes {
-		diff := expected - len(f.jobs[t])
-		g.Log(grohl.Data{"at": "update", "type": t, "expected": expected, "actual": len(f.jobs[t]), "diff": diff})
-		if diff > 0 {
-			f.add(diff, t)
-		} else if diff < 0 {
+	for i := len(order) - 1; i >= 0; i-- {
+		t := order[i]
+		if diff := f.Processes[t] - len(f.jobs[t]); diff < 0 {
+			g.Log(grohl.Data{"at": "update", "type": t, "expected": f.Processes[t], "actual": len(f.jobs[t]), "diff": diff})
 			f.remove(-diff, t)
 		}
 	}
+	for _, t := range order {
+		if diff := f.Processes[t] - len(f.jobs[t]); diff > 0 {
+			// the jobs are started once the types they depend on are
+			// running, by the rectify of JobStarted
+			if dep := f.waitingOn(t); dep != "" {
+				g.Log(grohl.Data{"at": "wait", "type": t, "depends_on": dep, "expected": f.Processes[dep], "running": f.running(dep)})
+				continue
+			}
+			g.Log(grohl.Data{"at": "update", "type": t, "expected": f.Processes[t], "actual": len(f.jobs[t]), "diff": diff})
+			f.add(diff, t)
+		}
+	}
+}
 
-	// remove process types
-	for t, jobs := range f.jobs {
-		if _, exists := f.Processes[t]; !exists {
-			g.Log(grohl.Data{"at": "cleanup", "type": t, "count": len(jobs)})
-			f.remove(len(jobs), t)
+// waitingOn returns a process type which typ depends on that does not have
+// as many running jobs as the formation specifies, or an empty string if
+// the jobs of typ can be started.
+func (f *Formation) waitingOn(typ string) string {
+	for _, dep := range f.Release.Processes[typ].DependsOn {
+		if f.running(dep) < f.Processes[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+// running returns the number of running jobs of a process type.
+func (f *Formation) running(typ string) int {
+	var n int
+	for _, job := range f.jobs[typ] {
+		if job.Running {
+			n++
+		}
+	}
+	return n
+}
+
+// processOrder returns the process types of the formation and its running
+// jobs in dependency order, see utils.ProcessOrder.
+func (f *Formation) processOrder() []string {
+	// releases are validated on creation, so errors are not expected
+	order, _ := utils.ProcessOrder(f.Release.Processes)
+	seen := make(map[string]bool, len(order))
+	for _, t := range order {
+		seen[t] = true
+	}
+	var extra []string
+	for t := range f.Processes {
+		if !seen[t] {
+			seen[t] = true
+			extra = append(extra, t)
 		}
 	}
+	for t := range f.jobs {
+		if !seen[t] {
+			seen[t] = true
+			extra = append(extra, t)
+		}
+	}
+	sort.Strings(extra)
+	return append(order, extra...)
 }
 
 func (f *Formation) add(n int, name string) {
@@ -420,8 +605,15 @@ func (f *Formation) add(n int, name string) {
 	if err != nil {
 		// TODO: log/handle error
 	}
+	env := config.Config.Env
 	for i := 0; i < n; i++ {
 		config.ID = cluster.RandomJobID("")
+		cert, err := f.c.IssueCertificate(&ct.CertificateReq{AppID: f.AppID, ReleaseID: f.Release.ID, Type: name})
+		if err != nil {
+			g.Log(grohl.Data{"at": "issueCertificate", "status": "error", "err": err})
+			continue
+		}
+		config.Config.Env = append(utils.FormatEnv(utils.CertEnv(cert)), env...)
 		hosts, err := f.c.ListHosts()
 		if err != nil {
 			// TODO: log/handle error
@@ -491,9 +683,11 @@ func (f *Formation) remove(n int, name string) {
 
 func (f *Formation) jobConfig(name string) (*host.Job, error) {
 	return utils.JobConfig(&ct.ExpandedFormation{
-		App:      &ct.App{ID: f.AppID},
-		Release:  f.Release,
-		Artifact: f.Artifact,
+		App:            &ct.App{ID: f.AppID, Name: f.AppName},
+		Release:        f.Release,
+		Artifact:       f.Artifact,
+		AppEnv:         f.AppEnv,
+		RegistryConfig: f.Registry,
 	}, name)
 }
 
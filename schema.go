@@ -134,5 +134,403 @@ $$ LANGUAGE plpgsql`,
 )`,
 		`CREATE INDEX ON app_resources (resource_id)`,
 	)
+	m.Add(2,
+		`CREATE TABLE certificate_authorities (
+    name text PRIMARY KEY,
+    cert text NOT NULL,
+    key text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+	)
+	m.Add(3,
+		`CREATE TABLE network_policies (
+    app_id uuid PRIMARY KEY REFERENCES apps (app_id),
+    ingress text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+
+		`CREATE FUNCTION notify_network_policy() RETURNS TRIGGER AS $$
+    BEGIN
+        PERFORM pg_notify('network_policies', NEW.app_id::text);
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+
+		`CREATE TRIGGER notify_network_policy
+    AFTER INSERT OR UPDATE ON network_policies
+    FOR EACH ROW EXECUTE PROCEDURE notify_network_policy()`,
+	)
+	m.Add(4,
+		`CREATE TABLE adopted_jobs (
+    host_id text NOT NULL,
+    job_id text NOT NULL,
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    release_id uuid NOT NULL REFERENCES releases (release_id),
+    type text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (host_id, job_id)
+)`,
+		`CREATE INDEX ON adopted_jobs (app_id)`,
+	)
+	m.Add(5,
+		`ALTER TABLE providers ADD COLUMN protocol_version integer NOT NULL DEFAULT 1`,
+		`ALTER TABLE providers ADD COLUMN capabilities text`,
+	)
+	m.Add(6,
+		`ALTER TABLE providers ADD COLUMN plans text`,
+		`ALTER TABLE resources ADD COLUMN plan text`,
+	)
+	m.Add(7,
+		`CREATE TABLE env_groups (
+    env_group_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name text NOT NULL,
+    env hstore,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE UNIQUE INDEX ON env_groups (name) WHERE deleted_at IS NULL`,
+
+		`CREATE TABLE app_env_groups (
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    env_group_id uuid NOT NULL REFERENCES env_groups (env_group_id),
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (app_id, env_group_id)
+)`,
+		`CREATE INDEX ON app_env_groups (env_group_id)`,
+	)
+	m.Add(8,
+		`CREATE TABLE tasks (
+    task_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    type text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    data text,
+    result text,
+    error text,
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL,
+    run_at timestamptz NOT NULL DEFAULT now(),
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    finished_at timestamptz
+)`,
+		`CREATE INDEX ON tasks (run_at) WHERE status = 'pending'`,
+	)
+	m.Add(9,
+		`CREATE TABLE cluster_read_only (
+    id bool PRIMARY KEY DEFAULT true CHECK (id),
+    enabled bool NOT NULL DEFAULT false,
+    reason text,
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`INSERT INTO cluster_read_only (enabled) VALUES (false)`,
+	)
+	m.Add(10,
+		`ALTER TABLE apps DROP CONSTRAINT apps_name_key`,
+		`CREATE UNIQUE INDEX ON apps (name) WHERE deleted_at IS NULL`,
+	)
+	m.Add(11,
+		`CREATE FUNCTION check_release_immutable() RETURNS TRIGGER AS $$
+    BEGIN
+        IF NEW.artifact_id IS DISTINCT FROM OLD.artifact_id OR NEW.data IS DISTINCT FROM OLD.data THEN
+            RAISE EXCEPTION 'releases are immutable';
+        END IF;
+        RETURN NEW;
+    END;
+$$ LANGUAGE plpgsql`,
+
+		`CREATE TRIGGER check_release_immutable
+    BEFORE UPDATE ON releases
+    FOR EACH ROW EXECUTE PROCEDURE check_release_immutable()`,
+	)
+	m.Add(12,
+		`CREATE INDEX ON apps USING gin (meta) WHERE deleted_at IS NULL`,
+	)
+	m.Add(13,
+		`ALTER TABLE formations ADD COLUMN replaces uuid`,
+
+		// A formation removed because another formation replaced it is
+		// published as part of the replacing formation's update.
+		`CREATE OR REPLACE FUNCTION notify_formation() RETURNS TRIGGER AS $$
+    BEGIN
+        IF NEW.deleted_at IS NOT NULL AND EXISTS (
+            SELECT 1 FROM formations
+            WHERE app_id = NEW.app_id AND replaces = NEW.release_id AND deleted_at IS NULL
+        ) THEN
+            RETURN NULL;
+        END IF;
+        PERFORM pg_notify('formations', NEW.app_id || ':' || NEW.release_id || COALESCE(':' || NEW.replaces, ''));
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+	)
+	m.Add(14,
+		`ALTER TABLE releases ADD COLUMN schema_version integer NOT NULL DEFAULT 1`,
+	)
+	m.Add(15,
+		`CREATE INDEX apps_name_prefix_idx ON apps (name text_pattern_ops) WHERE deleted_at IS NULL`,
+	)
+	m.Add(16,
+		`CREATE TABLE app_locks (
+    app_id uuid PRIMARY KEY REFERENCES apps (app_id),
+    lock_id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    holder text NOT NULL,
+    operation text,
+    ttl integer NOT NULL,
+    expires_at timestamptz NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+	)
+	m.Add(17,
+		`ALTER TABLE apps ADD COLUMN maintenance boolean NOT NULL DEFAULT false`,
+	)
+	m.Add(18,
+		`ALTER TABLE apps ADD COLUMN strategy text NOT NULL DEFAULT 'all-at-once'`,
+	)
+	m.Add(19,
+		`ALTER TABLE apps ADD COLUMN env hstore`,
+	)
+	m.Add(20,
+		`ALTER TABLE apps ADD COLUMN deleted_routes text`,
+	)
+	m.Add(21,
+		// Record changes to the release, env and formations of apps in
+		// app_logs so that the configuration of an app can be reconstructed
+		// as of a point in time.
+		`CREATE FUNCTION log_app_config() RETURNS TRIGGER AS $$
+    BEGIN
+        IF NEW.release_id IS NOT NULL AND (TG_OP = 'INSERT' OR NEW.release_id IS DISTINCT FROM OLD.release_id) THEN
+            INSERT INTO app_logs (app_id, log_id, event, subject_id, data)
+            VALUES (NEW.app_id, next_log_id(NEW.app_id), 'release', NEW.release_id, '{}');
+        END IF;
+        IF TG_OP = 'INSERT' OR NEW.env IS DISTINCT FROM OLD.env THEN
+            INSERT INTO app_logs (app_id, log_id, event, data)
+            VALUES (NEW.app_id, next_log_id(NEW.app_id), 'env', hstore_to_json(COALESCE(NEW.env, ''::hstore))::text);
+        END IF;
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+
+		`CREATE TRIGGER log_app_config
+    AFTER INSERT OR UPDATE ON apps
+    FOR EACH ROW EXECUTE PROCEDURE log_app_config()`,
+
+		`CREATE FUNCTION log_formation() RETURNS TRIGGER AS $$
+    BEGIN
+        IF TG_OP = 'INSERT' OR NEW.processes IS DISTINCT FROM OLD.processes OR NEW.deleted_at IS DISTINCT FROM OLD.deleted_at THEN
+            INSERT INTO app_logs (app_id, log_id, event, subject_id, data)
+            VALUES (NEW.app_id, next_log_id(NEW.app_id), 'formation', NEW.release_id, CASE
+                WHEN NEW.deleted_at IS NULL THEN hstore_to_json(COALESCE(NEW.processes, ''::hstore))::text
+                ELSE 'null'
+            END);
+        END IF;
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+
+		`CREATE TRIGGER log_formation
+    AFTER INSERT OR UPDATE ON formations
+    FOR EACH ROW EXECUTE PROCEDURE log_formation()`,
+
+		`CREATE INDEX ON app_logs (app_id, event, created_at)`,
+
+		// start the log with the current configuration
+		`INSERT INTO app_logs (app_id, log_id, event, subject_id, data)
+    SELECT app_id, next_log_id(app_id), 'release', release_id, '{}' FROM apps
+    WHERE release_id IS NOT NULL AND deleted_at IS NULL`,
+		`INSERT INTO app_logs (app_id, log_id, event, data)
+    SELECT app_id, next_log_id(app_id), 'env', hstore_to_json(COALESCE(env, ''::hstore))::text FROM apps
+    WHERE deleted_at IS NULL`,
+		`INSERT INTO app_logs (app_id, log_id, event, subject_id, data)
+    SELECT app_id, next_log_id(app_id), 'formation', release_id, hstore_to_json(COALESCE(processes, ''::hstore))::text FROM formations
+    WHERE deleted_at IS NULL`,
+	)
+	m.Add(22,
+		// job_index is a snapshot of the jobs running on the cluster which is
+		// refreshed by the controller leader, it is indexed for counting the
+		// jobs of an app by type and state.
+		`CREATE TABLE job_index (
+    host_id text NOT NULL,
+    job_id text NOT NULL,
+    app_id uuid NOT NULL,
+    release_id text,
+    type text NOT NULL,
+    state text NOT NULL,
+    started_at timestamptz,
+    indexed_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (host_id, job_id)
+)`,
+		`CREATE INDEX ON job_index (app_id, type, state)`,
+	)
+	m.Add(23,
+		// object_id identifies objects of app log events which are not
+		// referenced by subject_id, such as jobs and routes
+		`ALTER TABLE app_logs ADD COLUMN object_id text`,
+
+		`CREATE FUNCTION notify_app_log() RETURNS TRIGGER AS $$
+    BEGIN
+        PERFORM pg_notify('app_logs', NEW.app_id || ':' || NEW.log_id);
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+
+		`CREATE TRIGGER notify_app_log
+    AFTER INSERT ON app_logs
+    FOR EACH ROW EXECUTE PROCEDURE notify_app_log()`,
+	)
+	m.Add(24,
+		// spread is a JSON object of placement hints by process type
+		`ALTER TABLE formations ADD COLUMN spread text`,
+	)
+	m.Add(25,
+		// host_id is set once a job has been scheduled for the token
+		`CREATE TABLE job_reservations (
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    token text NOT NULL,
+    job_id text NOT NULL,
+    host_id text,
+    release_id uuid REFERENCES releases (release_id),
+    cmd text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (app_id, token)
+)`,
+	)
+	m.Add(26,
+		// app names are unique regardless of case, so apps whose names only
+		// differ in case from an older app are renamed with a suffix of
+		// their ID
+		`UPDATE apps a SET name = a.name || '-' || substr(replace(a.app_id::text, '-', ''), 1, 8)
+WHERE a.deleted_at IS NULL AND EXISTS (
+    SELECT 1 FROM apps b WHERE b.deleted_at IS NULL AND lower(b.name) = lower(a.name)
+    AND (b.created_at, b.app_id) < (a.created_at, a.app_id)
+)`,
+		`DROP INDEX apps_name_idx`,
+		`CREATE UNIQUE INDEX apps_lower_name_idx ON apps (lower(name)) WHERE deleted_at IS NULL`,
+		// name prefixes are matched regardless of case
+		`DROP INDEX apps_name_prefix_idx`,
+		`CREATE INDEX apps_lower_name_prefix_idx ON apps (lower(name) text_pattern_ops) WHERE deleted_at IS NULL`,
+	)
+	m.Add(27,
+		// env is the env of the group last applied to the release of the
+		// app, existing references are assumed to be up to date
+		`ALTER TABLE app_env_groups ADD COLUMN env hstore`,
+		`UPDATE app_env_groups a SET env = g.env FROM env_groups g WHERE g.env_group_id = a.env_group_id`,
+	)
+	m.Add(28,
+		// Clearing replaces once the replacement has been published is not
+		// itself published, as it does not change the formation.
+		`CREATE OR REPLACE FUNCTION notify_formation() RETURNS TRIGGER AS $$
+    BEGIN
+        IF TG_OP = 'UPDATE' AND OLD.replaces IS NOT NULL AND NEW.replaces IS NULL AND NEW.updated_at = OLD.updated_at THEN
+            RETURN NULL;
+        END IF;
+        IF NEW.deleted_at IS NOT NULL AND EXISTS (
+            SELECT 1 FROM formations
+            WHERE app_id = NEW.app_id AND replaces = NEW.release_id AND deleted_at IS NULL
+        ) THEN
+            RETURN NULL;
+        END IF;
+        PERFORM pg_notify('formations', NEW.app_id || ':' || NEW.release_id || COALESCE(':' || NEW.replaces, ''));
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`UPDATE formations SET replaces = NULL WHERE replaces IS NOT NULL`,
+	)
+	m.Add(29,
+		`CREATE TABLE release_tags (
+    tag text PRIMARY KEY,
+    release_id uuid NOT NULL REFERENCES releases (release_id),
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON release_tags (release_id)`,
+	)
+	m.Add(30,
+		`ALTER TABLE apps ADD COLUMN release_retention integer NOT NULL DEFAULT 0`,
+	)
+	m.Add(31,
+		`CREATE TABLE online_migrations (
+    name text PRIMARY KEY,
+    state text NOT NULL,
+    backfilled bigint NOT NULL DEFAULT 0,
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+	)
+	m.Add(32,
+		`CREATE TABLE deployments (
+    deployment_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    old_release_id uuid,
+    new_release_id uuid NOT NULL,
+    strategy text NOT NULL,
+    status text NOT NULL,
+    error text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    finished_at timestamptz
+)`,
+		`CREATE INDEX ON deployments (app_id, created_at)`,
+		`CREATE UNIQUE INDEX deployments_active_idx ON deployments (app_id) WHERE status IN ('pending', 'running')`,
+	)
+	m.Add(33,
+		`CREATE TABLE job_logs (
+    job_id text PRIMARY KEY,
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    data text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON job_logs (created_at)`,
+	)
+	m.Add(34,
+		`ALTER TABLE artifacts ADD COLUMN digest text`,
+		`ALTER TABLE artifacts ADD COLUMN size bigint`,
+	)
+	m.Add(35,
+		`CREATE TABLE route_index (
+    route_id text PRIMARY KEY,
+    app_id uuid NOT NULL,
+    data text NOT NULL,
+    indexed_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON route_index (app_id)`,
+	)
+	m.Add(36,
+		`CREATE TABLE registry_configs (
+    app_id uuid REFERENCES apps (app_id),
+    mirrors text NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE UNIQUE INDEX ON registry_configs (app_id)`,
+		`CREATE UNIQUE INDEX ON registry_configs ((app_id IS NULL)) WHERE app_id IS NULL`,
+	)
+	m.Add(37,
+		`ALTER TABLE deployments ADD COLUMN org text`,
+		`ALTER TABLE deployments ADD COLUMN queue_position integer`,
+		`DROP INDEX deployments_active_idx`,
+		`CREATE UNIQUE INDEX deployments_active_idx ON deployments (app_id) WHERE status IN ('queued', 'pending', 'running')`,
+		`CREATE INDEX ON deployments (created_at) WHERE status = 'queued'`,
+	)
+	m.Add(38,
+		`ALTER TABLE release_tags DROP CONSTRAINT release_tags_pkey`,
+		`ALTER TABLE release_tags ADD COLUMN app_id uuid REFERENCES apps (app_id)`,
+		// tags are kept for each app using the release, and dropped for
+		// releases no app uses
+		`INSERT INTO release_tags (app_id, tag, release_id, created_at)
+    SELECT DISTINCT a.app_id, t.tag, t.release_id, t.created_at FROM release_tags t
+    JOIN (SELECT app_id, release_id FROM apps UNION SELECT app_id, release_id FROM formations) a USING (release_id)`,
+		`DELETE FROM release_tags WHERE app_id IS NULL`,
+		`ALTER TABLE release_tags ALTER COLUMN app_id SET NOT NULL`,
+		`ALTER TABLE release_tags ADD PRIMARY KEY (app_id, tag)`,
+	)
+	m.Add(39,
+		// started is set once the job of a claimed token may have been
+		// started, existing claims are assumed to have been
+		`ALTER TABLE job_reservations ADD COLUMN started boolean NOT NULL DEFAULT true`,
+		`ALTER TABLE job_reservations ALTER COLUMN started SET DEFAULT false`,
+	)
+	m.Add(40,
+		// process_type limits restarts to the jobs of a process type
+		`ALTER TABLE deployments ADD COLUMN process_type text`,
+	)
 	return m.Migrate(db)
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+
+	strowgerc "github.com/flynn/strowger/client"
+)
+
+// maxShadowReads is the number of shadow reads run concurrently, reads made
+// while the limit is reached are dropped rather than queued.
+const maxShadowReads = 10
+
+// ShadowStats are the counters of shadow reads for a resource.
+type ShadowStats struct {
+	Compared   uint64 `json:"compared"`
+	Mismatches uint64 `json:"mismatches"`
+	Errors     uint64 `json:"errors"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// ShadowReader repeats get and list requests against alternative
+// repositories, such as a refactored implementation or a replica, compares
+// the results with those of the primary repository and logs mismatches.
+// Shadow reads run in the background and never affect responses.
+type ShadowReader struct {
+	repos map[string]Repository
+	sem   chan struct{}
+	wg    sync.WaitGroup
+
+	mtx   sync.Mutex
+	stats map[string]*ShadowStats
+}
+
+func NewShadowReader(repos map[string]Repository) *ShadowReader {
+	return &ShadowReader{
+		repos: repos,
+		sem:   make(chan struct{}, maxShadowReads),
+		stats: make(map[string]*ShadowStats),
+	}
+}
+
+// Get compares the primary result of getting id with the shadow repository
+// of the resource, if any.
+func (s *ShadowReader) Get(resource, id string, primary interface{}, primaryErr error) {
+	s.compare(resource, "get "+id, primary, primaryErr, func(repo Repository) (interface{}, error) {
+		return repo.Get(id)
+	})
+}
+
+// List compares the primary result of listing with query q with the shadow
+// repository of the resource, if any.
+func (s *ShadowReader) List(resource string, q url.Values, primary interface{}, primaryErr error) {
+	s.compare(resource, "list "+q.Encode(), primary, primaryErr, func(repo Repository) (interface{}, error) {
+		list, _, err := listRepo(repo, q)
+		return list, err
+	})
+}
+
+func (s *ShadowReader) compare(resource, op string, primary interface{}, primaryErr error, read func(Repository) (interface{}, error)) {
+	if s == nil {
+		return
+	}
+	repo, ok := s.repos[resource]
+	if !ok {
+		return
+	}
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		s.count(resource, func(st *ShadowStats) { st.Dropped++ })
+		return
+	}
+	// encode now as the primary result may be modified once the response
+	// has been written
+	expected, err := shadowResult(primary, primaryErr)
+	if err != nil {
+		<-s.sem
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.sem
+			s.wg.Done()
+		}()
+		actual, err := shadowResult(read(repo))
+		if err != nil {
+			log.Printf("shadow: resource=%s op=%q error=%q", resource, op, err)
+			s.count(resource, func(st *ShadowStats) { st.Compared++; st.Errors++ })
+			return
+		}
+		if !bytes.Equal(expected, actual) {
+			log.Printf("shadow: resource=%s op=%q mismatch primary=%s shadow=%s", resource, op, expected, actual)
+			s.count(resource, func(st *ShadowStats) { st.Compared++; st.Mismatches++ })
+			return
+		}
+		s.count(resource, func(st *ShadowStats) { st.Compared++ })
+	}()
+}
+
+// shadowResult encodes a read result for comparison, errors other than
+// ErrNotFound are returned so that they are not compared.
+func shadowResult(v interface{}, err error) ([]byte, error) {
+	if err == ErrNotFound {
+		return []byte("not found"), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (s *ShadowReader) count(resource string, f func(*ShadowStats)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st, ok := s.stats[resource]
+	if !ok {
+		st = &ShadowStats{}
+		s.stats[resource] = st
+	}
+	f(st)
+}
+
+func (s *ShadowReader) Stats() map[string]ShadowStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stats := make(map[string]ShadowStats, len(s.stats))
+	for resource, st := range s.stats {
+		stats[resource] = *st
+	}
+	return stats
+}
+
+// wait waits for running shadow reads to finish.
+func (s *ShadowReader) wait() {
+	s.wg.Wait()
+}
+
+var (
+	publishShadowStatsOnce sync.Once
+	shadowStatsReader      *ShadowReader
+	shadowStatsMtx         sync.Mutex
+)
+
+// publishShadowStats exposes the stats of s as the shadow_reads expvar.
+func publishShadowStats(s *ShadowReader) {
+	shadowStatsMtx.Lock()
+	shadowStatsReader = s
+	shadowStatsMtx.Unlock()
+	publishShadowStatsOnce.Do(func() {
+		expvar.Publish("shadow_reads", expvar.Func(func() interface{} {
+			shadowStatsMtx.Lock()
+			defer shadowStatsMtx.Unlock()
+			return shadowStatsReader.Stats()
+		}))
+	})
+}
+
+// newShadowRepos returns repositories of the given resources reading from
+// db, such as a replica of the primary database.
+func newShadowRepos(db *DB, router strowgerc.Client, resources []string) (map[string]Repository, error) {
+	repos := make(map[string]Repository, len(resources))
+	for _, resource := range resources {
+		var repo Repository
+		switch resource {
+		case "apps":
+			repo = NewAppRepo(db, "", router)
+		case "releases":
+			repo = NewReleaseRepo(db)
+		case "artifacts":
+			repo = NewArtifactRepo(db, nil)
+		case "providers":
+			repo = NewProviderRepo(db)
+		case "keys":
+			repo = NewKeyRepo(db)
+		case "tasks":
+			repo = NewTaskRepo(db)
+		default:
+			return nil, fmt.Errorf("controller: unknown shadow read resource %q", resource)
+		}
+		repos[resource] = repo
+	}
+	return repos, nil
+}
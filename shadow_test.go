@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+// fakeShadowRepo reads apps from the primary repo, renaming the app with ID
+// bad to simulate a divergent data path.
+type fakeShadowRepo struct {
+	*AppRepo
+	bad string
+}
+
+func (r *fakeShadowRepo) Get(id string) (interface{}, error) {
+	app, err := r.AppRepo.Get(id)
+	if err == nil && app.(*ct.App).ID == r.bad {
+		app.(*ct.App).Name = "diverged"
+	}
+	return app, err
+}
+
+func (s *S) TestShadowReads(c *C) {
+	good := s.createTestApp(c, &ct.App{Name: "shadow-good"})
+	bad := s.createTestApp(c, &ct.App{Name: "shadow-bad"})
+
+	apps := s.m.Get(reflect.TypeOf((*AppRepo)(nil))).Interface().(*AppRepo)
+	shadow := s.m.Get(reflect.TypeOf((*ShadowReader)(nil))).Interface().(*ShadowReader)
+	shadow.repos = map[string]Repository{"apps": &fakeShadowRepo{AppRepo: apps, bad: bad.ID}}
+	defer func() { shadow.repos = nil }()
+
+	gotApp := &ct.App{}
+	_, err := s.Get("/apps/"+good.ID, gotApp)
+	c.Assert(err, IsNil)
+	shadow.wait()
+	c.Assert(shadow.Stats()["apps"], DeepEquals, ShadowStats{Compared: 1})
+
+	// the response is served from the primary repository
+	_, err = s.Get("/apps/"+bad.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Name, Equals, "shadow-bad")
+	shadow.wait()
+	c.Assert(shadow.Stats()["apps"], DeepEquals, ShadowStats{Compared: 2, Mismatches: 1})
+
+	res, err := s.Get("/apps/does-not-exist", gotApp)
+	c.Assert(res.StatusCode, Equals, 404)
+	shadow.wait()
+	c.Assert(shadow.Stats()["apps"], DeepEquals, ShadowStats{Compared: 3, Mismatches: 1})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/martini-contrib/render"
+)
+
+const defaultSimChurnInterval = 10 * time.Second
+
+var errSimAttach = errors.New("controller: attach is not supported by the simulated cluster")
+
+// simCluster is a cluster client backed by synthetic hosts, used to load test
+// the API without real hardware. Added jobs start running immediately, and
+// while churn is enabled running jobs are stopped and replaced at random, as
+// if they had crashed and been restarted by the scheduler.
+type simCluster struct {
+	mtx    sync.RWMutex
+	hosts  map[string]*simHost
+	nextID int
+	conf   ct.SimClusterConfig
+	reset  chan struct{}
+}
+
+type simHost struct {
+	jobs        map[string]*host.ActiveJob
+	subscribers map[chan<- *host.Event]string
+}
+
+func newSimCluster(hosts int, churnRate float64, churnInterval time.Duration) *simCluster {
+	c := &simCluster{hosts: make(map[string]*simHost), reset: make(chan struct{}, 1)}
+	c.Configure(&ct.SimClusterConfig{Hosts: hosts, ChurnRate: churnRate, ChurnInterval: churnInterval})
+	go c.churnLoop()
+	return c
+}
+
+// Config returns the current configuration and the number of running jobs.
+func (c *simCluster) Config() *ct.SimClusterConfig {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	conf := c.conf
+	for _, h := range c.hosts {
+		conf.Jobs += len(h.jobs)
+	}
+	return &conf
+}
+
+// Configure changes the number of hosts and the churn of the cluster. Hosts
+// are removed newest first, along with their jobs.
+func (c *simCluster) Configure(conf *ct.SimClusterConfig) error {
+	if conf.Hosts < 0 {
+		return ct.ValidationError{Field: "hosts", Message: "must not be negative"}
+	}
+	if conf.ChurnRate < 0 || conf.ChurnRate > 1 {
+		return ct.ValidationError{Field: "churn_rate", Message: "must be between 0 and 1"}
+	}
+	if conf.ChurnInterval < 0 {
+		return ct.ValidationError{Field: "churn_interval", Message: "must not be negative"}
+	}
+	if conf.ChurnInterval == 0 {
+		conf.ChurnInterval = defaultSimChurnInterval
+	}
+
+	c.mtx.Lock()
+	for i := 0; i < conf.Hosts; i++ {
+		id := simHostID(i)
+		if _, ok := c.hosts[id]; !ok {
+			c.hosts[id] = &simHost{jobs: make(map[string]*host.ActiveJob), subscribers: make(map[chan<- *host.Event]string)}
+		}
+	}
+	for i := conf.Hosts; i < c.conf.Hosts; i++ {
+		delete(c.hosts, simHostID(i))
+	}
+	c.conf = ct.SimClusterConfig{Hosts: conf.Hosts, ChurnRate: conf.ChurnRate, ChurnInterval: conf.ChurnInterval}
+	c.mtx.Unlock()
+
+	select {
+	case c.reset <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func simHostID(i int) string {
+	return fmt.Sprintf("sim%d", i)
+}
+
+func (c *simCluster) ListHosts() (map[string]host.Host, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	hosts := make(map[string]host.Host, len(c.hosts))
+	for id, h := range c.hosts {
+		jobs := make([]*host.Job, 0, len(h.jobs))
+		for _, j := range h.jobs {
+			jobs = append(jobs, j.Job)
+		}
+		hosts[id] = host.Host{ID: id, Jobs: jobs}
+	}
+	return hosts, nil
+}
+
+func (c *simCluster) DialHost(id string) (cluster.Host, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if _, ok := c.hosts[id]; !ok {
+		return nil, fmt.Errorf("controller: unknown simulated host %q", id)
+	}
+	return &simHostClient{c: c, id: id}, nil
+}
+
+func (c *simCluster) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for hostID := range req.HostJobs {
+		if _, ok := c.hosts[hostID]; !ok {
+			return &host.AddJobsRes{}, nil
+		}
+	}
+	for hostID, jobs := range req.HostJobs {
+		for _, job := range jobs {
+			c.startJob(hostID, job)
+		}
+	}
+	state := make(map[string]host.Host, len(c.hosts))
+	for id, h := range c.hosts {
+		jobs := make([]*host.Job, 0, len(h.jobs))
+		for _, j := range h.jobs {
+			jobs = append(jobs, j.Job)
+		}
+		state[id] = host.Host{ID: id, Jobs: jobs}
+	}
+	return &host.AddJobsRes{Success: true, State: state}, nil
+}
+
+// startJob runs a job on a host with the lock held.
+func (c *simCluster) startJob(hostID string, job *host.Job) {
+	h := c.hosts[hostID]
+	j := &host.ActiveJob{Job: job, HostID: hostID, Status: host.StatusRunning, StartedAt: time.Now()}
+	h.jobs[job.ID] = j
+	c.publish(h, "start", j)
+}
+
+// stopJob stops a job on a host with the lock held.
+func (c *simCluster) stopJob(hostID, jobID string, status host.JobStatus) *host.ActiveJob {
+	h := c.hosts[hostID]
+	j, ok := h.jobs[jobID]
+	if !ok {
+		return nil
+	}
+	delete(h.jobs, jobID)
+	stopped := *j
+	stopped.Status = status
+	stopped.EndedAt = time.Now()
+	c.publish(h, "stop", &stopped)
+	return &stopped
+}
+
+// publish sends an event to the subscribers of a host, dropping it for
+// subscribers which are not keeping up so that the cluster never blocks.
+func (c *simCluster) publish(h *simHost, event string, j *host.ActiveJob) {
+	e := &host.Event{Event: event, JobID: j.Job.ID, Job: j}
+	for ch, jobID := range h.subscribers {
+		if jobID != "all" && jobID != j.Job.ID {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (c *simCluster) churnLoop() {
+	for {
+		c.mtx.RLock()
+		interval := c.conf.ChurnInterval
+		c.mtx.RUnlock()
+		select {
+		case <-time.After(interval):
+			c.churn()
+		case <-c.reset:
+		}
+	}
+}
+
+// churn replaces a random fraction of the running jobs of each host,
+// according to the churn rate.
+func (c *simCluster) churn() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conf.ChurnRate == 0 {
+		return
+	}
+	var replaced int
+	for hostID, h := range c.hosts {
+		ids := make([]string, 0, len(h.jobs))
+		for id := range h.jobs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if rand.Float64() >= c.conf.ChurnRate {
+				continue
+			}
+			stopped := c.stopJob(hostID, id, host.StatusCrashed)
+			c.nextID++
+			c.startJob(hostID, &host.Job{ID: fmt.Sprintf("%s-churn%d", id, c.nextID), Attributes: stopped.Job.Attributes})
+			replaced++
+		}
+	}
+	if replaced > 0 {
+		log.Printf("sim cluster: replaced %d jobs", replaced)
+	}
+}
+
+type simHostClient struct {
+	c  *simCluster
+	id string
+}
+
+func (h *simHostClient) ListJobs() (map[string]host.ActiveJob, error) {
+	h.c.mtx.RLock()
+	defer h.c.mtx.RUnlock()
+	sh, ok := h.c.hosts[h.id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	jobs := make(map[string]host.ActiveJob, len(sh.jobs))
+	for id, j := range sh.jobs {
+		jobs[id] = *j
+	}
+	return jobs, nil
+}
+
+func (h *simHostClient) GetJob(id string) (*host.ActiveJob, error) {
+	h.c.mtx.RLock()
+	defer h.c.mtx.RUnlock()
+	sh, ok := h.c.hosts[h.id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	j, ok := sh.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	job := *j
+	return &job, nil
+}
+
+func (h *simHostClient) StopJob(id string) error {
+	h.c.mtx.Lock()
+	defer h.c.mtx.Unlock()
+	if _, ok := h.c.hosts[h.id]; !ok {
+		return ErrNotFound
+	}
+	if h.c.stopJob(h.id, id, host.StatusDone) == nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// StreamEvents sends the events of the job with the given ID, or of all jobs
+// if id is "all", until the stream is closed.
+func (h *simHostClient) StreamEvents(id string, ch chan<- *host.Event) cluster.Stream {
+	h.c.mtx.Lock()
+	defer h.c.mtx.Unlock()
+	s := &simStream{c: h.c, hostID: h.id, ch: ch}
+	if sh, ok := h.c.hosts[h.id]; ok {
+		sh.subscribers[ch] = id
+	} else {
+		s.err = ErrNotFound
+	}
+	return s
+}
+
+func (h *simHostClient) Attach(req *host.AttachReq, wait bool) (cluster.ReadWriteCloser, func() error, error) {
+	return nil, nil, errSimAttach
+}
+
+func (h *simHostClient) Close() error { return nil }
+
+type simStream struct {
+	c      *simCluster
+	hostID string
+	ch     chan<- *host.Event
+	err    error
+}
+
+func (s *simStream) Close() error {
+	s.c.mtx.Lock()
+	defer s.c.mtx.Unlock()
+	if sh, ok := s.c.hosts[s.hostID]; ok {
+		delete(sh.subscribers, s.ch)
+	}
+	return nil
+}
+
+func (s *simStream) Err() error { return s.err }
+
+func getSimCluster(sim *simCluster, r render.Render) {
+	r.JSON(200, sim.Config())
+}
+
+func setSimCluster(conf ct.SimClusterConfig, sim *simCluster, r render.Render) {
+	if err := sim.Configure(&conf); err != nil {
+		respondWithError(r, err)
+		return
+	}
+	r.JSON(200, sim.Config())
+}
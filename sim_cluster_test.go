@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-host/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestSimCluster(c *C) {
+	sim := newSimCluster(2, 0, 0)
+	res, err := sim.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{
+		"sim0": {{ID: "job0", Attributes: map[string]string{"flynn-controller.type": "web"}}},
+		"sim1": {{ID: "job1"}, {ID: "job2"}},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(res.Success, Equals, true)
+	c.Assert(sim.Config().Jobs, Equals, 3)
+
+	// jobs cannot be added to unknown hosts
+	res, err = sim.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{"sim2": {{ID: "job3"}}}})
+	c.Assert(err, IsNil)
+	c.Assert(res.Success, Equals, false)
+
+	client, err := sim.DialHost("sim0")
+	c.Assert(err, IsNil)
+	events := make(chan *host.Event, 2)
+	stream := client.StreamEvents("all", events)
+	defer stream.Close()
+
+	// with a churn rate of 1 every job is replaced, keeping its attributes
+	c.Assert(sim.Configure(&ct.SimClusterConfig{Hosts: 2, ChurnRate: 1, ChurnInterval: time.Hour}), IsNil)
+	sim.churn()
+	c.Assert((<-events).Event, Equals, "stop")
+	e := <-events
+	c.Assert(e.Event, Equals, "start")
+	c.Assert(e.JobID, Not(Equals), "job0")
+	c.Assert(e.Job.Job.Attributes["flynn-controller.type"], Equals, "web")
+	jobs, err := client.ListJobs()
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(sim.Config().Jobs, Equals, 3)
+
+	c.Assert(sim.Configure(&ct.SimClusterConfig{Hosts: 1}), IsNil)
+	hosts, err := sim.ListHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, HasLen, 1)
+	c.Assert(sim.Config().Jobs, Equals, 1)
+	c.Assert(sim.Configure(&ct.SimClusterConfig{Hosts: 1, ChurnRate: 2}), NotNil)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/martini-contrib/render"
+)
+
+// streamLagWarning is how long an update can wait to be received by a stream
+// subscriber before a warning is logged.
+var streamLagWarning = 10 * time.Second
+
+// subscriberStats tracks the updates that have been published to a stream
+// subscriber but not yet received by it, both those in the buffer of its
+// channel and those waiting for room in it.
+type subscriberStats struct {
+	id           uint64
+	subscribedAt time.Time
+	ch           chan<- *ct.ExpandedFormation
+
+	mtx     sync.Mutex
+	nextSeq uint64
+	pending map[uint64]time.Time
+	sent    uint64
+}
+
+func newSubscriberStats(id uint64, ch chan<- *ct.ExpandedFormation) *subscriberStats {
+	return &subscriberStats{id: id, subscribedAt: time.Now(), ch: ch, pending: make(map[uint64]time.Time)}
+}
+
+// queue records an update waiting to be sent, and returns a sequence number
+// to pass to done once it has been received.
+func (s *subscriberStats) queue() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	seq := s.nextSeq
+	s.nextSeq++
+	s.pending[seq] = time.Now()
+	return seq
+}
+
+func (s *subscriberStats) done(seq uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.pending, seq)
+	s.sent++
+}
+
+func (s *subscriberStats) snapshot(stream string) *ct.StreamSubscriber {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sub := &ct.StreamSubscriber{
+		ID:           s.id,
+		Stream:       stream,
+		SubscribedAt: s.subscribedAt,
+		Buffered:     len(s.ch) + len(s.pending),
+		Sent:         s.sent,
+	}
+	now := time.Now()
+	for _, t := range s.pending {
+		if lag := now.Sub(t); lag > sub.Lag {
+			sub.Lag = lag
+		}
+	}
+	return sub
+}
+
+// sendFormation sends f to a subscriber, logging a warning if the
+// subscriber takes longer than streamLagWarning to receive it.
+func sendFormation(ch chan<- *ct.ExpandedFormation, stats *subscriberStats, f *ct.ExpandedFormation) {
+	seq := stats.queue()
+	defer stats.done(seq)
+	select {
+	case ch <- f:
+		return
+	case <-time.After(streamLagWarning):
+	}
+	sub := stats.snapshot("formations")
+	log.Printf("formation stream subscriber %d is falling behind: %d updates buffered, oldest waiting %s", sub.ID, sub.Buffered, sub.Lag)
+	ch <- f
+}
+
+// StreamStats returns the state of all formation stream subscribers ordered
+// by ID.
+func (r *FormationRepo) StreamStats() []*ct.StreamSubscriber {
+	r.subMtx.RLock()
+	defer r.subMtx.RUnlock()
+	subs := make([]*ct.StreamSubscriber, 0, len(r.subscriptions))
+	for _, stats := range r.subscriptions {
+		subs = append(subs, stats.snapshot("formations"))
+	}
+	sort.Sort(subscribersByID(subs))
+	return subs
+}
+
+type subscribersByID []*ct.StreamSubscriber
+
+func (p subscribersByID) Len() int           { return len(p) }
+func (p subscribersByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p subscribersByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+var (
+	publishStreamStatsOnce sync.Once
+	streamStatsRepo        *FormationRepo
+	streamStatsMtx         sync.Mutex
+)
+
+// publishStreamStats exposes the formation stream subscriber stats of repo
+// as the formation_streams expvar.
+func publishStreamStats(repo *FormationRepo) {
+	streamStatsMtx.Lock()
+	streamStatsRepo = repo
+	streamStatsMtx.Unlock()
+	publishStreamStatsOnce.Do(func() {
+		expvar.Publish("formation_streams", expvar.Func(func() interface{} {
+			streamStatsMtx.Lock()
+			defer streamStatsMtx.Unlock()
+			return streamStatsRepo.StreamStats()
+		}))
+	})
+}
+
+func getStreamStats(formations *FormationRepo, r render.Render) {
+	r.JSON(200, map[string][]*ct.StreamSubscriber{"formations": formations.StreamStats()})
+}
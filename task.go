@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-sql"
+)
+
+const (
+	taskPollInterval   = 5 * time.Second
+	defaultTaskRetries = 5
+	maxTaskBackoff     = 5 * time.Minute
+)
+
+type TaskRepo struct {
+	db *DB
+}
+
+func NewTaskRepo(db *DB) *TaskRepo {
+	return &TaskRepo{db}
+}
+
+const taskColumns = "task_id, type, status, data, result, error, attempts, max_attempts, run_at, created_at, updated_at, finished_at"
+
+func (r *TaskRepo) Add(t *ct.Task) error {
+	if t.MaxAttempts == 0 {
+		t.MaxAttempts = defaultTaskRetries
+	}
+	var data []byte
+	if t.Data != nil {
+		data = *t.Data
+	}
+	added, err := scanTask(r.db.QueryRow("INSERT INTO tasks (type, data, max_attempts) VALUES ($1, $2, $3) RETURNING "+taskColumns,
+		t.Type, data, t.MaxAttempts))
+	if err != nil {
+		return err
+	}
+	*t = *added
+	return nil
+}
+
+func scanTask(s Scanner) (*ct.Task, error) {
+	t := &ct.Task{}
+	var data, result []byte
+	var taskErr sql.NullString
+	err := s.Scan(&t.ID, &t.Type, &t.Status, &data, &result, &taskErr, &t.Attempts, &t.MaxAttempts, &t.RunAt, &t.CreatedAt, &t.UpdatedAt, &t.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if len(data) > 0 {
+		raw := json.RawMessage(data)
+		t.Data = &raw
+	}
+	if len(result) > 0 {
+		raw := json.RawMessage(result)
+		t.Result = &raw
+	}
+	t.ID = cleanUUID(t.ID)
+	t.Error = taskErr.String
+	return t, nil
+}
+
+func (r *TaskRepo) Get(id string) (interface{}, error) {
+	return scanTask(r.db.QueryRow("SELECT "+taskColumns+" FROM tasks WHERE task_id = $1", id))
+}
+
+func (r *TaskRepo) List() (interface{}, error) {
+	rows, err := r.db.Query("SELECT " + taskColumns + " FROM tasks ORDER BY created_at DESC LIMIT 100")
+	if err != nil {
+		return nil, err
+	}
+	tasks := []*ct.Task{}
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// Claim marks the next due pending task as running and returns it, or
+// returns ErrNotFound if there are no tasks to run.
+func (r *TaskRepo) Claim() (*ct.Task, error) {
+	return scanTask(r.db.QueryRow(`UPDATE tasks SET status = 'running', attempts = attempts + 1, updated_at = now()
+		WHERE task_id = (SELECT task_id FROM tasks WHERE status = 'pending' AND run_at <= now() ORDER BY run_at LIMIT 1 FOR UPDATE)
+		RETURNING ` + taskColumns))
+}
+
+func (r *TaskRepo) Succeed(id string, result []byte) error {
+	return r.db.Exec("UPDATE tasks SET status = 'succeeded', result = $2, error = NULL, updated_at = now(), finished_at = now() WHERE task_id = $1", id, result)
+}
+
+func (r *TaskRepo) Fail(id string, err error) error {
+	return r.db.Exec("UPDATE tasks SET status = 'failed', error = $2, updated_at = now(), finished_at = now() WHERE task_id = $1", id, err.Error())
+}
+
+func (r *TaskRepo) Retry(id string, err error, runAt time.Time) error {
+	return r.db.Exec("UPDATE tasks SET status = 'pending', error = $2, run_at = $3, updated_at = now() WHERE task_id = $1", id, err.Error(), runAt)
+}
+
+// Schedule adds a task of a periodic type unless one is already pending or
+// running.
+func (r *TaskRepo) Schedule(typ string) error {
+	return r.db.Exec(`INSERT INTO tasks (type, max_attempts) SELECT $1, $2
+		WHERE NOT EXISTS (SELECT 1 FROM tasks WHERE type = $1 AND status IN ('pending', 'running'))`, typ, defaultTaskRetries)
+}
+
+// Reschedule records the outcome of a run of a periodic task and returns it
+// to the queue to run again at runAt. Attempts count the runs which failed
+// in a row.
+func (r *TaskRepo) Reschedule(id string, result []byte, taskErr error, runAt time.Time) error {
+	var msg *string
+	if taskErr != nil {
+		s := taskErr.Error()
+		msg = &s
+	}
+	return r.db.Exec(`UPDATE tasks SET status = 'pending', result = $2, error = $3,
+		attempts = CASE WHEN $3::text IS NULL THEN 0 ELSE attempts END, run_at = $4, updated_at = now(), finished_at = now()
+		WHERE task_id = $1`, id, result, msg, runAt)
+}
+
+// Trigger makes the pending task of a periodic type due, returning false if
+// it has no pending task.
+func (r *TaskRepo) Trigger(typ string) (bool, error) {
+	var id string
+	err := r.db.QueryRow("UPDATE tasks SET run_at = now(), updated_at = now() WHERE type = $1 AND status = 'pending' RETURNING task_id", typ).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Requeue returns tasks left running by a previous leader to the queue,
+// except those with the given IDs which are still running.
+func (r *TaskRepo) Requeue(running []string) error {
+	return r.db.Exec("UPDATE tasks SET status = 'pending', updated_at = now() WHERE status = 'running' AND NOT task_id = ANY($1::uuid[])", uuidArray(running))
+}
+
+// TaskFunc performs a task, returning a JSON encodable result.
+type TaskFunc func(task *ct.Task) (interface{}, error)
+
+// TaskRunner executes queued tasks on the controller leader, retrying failed
+// tasks with exponential backoff until they exhaust their attempts. Periodic
+// tasks replace the background loops of the leader, so that their runs are
+// recorded and retried like other tasks.
+type TaskRunner struct {
+	repo     *TaskRepo
+	isLeader func() bool
+
+	handlers   map[string]TaskFunc
+	concurrent map[string]bool
+	periodic   map[string]time.Duration
+	stepDown   []func()
+	mtx        sync.RWMutex
+
+	// triggered is the periodic task types which were triggered while
+	// running, which run again straight away
+	triggered    map[string]bool
+	triggeredMtx sync.Mutex
+
+	// running is the IDs of the concurrent tasks running in the
+	// background, which are not requeued if leadership is regained while
+	// they run
+	running    map[string]bool
+	runningMtx sync.Mutex
+
+	wake chan struct{}
+	stop chan struct{}
+}
+
+func NewTaskRunner(repo *TaskRepo, isLeader func() bool) *TaskRunner {
+	if isLeader == nil {
+		isLeader = func() bool { return true }
+	}
+	return &TaskRunner{
+		repo:       repo,
+		isLeader:   isLeader,
+		handlers:   make(map[string]TaskFunc),
+		concurrent: make(map[string]bool),
+		periodic:   make(map[string]time.Duration),
+		triggered:  make(map[string]bool),
+		running:    make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+func (r *TaskRunner) Register(typ string, f TaskFunc) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handlers[typ] = f
+}
+
+// RegisterConcurrent registers a task type whose tasks run alongside other
+// tasks rather than in turn, for long running tasks which would otherwise
+// hold up the queue.
+func (r *TaskRunner) RegisterConcurrent(typ string, f TaskFunc) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handlers[typ] = f
+	r.concurrent[typ] = true
+}
+
+// RegisterPeriodic registers a task type which runs every interval on the
+// controller leader. A single task of the type is kept in the queue, which
+// is rescheduled after each run with the result or error of the run. Failed
+// runs are retried with backoff, but no later than the next run. Periodic
+// tasks run alongside other tasks.
+func (r *TaskRunner) RegisterPeriodic(typ string, interval time.Duration, f TaskFunc) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handlers[typ] = f
+	r.concurrent[typ] = true
+	r.periodic[typ] = interval
+}
+
+// OnStepDown registers a function which is called when the controller stops
+// being the leader, to release state held for periodic tasks.
+func (r *TaskRunner) OnStepDown(f func()) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.stepDown = append(r.stepDown, f)
+}
+
+// Trigger runs the task of a periodic type without waiting for its next
+// run, or runs it again once it finishes if it is running.
+func (r *TaskRunner) Trigger(typ string) {
+	pending, err := r.repo.Trigger(typ)
+	if err != nil {
+		log.Printf("error triggering %s task: %s", typ, err)
+		return
+	}
+	if !pending {
+		r.triggeredMtx.Lock()
+		r.triggered[typ] = true
+		r.triggeredMtx.Unlock()
+	}
+	r.notify()
+}
+
+func (r *TaskRunner) takeTriggered(typ string) bool {
+	r.triggeredMtx.Lock()
+	defer r.triggeredMtx.Unlock()
+	triggered := r.triggered[typ]
+	delete(r.triggered, typ)
+	return triggered
+}
+
+func (r *TaskRunner) handler(typ string) TaskFunc {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.handlers[typ]
+}
+
+func (r *TaskRunner) isConcurrent(typ string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.concurrent[typ]
+}
+
+func (r *TaskRunner) interval(typ string) (time.Duration, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	interval, ok := r.periodic[typ]
+	return interval, ok
+}
+
+// Enqueue adds a task of a registered type to the queue.
+func (r *TaskRunner) Enqueue(typ string, data interface{}, maxAttempts int) (*ct.Task, error) {
+	if r.handler(typ) == nil {
+		return nil, fmt.Errorf("controller: unknown task type %q", typ)
+	}
+	if _, ok := r.interval(typ); ok {
+		return nil, fmt.Errorf("controller: %q tasks are periodic", typ)
+	}
+	task := &ct.Task{Type: typ, MaxAttempts: maxAttempts}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		raw := json.RawMessage(b)
+		task.Data = &raw
+	}
+	if err := r.repo.Add(task); err != nil {
+		return nil, err
+	}
+	r.notify()
+	return task, nil
+}
+
+// notify wakes the runner to run due tasks without waiting for the next
+// poll.
+func (r *TaskRunner) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *TaskRunner) Start() {
+	go r.loop()
+}
+
+func (r *TaskRunner) Stop() {
+	close(r.stop)
+}
+
+func (r *TaskRunner) loop() {
+	ticker := time.NewTicker(taskPollInterval)
+	defer ticker.Stop()
+	var leader bool
+	for {
+		if r.isLeader() {
+			if !leader {
+				if err := r.requeue(); err != nil {
+					log.Println("error requeuing tasks:", err)
+				}
+				r.schedule()
+				leader = true
+			}
+			r.runPending()
+		} else if leader {
+			r.stepDownAll()
+			leader = false
+		}
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// requeue returns tasks left running by a previous leader to the queue. The
+// concurrent tasks of this runner may still be running after leadership was
+// lost and regained, and are left running rather than being run again.
+func (r *TaskRunner) requeue() error {
+	r.runningMtx.Lock()
+	defer r.runningMtx.Unlock()
+	ids := make([]string, 0, len(r.running))
+	for id := range r.running {
+		ids = append(ids, id)
+	}
+	return r.repo.Requeue(ids)
+}
+
+// schedule adds the tasks of the periodic types which are not queued yet.
+func (r *TaskRunner) schedule() {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for typ := range r.periodic {
+		if err := r.repo.Schedule(typ); err != nil {
+			log.Printf("error scheduling %s task: %s", typ, err)
+		}
+	}
+}
+
+func (r *TaskRunner) stepDownAll() {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, f := range r.stepDown {
+		f()
+	}
+}
+
+func (r *TaskRunner) setRunning(id string, running bool) {
+	r.runningMtx.Lock()
+	defer r.runningMtx.Unlock()
+	if running {
+		r.running[id] = true
+	} else {
+		delete(r.running, id)
+	}
+}
+
+func (r *TaskRunner) runPending() {
+	for {
+		task, err := r.repo.Claim()
+		if err == ErrNotFound {
+			return
+		} else if err != nil {
+			log.Println("error claiming task:", err)
+			return
+		}
+		if r.isConcurrent(task.Type) {
+			r.setRunning(task.ID, true)
+			go func(task *ct.Task) {
+				defer r.setRunning(task.ID, false)
+				r.run(task)
+			}(task)
+			continue
+		}
+		r.run(task)
+	}
+}
+
+func (r *TaskRunner) run(task *ct.Task) {
+	result, err := r.call(task)
+	var data []byte
+	if err == nil && result != nil {
+		data, err = json.Marshal(normalizeTimes(result))
+	}
+	if interval, ok := r.interval(task.Type); ok {
+		runAt := time.Now().Add(interval)
+		triggered := r.takeTriggered(task.Type)
+		if triggered {
+			runAt = time.Now()
+		} else if backoff := taskBackoff(task.Attempts); err != nil && backoff < interval {
+			runAt = time.Now().Add(backoff)
+		}
+		if err != nil {
+			log.Printf("error running %s task: %s", task.Type, err)
+		}
+		err = r.repo.Reschedule(task.ID, data, err, runAt)
+		if triggered {
+			r.notify()
+		}
+	} else if err == nil {
+		err = r.repo.Succeed(task.ID, data)
+	} else if task.Attempts < task.MaxAttempts {
+		err = r.repo.Retry(task.ID, err, time.Now().Add(taskBackoff(task.Attempts)))
+	} else {
+		err = r.repo.Fail(task.ID, err)
+	}
+	if err != nil {
+		log.Printf("error updating task %s: %s", task.ID, err)
+	}
+}
+
+func (r *TaskRunner) call(task *ct.Task) (result interface{}, err error) {
+	f := r.handler(task.Type)
+	if f == nil {
+		return nil, fmt.Errorf("controller: unknown task type %q", task.Type)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("controller: task panicked: %v", p)
+		}
+	}()
+	return f(task)
+}
+
+func taskBackoff(attempts int) time.Duration {
+	d := time.Second << uint(attempts)
+	if d > maxTaskBackoff || d <= 0 {
+		d = maxTaskBackoff
+	}
+	return d
+}
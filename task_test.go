@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) taskRunner() *TaskRunner {
+	return s.m.Get(reflect.TypeOf((*TaskRunner)(nil))).Interface().(*TaskRunner)
+}
+
+func (s *S) waitTask(c *C, id string) *ct.Task {
+	task := &ct.Task{}
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		_, err := s.Get("/tasks/"+id, task)
+		c.Assert(err, IsNil)
+		if task.Status == ct.TaskStatusSucceeded || task.Status == ct.TaskStatusFailed {
+			return task
+		}
+	}
+	c.Fatalf("timed out waiting for task %s", id)
+	return nil
+}
+
+func (s *S) TestTasks(c *C) {
+	runner := s.taskRunner()
+	runner.Register("test-echo", func(task *ct.Task) (interface{}, error) {
+		return task.Data, nil
+	})
+	runner.Register("test-fail", func(task *ct.Task) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	runner.Register("test-panic", func(task *ct.Task) (interface{}, error) {
+		panic("boom")
+	})
+
+	_, err := runner.Enqueue("test-unknown", nil, 0)
+	c.Assert(err, NotNil)
+
+	echo, err := runner.Enqueue("test-echo", map[string]string{"foo": "bar"}, 0)
+	c.Assert(err, IsNil)
+	c.Assert(echo.Status, Equals, ct.TaskStatusPending)
+	c.Assert(echo.MaxAttempts, Equals, defaultTaskRetries)
+
+	task := s.waitTask(c, echo.ID)
+	c.Assert(task.Status, Equals, ct.TaskStatusSucceeded)
+	c.Assert(task.Attempts, Equals, 1)
+	c.Assert(string(*task.Result), Equals, `{"foo":"bar"}`)
+	c.Assert(task.FinishedAt, NotNil)
+
+	for _, typ := range []string{"test-fail", "test-panic"} {
+		failed, err := runner.Enqueue(typ, nil, 1)
+		c.Assert(err, IsNil)
+		task = s.waitTask(c, failed.ID)
+		c.Assert(task.Status, Equals, ct.TaskStatusFailed)
+		c.Assert(task.Attempts, Equals, 1)
+		c.Assert(task.Error, Not(Equals), "")
+	}
+
+	var tasks []*ct.Task
+	_, err = s.Get("/tasks", &tasks)
+	c.Assert(err, IsNil)
+	c.Assert(len(tasks) >= 3, Equals, true)
+
+	res, err := s.Get("/tasks/00000000-0000-0000-0000-000000000000", task)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestTaskBackoff(c *C) {
+	c.Assert(taskBackoff(1), Equals, 2*time.Second)
+	c.Assert(taskBackoff(3), Equals, 8*time.Second)
+	c.Assert(taskBackoff(20), Equals, maxTaskBackoff)
+	c.Assert(taskBackoff(100), Equals, maxTaskBackoff)
+}
+
+func (s *S) TestTaskRequeueRunning(c *C) {
+	runner := s.taskRunner()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	runner.RegisterConcurrent("test-block", func(task *ct.Task) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	blocked, err := runner.Enqueue("test-block", nil, 0)
+	c.Assert(err, IsNil)
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for task to start")
+	}
+
+	// regaining leadership does not requeue the task while it runs
+	c.Assert(runner.requeue(), IsNil)
+	task := &ct.Task{}
+	_, err = s.Get("/tasks/"+blocked.ID, task)
+	c.Assert(err, IsNil)
+	c.Assert(task.Status, Equals, ct.TaskStatusRunning)
+
+	close(release)
+	task = s.waitTask(c, blocked.ID)
+	c.Assert(task.Status, Equals, ct.TaskStatusSucceeded)
+	c.Assert(task.Attempts, Equals, 1)
+}
+
+func (s *S) TestPeriodicTasks(c *C) {
+	runner := s.taskRunner()
+	runs := make(chan int, 10)
+	var n int
+	runner.RegisterPeriodic("test-periodic", time.Hour, func(task *ct.Task) (interface{}, error) {
+		n++
+		runs <- n
+		if n == 2 {
+			return nil, errors.New("failed")
+		}
+		return n, nil
+	})
+	wait := func(expected int) {
+		select {
+		case i := <-runs:
+			c.Assert(i, Equals, expected)
+		case <-time.After(10 * time.Second):
+			c.Fatalf("timed out waiting for run %d", expected)
+		}
+	}
+	_, err := runner.Enqueue("test-periodic", nil, 0)
+	c.Assert(err, NotNil)
+
+	// a single task is kept for the type, which runs when scheduled and
+	// again when triggered
+	runner.schedule()
+	runner.schedule()
+	wait(1)
+	runner.Trigger("test-periodic")
+	wait(2)
+
+	var tasks []*ct.Task
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		tasks = nil
+		_, err = s.Get("/tasks", &tasks)
+		c.Assert(err, IsNil)
+		var periodic []*ct.Task
+		for _, t := range tasks {
+			if t.Type == "test-periodic" {
+				periodic = append(periodic, t)
+			}
+		}
+		c.Assert(periodic, HasLen, 1)
+		if periodic[0].Status == ct.TaskStatusPending && periodic[0].Error != "" {
+			c.Assert(periodic[0].Error, Equals, "failed")
+			c.Assert(periodic[0].Attempts, Equals, 1)
+			c.Assert(periodic[0].RunAt.After(time.Now()), Equals, true)
+			return
+		}
+	}
+	c.Fatal("timed out waiting for the failed run to be recorded")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// Timestamps are returned by the API in UTC with microsecond precision, which
+// is the precision of the database, regardless of the time zone of the
+// database session or whether the time was read back from the database.
+const timestampPrecision = time.Microsecond
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func normalizeTime(t time.Time) time.Time {
+	return t.UTC().Round(timestampPrecision)
+}
+
+// parseTimestamp parses an RFC 3339 timestamp with or without fractional
+// seconds, returning it in UTC.
+func parseTimestamp(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return t.UTC(), nil
+}
+
+// normalizeTimes returns a copy of v with every time it contains normalized.
+// Values are copied rather than modified in place as they may be shared, such
+// as formations sent to several stream subscribers.
+func normalizeTimes(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return normalizeValue(reflect.ValueOf(v)).Interface()
+}
+
+func normalizeValue(v reflect.Value) reflect.Value {
+	if !containsTime(v.Type()) {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return reflect.ValueOf(normalizeTime(v.Interface().(time.Time)))
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			// unexported fields are not encoded and were copied as is
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			out.Field(i).Set(normalizeValue(v.Field(i)))
+		}
+		return out
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(normalizeValue(v.Elem()))
+		return out
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(normalizeValue(v.Elem()))
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(normalizeValue(v.Index(i)))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(normalizeValue(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMap(v.Type())
+		for _, k := range v.MapKeys() {
+			out.SetMapIndex(k, normalizeValue(v.MapIndex(k)))
+		}
+		return out
+	}
+	return v
+}
+
+var timeTypes = struct {
+	sync.Mutex
+	m map[reflect.Type]bool
+}{m: make(map[reflect.Type]bool)}
+
+// containsTime reports whether values of t may contain a time. Interfaces
+// may hold anything, so they are always walked.
+func containsTime(t reflect.Type) bool {
+	timeTypes.Lock()
+	defer timeTypes.Unlock()
+	return containsTimeLocked(t)
+}
+
+func containsTimeLocked(t reflect.Type) bool {
+	if res, ok := timeTypes.m[t]; ok {
+		return res
+	}
+	// recursive types are assumed not to contain a time until they have
+	// been walked
+	timeTypes.m[t] = false
+	var res bool
+	switch t.Kind() {
+	case reflect.Interface:
+		res = true
+	case reflect.Struct:
+		if t == timeType {
+			res = true
+			break
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && containsTimeLocked(f.Type) {
+				res = true
+				break
+			}
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		res = containsTimeLocked(t.Elem())
+	}
+	timeTypes.m[t] = res
+	return res
+}
+
+// utcRender normalizes the times in JSON responses.
+type utcRender struct {
+	render.Render
+}
+
+func (r utcRender) JSON(status int, v interface{}) {
+	r.Render.JSON(status, normalizeTimes(v))
+}
+
+// utcRenderer replaces the render.Render of a request with a utcRender, and
+// must come after render.Renderer.
+func utcRenderer(c martini.Context, r render.Render) {
+	c.MapTo(utcRender{r}, (*render.Render)(nil))
+}
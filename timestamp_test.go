@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+var timestampPattern = regexp.MustCompile(`"(\d{4}-\d\d-\d\dT[^"]*)"`)
+
+// fillTimes sets every time in v to t, allocating structs and one element of
+// slices so that nested times are set too.
+func fillTimes(v reflect.Value, t time.Time, depth int) {
+	if depth > 5 {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.Type().Elem() == timeType {
+			v.Set(reflect.ValueOf(&t))
+			return
+		}
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		fillTimes(v.Elem(), t, depth+1)
+	case reflect.Struct:
+		if v.Type() == timeType {
+			v.Set(reflect.ValueOf(t))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				fillTimes(v.Field(i), t, depth+1)
+			}
+		}
+	case reflect.Slice:
+		if k := v.Type().Elem().Kind(); k != reflect.Struct && k != reflect.Ptr {
+			return
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillTimes(v.Index(0), t, depth+1)
+	}
+}
+
+func (s *S) TestNormalizeTimes(c *C) {
+	local := time.Date(2014, 5, 1, 12, 30, 0, 123456789, time.FixedZone("PDT", -7*3600))
+	for _, v := range []interface{}{
+		&ct.App{}, &ct.Release{}, &ct.Artifact{}, &ct.Formation{}, &ct.ExpandedFormation{},
+		&ct.Key{}, &ct.Provider{}, &ct.Resource{}, &ct.Task{}, &ct.Deployment{},
+		&ct.AppEvent{}, &ct.JobSummary{}, &ct.OnlineMigration{}, &ct.AppGCReport{},
+		&ct.AppLock{}, &ct.AppSnapshot{}, &ct.Certificate{}, &ct.ConsistencyReport{},
+		&ct.EnvGroup{}, &ct.FormationSnapshot{}, &ct.JobReservation{}, &ct.NetworkPolicy{},
+		&ct.PolicySet{}, &ct.ReadOnlyMode{}, &ct.ResourceStatus{}, &ct.StreamSubscriber{},
+	} {
+		fillTimes(reflect.ValueOf(v).Elem(), local, 0)
+		before, err := json.Marshal(v)
+		c.Assert(err, IsNil)
+		data, err := json.Marshal(normalizeTimes(v))
+		c.Assert(err, IsNil)
+
+		matches := timestampPattern.FindAllStringSubmatch(string(data), -1)
+		c.Assert(len(matches) > 0, Equals, true, Commentf("%T", v))
+		for _, m := range matches {
+			c.Assert(m[1], Equals, "2014-05-01T19:30:00.123457Z", Commentf("%T", v))
+		}
+		// the value itself is left as is
+		after, err := json.Marshal(v)
+		c.Assert(err, IsNil)
+		c.Assert(string(after), Equals, string(before))
+	}
+	c.Assert(normalizeTimes(nil), IsNil)
+	c.Assert(normalizeTimes("foo"), Equals, "foo")
+}
+
+func (s *S) TestParseTimestamp(c *C) {
+	for _, str := range []string{"2014-05-01T12:30:00-07:00", "2014-05-01T19:30:00Z", "2014-05-01T19:30:00.000Z"} {
+		t, err := parseTimestamp(str)
+		c.Assert(err, IsNil)
+		c.Assert(t.Location(), Equals, time.UTC)
+		c.Assert(t.Equal(time.Date(2014, 5, 1, 19, 30, 0, 0, time.UTC)), Equals, true)
+	}
+	_, err := parseTimestamp("2014-05-01 19:30:00")
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestTimestampsUTC(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "timestamps-utc"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	for _, path := range []string{"/apps/" + app.ID, "/releases/" + release.ID, "/apps/" + app.ID + "/events"} {
+		var raw json.RawMessage
+		_, err := s.Get(path, &raw)
+		c.Assert(err, IsNil)
+		matches := timestampPattern.FindAllStringSubmatch(string(raw), -1)
+		c.Assert(len(matches) > 0, Equals, true, Commentf(path))
+		for _, m := range matches {
+			t, err := time.Parse(time.RFC3339Nano, m[1])
+			c.Assert(err, IsNil)
+			c.Assert(t.Location(), Equals, time.UTC, Commentf("%s %s", path, m[1]))
+			c.Assert(t.Nanosecond()%int(timestampPrecision), Equals, 0)
+		}
+	}
+}
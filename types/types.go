@@ -2,31 +2,219 @@ package types
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
+
+	"github.com/flynn/strowger/types"
 )
 
+// ExpandedFormation is a formation along with its app, release and
+// artifact. Replaces is set when the formation replaced the formation of
+// another release of the app in the same change, in which case the replaced
+// formation has been removed.
 type ExpandedFormation struct {
-	App       *App           `json:"app,omitempty"`
-	Release   *Release       `json:"release,omitempty"`
-	Artifact  *Artifact      `json:"artifact,omitempty"`
-	Processes map[string]int `json:"processes,omitempty"`
+	App       *App              `json:"app,omitempty"`
+	Release   *Release          `json:"release,omitempty"`
+	Artifact  *Artifact         `json:"artifact,omitempty"`
+	Processes map[string]int    `json:"processes,omitempty"`
+	Spread    map[string]Spread `json:"spread,omitempty"`
+	Replaces  string            `json:"replaces,omitempty"`
+	Strategy  string            `json:"strategy,omitempty"`
+
+	// AppEnv is the app-scoped environment which is overridden by the
+	// release environment.
+	AppEnv map[string]string `json:"app_env,omitempty"`
+
+	// RegistryConfig is the registry config of the app, with the overrides
+	// of the app applied to the cluster config.
+	RegistryConfig *RegistryConfig `json:"registry_config,omitempty"`
 }
 
-type App struct {
-	ID        string            `json:"id,omitempty"`
-	Name      string            `json:"name,omitempty"`
-	Protected bool              `json:"protected"`
-	Meta      map[string]string `json:"meta,omitempty"`
-	CreatedAt *time.Time        `json:"created_at,omitempty"`
+// RegistryConfig configures the pull-through mirrors which hosts pull the
+// images of jobs through. Mirrors maps registry hosts, with docker.io for
+// the Docker Hub, to the host of their mirror. In app overrides, an empty
+// mirror host pulls from the registry itself.
+type RegistryConfig struct {
+	Mirrors   map[string]string `json:"mirrors"`
 	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
 }
 
+// FormationSnapshot is a page of the active formations of a cluster as of
+// Since. Streaming formations from Since after loading every page gives the
+// changes made after the snapshot.
+type FormationSnapshot struct {
+	Formations []*ExpandedFormation `json:"formations"`
+	Since      time.Time            `json:"since"`
+
+	// NextPage is passed as the page parameter to fetch the rest of the
+	// snapshot, and is empty on the last page.
+	NextPage string `json:"next_page,omitempty"`
+}
+
+type StreamFormationsReq struct {
+	Since          time.Time     `json:"since"`
+	CoalesceWindow time.Duration `json:"coalesce_window,omitempty"`
+}
+
+// App is an application. While Maintenance is set, new jobs and scale ups
+// are rejected and the scheduler stops the app's processes. If
+// ReleaseRetention is set, only that many of the app's most recent releases
+// are kept when a release is deployed.
+type App struct {
+	ID               string            `json:"id,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	Protected        bool              `json:"protected"`
+	Maintenance      bool              `json:"maintenance"`
+	Strategy         string            `json:"strategy,omitempty"`
+	ReleaseRetention int               `json:"release_retention,omitempty"`
+	Meta             map[string]string `json:"meta,omitempty"`
+	CreatedAt        *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt        *time.Time        `json:"updated_at,omitempty"`
+	DeletedAt        *time.Time        `json:"deleted_at,omitempty"`
+}
+
+// AppExport is a bundle of an app and its current configuration, used to
+// migrate apps between clusters.
+type AppExport struct {
+	App       *App              `json:"app,omitempty"`
+	Release   *Release          `json:"release,omitempty"`
+	Artifact  *Artifact         `json:"artifact,omitempty"`
+	Formation *Formation        `json:"formation,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Routes    []*strowger.Route `json:"routes,omitempty"`
+}
+
+// BulkAppsRes is the response to creating apps in bulk. The apps are created
+// in a single transaction, so if any app has an error none are created.
+type BulkAppsRes struct {
+	Created bool             `json:"created"`
+	Results []*BulkAppResult `json:"results"`
+}
+
+// BulkAppResult is the created app, or the reason it was rejected.
+type BulkAppResult struct {
+	App   *App   `json:"app,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// AppSnapshot is the configuration of an app as of a point in time,
+// reconstructed from the app log.
+type AppSnapshot struct {
+	App        *App              `json:"app"`
+	Time       time.Time         `json:"time"`
+	Release    *Release          `json:"release,omitempty"`
+	Env        map[string]string `json:"env"`
+	Formations []*Formation      `json:"formations"`
+}
+
+// Deploy strategies select how deployers roll out a new release of an app.
+const (
+	// DeployAllAtOnce starts all processes of the new release before stopping
+	// those of the previous release.
+	DeployAllAtOnce = "all-at-once"
+
+	// DeployOneByOne replaces the processes of the previous release one at a
+	// time.
+	DeployOneByOne = "one-by-one"
+)
+
+// DeployStrategies are the valid values of App.Strategy.
+var DeployStrategies = []string{DeployAllAtOnce, DeployOneByOne}
+
+// DeployRestart is the strategy of deployments created by Client.RestartApp,
+// which replace the running jobs of the current release one at a time rather
+// than deploy a new release. It is not a valid App.Strategy.
+const DeployRestart = "restart"
+
+// Deployment is the rollout of a new release to an app, moving the formation
+// of the old release over to it. Org is the org of the app when it was
+// deployed. While the deployment is queued behind others, QueuePosition is
+// its position in the queue, starting at 1. Restarts limited to a process
+// type set ProcessType.
+type Deployment struct {
+	ID            string     `json:"id,omitempty"`
+	AppID         string     `json:"app,omitempty"`
+	OldReleaseID  string     `json:"old_release,omitempty"`
+	NewReleaseID  string     `json:"new_release,omitempty"`
+	Strategy      string     `json:"strategy,omitempty"`
+	ProcessType   string     `json:"process_type,omitempty"`
+	Status        string     `json:"status,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Org           string     `json:"org,omitempty"`
+	QueuePosition int        `json:"queue_position,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+}
+
+// AppMetaOrg is the app meta key naming the org an app belongs to, which
+// deployment concurrency limits are applied per. Unlike the rest of the meta
+// it can only be set or removed with the admin key, so that apps cannot
+// avoid the limit of their org or use up the limit of another.
+const AppMetaOrg = "org"
+
+const (
+	DeploymentStatusQueued   = "queued"
+	DeploymentStatusPending  = "pending"
+	DeploymentStatusRunning  = "running"
+	DeploymentStatusComplete = "complete"
+	DeploymentStatusFailed   = "failed"
+)
+
+// DeployReq deploys a release to an app. If Base is set, the deployment is
+// only created if it is the current release of the app.
+type DeployReq struct {
+	ReleaseID string `json:"id"`
+	Base      string `json:"base,omitempty"`
+}
+
+// DeploymentEvent is recorded in the app log when the status of a deployment
+// or the progress of its processes changes. Processes is set while it is
+// running, keyed by process type.
+type DeploymentEvent struct {
+	*Deployment
+	Processes map[string]*DeploymentProcess `json:"processes,omitempty"`
+}
+
+// DeploymentProcess is the progress of a process type of a deployment. Up
+// counts the jobs of the new release which are running, and Down those which
+// crashed or failed after the deployment began.
+type DeploymentProcess struct {
+	Desired int `json:"desired"`
+	Up      int `json:"up"`
+	Down    int `json:"down"`
+}
+
+// ReleaseSchemaVersion is the version of the release data format understood
+// by this version of the controller.
+const ReleaseSchemaVersion = 1
+
 type Release struct {
-	ID         string                 `json:"id,omitempty"`
-	ArtifactID string                 `json:"artifact,omitempty"`
-	Env        map[string]string      `json:"env,omitempty"`
-	Processes  map[string]ProcessType `json:"processes,omitempty"`
-	CreatedAt  *time.Time             `json:"created_at,omitempty"`
+	ID            string                 `json:"id,omitempty"`
+	ArtifactID    string                 `json:"artifact,omitempty"`
+	Env           map[string]string      `json:"env,omitempty"`
+	Processes     map[string]ProcessType `json:"processes,omitempty"`
+	SchemaVersion int                    `json:"schema_version,omitempty"`
+	CreatedAt     *time.Time             `json:"created_at,omitempty"`
+
+	// Meta records the provenance of the release, such as the git commit
+	// and build it was created from.
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// CloneReleaseReq holds the overrides applied when cloning a release. A null
+// env value, process type or meta value removes it from the clone.
+type CloneReleaseReq struct {
+	Env       map[string]*string      `json:"env,omitempty"`
+	Processes map[string]*ProcessType `json:"processes,omitempty"`
+	Meta      map[string]*string      `json:"meta,omitempty"`
+}
+
+// AppReleaseReq creates a release from the current release of an app with
+// the overrides applied. If Base is set, the request fails unless it is the
+// current release of the app.
+type AppReleaseReq struct {
+	CloneReleaseReq
+	Base string `json:"base,omitempty"`
 }
 
 type ProcessType struct {
@@ -34,6 +222,11 @@ type ProcessType struct {
 	Env   map[string]string `json:"env,omitempty"`
 	Ports ProcessPorts      `json:"ports,omitempty"`
 	Data  bool              `json:"data,omitempty"`
+
+	// DependsOn lists the process types of the release which are started
+	// before, and stopped after, this type. The jobs of this type are only
+	// started once the jobs of these types are running.
+	DependsOn []string `json:"depends_on,omitempty"`
 }
 
 type ProcessPorts struct {
@@ -42,18 +235,409 @@ type ProcessPorts struct {
 }
 
 type Artifact struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type,omitempty"`
+	URI  string `json:"uri,omitempty"`
+
+	// Digest is the content digest of the artifact, such as sha256:...,
+	// which pins the content a mutable URI such as a tag referred to when
+	// the artifact was created. Size is the size in bytes of the content
+	// the digest identifies.
+	Digest string `json:"digest,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Artifact types with type-specific handling. Artifacts of other types are
+// run as docker images.
+const (
+	// ArtifactTypeDocker artifacts are docker images with docker:// URIs.
+	ArtifactTypeDocker = "docker"
+
+	// ArtifactTypeFile artifacts are tarballs, such as slugs, with http or
+	// https URIs, which jobs download and run.
+	ArtifactTypeFile = "file"
+)
+
+// EnvGroup is a named set of env vars shared by the apps that reference it.
+// Env vars an app sets to other values in its release override the group.
+type EnvGroup struct {
+	ID        string            `json:"id,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+
+	// SkippedApps is set in the response to an update to the IDs of the
+	// apps which were not released, because they are protected, locked,
+	// in maintenance mode or being deployed, mapped to the reason. They
+	// are released when the group is updated again.
+	SkippedApps map[string]string `json:"skipped_apps,omitempty"`
+}
+
+// Task is a background operation run by the controller leader.
+type Task struct {
+	ID          string           `json:"id,omitempty"`
+	Type        string           `json:"type,omitempty"`
+	Status      string           `json:"status,omitempty"`
+	Data        *json.RawMessage `json:"data,omitempty"`
+	Result      *json.RawMessage `json:"result,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	Attempts    int              `json:"attempts"`
+	MaxAttempts int              `json:"max_attempts,omitempty"`
+	RunAt       *time.Time       `json:"run_at,omitempty"`
+	CreatedAt   *time.Time       `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time       `json:"updated_at,omitempty"`
+	FinishedAt  *time.Time       `json:"finished_at,omitempty"`
+}
+
+const (
+	TaskStatusPending   = "pending"
+	TaskStatusRunning   = "running"
+	TaskStatusSucceeded = "succeeded"
+	TaskStatusFailed    = "failed"
+)
+
+type ConsistencyReport struct {
+	Findings  []*ConsistencyFinding `json:"findings"`
+	CheckedAt *time.Time            `json:"checked_at,omitempty"`
+}
+
+// AppEvent is a change to an app or one of its releases, formations, jobs or
+// routes, recorded in the app log. ObjectType is the event type, such as
+// EventTypeFormation, and Data is the object after the change, or null if it
+// was deleted. IDs increase monotonically per app.
+type AppEvent struct {
+	ID         int64            `json:"id"`
+	AppID      string           `json:"app"`
+	ObjectType EventType        `json:"object_type"`
+	ObjectID   string           `json:"object_id,omitempty"`
+	Data       *json.RawMessage `json:"data"`
+	CreatedAt  *time.Time       `json:"created_at,omitempty"`
+}
+
+// EventType is the type of an app event, named after the object which
+// changed.
+type EventType string
+
+const (
+	EventTypeRelease            EventType = "release"
+	EventTypeEnv                EventType = "env"
+	EventTypeFormation          EventType = "formation"
+	EventTypeFormationThrottled EventType = "formation_throttled"
+	EventTypeJob                EventType = "job"
+	EventTypeRoute              EventType = "route"
+	EventTypeDeployment         EventType = "deployment"
+	EventTypeCertificate        EventType = "certificate"
+	EventTypeAudit              EventType = "audit"
+)
+
+// AuditEvent is the data of audit events, recorded when an admin accesses
+// the objects of an app through an endpoint which is not scoped to the app,
+// such as the log of a job.
+type AuditEvent struct {
+	Subject    string `json:"subject"`
+	Action     string `json:"action"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+}
+
+// RouteEvent is the data of route events. Route is the route as it was last
+// seen for deleted routes.
+type RouteEvent struct {
+	Action RouteAction     `json:"action"`
+	Route  *strowger.Route `json:"route"`
+}
+
+// RouteAction is the change to a route recorded by a route event.
+type RouteAction string
+
+const (
+	RouteCreated RouteAction = "created"
+	RouteUpdated RouteAction = "updated"
+	RouteDeleted RouteAction = "deleted"
+)
+
+// CertificateEvent is the data of certificate events, recorded when the
+// certificate of a route with managed TLS is issued or fails to be. Expires
+// is when the new certificate expires, Error why it could not be issued.
+type CertificateEvent struct {
+	RouteID string            `json:"route_id"`
+	Domain  string            `json:"domain"`
+	Status  CertificateStatus `json:"status"`
+	Expires *time.Time        `json:"expires_at,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// CertificateStatus is the outcome of a certificate renewal.
+type CertificateStatus string
+
+const (
+	CertificateRenewed CertificateStatus = "renewed"
+	CertificateFailed  CertificateStatus = "failed"
+)
+
+// RouteCertificateReq is sent to certificate provider hooks to request a
+// certificate for a domain, which may be a wildcard such as *.example.com.
+// Hooks respond with a Certificate with the PEM encoded certificate chain
+// and key.
+type RouteCertificateReq struct {
+	Domain string `json:"domain"`
+}
+
+// Valid reports whether t is one of the known event types. Unknown types
+// are decoded as is, so that clients keep working when the controller adds
+// types, and should be checked with Valid where they are accepted as input.
+func (t EventType) Valid() bool {
+	switch t {
+	case EventTypeRelease, EventTypeEnv, EventTypeFormation, EventTypeFormationThrottled, EventTypeJob, EventTypeRoute, EventTypeDeployment, EventTypeCertificate, EventTypeAudit:
+		return true
+	}
+	return false
+}
+
+// AppGCReport lists the soft-deleted apps, and the releases and artifacts
+// only they used, which were purged by a garbage collection run, or which
+// would be purged if DryRun is set.
+type AppGCReport struct {
+	DryRun    bool       `json:"dry_run"`
+	Before    *time.Time `json:"before"`
+	Apps      []string   `json:"apps"`
+	Releases  []string   `json:"releases"`
+	Artifacts []string   `json:"artifacts"`
+}
+
+// StreamSubscriber describes a subscriber to a controller stream. Buffered
+// is the number of updates waiting to be received by the subscriber, and Lag
+// is how long the oldest update which did not fit in its buffer has been
+// waiting.
+type StreamSubscriber struct {
+	ID           uint64        `json:"id"`
+	Stream       string        `json:"stream"`
+	SubscribedAt time.Time     `json:"subscribed_at"`
+	Buffered     int           `json:"buffered"`
+	Lag          time.Duration `json:"lag"`
+	Sent         uint64        `json:"sent"`
+}
+
+// ConsistencyFinding describes a row that violates an integrity check. ID is
+// the primary key of the row, with composite keys joined by ':'.
+type ConsistencyFinding struct {
+	Check    string `json:"check"`
+	ID       string `json:"id"`
+	Message  string `json:"message"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// States of an online migration, which moves a column of a table to a new
+// column while the controller keeps serving writes.
+const (
+	OnlineMigrationPending    = "pending"
+	OnlineMigrationDualWrite  = "dual_write"
+	OnlineMigrationBackfilled = "backfilled"
+	OnlineMigrationCutover    = "cutover"
+)
+
+// OnlineMigration is the state of an online migration. Backfilled is the
+// number of rows copied by backfill tasks.
+type OnlineMigration struct {
+	Name       string     `json:"name"`
+	Table      string     `json:"table"`
+	OldColumn  string     `json:"old_column"`
+	NewColumn  string     `json:"new_column"`
+	State      string     `json:"state"`
+	Backfilled int64      `json:"backfilled"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// SimClusterConfig configures the simulated cluster used for load testing.
+// Each interval, every running job is replaced with probability ChurnRate.
+// Jobs is the number of running jobs and is ignored when configuring.
+type SimClusterConfig struct {
+	Hosts         int           `json:"hosts"`
+	ChurnRate     float64       `json:"churn_rate"`
+	ChurnInterval time.Duration `json:"churn_interval"`
+	Jobs          int           `json:"jobs"`
+}
+
+// ReadOnlyMode is the cluster-wide read-only switch. While enabled the
+// controller rejects all mutations with 503.
+type ReadOnlyMode struct {
+	Enabled   bool       `json:"enabled"`
+	Reason    string     `json:"reason,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// JobLogTruncatedHeader is set on job log responses which were truncated to
+// the most recent data, to the number of bytes dropped.
+const JobLogTruncatedHeader = "Flynn-Log-Truncated"
+
+// JobStateHeader is set to JobLogStateDone on job log responses served from
+// the log stored by the controller once a one-off job has exited.
+const JobStateHeader = "X-Flynn-Job-State"
+
+const JobLogStateDone = "done"
+
+// ReadOnlyHeader is set on responses to requests rejected because the
+// cluster is in read-only mode.
+const ReadOnlyHeader = "Flynn-Read-Only"
+
+// ImageAllowlistOverrideHeader is set to "true" by admins on requests which
+// create artifacts or releases with images outside the image allowlist.
+const ImageAllowlistOverrideHeader = "Flynn-Image-Allowlist-Override"
+
+// ArtifactInUseHeader is set on responses to requests to delete an artifact
+// which is rejected because releases reference it.
+const ArtifactInUseHeader = "Flynn-Artifact-In-Use"
+
+// ArtifactVerification is the result of checking that the content of an
+// artifact can be pulled. Status is one of the ArtifactStatus values, and
+// Error explains statuses other than ArtifactAvailable. Digest is the digest
+// of the content the URI currently refers to, if the source reports it.
+type ArtifactVerification struct {
+	ArtifactID string         `json:"artifact"`
+	Status     ArtifactStatus `json:"status"`
+	Digest     string         `json:"digest,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	CheckedAt  *time.Time     `json:"checked_at"`
+}
+
+// ArtifactStatus is the outcome of an artifact verification.
+type ArtifactStatus string
+
+const (
+	// ArtifactAvailable artifacts can be pulled.
+	ArtifactAvailable ArtifactStatus = "available"
+
+	// ArtifactMissing artifacts do not exist at their URI.
+	ArtifactMissing ArtifactStatus = "missing"
+
+	// ArtifactMismatch artifacts exist but their URI refers to different
+	// content than their digest or size.
+	ArtifactMismatch ArtifactStatus = "mismatch"
+
+	// ArtifactUnreachable artifacts could not be checked because their
+	// source failed or could not be reached.
+	ArtifactUnreachable ArtifactStatus = "unreachable"
+
+	// ArtifactUnverifiable artifacts cannot be checked by the controller,
+	// such as images on the Docker Hub or artifacts on hosts which the
+	// controller is not configured to verify artifacts on.
+	ArtifactUnverifiable ArtifactStatus = "unverifiable"
+
+	// ArtifactNotAllowed artifacts are outside the image allowlist of the
+	// cluster, so new artifacts and releases cannot be created with them.
+	// Existing releases using them keep running.
+	ArtifactNotAllowed ArtifactStatus = "not_allowed"
+)
+
+// ArtifactInUse lists the releases which prevent an artifact being deleted.
+type ArtifactInUse struct {
+	Releases []string `json:"releases"`
+}
+
+// HTTPRoute is the config of an HTTP route created through the controller.
+// Domain may be a wildcard such as *.example.com, and Path limits the route
+// to requests with the path prefix, if the router supports them. The TLS
+// certificate of routes with ManagedTLS set is issued and renewed by the
+// controller.
+type HTTPRoute struct {
+	strowger.HTTPRoute
+	Path       string `json:"path,omitempty"`
+	ManagedTLS bool   `json:"managed_tls,omitempty"`
+}
+
+// RouteConflictHeader is set on responses to requests to create a route
+// which is rejected because another route has the same domain and path.
+const RouteConflictHeader = "Flynn-Route-Conflict"
+
+// RouteConflict describes the route which prevents a route being created.
+// RouteID is only set if the route belongs to the same app.
+type RouteConflict struct {
+	Domain  string `json:"domain"`
+	Path    string `json:"path,omitempty"`
+	RouteID string `json:"route_id,omitempty"`
+}
+
+// ProtectedOverrideHeader is set to "true" on requests which make destructive
+// changes to protected apps, such as stopping jobs or changing the release.
+const ProtectedOverrideHeader = "Flynn-Protected-Override"
+
+// TotalCountHeader is set on paginated list responses to the total number of
+// results across all pages.
+const TotalCountHeader = "Flynn-Total-Count"
+
+// AppLock is an exclusive lock on operations such as deploys and scaling
+// for an app. It expires TTL seconds after it was acquired or last renewed.
+type AppLock struct {
 	ID        string     `json:"id,omitempty"`
-	Type      string     `json:"type,omitempty"`
-	URI       string     `json:"uri,omitempty"`
+	AppID     string     `json:"app,omitempty"`
+	Holder    string     `json:"holder,omitempty"`
+	Operation string     `json:"operation,omitempty"`
+	TTL       int        `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
+// AppLockHeader carries the ID of the lock held by the client on requests
+// which modify a locked app. It is set to "true" on responses to requests
+// rejected because the app is locked, which describe the lock without its
+// ID.
+const AppLockHeader = "Flynn-App-Lock"
+
+// AdmissionReview is sent to admission hooks before an object is persisted.
+// Resource is the resource type, such as "releases", and Action is "create"
+// or "update".
+type AdmissionReview struct {
+	Resource string          `json:"resource"`
+	Action   string          `json:"action"`
+	Object   json.RawMessage `json:"object"`
+}
+
+// AdmissionResponse is the response of an admission hook. If Object is set
+// it replaces the reviewed object.
+type AdmissionResponse struct {
+	Allowed bool            `json:"allowed"`
+	Reason  string          `json:"reason,omitempty"`
+	Object  json.RawMessage `json:"object,omitempty"`
+}
+
+// BatchGetReq is a request for several objects of the same type by ID.
+type BatchGetReq struct {
+	IDs []string `json:"ids"`
+}
+
 type Formation struct {
 	AppID     string         `json:"app,omitempty"`
 	ReleaseID string         `json:"release,omitempty"`
 	Processes map[string]int `json:"processes,omitempty"`
-	CreatedAt *time.Time     `json:"created_at,omitempty"`
-	UpdatedAt *time.Time     `json:"updated_at,omitempty"`
+
+	// Spread holds placement hints for the jobs of each process type, which
+	// schedulers may honor to spread jobs across hosts.
+	Spread map[string]Spread `json:"spread,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// Spread is a placement hint for the jobs of a process type.
+type Spread struct {
+	// MaxPerHost limits the number of jobs of the type on each host, zero
+	// means no limit.
+	MaxPerHost int `json:"max_per_host,omitempty"`
+
+	// HostAttribute spreads the jobs evenly across groups of hosts with the
+	// same value of the attribute, such as rack.
+	HostAttribute string `json:"host_attribute,omitempty"`
+}
+
+// FormationThrottled is returned with status 429 when the formations of an
+// app have changed more than Limit times a minute. Changes are rejected for
+// RetryAfter seconds.
+type FormationThrottled struct {
+	Limit      int `json:"limit"`
+	RetryAfter int `json:"retry_after"`
 }
 
 type Key struct {
@@ -68,6 +652,114 @@ type Job struct {
 	Type      string   `json:"type,omitempty"`
 	ReleaseID string   `json:"release,omitempty"`
 	Cmd       []string `json:"cmd,omitempty"`
+	State     JobState `json:"state,omitempty"`
+}
+
+// JobEnvDiff lists the env vars of a running job which differ from the env
+// of the current release of its app, in which case the job needs restarting
+// to pick up the change.
+type JobEnvDiff struct {
+	JobID            string                `json:"job_id,omitempty"`
+	ReleaseID        string                `json:"release,omitempty"`
+	CurrentReleaseID string                `json:"current_release,omitempty"`
+	Env              map[string]EnvVarDiff `json:"env"`
+}
+
+// EnvVarDiff holds the value of an env var in a job and in the current
+// release, which are nil if it is unset.
+type EnvVarDiff struct {
+	Job     *string `json:"job"`
+	Current *string `json:"current"`
+}
+
+// JobTypeRun is the type of one-off jobs, which are started without a
+// process type.
+const JobTypeRun = "run"
+
+// JobState is the state of a job as reported by its host.
+type JobState string
+
+const (
+	JobStateStarting JobState = "starting"
+	JobStateUp       JobState = "up"
+	JobStateDown     JobState = "down"
+	JobStateCrashed  JobState = "crashed"
+	JobStateFailed   JobState = "failed"
+)
+
+// Valid reports whether s is one of the known job states.
+func (s JobState) Valid() bool {
+	switch s {
+	case JobStateStarting, JobStateUp, JobStateDown, JobStateCrashed, JobStateFailed:
+		return true
+	}
+	return false
+}
+
+// JobSummary counts the jobs of an app by type and state. It is computed from
+// an index of the cluster's jobs which was last refreshed at IndexedAt.
+type JobSummary struct {
+	AppID     string                      `json:"app"`
+	Types     map[string]map[JobState]int `json:"types"`
+	Total     int                         `json:"total"`
+	IndexedAt *time.Time                  `json:"indexed_at,omitempty"`
+}
+
+// AppStatus is the status of an app, from its indexed jobs and its routes.
+type AppStatus struct {
+	App    *App           `json:"app"`
+	Jobs   *JobSummary    `json:"jobs"`
+	Routes []*RouteStatus `json:"routes"`
+}
+
+// RouteStatus is a route of an app along with its traffic, which is omitted if
+// the router does not report traffic stats.
+type RouteStatus struct {
+	Route   *strowger.Route `json:"route"`
+	Traffic *RouteTraffic   `json:"traffic,omitempty"`
+}
+
+// RouteTraffic is the recent traffic of a route as reported by the router.
+type RouteTraffic struct {
+	// RequestRate is the number of requests per second.
+	RequestRate float64 `json:"request_rate"`
+
+	// ErrorRate is the number of requests per second which failed with a
+	// server error.
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// AppStats counts the releases, formations, running jobs and resources of an
+// app. Releases are those which the app has been deployed or scaled with.
+type AppStats struct {
+	AppID      string         `json:"app"`
+	Releases   int            `json:"releases"`
+	Formations int            `json:"formations"`
+	Jobs       int            `json:"jobs"`
+	JobTypes   map[string]int `json:"job_types"`
+	Resources  int            `json:"resources"`
+}
+
+// StopJobsRes lists the jobs stopped by a filtered job delete, and the jobs
+// or hosts which failed.
+type StopJobsRes struct {
+	Stopped []string        `json:"stopped"`
+	Failed  []*StopJobError `json:"failed"`
+}
+
+type StopJobError struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+// AdoptJobReq assigns a running job that was not started by the controller
+// to an app and release.
+type AdoptJobReq struct {
+	JobID     string     `json:"id,omitempty"`
+	AppID     string     `json:"app,omitempty"`
+	ReleaseID string     `json:"release,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
 type NewJob struct {
@@ -77,6 +769,43 @@ type NewJob struct {
 	TTY       bool              `json:"tty,omitempty"`
 	Columns   int               `json:"tty_columns,omitempty"`
 	Lines     int               `json:"tty_lines,omitempty"`
+
+	// IdempotencyToken makes a detached run at-most-once: retrying with the
+	// same token returns the job started by the first request, even if that
+	// request failed without knowing whether the job started. Retrying while
+	// the first request is still scheduling the job fails with 409.
+	IdempotencyToken string `json:"idempotency_token,omitempty"`
+
+	// PreviousJobID runs the job on the same host as the given job, such as
+	// a previous run using host volumes or local caches. If the host has
+	// left the cluster another host is used and a Warning header is set on
+	// the response.
+	PreviousJobID string `json:"previous_job_id,omitempty"`
+
+	// ExpectedReleaseID rejects the job unless it is the ID or tag of the
+	// current release of the app, so that jobs such as migrations for a
+	// release being deployed do not run against a newer release.
+	ExpectedReleaseID string `json:"expected_release,omitempty"`
+}
+
+// ReleaseMismatchHeader is set on responses to requests to run a job which
+// are rejected because the current release of the app is not the expected
+// release.
+const ReleaseMismatchHeader = "Flynn-Release-Mismatch"
+
+// ReleaseMismatch describes the current release of an app which prevented a
+// job running. Current is empty if the app has no release.
+type ReleaseMismatch struct {
+	Expected string `json:"expected"`
+	Current  string `json:"current,omitempty"`
+}
+
+// JobReservation ties a job ID to an idempotency token before the job is run.
+type JobReservation struct {
+	Token     string     `json:"token,omitempty"`
+	JobID     string     `json:"job_id,omitempty"`
+	HostID    string     `json:"host_id,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
 type Frontend struct {
@@ -86,24 +815,123 @@ type Frontend struct {
 }
 
 type Provider struct {
-	ID        string     `json:"id,omitempty"`
-	URL       string     `json:"url,omitempty"`
-	Name      string     `json:"name,omitempty"`
-	CreatedAt *time.Time `json:"created_at,omitempty"`
-	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	ID           string                `json:"id,omitempty"`
+	URL          string                `json:"url,omitempty"`
+	Name         string                `json:"name,omitempty"`
+	Capabilities *ProviderCapabilities `json:"capabilities,omitempty"`
+	Plans        []ProviderPlan        `json:"plans,omitempty"`
+	CreatedAt    *time.Time            `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time            `json:"updated_at,omitempty"`
+}
+
+// ProviderPlan is a named resource configuration offered by a provider.
+// Schema describes the config parameters accepted when provisioning the plan.
+type ProviderPlan struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description,omitempty"`
+	Schema      map[string]PlanParameter `json:"schema,omitempty"`
+}
+
+type PlanParameter struct {
+	Type        string      `json:"type"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+// ProviderCapabilities is served by resource providers at GET
+// <url>/capabilities and describes the parts of the provider protocol that
+// they implement.
+type ProviderCapabilities struct {
+	ProtocolVersion    int  `json:"protocol_version"`
+	Provision          bool `json:"provision"`
+	Deprovision        bool `json:"deprovision,omitempty"`
+	Async              bool `json:"async,omitempty"`
+	CredentialRotation bool `json:"credential_rotation,omitempty"`
+	Status             bool `json:"status,omitempty"`
 }
 
 type Resource struct {
 	ID         string            `json:"id,omitempty"`
 	ProviderID string            `json:"provider_id,omitempty"`
 	ExternalID string            `json:"external_id,omitempty"`
+	Plan       string            `json:"plan,omitempty"`
 	Env        map[string]string `json:"env,omitempty"`
 	Apps       []string          `json:"apps,omitempty"`
 	CreatedAt  *time.Time        `json:"created_at,omitempty"`
 }
 
+// ResourceStatus is the health and usage of a resource as reported by its
+// provider. Usage and Limits are keyed by metric, e.g. "size_bytes" or
+// "connections".
+type ResourceStatus struct {
+	ResourceID string           `json:"resource_id"`
+	State      string           `json:"state"`
+	Message    string           `json:"message,omitempty"`
+	Usage      map[string]int64 `json:"usage,omitempty"`
+	Limits     map[string]int64 `json:"limits,omitempty"`
+	CheckedAt  *time.Time       `json:"checked_at,omitempty"`
+}
+
+const (
+	ResourceStateHealthy     = "healthy"
+	ResourceStateDegraded    = "degraded"
+	ResourceStateUnavailable = "unavailable"
+)
+
 type ResourceReq struct {
 	ProviderID string           `json:"-"`
+	Plan       string           `json:"plan,omitempty"`
 	Apps       []string         `json:"apps,omitempty"`
 	Config     *json.RawMessage `json:"config"`
 }
+
+type CertificateReq struct {
+	AppID     string `json:"app,omitempty"`
+	ReleaseID string `json:"release,omitempty"`
+	Type      string `json:"type,omitempty"`
+}
+
+type Certificate struct {
+	Name      string     `json:"name,omitempty"`
+	Cert      string     `json:"cert,omitempty"`
+	Key       string     `json:"key,omitempty"`
+	CACert    string     `json:"ca_cert,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type NetworkPolicy struct {
+	AppID     string         `json:"app,omitempty"`
+	Ingress   []PolicySource `json:"ingress"`
+	CreatedAt *time.Time     `json:"created_at,omitempty"`
+	UpdatedAt *time.Time     `json:"updated_at,omitempty"`
+}
+
+// PolicySource identifies an app (by ID or name) or a discoverd service that
+// may connect to an app.
+type PolicySource struct {
+	App     string `json:"app,omitempty"`
+	Service string `json:"service,omitempty"`
+}
+
+type CompiledPolicy struct {
+	AppID         string   `json:"app"`
+	AllowApps     []string `json:"allow_apps"`
+	AllowServices []string `json:"allow_services"`
+}
+
+// PolicySet is the compiled set of network policies keyed by app ID. Apps
+// that are not present accept connections from anywhere.
+type PolicySet struct {
+	Policies  map[string]*CompiledPolicy `json:"policies"`
+	UpdatedAt *time.Time                 `json:"updated_at,omitempty"`
+}
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (v ValidationError) Error() string {
+	return fmt.Sprintf("validation error: %s %s", v.Field, v.Message)
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// Job IDs are scoped to hosts, so the controller identifies a job across the
+// cluster by combining the host ID and the job ID. Dashes in the host ID are
+// doubled, making the first single dash the separator:
+//
+//	FormatJobID("host0", "job0")   == "host0-job0"
+//	FormatJobID("us-east", "job0") == "us--east-job0"
+//
+// IDs of hosts without dashes are encoded the same as they were before the
+// encoding was introduced.
+
+var ErrInvalidJobID = errors.New("utils: invalid job ID")
+
+const maxJobIDLen = 255
+
+// FormatJobID returns the cluster-wide ID of a job running on a host.
+func FormatJobID(hostID, jobID string) string {
+	return strings.Replace(hostID, "-", "--", -1) + "-" + jobID
+}
+
+// ParseJobID splits a cluster-wide job ID into a host ID and a job ID,
+// returning ErrInvalidJobID if either is empty or contains characters other
+// than letters, digits, '-', '_' and '.'.
+func ParseJobID(id string) (hostID, jobID string, err error) {
+	if len(id) > maxJobIDLen || !validJobIDChars(id) {
+		return "", "", ErrInvalidJobID
+	}
+	host := make([]byte, 0, len(id))
+	for i := 0; i < len(id); i++ {
+		if id[i] != '-' {
+			host = append(host, id[i])
+			continue
+		}
+		if i+1 < len(id) && id[i+1] == '-' {
+			host = append(host, '-')
+			i++
+			continue
+		}
+		hostID, jobID = string(host), id[i+1:]
+		break
+	}
+	if hostID == "" || jobID == "" || jobID[0] == '-' {
+		return "", "", ErrInvalidJobID
+	}
+	return hostID, jobID, nil
+}
+
+func validJobIDChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
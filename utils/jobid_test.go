@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/titanous/gocheck"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type JobIDSuite struct{}
+
+var _ = Suite(&JobIDSuite{})
+
+func (JobIDSuite) TestRoundTrip(c *C) {
+	for _, t := range []struct {
+		host, job, id string
+	}{
+		{"host0", "job0", "host0-job0"},
+		{"us-east-1", "job0", "us--east--1-job0"},
+		{"host0", "flynn-0123-abcd", "host0-flynn-0123-abcd"},
+		{"a-", "b", "a---b"},
+		{"a--b", "c.d_e", "a----b-c.d_e"},
+	} {
+		c.Assert(FormatJobID(t.host, t.job), Equals, t.id)
+		host, job, err := ParseJobID(t.id)
+		c.Assert(err, IsNil)
+		c.Assert(host, Equals, t.host)
+		c.Assert(job, Equals, t.job)
+	}
+}
+
+func (JobIDSuite) TestInvalid(c *C) {
+	for _, id := range []string{
+		"",
+		"-",
+		"--",
+		"host0",
+		"host0-",
+		"-job0",
+		"host0--job0",
+		"host0--",
+		"../../etc-passwd",
+		"host0-job0/..",
+		"host0-job%2F0",
+		"host0-job 0",
+		"host0-job0\x00",
+		"hôst-job0",
+		"host0-" + strings.Repeat("a", 300),
+	} {
+		_, _, err := ParseJobID(id)
+		c.Assert(err, Equals, ErrInvalidJobID, Commentf("id: %q", id))
+	}
+}
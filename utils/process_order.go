@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+// ProcessOrder returns the process types in the order they should be
+// started, with each type after the types it depends on. Types without
+// dependencies between them are sorted by name. Processes should be stopped
+// in the reverse order.
+func ProcessOrder(procs map[string]ct.ProcessType) ([]string, error) {
+	names := make([]string, 0, len(procs))
+	for name, t := range procs {
+		for _, dep := range t.DependsOn {
+			if _, ok := procs[dep]; !ok {
+				return nil, fmt.Errorf("%s depends on unknown process type %s", name, dep)
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(procs))
+	order := make([]string, 0, len(procs))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("have a dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		deps := append([]string(nil), procs[name].DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
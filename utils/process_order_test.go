@@ -0,0 +1,32 @@
+package utils
+
+import (
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+type ProcessOrderSuite struct{}
+
+var _ = Suite(&ProcessOrderSuite{})
+
+func (ProcessOrderSuite) TestOrder(c *C) {
+	order, err := ProcessOrder(map[string]ct.ProcessType{
+		"worker":  {DependsOn: []string{"web", "migrate"}},
+		"web":     {DependsOn: []string{"migrate"}},
+		"migrate": {},
+		"clock":   {},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(order, DeepEquals, []string{"clock", "migrate", "web", "worker"})
+}
+
+func (ProcessOrderSuite) TestInvalid(c *C) {
+	_, err := ProcessOrder(map[string]ct.ProcessType{"web": {DependsOn: []string{"db"}}})
+	c.Assert(err, ErrorMatches, "web depends on unknown process type db")
+
+	_, err = ProcessOrder(map[string]ct.ProcessType{
+		"web":    {DependsOn: []string{"worker"}},
+		"worker": {DependsOn: []string{"web"}},
+	})
+	c.Assert(err, ErrorMatches, "have a dependency cycle: web -> worker -> web")
+}
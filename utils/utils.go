@@ -24,7 +24,27 @@ func FormatEnv(envs ...map[string]string) []string {
 	return res
 }
 
+// CertEnv returns the environment variables used to inject a job identity
+// certificate into a job config.
+func CertEnv(cert *ct.Certificate) map[string]string {
+	return map[string]string{
+		"FLYNN_TLS_CERT": cert.Cert,
+		"FLYNN_TLS_KEY":  cert.Key,
+		"FLYNN_TLS_CA":   cert.CACert,
+	}
+}
+
 func DockerImage(uri string) (string, error) {
+	return MirroredDockerImage(uri, nil)
+}
+
+// DockerHub is the registry of docker artifact URIs without a registry host
+// in registry configs.
+const DockerHub = "docker.io"
+
+// MirroredDockerImage is like DockerImage but pulls the image through the
+// mirror of its registry, if conf has one.
+func MirroredDockerImage(uri string, conf *ct.RegistryConfig) (string, error) {
 	// TODO: ID refs (see https://github.com/dotcloud/docker/issues/4106)
 	u, err := url.Parse(uri)
 	if err != nil {
@@ -33,6 +53,19 @@ func DockerImage(uri string) (string, error) {
 	if u.Scheme != "docker" {
 		return "", errors.New("utils: only docker artifact URIs are currently supported")
 	}
+	if conf != nil {
+		registry := u.Host
+		if registry == "" {
+			registry = DockerHub
+		}
+		if mirror := conf.Mirrors[registry]; mirror != "" {
+			if registry == DockerHub && !strings.Contains(strings.Trim(u.Path, "/"), "/") {
+				// official images are in the library namespace
+				u.Path = "/library/" + strings.Trim(u.Path, "/")
+			}
+			u.Host = mirror
+		}
+	}
 	if tag := u.Query().Get("tag"); tag != "" {
 		u.Path += ":" + tag
 	}
@@ -43,9 +76,26 @@ func DockerImage(uri string) (string, error) {
 	return u.Host + u.Path, nil
 }
 
+// FileArtifactRunner is the image which runs file artifacts, downloading
+// the tarball from SLUG_URL.
+const FileArtifactRunner = "docker:///flynn/slugrunner"
+
+// ArtifactImage returns the image which runs an artifact, pulled through the
+// mirrors of conf, along with the env which tells the image where to find
+// the artifact if it is not the image itself.
+func ArtifactImage(a *ct.Artifact, conf *ct.RegistryConfig) (string, map[string]string, error) {
+	switch a.Type {
+	case ct.ArtifactTypeFile:
+		image, err := MirroredDockerImage(FileArtifactRunner, conf)
+		return image, map[string]string{"SLUG_URL": a.URI}, err
+	}
+	image, err := MirroredDockerImage(a.URI, conf)
+	return image, nil, err
+}
+
 func JobConfig(f *ct.ExpandedFormation, name string) (*host.Job, error) {
 	t := f.Release.Processes[name]
-	image, err := DockerImage(f.Artifact.URI)
+	image, artifactEnv, err := ArtifactImage(f.Artifact, f.RegistryConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +108,7 @@ func JobConfig(f *ct.ExpandedFormation, name string) (*host.Job, error) {
 		},
 		Config: &docker.Config{
 			Cmd: t.Cmd,
-			Env: FormatEnv(f.Release.Env, t.Env,
+			Env: FormatEnv(f.AppEnv, f.Release.Env, t.Env, artifactEnv,
 				map[string]string{
 					"FLYNN_APP_ID":     f.App.ID,
 					"FLYNN_RELEASE_ID": f.Release.ID,
@@ -67,6 +117,9 @@ func JobConfig(f *ct.ExpandedFormation, name string) (*host.Job, error) {
 			Image: image,
 		},
 	}
+	if f.App.Name != "" {
+		job.Attributes["flynn-controller.app_name"] = f.App.Name
+	}
 	if t.Data {
 		job.Config.Volumes = map[string]struct{}{"/data": {}}
 	}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+type ImageSuite struct{}
+
+var _ = Suite(&ImageSuite{})
+
+func (ImageSuite) TestMirroredDockerImage(c *C) {
+	conf := &ct.RegistryConfig{Mirrors: map[string]string{
+		"docker.io":            "mirror.example.com:5000",
+		"registry.example.com": "mirror.example.com:5001",
+	}}
+	for _, t := range []struct {
+		uri   string
+		conf  *ct.RegistryConfig
+		image string
+	}{
+		{"docker:///flynn/slugrunner?tag=v1", nil, "flynn/slugrunner:v1"},
+		{"docker:///flynn/slugrunner?tag=v1", conf, "mirror.example.com:5000/flynn/slugrunner:v1"},
+		{"docker:///ubuntu", conf, "mirror.example.com:5000/library/ubuntu"},
+		{"docker://registry.example.com/flynn/host", conf, "mirror.example.com:5001/flynn/host"},
+		{"docker://quay.io/flynn/host", conf, "quay.io/flynn/host"},
+	} {
+		image, err := MirroredDockerImage(t.uri, t.conf)
+		c.Assert(err, IsNil)
+		c.Assert(image, Equals, t.image, Commentf("%s", t.uri))
+	}
+}
+
+func (ImageSuite) TestArtifactImage(c *C) {
+	conf := &ct.RegistryConfig{Mirrors: map[string]string{"docker.io": "mirror.example.com:5000"}}
+	image, env, err := ArtifactImage(&ct.Artifact{Type: ct.ArtifactTypeDocker, URI: "docker:///flynn/redis"}, conf)
+	c.Assert(err, IsNil)
+	c.Assert(image, Equals, "mirror.example.com:5000/flynn/redis")
+	c.Assert(env, IsNil)
+
+	image, env, err = ArtifactImage(&ct.Artifact{Type: ct.ArtifactTypeFile, URI: "https://blobstore.example.com/slug.tgz"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(image, Equals, "flynn/slugrunner")
+	c.Assert(env, DeepEquals, map[string]string{"SLUG_URL": "https://blobstore.example.com/slug.tgz"})
+}